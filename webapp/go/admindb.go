@@ -0,0 +1,88 @@
+package isuports
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/mattn/go-sqlite3"
+)
+
+// 管理用DBのドライバ
+// 本番はMySQL、手元での開発やCIではSQLiteのファイルでも動かせる
+// 環境変数 ISUCON_DB_DRIVER で選ぶ
+const (
+	adminDBDriverMySQL  = "mysql"
+	adminDBDriverSQLite = "sqlite3"
+)
+
+// 管理用DBに接続する
+// driverName はクエリログやトレースを有効にしたドライバの名前。設定のドライバと同じ種類であること
+func connectAdminDB(conf AdminDBConfig, driverName string) (*sqlx.DB, error) {
+	switch conf.Driver {
+	case adminDBDriverSQLite:
+		// 書き込みが重なったときにすぐSQLITE_BUSYにならないよう、待ち時間を設定して
+		// トランザクションは開始時に書き込みロックを取る
+		q := url.Values{}
+		q.Set("_busy_timeout", "5000")
+		q.Set("_journal_mode", "WAL")
+		q.Set("_txlock", "immediate")
+		dsn := fmt.Sprintf("file:%s?%s", conf.Path, q.Encode())
+		return sqlx.Open(driverName, dsn)
+	default:
+		config := mysql.NewConfig()
+		config.Net = "tcp"
+		config.Addr = net.JoinHostPort(conf.Host, conf.Port)
+		config.User = conf.User
+		config.Passwd = conf.Password
+		config.DBName = conf.Name
+		config.ParseTime = true
+		dsn := config.FormatDSN()
+		return sqlx.Open(driverName, dsn)
+	}
+}
+
+// /initialize で実行するスクリプトに渡す環境変数
+// 設定ファイルで指定した値もスクリプトから同じように見えるようにする
+func (conf AdminDBConfig) env() []string {
+	return []string{
+		"ISUCON_DB_DRIVER=" + conf.Driver,
+		"ISUCON_DB_HOST=" + conf.Host,
+		"ISUCON_DB_PORT=" + conf.Port,
+		"ISUCON_DB_USER=" + conf.User,
+		"ISUCON_DB_PASSWORD=" + conf.Password,
+		"ISUCON_DB_NAME=" + conf.Name,
+		"ISUCON_DB_PATH=" + conf.Path,
+	}
+}
+
+// 一意制約に違反したエラーか
+func isDuplicateKeyError(err error) bool {
+	var merr *mysql.MySQLError
+	if errors.As(err, &merr) {
+		return merr.Number == 1062 // duplicate entry
+	}
+	var serr sqlite3.Error
+	if errors.As(err, &serr) {
+		return serr.ExtendedCode == sqlite3.ErrConstraintUnique ||
+			serr.ExtendedCode == sqlite3.ErrConstraintPrimaryKey
+	}
+	return false
+}
+
+// ロックの競合で失敗した、やり直せば成功しうるエラーか
+// MySQLはデッドロック、SQLiteは待ち時間を過ぎてもロックを取れなかった場合
+func isDeadlockError(err error) bool {
+	var merr *mysql.MySQLError
+	if errors.As(err, &merr) {
+		return merr.Number == 1213 // deadlock
+	}
+	var serr sqlite3.Error
+	if errors.As(err, &serr) {
+		return serr.Code == sqlite3.ErrBusy || serr.Code == sqlite3.ErrLocked
+	}
+	return false
+}
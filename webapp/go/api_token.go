@@ -0,0 +1,350 @@
+package isuports
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// APIトークンのスコープと、それで使える主催者の権限
+// 主催者の管理とAPIトークンの管理 (manage_tenant) と、権限の要らない一覧の閲覧はAPIトークンではできない
+const (
+	APITokenScopePlayersWrite      = "players:write"
+	APITokenScopeCompetitionsWrite = "competitions:write"
+	APITokenScopeScoresWrite       = "scores:write"
+	APITokenScopeBillingRead       = "billing:read"
+)
+
+var apiTokenScopes = []struct {
+	scope      string
+	permission string
+}{
+	{APITokenScopePlayersWrite, PermissionManagePlayers},
+	{APITokenScopeCompetitionsWrite, PermissionManageCompetitions},
+	{APITokenScopeScoresWrite, PermissionUploadScores},
+	{APITokenScopeBillingRead, PermissionViewBilling},
+}
+
+const (
+	// 発行したトークンの先頭につける文字列。漏洩したときに見つけやすくする
+	apiTokenPrefix = "isp_"
+	// 有効期限の上限
+	apiTokenMaxLifetime = 365 * 24 * time.Hour
+	// 最終利用日時を更新する間隔
+	// 毎回書き込むと管理用DBの負荷になるので、この間隔より古いときだけ更新する
+	apiTokenLastUsedInterval = 60
+)
+
+// 機械から主催者向けAPIを使うためのトークン
+// トークン自体は保存せず、SHA-256のハッシュだけを保存する
+type APITokenRow struct {
+	ID            string        `db:"id"`
+	TenantID      int64         `db:"tenant_id"`
+	Name          string        `db:"name"`
+	TokenHash     string        `db:"token_hash"`
+	Scopes        string        `db:"scopes"`         // カンマ区切りのスコープ
+	CompetitionID string        `db:"competition_id"` // 空なら全ての大会に使える
+	ExpiresAt     int64         `db:"expires_at"`
+	LastUsedAt    sql.NullInt64 `db:"last_used_at"`
+	CreatedBy     string        `db:"created_by"` // 発行した主催者のID。トークンはこの主催者として操作する
+	CreatedAt     int64         `db:"created_at"`
+}
+
+func (t *APITokenRow) scopes() []string {
+	if t.Scopes == "" {
+		return []string{}
+	}
+	return strings.Split(t.Scopes, ",")
+}
+
+// スコープで主催者の権限 perm が使えるか
+func (t *APITokenRow) allows(perm string) bool {
+	for _, scope := range t.scopes() {
+		for _, sc := range apiTokenScopes {
+			if sc.scope == scope && sc.permission == perm {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authorization: Bearer ヘッダのトークンを返す
+func bearerToken(c echo.Context) (string, bool) {
+	auth := c.Request().Header.Get(echo.HeaderAuthorization)
+	if len(auth) <= len("Bearer ") || !strings.EqualFold(auth[:len("Bearer ")], "Bearer ") {
+		return "", false
+	}
+	return strings.TrimSpace(auth[len("Bearer "):]), true
+}
+
+// APIトークンを検証してViewerを返す
+// APIトークンでは発行した主催者として、スコープの範囲で主催者向けAPIを使える
+func (s *Server) parseAPITokenViewer(c echo.Context, tokenStr string) (*Viewer, error) {
+	ctx := requestContext(c)
+	var t APITokenRow
+	if err := s.adminDB.GetContext(ctx, &t, "SELECT * FROM api_token WHERE token_hash = ?", hashAPIToken(tokenStr)); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid api token")
+		}
+		return nil, fmt.Errorf("error Select api_token: %w", err)
+	}
+	now := s.now()
+	if t.ExpiresAt <= now {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "api token expired")
+	}
+	tenant, err := s.retrieveTenantRowFromHeader(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, echo.NewHTTPError(http.StatusUnauthorized, "tenant not found")
+		}
+		return nil, fmt.Errorf("error retrieveTenantRowFromHeader at parseAPITokenViewer: %w", err)
+	}
+	// 他のテナントや管理者用のホスト名では使えない
+	if tenant.ID != t.TenantID {
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, "invalid api token")
+	}
+
+	if !t.LastUsedAt.Valid || t.LastUsedAt.Int64 <= now-apiTokenLastUsedInterval {
+		if _, err := s.adminDB.ExecContext(
+			ctx,
+			"UPDATE api_token SET last_used_at = ? WHERE id = ?",
+			now, t.ID,
+		); err != nil {
+			return nil, fmt.Errorf("error Update api_token: id=%s, %w", t.ID, err)
+		}
+		t.LastUsedAt = sql.NullInt64{Int64: now, Valid: true}
+	}
+
+	return &Viewer{
+		role:       RoleOrganizer,
+		playerID:   t.CreatedBy,
+		tenantName: tenant.Name,
+		tenantID:   tenant.ID,
+		apiToken:   &t,
+	}, nil
+}
+
+// リクエストからスコープの一覧を読み取る
+// 重複は除き、apiTokenScopes の順に並べる
+func parseAPITokenScopeParams(c echo.Context) ([]string, error) {
+	params, err := c.FormParams()
+	if err != nil {
+		return nil, fmt.Errorf("error c.FormParams: %w", err)
+	}
+	order := map[string]int{}
+	for i, sc := range apiTokenScopes {
+		order[sc.scope] = i
+	}
+	seen := map[string]struct{}{}
+	scopes := []string{}
+	for _, s := range params["scope[]"] {
+		if _, ok := order[s]; !ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid scope: %s", s))
+		}
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		scopes = append(scopes, s)
+	}
+	if len(scopes) == 0 {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "scope[] required")
+	}
+	sort.Slice(scopes, func(i, j int) bool { return order[scopes[i]] < order[scopes[j]] })
+	return scopes, nil
+}
+
+type APITokenDetail struct {
+	ID            string   `json:"id"`
+	Name          string   `json:"name"`
+	Scopes        []string `json:"scopes"`
+	CompetitionID *string  `json:"competition_id"`
+	ExpiresAt     int64    `json:"expires_at"`
+	LastUsedAt    *int64   `json:"last_used_at"`
+	CreatedBy     string   `json:"created_by"`
+	CreatedAt     int64    `json:"created_at"`
+}
+
+func apiTokenDetail(t *APITokenRow) APITokenDetail {
+	d := APITokenDetail{
+		ID:         t.ID,
+		Name:       t.Name,
+		Scopes:     t.scopes(),
+		ExpiresAt:  t.ExpiresAt,
+		LastUsedAt: nullInt64Ptr(t.LastUsedAt),
+		CreatedBy:  t.CreatedBy,
+		CreatedAt:  t.CreatedAt,
+	}
+	if t.CompetitionID != "" {
+		id := t.CompetitionID
+		d.CompetitionID = &id
+	}
+	return d
+}
+
+type APITokensAddHandlerResult struct {
+	APIToken APITokenDetail `json:"api_token"`
+	Token    string         `json:"token"` // 発行時にだけ返す
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/api_tokens/add
+// APIトークンを発行する
+// 発行した主催者が持っていない権限のスコープは指定できない
+func (s *Server) apiTokensAddHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	name := c.FormValue("name")
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name required")
+	}
+	scopes, err := parseAPITokenScopeParams(c)
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	expiresAt, err := strconv.ParseInt(c.FormValue("expires_at"), 10, 64)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "expires_at required")
+	}
+	if expiresAt <= now || now+int64(apiTokenMaxLifetime/time.Second) < expiresAt {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("expires_at must be in the future and within %s", apiTokenMaxLifetime),
+		)
+	}
+
+	o, err := s.retrieveOrganizer(ctx, v.tenantID, v.playerID)
+	if err != nil {
+		return fmt.Errorf("error retrieveOrganizer: %w", err)
+	}
+	for _, scope := range scopes {
+		for _, sc := range apiTokenScopes {
+			if sc.scope == scope && !o.has(sc.permission) {
+				return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("permission %s required for scope %s", sc.permission, scope))
+			}
+		}
+	}
+
+	competitionID := c.FormValue("competition_id")
+	if competitionID != "" {
+		tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+		if err != nil {
+			return fmt.Errorf("error connectToTenantDB: %w", err)
+		}
+		defer tenantDB.Close()
+		if _, err := retrieveCompetition(ctx, tenantDB, competitionID); err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(http.StatusBadRequest, "competition not found")
+			}
+			return fmt.Errorf("error retrieveCompetition: %w", err)
+		}
+	}
+
+	id, err := s.ids.DispenseID(ctx)
+	if err != nil {
+		return fmt.Errorf("error DispenseID: %w", err)
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return fmt.Errorf("error randomHex: %w", err)
+	}
+	token := apiTokenPrefix + secret
+	t := APITokenRow{
+		ID:            id,
+		TenantID:      v.tenantID,
+		Name:          name,
+		TokenHash:     hashAPIToken(token),
+		Scopes:        strings.Join(scopes, ","),
+		CompetitionID: competitionID,
+		ExpiresAt:     expiresAt,
+		CreatedBy:     v.playerID,
+		CreatedAt:     now,
+	}
+	if _, err := s.adminDB.NamedExecContext(
+		ctx,
+		"INSERT INTO api_token (id, tenant_id, name, token_hash, scopes, competition_id, expires_at, last_used_at, created_by, created_at) VALUES (:id, :tenant_id, :name, :token_hash, :scopes, :competition_id, :expires_at, :last_used_at, :created_by, :created_at)",
+		t,
+	); err != nil {
+		return fmt.Errorf("error Insert api_token: tenantID=%d, id=%s, %w", v.tenantID, id, err)
+	}
+	setAuditTarget(c, id)
+
+	res := APITokensAddHandlerResult{
+		APIToken: apiTokenDetail(&t),
+		Token:    token,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type APITokensHandlerResult struct {
+	APITokens []APITokenDetail `json:"api_tokens"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/api_tokens
+// APIトークンの一覧を発行した順に取得する。期限切れのものも含む
+func (s *Server) apiTokensHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return err
+	}
+
+	ts := []APITokenRow{}
+	if err := s.adminDB.SelectContext(
+		ctx,
+		&ts,
+		"SELECT * FROM api_token WHERE tenant_id = ? ORDER BY created_at ASC, id ASC",
+		v.tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select api_token: tenantID=%d, %w", v.tenantID, err)
+	}
+	tds := make([]APITokenDetail, 0, len(ts))
+	for _, t := range ts {
+		tds = append(tds, apiTokenDetail(&t))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: APITokensHandlerResult{APITokens: tds}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/api_token/:token_id/revoke
+// APIトークンを失効させる。以降そのトークンは使えない
+func (s *Server) apiTokenRevokeHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	id := c.Param("token_id")
+	res, err := s.adminDB.ExecContext(ctx, "DELETE FROM api_token WHERE tenant_id = ? AND id = ?", v.tenantID, id)
+	if err != nil {
+		return fmt.Errorf("error Delete api_token: tenantID=%d, id=%s, %w", v.tenantID, id, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error RowsAffected: %w", err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "api token not found")
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
@@ -0,0 +1,329 @@
+package isuports
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+const (
+	// 監査ログの一覧で一度に返す件数の既定値と上限
+	auditLogsDefaultLimit = 100
+	auditLogsMaxLimit     = 1000
+
+	// CSVで書き出すときに一度に読む件数
+	auditLogsExportBatchSize = 1000
+
+	auditTargetContextKey = "audit_target"
+
+	// APIトークンでの操作の actor は "token:<トークンのID>" にする
+	auditActorAPITokenPrefix = "token:"
+)
+
+// 監査ログ
+// 書き込みのAPIが成功するたびに1行追加し、変更や削除はしない
+type AuditLogRow struct {
+	ID        int64  `db:"id"`
+	TenantID  int64  `db:"tenant_id"` // テナントに紐づかない操作では0
+	Actor     string `db:"actor"`     // JWTのsubか、APIトークンなら "token:<ID>"。未認証なら空
+	Role      string `db:"role"`
+	Action    string `db:"action"`    // "<メソッド> <Run()で登録したパス>"
+	TargetID  string `db:"target_id"` // 操作の対象のID。複数の場合はカンマ区切り
+	RequestID string `db:"request_id"`
+	CreatedAt int64  `db:"created_at"`
+}
+
+// 監査ログに記録する操作の対象を設定する
+// 未設定ならパスの最後のパラメータを対象とする。追加のAPIなど、パスに対象が含まれないときに使う
+func setAuditTarget(c echo.Context, ids ...string) {
+	c.Set(auditTargetContextKey, strings.Join(ids, ","))
+}
+
+// 書き込みのAPIが成功したときに監査ログを記録するミドルウェア
+// GET以外のメソッドを書き込みとみなすので、Run()で登録したルートは全て対象になる
+// エラーを返したリクエストは何も変更していないので記録しない
+func (s *Server) AuditLog(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		method := c.Request().Method
+		if method == http.MethodGet || method == http.MethodHead || method == http.MethodOptions {
+			return next(c)
+		}
+		if err := next(c); err != nil {
+			return err
+		}
+		if c.Response().Status >= http.StatusBadRequest {
+			return nil
+		}
+
+		a := AuditLogRow{
+			Role:      RoleNone,
+			Action:    method + " " + c.Path(),
+			RequestID: requestID(c),
+			CreatedAt: s.now(),
+		}
+		if v, ok := c.Get(viewerContextKey).(*Viewer); ok {
+			a.Actor = v.playerID
+			a.Role = v.role
+			a.TenantID = v.tenantID
+			// トークンを作った主催者ではなく、トークンでの操作として記録する
+			if v.apiToken != nil {
+				a.Actor = auditActorAPITokenPrefix + v.apiToken.ID
+			}
+		}
+		// SaaS管理者がテナントを指定して操作した場合や、テナントを追加した場合
+		if ri, ok := c.Get(requestInfoContextKey).(*requestInfo); ok && a.TenantID == 0 {
+			a.TenantID = ri.TenantID()
+		}
+		if a.TenantID == 0 {
+			if id, err := strconv.ParseInt(c.Param("tenant_id"), 10, 64); err == nil {
+				a.TenantID = id
+			}
+		}
+		if target, ok := c.Get(auditTargetContextKey).(string); ok {
+			a.TargetID = target
+		} else if values := c.ParamValues(); len(values) > 0 {
+			a.TargetID = values[len(values)-1]
+		}
+
+		// レスポンスは書き込み済みなので、記録に失敗してもログに出すだけにする
+		if _, err := s.adminDB.NamedExecContext(
+			requestContext(c),
+			"INSERT INTO audit_log (tenant_id, actor, role, action, target_id, request_id, created_at) VALUES (:tenant_id, :actor, :role, :action, :target_id, :request_id, :created_at)",
+			a,
+		); err != nil {
+			s.logRequest(c, log.ERROR, "failed to record audit log", log.JSON{"action": a.Action, "error": err.Error()})
+		}
+		return nil
+	}
+}
+
+// 監査ログの絞り込み条件
+type auditLogCondition struct {
+	TenantID int64  // 0なら全て
+	Actor    string // 空なら全て
+	Since    int64  // この時刻以降。0なら指定なし
+	Until    int64  // この時刻より前。0なら指定なし
+	BeforeID int64  // このIDより前。0なら指定なし
+}
+
+func parseAuditLogCondition(c echo.Context) (*auditLogCondition, error) {
+	cond := &auditLogCondition{Actor: c.QueryParam("actor")}
+	for _, p := range []struct {
+		name string
+		dest *int64
+	}{
+		{"tenant_id", &cond.TenantID},
+		{"since", &cond.Since},
+		{"until", &cond.Until},
+		{"before", &cond.BeforeID},
+	} {
+		s := c.QueryParam(p.name)
+		if s == "" {
+			continue
+		}
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || v < 0 {
+			return nil, echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("failed to parse query parameter '%s': %s", p.name, s),
+			)
+		}
+		*p.dest = v
+	}
+	if cond.Since != 0 && cond.Until != 0 && cond.Until <= cond.Since {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "until must be after since")
+	}
+	return cond, nil
+}
+
+// 条件に一致する監査ログを新しい順に最大limit件取得する
+func (s *Server) searchAuditLogs(c echo.Context, cond *auditLogCondition, limit int) ([]AuditLogRow, error) {
+	where := []string{"1 = 1"}
+	args := []interface{}{}
+	if cond.TenantID != 0 {
+		where = append(where, "tenant_id = ?")
+		args = append(args, cond.TenantID)
+	}
+	if cond.Actor != "" {
+		where = append(where, "actor = ?")
+		args = append(args, cond.Actor)
+	}
+	if cond.Since != 0 {
+		where = append(where, "created_at >= ?")
+		args = append(args, cond.Since)
+	}
+	if cond.Until != 0 {
+		where = append(where, "created_at < ?")
+		args = append(args, cond.Until)
+	}
+	if cond.BeforeID != 0 {
+		where = append(where, "id < ?")
+		args = append(args, cond.BeforeID)
+	}
+	args = append(args, limit)
+
+	as := []AuditLogRow{}
+	if err := s.adminDB.SelectContext(
+		requestContext(c),
+		&as,
+		"SELECT * FROM audit_log WHERE "+strings.Join(where, " AND ")+" ORDER BY id DESC LIMIT ?",
+		args...,
+	); err != nil {
+		return nil, fmt.Errorf("error Select audit_log: %w", err)
+	}
+	return as, nil
+}
+
+type AuditLogDetail struct {
+	ID        string `json:"id"`
+	TenantID  string `json:"tenant_id"`
+	Actor     string `json:"actor"`
+	Role      string `json:"role"`
+	Action    string `json:"action"`
+	TargetID  string `json:"target_id"`
+	RequestID string `json:"request_id"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func auditLogDetail(a *AuditLogRow) AuditLogDetail {
+	return AuditLogDetail{
+		ID:        strconv.FormatInt(a.ID, 10),
+		TenantID:  strconv.FormatInt(a.TenantID, 10),
+		Actor:     a.Actor,
+		Role:      a.Role,
+		Action:    a.Action,
+		TargetID:  a.TargetID,
+		RequestID: a.RequestID,
+		CreatedAt: a.CreatedAt,
+	}
+}
+
+type AuditLogsHandlerResult struct {
+	AuditLogs []AuditLogDetail `json:"audit_logs"`
+}
+
+// SaaS管理者向けAPI
+// GET /api/admin/audit_logs
+// 監査ログを新しい順に取得する
+func (s *Server) auditLogsHandler(c echo.Context) error {
+	if host := c.Request().Host; host != s.adminHostname {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("invalid hostname %s", host),
+		)
+	}
+	if v, err := s.parseViewer(c); err != nil {
+		return err
+	} else if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	cond, err := parseAuditLogCondition(c)
+	if err != nil {
+		return err
+	}
+	limit := auditLogsDefaultLimit
+	if s := c.QueryParam("limit"); s != "" {
+		l, err := strconv.Atoi(s)
+		if err != nil || l < 1 || auditLogsMaxLimit < l {
+			return echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("query parameter 'limit' must be between 1 and %d", auditLogsMaxLimit),
+			)
+		}
+		limit = l
+	}
+	as, err := s.searchAuditLogs(c, cond, limit)
+	if err != nil {
+		return err
+	}
+	ads := make([]AuditLogDetail, 0, len(as))
+	for _, a := range as {
+		ads = append(ads, auditLogDetail(&a))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: AuditLogsHandlerResult{AuditLogs: ads}})
+}
+
+// SaaS管理者向けAPI
+// GET /api/admin/audit_logs/export
+// 条件に一致する監査ログを全て新しい順にCSVで書き出す
+// 件数が多くてもメモリを使い切らないように、少しずつ読んで書き出す
+func (s *Server) auditLogsExportHandler(c echo.Context) error {
+	if host := c.Request().Host; host != s.adminHostname {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("invalid hostname %s", host),
+		)
+	}
+	if v, err := s.parseViewer(c); err != nil {
+		return err
+	} else if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	cond, err := parseAuditLogCondition(c)
+	if err != nil {
+		return err
+	}
+	// ヘッダを書き込む前に読んでおき、最初の読み込みの失敗はエラーレスポンスで返す
+	as, err := s.searchAuditLogs(c, cond, auditLogsExportBatchSize)
+	if err != nil {
+		return err
+	}
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/csv; charset=utf-8")
+	res.Header().Set(echo.HeaderContentDisposition, `attachment; filename="audit_logs.csv"`)
+	res.WriteHeader(http.StatusOK)
+	// ヘッダを送った後はエラーレスポンスを返せないので、ログに出して途中で打ち切る
+	if err := writeAuditLogsCSV(res, as, func(beforeID int64) ([]AuditLogRow, error) {
+		cond.BeforeID = beforeID
+		return s.searchAuditLogs(c, cond, auditLogsExportBatchSize)
+	}); err != nil {
+		s.logRequest(c, log.ERROR, "failed to export audit logs", log.JSON{"error": err.Error()})
+	}
+	return nil
+}
+
+// 監査ログをCSVで書き出す
+// as を書き出した後、最後のIDより前のものを next で読んで続ける
+func writeAuditLogsCSV(out io.Writer, as []AuditLogRow, next func(beforeID int64) ([]AuditLogRow, error)) error {
+	w := csv.NewWriter(out)
+	if err := w.Write([]string{"id", "tenant_id", "actor", "role", "action", "target_id", "request_id", "created_at"}); err != nil {
+		return fmt.Errorf("error csv.Write: %w", err)
+	}
+	for len(as) > 0 {
+		for _, a := range as {
+			if err := w.Write([]string{
+				strconv.FormatInt(a.ID, 10),
+				strconv.FormatInt(a.TenantID, 10),
+				a.Actor,
+				a.Role,
+				a.Action,
+				a.TargetID,
+				a.RequestID,
+				strconv.FormatInt(a.CreatedAt, 10),
+			}); err != nil {
+				return fmt.Errorf("error csv.Write: %w", err)
+			}
+		}
+		if len(as) < auditLogsExportBatchSize {
+			break
+		}
+		var err error
+		if as, err = next(as[len(as)-1].ID); err != nil {
+			return err
+		}
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		return fmt.Errorf("error csv.Flush: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,239 @@
+// querydigest はisuportsが出力するSQLのトレースログを集計するコマンドです
+// ISUCON_SQLITE_TRACE_FILE や ISUCON_MYSQL_TRACE_FILE に書き出されたJSONを読み、
+// 値を?に置き換えたクエリごとに回数や時間をまとめて、合計時間の長い順に出力します
+//
+//	go run ./cmd/querydigest /tmp/sqlite-trace.log /tmp/mysql-trace.log
+//	go run ./cmd/querydigest -format json -limit 0 /tmp/sqlite-trace.log.1 /tmp/sqlite-trace.log
+//
+// ファイルを指定しない場合や - を指定した場合は標準入力から読みます
+// -by-tenant=false を指定すると、テナントDBごとに分けずに集計します
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// sqltrace.go の sqlTraceLog のうち集計に使う項目
+type traceLog struct {
+	DB           string  `json:"db"`
+	TenantID     int64   `json:"tenant_id"`
+	Statement    string  `json:"statement"`
+	QueryTime    float64 `json:"query_time"`
+	AffectedRows int64   `json:"affected_rows"`
+}
+
+type digestKey struct {
+	group       string
+	fingerprint string
+}
+
+type digest struct {
+	Group        string    `json:"group"`
+	Fingerprint  string    `json:"fingerprint"`
+	Example      string    `json:"example"`
+	Count        int       `json:"count"`
+	TotalTime    float64   `json:"total_time"`
+	AvgTime      float64   `json:"avg_time"`
+	P95Time      float64   `json:"p95_time"`
+	MaxTime      float64   `json:"max_time"`
+	AffectedRows int64     `json:"affected_rows"`
+	times        []float64 // p95を求めるために全件の時間を持っておく
+}
+
+type report struct {
+	Files   []string  `json:"files"`
+	Lines   int       `json:"lines"`
+	Skipped int       `json:"skipped"` // JSONとして読めなかった行
+	Total   float64   `json:"total_time"`
+	Queries []*digest `json:"queries"`
+}
+
+func main() {
+	format := flag.String("format", "text", "output format: text or json")
+	limit := flag.Int("limit", 20, "number of queries to show (0 for all)")
+	byTenant := flag.Bool("by-tenant", true, "group queries by tenant DB")
+	flag.Parse()
+
+	if *format != "text" && *format != "json" {
+		log.Fatalf("invalid -format: %s", *format)
+	}
+	files := flag.Args()
+	if len(files) == 0 {
+		files = []string{"-"}
+	}
+
+	r := &report{Files: files}
+	digests := map[digestKey]*digest{}
+	for _, f := range files {
+		if err := readTraceFile(f, r, digests, *byTenant); err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	r.Queries = make([]*digest, 0, len(digests))
+	for _, d := range digests {
+		sort.Float64s(d.times)
+		d.AvgTime = d.TotalTime / float64(d.Count)
+		d.P95Time = percentile(d.times, 0.95)
+		d.MaxTime = d.times[len(d.times)-1]
+		r.Queries = append(r.Queries, d)
+	}
+	sort.Slice(r.Queries, func(i, j int) bool {
+		a, b := r.Queries[i], r.Queries[j]
+		if a.TotalTime != b.TotalTime {
+			return a.TotalTime > b.TotalTime
+		}
+		if a.Group != b.Group {
+			return a.Group < b.Group
+		}
+		return a.Fingerprint < b.Fingerprint
+	})
+	if *limit > 0 && len(r.Queries) > *limit {
+		r.Queries = r.Queries[:*limit]
+	}
+
+	var err error
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(os.Stdout)
+		enc.SetEscapeHTML(false)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(r)
+	default:
+		err = writeText(os.Stdout, r)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readTraceFile(name string, r *report, digests map[digestKey]*digest, byTenant bool) error {
+	var in io.Reader = os.Stdin
+	if name != "-" {
+		f, err := os.Open(name)
+		if err != nil {
+			return fmt.Errorf("error os.Open: %w", err)
+		}
+		defer f.Close()
+		in = f
+	}
+
+	s := bufio.NewScanner(in)
+	// 長いINリストを含むクエリもあるので、行の長さの上限を広げておく
+	s.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for s.Scan() {
+		line := s.Bytes()
+		if len(strings.TrimSpace(string(line))) == 0 {
+			continue
+		}
+		r.Lines++
+		var l traceLog
+		if err := json.Unmarshal(line, &l); err != nil {
+			r.Skipped++
+			continue
+		}
+		key := digestKey{group: groupName(l, byTenant), fingerprint: fingerprint(l.Statement)}
+		d, ok := digests[key]
+		if !ok {
+			d = &digest{Group: key.group, Fingerprint: key.fingerprint, Example: l.Statement}
+			digests[key] = d
+		}
+		d.Count++
+		d.TotalTime += l.QueryTime
+		d.AffectedRows += l.AffectedRows
+		d.times = append(d.times, l.QueryTime)
+		r.Total += l.QueryTime
+	}
+	if err := s.Err(); err != nil {
+		return fmt.Errorf("error reading %s: %w", name, err)
+	}
+	return nil
+}
+
+// 集計の単位
+// dbを出力していない古いトレースログはsqliteのものなのでtenantとして扱う
+func groupName(l traceLog, byTenant bool) string {
+	db := l.DB
+	if db == "" {
+		db = "tenant"
+	}
+	if db == "tenant" && byTenant && l.TenantID != 0 {
+		return "tenant:" + strconv.FormatInt(l.TenantID, 10)
+	}
+	return db
+}
+
+var (
+	stringLiteralRegexp   = regexp.MustCompile(`'(?:[^'\\]|\\.|'')*'|"(?:[^"\\]|\\.|"")*"`)
+	numberRegexp          = regexp.MustCompile(`\b-?(?:0x[0-9a-f]+|\d+(?:\.\d+)?(?:e[+-]?\d+)?)\b`)
+	placeholderListRegexp = regexp.MustCompile(`\(\s*\?(?:\s*,\s*\?)*\s*\)`)
+	valuesListRegexp      = regexp.MustCompile(`(?i)\bvalues\s*\(\?\+?\)(?:\s*,\s*\(\?\+?\))+`)
+	whitespaceRegexp      = regexp.MustCompile(`\s+`)
+)
+
+// クエリを正規化する
+// リテラルを?に置き換え、IN句やVALUESの要素数の違いは1つにまとめる
+func fingerprint(q string) string {
+	q = strings.TrimSpace(q)
+	q = strings.TrimSuffix(q, ";")
+	q = stringLiteralRegexp.ReplaceAllString(q, "?")
+	q = strings.ToLower(q)
+	q = numberRegexp.ReplaceAllString(q, "?")
+	q = whitespaceRegexp.ReplaceAllString(q, " ")
+	q = placeholderListRegexp.ReplaceAllStringFunc(q, func(s string) string {
+		if strings.Contains(s, ",") {
+			return "(?+)"
+		}
+		return "(?)"
+	})
+	q = valuesListRegexp.ReplaceAllString(q, "values (?+)")
+	return strings.TrimSpace(q)
+}
+
+// ソート済みの値からnearest-rank法でパーセンタイルを求める
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(math.Ceil(p*float64(len(sorted)))) - 1
+	if i < 0 {
+		i = 0
+	}
+	return sorted[i]
+}
+
+func writeText(w io.Writer, r *report) error {
+	fmt.Fprintf(w, "# files: %s\n", strings.Join(r.Files, ", "))
+	fmt.Fprintf(w, "# queries: %d, skipped lines: %d, total time: %.3fs\n\n", r.Lines-r.Skipped, r.Skipped, r.Total)
+
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', tabwriter.AlignRight)
+	fmt.Fprintln(tw, "rank\tgroup\tcount\ttotal(s)\tratio\tavg(ms)\tp95(ms)\tmax(ms)\trows\t")
+	for i, d := range r.Queries {
+		ratio := 0.0
+		if r.Total > 0 {
+			ratio = d.TotalTime / r.Total * 100
+		}
+		fmt.Fprintf(tw, "%d\t%s\t%d\t%.3f\t%.1f%%\t%.2f\t%.2f\t%.2f\t%d\t\n",
+			i+1, d.Group, d.Count, d.TotalTime, ratio, d.AvgTime*1000, d.P95Time*1000, d.MaxTime*1000, d.AffectedRows)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+
+	for i, d := range r.Queries {
+		fmt.Fprintf(w, "\n# %d %s\n%s\n", i+1, d.Group, d.Fingerprint)
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package main
+
+import "testing"
+
+func TestFingerprint(t *testing.T) {
+	for _, tc := range []struct {
+		query string
+		want  string
+	}{
+		{
+			"SELECT * FROM player WHERE id = 'abc' AND tenant_id = 12;",
+			"select * from player where id = ? and tenant_id = ?",
+		},
+		{
+			"SELECT *\n  FROM player\n  WHERE display_name = 'it''s' OR display_name = \"x\"",
+			"select * from player where display_name = ? or display_name = ?",
+		},
+		{
+			"SELECT * FROM player_score WHERE competition_id IN (1, 2, 3)",
+			"select * from player_score where competition_id in (?+)",
+		},
+		{
+			"SELECT * FROM player_score WHERE competition_id IN (?)",
+			"select * from player_score where competition_id in (?)",
+		},
+		{
+			"INSERT INTO player (id, name) VALUES (1, 'a'), (2, 'b'), (3, 'c')",
+			"insert into player (id, name) values (?+)",
+		},
+		{
+			"INSERT INTO player (id, name) VALUES (?, ?)",
+			"insert into player (id, name) values (?+)",
+		},
+		{
+			"SELECT col1 FROM t2 WHERE score > 1.5e3 AND flags = 0x1f",
+			"select col1 from t2 where score > ? and flags = ?",
+		},
+	} {
+		if got := fingerprint(tc.query); got != tc.want {
+			t.Errorf("fingerprint(%q):\nwant %q\ngot  %q", tc.query, tc.want, got)
+		}
+	}
+}
+
+func TestPercentile(t *testing.T) {
+	sorted := []float64{1, 2, 3, 4, 5, 6, 7, 8, 9, 10}
+	for _, tc := range []struct {
+		values []float64
+		p      float64
+		want   float64
+	}{
+		{nil, 0.5, 0},
+		{[]float64{42}, 0.99, 42},
+		{sorted, 0, 1},
+		{sorted, 0.5, 5},
+		{sorted, 0.95, 10},
+		{sorted, 0.91, 10},
+		{sorted, 0.9, 9},
+		{sorted, 1, 10},
+	} {
+		if got := percentile(tc.values, tc.p); got != tc.want {
+			t.Errorf("percentile(%v, %v): want %v, got %v", tc.values, tc.p, tc.want, got)
+		}
+	}
+}
@@ -0,0 +1,54 @@
+// webhook-receiver はisuportsのWebhookを手元で受け取るためのサーバーです
+// 受け取ったWebhookの署名を検証し、内容を標準出力に書き出します
+//
+//	WEBHOOK_SECRET=<登録時に返されたsecret> go run ./cmd/webhook-receiver -listen :8080
+//
+// -status を指定すると常にそのステータスコードを返すので、再送の動作確認に使えます
+// isuportsはプライベートのアドレスにWebhookを送らないので、
+// 手元で受け取る場合はisuportsを ISUCON_WEBHOOK_ALLOW_PRIVATE_ADDRESSES=true で起動してください
+package main
+
+import (
+	"flag"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+
+	isuports "github.com/isucon/isucon12-qualify/webapp/go"
+)
+
+func main() {
+	listen := flag.String("listen", ":8080", "listen address")
+	status := flag.Int("status", http.StatusOK, "status code to respond")
+	flag.Parse()
+
+	secret := os.Getenv("WEBHOOK_SECRET")
+	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		verified := "skipped"
+		if secret != "" {
+			verified = "ng"
+			ts, err := strconv.ParseInt(r.Header.Get("X-Isuports-Timestamp"), 10, 64)
+			if err == nil && isuports.VerifyWebhookSignature(secret, ts, body, r.Header.Get("X-Isuports-Signature")) {
+				verified = "ok"
+			}
+		}
+		log.Printf(
+			"event=%s delivery=%s signature=%s body=%s",
+			r.Header.Get("X-Isuports-Event"), r.Header.Get("X-Isuports-Delivery"), verified, body,
+		)
+		if verified == "ng" {
+			http.Error(w, "invalid signature", http.StatusUnauthorized)
+			return
+		}
+		w.WriteHeader(*status)
+	})
+	log.Printf("listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, nil))
+}
@@ -0,0 +1,352 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// 大会の開始・終了時刻のパラメータを読み取る
+// 値はUnix秒で、空文字列の場合は未設定として扱う
+func parseScheduleParam(c echo.Context, name string) (sql.NullInt64, error) {
+	s := c.FormValue(name)
+	if s == "" {
+		return sql.NullInt64{}, nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	if err != nil {
+		return sql.NullInt64{}, echo.NewHTTPError(
+			http.StatusBadRequest,
+			fmt.Sprintf("failed to parse %s: %s", name, err.Error()),
+		)
+	}
+	return sql.NullInt64{Int64: v, Valid: true}, nil
+}
+
+// 大会の開始・終了時刻が正しいかチェックする
+func validateSchedule(startAt, endAt sql.NullInt64, now int64) error {
+	if endAt.Valid && endAt.Int64 <= now {
+		return echo.NewHTTPError(http.StatusBadRequest, "end_at must be in the future")
+	}
+	if startAt.Valid && endAt.Valid && endAt.Int64 <= startAt.Int64 {
+		return echo.NewHTTPError(http.StatusBadRequest, "end_at must be after start_at")
+	}
+	return nil
+}
+
+type CompetitionUpdateHandlerResult struct {
+	Competition CompetitionDetail `json:"competition"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/update
+// 終了前の大会の名前や開催期間を変更する
+// 指定されなかった項目は変更しない。start_at, end_at に空文字列を指定すると未設定に戻す
+func (s *Server) competitionUpdateHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	id := c.Param("competition_id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, id)
+	if err != nil {
+		// 存在しない大会
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	if comp.FinishedAt.Valid {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition is finished")
+	}
+
+	params, err := c.FormParams()
+	if err != nil {
+		return fmt.Errorf("error c.FormParams: %w", err)
+	}
+	if _, ok := params["title"]; ok {
+		if title := c.FormValue("title"); title != "" {
+			comp.Title = title
+		} else {
+			return echo.NewHTTPError(http.StatusBadRequest, "title must not be empty")
+		}
+	}
+	_, startAtChanged := params["start_at"]
+	if startAtChanged {
+		if comp.StartAt, err = parseScheduleParam(c, "start_at"); err != nil {
+			return err
+		}
+	}
+	_, endAtChanged := params["end_at"]
+	if endAtChanged {
+		if comp.EndAt, err = parseScheduleParam(c, "end_at"); err != nil {
+			return err
+		}
+	}
+	// 変更した項目だけを確認する
+	// 終了時刻を過ぎてスケジューラが終了させるまでの間も、名前は変更できるようにする
+	now := s.now()
+	if endAtChanged && comp.EndAt.Valid && comp.EndAt.Int64 <= now {
+		return echo.NewHTTPError(http.StatusBadRequest, "end_at must be in the future")
+	}
+	if (startAtChanged || endAtChanged) && comp.StartAt.Valid && comp.EndAt.Valid && comp.EndAt.Int64 <= comp.StartAt.Int64 {
+		return echo.NewHTTPError(http.StatusBadRequest, "end_at must be after start_at")
+	}
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	result, err := tx.ExecContext(
+		ctx,
+		"UPDATE competition SET title = ?, start_at = ?, end_at = ?, updated_by = ?, updated_at = ? WHERE id = ? AND finished_at IS NULL",
+		comp.Title, comp.StartAt, comp.EndAt, v.playerID, now, id,
+	)
+	if err != nil {
+		return fmt.Errorf(
+			"error Update competition: title=%s, updatedAt=%d, id=%s, %w",
+			comp.Title, now, id, err,
+		)
+	}
+	// 取得してから更新するまでの間に終了した大会
+	if n, err := result.RowsAffected(); err != nil {
+		return fmt.Errorf("error result.RowsAffected: %w", err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition is finished")
+	}
+
+	res := CompetitionUpdateHandlerResult(competitionEventData(comp))
+	if err := bumpDataVersions(ctx, tx, now, dataVersionCompetitions, competitionDataVersion(id)); err != nil {
+		return fmt.Errorf("error bumpDataVersions: %w", err)
+	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventCompetitionUpdated, competitionEventData(comp)); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+	if endAtChanged {
+		if err := s.scheduleCompetitionEnd(ctx, comp); err != nil {
+			return fmt.Errorf("error scheduleCompetitionEnd: %w", err)
+		}
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/delete
+// 大会を削除する
+// 監査のためにデータは残し、一覧や請求からは除外する
+func (s *Server) competitionDeleteHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	id := c.Param("competition_id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, id)
+	if err != nil {
+		// 存在しない大会
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	now := s.now()
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE competition SET deleted_at = ?, updated_by = ?, updated_at = ? WHERE id = ?",
+		now, v.playerID, now, id,
+	); err != nil {
+		return fmt.Errorf(
+			"error Update competition: deletedAt=%d, updatedAt=%d, id=%s, %w",
+			now, now, id, err,
+		)
+	}
+	if err := bumpDataVersions(ctx, tx, now, dataVersionCompetitions, competitionDataVersion(id)); err != nil {
+		return fmt.Errorf("error bumpDataVersions: %w", err)
+	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventCompetitionDeleted, competitionEventData(comp)); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+	comp.DeletedAt = sql.NullInt64{Int64: now, Valid: true}
+	if err := s.scheduleCompetitionEnd(ctx, comp); err != nil {
+		return fmt.Errorf("error scheduleCompetitionEnd: %w", err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+// 大会の終了予定を管理用DBに記録する
+// スケジューラが全てのテナントDBを開かずに済むように、終了時刻が設定された終了前の大会だけを記録しておく
+// テナントDBへの変更をコミットした後に呼ぶこと
+func (s *Server) scheduleCompetitionEnd(ctx context.Context, comp *CompetitionRow) error {
+	if _, err := s.adminDB.ExecContext(
+		ctx,
+		"DELETE FROM competition_schedule WHERE tenant_id = ? AND competition_id = ?",
+		comp.TenantID, comp.ID,
+	); err != nil {
+		return fmt.Errorf("error Delete competition_schedule: tenantID=%d, competitionID=%s, %w", comp.TenantID, comp.ID, err)
+	}
+	if !comp.EndAt.Valid || comp.FinishedAt.Valid || comp.DeletedAt.Valid {
+		return nil
+	}
+	if _, err := s.adminDB.ExecContext(
+		ctx,
+		"INSERT INTO competition_schedule (tenant_id, competition_id, end_at) VALUES (?, ?, ?)",
+		comp.TenantID, comp.ID, comp.EndAt.Int64,
+	); err != nil {
+		return fmt.Errorf("error Insert competition_schedule: tenantID=%d, competitionID=%s, %w", comp.TenantID, comp.ID, err)
+	}
+	return nil
+}
+
+// 終了時刻を過ぎた大会を定期的に終了させる
+func (s *Server) runCompetitionScheduler(ctx context.Context, interval time.Duration, logger echo.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.finishEndedCompetitions(ctx, s.now(), logger); err != nil {
+				logger.Errorf("error finishEndedCompetitions: %s", err)
+			}
+		}
+	}
+}
+
+// 終了時刻を過ぎた大会のあるテナントについて、大会を終了させる
+// finished_at には終了時刻を入れる
+func (s *Server) finishEndedCompetitions(ctx context.Context, now int64, logger echo.Logger) error {
+	tenantIDs := []int64{}
+	if err := s.adminDB.SelectContext(
+		ctx,
+		&tenantIDs,
+		"SELECT DISTINCT tenant_id FROM competition_schedule WHERE end_at <= ? ORDER BY tenant_id",
+		now,
+	); err != nil {
+		return fmt.Errorf("error Select competition_schedule: %w", err)
+	}
+	for _, tenantID := range tenantIDs {
+		if err := s.finishTenantEndedCompetitions(ctx, tenantID, now, logger); err != nil {
+			// テナントDBが作成途中などの場合もあるので、他のテナントの処理は続ける
+			logger.Errorf("error finish competitions: tenantID=%d, %s", tenantID, err)
+		}
+	}
+	return nil
+}
+
+// テナントの終了時刻を過ぎた大会を終了させる
+func (s *Server) finishTenantEndedCompetitions(ctx context.Context, tenantID int64, now int64, logger echo.Logger) error {
+	// スコアの入稿と同じく、テナントDBへの書き込みは排他ロックを取ってから行う
+	fl, err := s.flockByTenantID(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	tenantDB, err := s.connectToTenantDB(ctx, tenantID)
+	if err != nil {
+		return fmt.Errorf("failed to connectToTenantDB: %w", err)
+	}
+	defer tenantDB.Close()
+	cs := []CompetitionRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&cs,
+		"SELECT * FROM competition WHERE tenant_id = ? AND finished_at IS NULL AND deleted_at IS NULL AND end_at <= ?",
+		tenantID, now,
+	); err != nil {
+		return fmt.Errorf("error Select competition: tenantID=%d, %w", tenantID, err)
+	}
+	for _, comp := range cs {
+		if err := s.finishEndedCompetition(ctx, tenantDB, &comp, now); err != nil {
+			return err
+		}
+		logger.Infof("finished competition: tenantID=%d, id=%s", tenantID, comp.ID)
+	}
+	// 終了させた大会と、テナントDB側で既に終了・削除されていた大会の予定をまとめて消す
+	if _, err := s.adminDB.ExecContext(
+		ctx,
+		"DELETE FROM competition_schedule WHERE tenant_id = ? AND end_at <= ?",
+		tenantID, now,
+	); err != nil {
+		return fmt.Errorf("error Delete competition_schedule: tenantID=%d, %w", tenantID, err)
+	}
+	return nil
+}
+
+// 終了時刻を過ぎた大会を1件終了させる
+func (s *Server) finishEndedCompetition(ctx context.Context, tenantDB *sqlx.DB, comp *CompetitionRow, now int64) error {
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE competition SET finished_at = end_at, updated_by = ?, updated_at = ? WHERE id = ? AND finished_at IS NULL",
+		auditActorSystem, now, comp.ID,
+	); err != nil {
+		return fmt.Errorf("error Update competition: tenantID=%d, id=%s, %w", comp.TenantID, comp.ID, err)
+	}
+	comp.FinishedAt = comp.EndAt
+	if err := bumpDataVersions(ctx, tx, now, dataVersionCompetitions, competitionDataVersion(comp.ID)); err != nil {
+		return fmt.Errorf("error bumpDataVersions: %w", err)
+	}
+	if err := recordDomainEvent(ctx, tx, now, comp.TenantID, DomainEventCompetitionFinished, competitionEventData(comp)); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, comp.TenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package isuports
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/gommon/log"
+	"github.com/lestrrat-go/jwx/v2/jwk"
+)
+
+// webappの設定
+// 起動時に一度だけ loadConfig で読み込み、検証してから使う
+// 値は環境変数、設定ファイル、デフォルト値の順に優先する
+//
+// ISUCON_CONFIG_FILE: 環境変数名をキー、値を文字列にしたJSONファイルのパス
+// 例: {"ISUCON_DB_HOST": "10.0.0.2", "ISUCON_RATE_LIMITS": "score.tenant=1/5"}
+type Config struct {
+	ServerPort string
+
+	AdminDB AdminDBConfig
+
+	// テナントDBを置くディレクトリ。絶対パスにして保持する
+	TenantDBDir string
+	// JWTの検証に使う公開鍵のファイル。絶対パスにして保持する
+	JWTKeyFile string
+	// JWTKeyFile を jwk.DecodePEM で読み込んだ鍵
+	JWTKey interface{}
+
+	// テナントのHostヘッダは <テナント名><BaseHostname>
+	BaseHostname string
+	// SaaS管理者用のHostヘッダ
+	AdminHostname string
+
+	CompetitionSchedulerInterval time.Duration
+	ShutdownTimeout              time.Duration
+	DomainEventLogFile           string
+	TenantCacheTTL               time.Duration
+	TenantCacheNegativeTTL       time.Duration
+	// Webhookをループバックやプライベートのアドレスに送ることを許可する
+	WebhookAllowPrivateAddresses bool
+
+	// ISUCON_RATE_LIMITS の値と、それを解析した規則
+	RateLimitsSpec              string
+	RateLimits                  map[string]map[string]rateLimitRule
+	RateLimitRetryAfterHTTPDate bool
+
+	Log      LogConfig
+	Trace    TraceConfig
+	SQLTrace SQLTraceConfig
+}
+
+type AdminDBConfig struct {
+	Driver string // "mysql" か "sqlite3"
+
+	// Driver が mysql のときに使う
+	Host     string
+	Port     string
+	User     string
+	Password string
+	Name     string
+
+	// Driver が sqlite3 のときのデータベースファイル。絶対パスにして保持する
+	Path string
+}
+
+type LogConfig struct {
+	Level      log.Lvl
+	LevelName  string
+	JSONFormat bool
+	Debug      bool
+}
+
+type TraceConfig struct {
+	Exporter     string // "", "file", "otlp" のいずれか
+	File         string
+	OTLPEndpoint string
+}
+
+type SQLTraceConfig struct {
+	SQLiteFile    string
+	MySQLFile     string
+	SlowThreshold time.Duration
+	MaxSize       int64 // バイト単位。0なら制限しない
+	MaxBackups    int
+}
+
+// 設定の値を探す
+type configSource struct {
+	file map[string]string
+}
+
+func (s configSource) get(key, defaultValue string) string {
+	if val, ok := os.LookupEnv(key); ok {
+		return val
+	}
+	if val, ok := s.file[key]; ok {
+		return val
+	}
+	return defaultValue
+}
+
+// 環境変数と設定ファイルから設定を読み込み、検証する
+// 不正な値があれば、見つかったものをすべてまとめてエラーにする
+func loadConfig() (*Config, error) {
+	src := configSource{}
+	if p := getEnv("ISUCON_CONFIG_FILE", ""); p != "" {
+		b, err := os.ReadFile(p)
+		if err != nil {
+			return nil, fmt.Errorf("cannot read ISUCON_CONFIG_FILE: %w", err)
+		}
+		if err := json.Unmarshal(b, &src.file); err != nil {
+			return nil, fmt.Errorf("cannot parse ISUCON_CONFIG_FILE: path=%s, %w", p, err)
+		}
+	}
+
+	var errs []string
+	invalid := func(key string, format string, args ...any) {
+		errs = append(errs, fmt.Sprintf("%s: %s", key, fmt.Sprintf(format, args...)))
+	}
+	// 0を無効の意味で使う設定
+	duration := func(key, defaultValue string) time.Duration {
+		v := src.get(key, defaultValue)
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			invalid(key, "invalid duration %q", v)
+		}
+		return d
+	}
+	// 間隔やタイムアウトのように0では動かない設定
+	positiveDuration := func(key, defaultValue string) time.Duration {
+		v := src.get(key, defaultValue)
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			invalid(key, "invalid positive duration %q", v)
+		}
+		return d
+	}
+	nonNegativeInt := func(key, defaultValue string) int64 {
+		v := src.get(key, defaultValue)
+		n, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || n < 0 {
+			invalid(key, "invalid non-negative integer %q", v)
+		}
+		return n
+	}
+	absPath := func(key, p string) string {
+		if p == "" {
+			return ""
+		}
+		abs, err := filepath.Abs(p)
+		if err != nil {
+			invalid(key, "%s", err)
+			return p
+		}
+		return abs
+	}
+
+	conf := &Config{
+		ServerPort: src.get("SERVER_APP_PORT", "3000"),
+		AdminDB: AdminDBConfig{
+			Driver:   src.get("ISUCON_DB_DRIVER", adminDBDriverMySQL),
+			Host:     src.get("ISUCON_DB_HOST", "127.0.0.1"),
+			Port:     src.get("ISUCON_DB_PORT", "3306"),
+			User:     src.get("ISUCON_DB_USER", "isucon"),
+			Password: src.get("ISUCON_DB_PASSWORD", "isucon"),
+			Name:     src.get("ISUCON_DB_NAME", "isuports"),
+			Path:     absPath("ISUCON_DB_PATH", src.get("ISUCON_DB_PATH", "../admin.db")),
+		},
+		TenantDBDir:                  absPath("ISUCON_TENANT_DB_DIR", src.get("ISUCON_TENANT_DB_DIR", "../tenant_db")),
+		JWTKeyFile:                   absPath("ISUCON_JWT_KEY_FILE", src.get("ISUCON_JWT_KEY_FILE", "../public.pem")),
+		BaseHostname:                 src.get("ISUCON_BASE_HOSTNAME", ".t.isucon.dev"),
+		AdminHostname:                src.get("ISUCON_ADMIN_HOSTNAME", "admin.t.isucon.dev"),
+		CompetitionSchedulerInterval: positiveDuration("ISUCON_COMPETITION_SCHEDULER_INTERVAL", "10s"),
+		ShutdownTimeout:              positiveDuration("ISUCON_SHUTDOWN_TIMEOUT", "30s"),
+		DomainEventLogFile:           src.get("ISUCON_DOMAIN_EVENT_LOG_FILE", ""),
+		TenantCacheTTL:               duration("ISUCON_TENANT_CACHE_TTL", "10s"),
+		TenantCacheNegativeTTL:       duration("ISUCON_TENANT_CACHE_NEGATIVE_TTL", "1s"),
+		RateLimitsSpec:               src.get("ISUCON_RATE_LIMITS", ""),
+		Trace: TraceConfig{
+			Exporter:     src.get("ISUCON_TRACE_EXPORTER", ""),
+			File:         src.get("ISUCON_TRACE_FILE", ""),
+			OTLPEndpoint: src.get("ISUCON_TRACE_OTLP_ENDPOINT", "http://127.0.0.1:4318/v1/traces"),
+		},
+		SQLTrace: SQLTraceConfig{
+			SQLiteFile:    src.get("ISUCON_SQLITE_TRACE_FILE", ""),
+			MySQLFile:     src.get("ISUCON_MYSQL_TRACE_FILE", ""),
+			SlowThreshold: duration("ISUCON_SQL_TRACE_SLOW_THRESHOLD", "0s"),
+			MaxSize:       nonNegativeInt("ISUCON_SQL_TRACE_MAX_SIZE_MB", "0") * 1024 * 1024,
+			MaxBackups:    int(nonNegativeInt("ISUCON_SQL_TRACE_MAX_BACKUPS", "3")),
+		},
+	}
+
+	if port, err := strconv.Atoi(conf.ServerPort); err != nil || port <= 0 || port > 65535 {
+		invalid("SERVER_APP_PORT", "invalid port %q", conf.ServerPort)
+	}
+	switch conf.AdminDB.Driver {
+	case adminDBDriverMySQL:
+		if port, err := strconv.Atoi(conf.AdminDB.Port); err != nil || port <= 0 || port > 65535 {
+			invalid("ISUCON_DB_PORT", "invalid port %q", conf.AdminDB.Port)
+		}
+		if !isValidHostname(conf.AdminDB.Host) && net.ParseIP(conf.AdminDB.Host) == nil {
+			invalid("ISUCON_DB_HOST", "invalid hostname %q", conf.AdminDB.Host)
+		}
+	case adminDBDriverSQLite:
+		// ファイルは /initialize で作るので、置き場所のディレクトリだけ確認する
+		if st, err := os.Stat(filepath.Dir(conf.AdminDB.Path)); err != nil {
+			invalid("ISUCON_DB_PATH", "%s", err)
+		} else if !st.IsDir() {
+			invalid("ISUCON_DB_PATH", "%s is not a directory", filepath.Dir(conf.AdminDB.Path))
+		}
+	default:
+		invalid("ISUCON_DB_DRIVER", "must be mysql or sqlite3: %q", conf.AdminDB.Driver)
+	}
+
+	if st, err := os.Stat(conf.TenantDBDir); err != nil {
+		invalid("ISUCON_TENANT_DB_DIR", "%s", err)
+	} else if !st.IsDir() {
+		invalid("ISUCON_TENANT_DB_DIR", "%s is not a directory", conf.TenantDBDir)
+	}
+	if keysrc, err := os.ReadFile(conf.JWTKeyFile); err != nil {
+		invalid("ISUCON_JWT_KEY_FILE", "%s", err)
+	} else if conf.JWTKey, _, err = jwk.DecodePEM(keysrc); err != nil {
+		invalid("ISUCON_JWT_KEY_FILE", "cannot parse %s: %s", conf.JWTKeyFile, err)
+	}
+
+	// テナントのHostヘッダは "<テナント名>.t.isucon.dev" なので、ベースのホスト名は "." から始まる
+	if !strings.HasPrefix(conf.BaseHostname, ".") || !isValidHostnameWithPort(conf.BaseHostname[1:]) {
+		invalid("ISUCON_BASE_HOSTNAME", "must be a hostname starting with \".\": %q", conf.BaseHostname)
+	}
+	if !isValidHostnameWithPort(conf.AdminHostname) {
+		invalid("ISUCON_ADMIN_HOSTNAME", "invalid hostname %q", conf.AdminHostname)
+	}
+
+	var err error
+	if conf.RateLimits, err = parseRateLimitRules(conf.RateLimitsSpec); err != nil {
+		invalid("ISUCON_RATE_LIMITS", "%s", err)
+	}
+	switch v := src.get("ISUCON_RATE_LIMIT_RETRY_AFTER", "seconds"); v {
+	case "seconds":
+	case "http-date":
+		conf.RateLimitRetryAfterHTTPDate = true
+	default:
+		invalid("ISUCON_RATE_LIMIT_RETRY_AFTER", "must be seconds or http-date: %q", v)
+	}
+
+	conf.Log.LevelName = strings.ToLower(src.get("ISUCON_LOG_LEVEL", "info"))
+	if lvl, ok := logLevels[conf.Log.LevelName]; ok {
+		conf.Log.Level = lvl
+	} else {
+		invalid("ISUCON_LOG_LEVEL", "must be one of debug, info, warn, error, off: %q", conf.Log.LevelName)
+	}
+	switch v := src.get("ISUCON_LOG_FORMAT", "json"); v {
+	case "json":
+		conf.Log.JSONFormat = true
+	case "text":
+	default:
+		invalid("ISUCON_LOG_FORMAT", "must be json or text: %q", v)
+	}
+	if v := src.get("ISUCON_WEBHOOK_ALLOW_PRIVATE_ADDRESSES", "false"); v != "" {
+		if conf.WebhookAllowPrivateAddresses, err = strconv.ParseBool(v); err != nil {
+			invalid("ISUCON_WEBHOOK_ALLOW_PRIVATE_ADDRESSES", "invalid bool %q", v)
+		}
+	}
+	if v := src.get("ISUCON_DEBUG", "false"); v != "" {
+		if conf.Log.Debug, err = strconv.ParseBool(v); err != nil {
+			invalid("ISUCON_DEBUG", "invalid bool %q", v)
+		}
+	}
+
+	switch conf.Trace.Exporter {
+	case "", "otlp":
+	case "file":
+		if conf.Trace.File == "" {
+			invalid("ISUCON_TRACE_FILE", "required for ISUCON_TRACE_EXPORTER=file")
+		}
+	default:
+		invalid("ISUCON_TRACE_EXPORTER", "must be file or otlp: %q", conf.Trace.Exporter)
+	}
+
+	if len(errs) > 0 {
+		return nil, fmt.Errorf("invalid config: %s", strings.Join(errs, "; "))
+	}
+	return conf, nil
+}
+
+var hostnameLabelRegexp = regexp.MustCompile(`^[A-Za-z0-9]([A-Za-z0-9-]{0,61}[A-Za-z0-9])?$`)
+
+// RFC 1123 のホスト名か
+func isValidHostname(host string) bool {
+	if host == "" || len(host) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(host, ".") {
+		if !hostnameLabelRegexp.MatchString(label) {
+			return false
+		}
+	}
+	return true
+}
+
+// Hostヘッダと比較するので、ポート番号が付いていてもよい
+func isValidHostnameWithPort(host string) bool {
+	if h, port, err := net.SplitHostPort(host); err == nil {
+		if p, err := strconv.Atoi(port); err != nil || p <= 0 || p > 65535 {
+			return false
+		}
+		host = h
+	}
+	return isValidHostname(host)
+}
+
+// 起動時にログへ出力するための値
+// パスワードは伏せる
+func (conf *Config) redacted() log.JSON {
+	password := ""
+	if conf.AdminDB.Password != "" {
+		password = "********"
+	}
+	return log.JSON{
+		"server_app_port":                 conf.ServerPort,
+		"db_driver":                       conf.AdminDB.Driver,
+		"db_host":                         conf.AdminDB.Host,
+		"db_port":                         conf.AdminDB.Port,
+		"db_user":                         conf.AdminDB.User,
+		"db_password":                     password,
+		"db_name":                         conf.AdminDB.Name,
+		"db_path":                         conf.AdminDB.Path,
+		"tenant_db_dir":                   conf.TenantDBDir,
+		"jwt_key_file":                    conf.JWTKeyFile,
+		"base_hostname":                   conf.BaseHostname,
+		"admin_hostname":                  conf.AdminHostname,
+		"competition_scheduler_interval":  conf.CompetitionSchedulerInterval.String(),
+		"shutdown_timeout":                conf.ShutdownTimeout.String(),
+		"domain_event_log_file":           conf.DomainEventLogFile,
+		"tenant_cache_ttl":                conf.TenantCacheTTL.String(),
+		"tenant_cache_negative_ttl":       conf.TenantCacheNegativeTTL.String(),
+		"webhook_allow_private_addresses": conf.WebhookAllowPrivateAddresses,
+		"rate_limits":                     conf.RateLimitsSpec,
+		"rate_limit_retry_after_httpdate": conf.RateLimitRetryAfterHTTPDate,
+		"log_level":                       conf.Log.LevelName,
+		"log_json_format":                 conf.Log.JSONFormat,
+		"debug":                           conf.Log.Debug,
+		"trace_exporter":                  conf.Trace.Exporter,
+		"trace_file":                      conf.Trace.File,
+		"trace_otlp_endpoint":             conf.Trace.OTLPEndpoint,
+		"sqlite_trace_file":               conf.SQLTrace.SQLiteFile,
+		"mysql_trace_file":                conf.SQLTrace.MySQLFile,
+		"sql_trace_slow_threshold":        conf.SQLTrace.SlowThreshold.String(),
+		"sql_trace_max_size_bytes":        conf.SQLTrace.MaxSize,
+		"sql_trace_max_backups":           conf.SQLTrace.MaxBackups,
+	}
+}
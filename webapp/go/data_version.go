@@ -0,0 +1,102 @@
+package isuports
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// テナントDBのdata_versionで管理するデータの単位
+const (
+	dataVersionCompetitions = "competitions" // テナント内の大会の一覧
+	dataVersionPlayers      = "players"      // 参加者の表示名
+)
+
+// 大会ごとのデータのバージョンの名前
+// 大会の内容とスコアが変わると更新する
+func competitionDataVersion(competitionID string) string {
+	return "competition:" + competitionID
+}
+
+type DataVersionRow struct {
+	Name      string `db:"name"`
+	Version   string `db:"version"`
+	UpdatedAt int64  `db:"updated_at"`
+}
+
+// データのバージョンを更新する
+// データを書き換えるのと同じトランザクションで呼び出すこと
+// バージョンは連番ではなくランダムな値なので、テナントDBを初期化し直しても以前のETagと一致しない
+func bumpDataVersions(ctx context.Context, tx dbOrTx, now int64, names ...string) error {
+	version, err := randomHex(8)
+	if err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO data_version (name, version, updated_at) VALUES (?, ?, ?) ON CONFLICT (name) DO UPDATE SET version = excluded.version, updated_at = excluded.updated_at",
+			name, version, now,
+		); err != nil {
+			return fmt.Errorf("error Upsert data_version: name=%s, %w", name, err)
+		}
+	}
+	return nil
+}
+
+// データのバージョンを取得する
+// 一度も更新されていないデータのバージョンは空文字列になる
+func retrieveDataVersions(ctx context.Context, tenantDB dbOrTx, names ...string) ([]string, error) {
+	query, args, err := sqlx.In("SELECT * FROM data_version WHERE name IN (?)", names)
+	if err != nil {
+		return nil, fmt.Errorf("error sqlx.In: %w", err)
+	}
+	rows := []DataVersionRow{}
+	if err := tenantDB.SelectContext(ctx, &rows, query, args...); err != nil {
+		return nil, fmt.Errorf("error Select data_version: names=%v, %w", names, err)
+	}
+	versionByName := make(map[string]string, len(rows))
+	for _, r := range rows {
+		versionByName[r.Name] = r.Version
+	}
+	versions := make([]string, 0, len(names))
+	for _, name := range names {
+		versions = append(versions, versionByName[name])
+	}
+	return versions, nil
+}
+
+// レスポンスを決める値からstrong ETagを作る
+func dataETag(parts ...string) string {
+	h := sha256.New()
+	for _, p := range parts {
+		h.Write([]byte(p))
+		h.Write([]byte{0})
+	}
+	return `"` + hex.EncodeToString(h.Sum(nil)[:16]) + `"`
+}
+
+// If-None-Matchがetagに一致するか
+// If-None-Matchの比較は弱い比較なので W/ は無視する
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, t := range strings.Split(ifNoneMatch, ",") {
+		t = strings.TrimSpace(t)
+		if t == "*" || strings.TrimPrefix(t, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// ETagを設定し、リクエストのIf-None-Matchと一致すればtrueを返す
+// trueの場合は呼び出し側で304を返すこと
+func checkNotModified(c echo.Context, etag string) bool {
+	c.Response().Header().Set("ETag", etag)
+	inm := c.Request().Header.Get("If-None-Match")
+	return inm != "" && etagMatches(inm, etag)
+}
@@ -0,0 +1,400 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	DomainEventTenantAdded            = "tenant.added"
+	DomainEventPlayerAdded            = "player.added"
+	DomainEventPlayerUpdated          = "player.updated"
+	DomainEventPlayerDisqualified     = "player.disqualified"
+	DomainEventPlayerReinstated       = "player.reinstated"
+	DomainEventCompetitionCreated     = "competition.created"
+	DomainEventCompetitionUpdated     = "competition.updated"
+	DomainEventCompetitionDeleted     = "competition.deleted"
+	DomainEventCompetitionFinished    = "competition.finished"
+	DomainEventCompetitionPublished   = "competition.published"
+	DomainEventCompetitionUnpublished = "competition.unpublished"
+	DomainEventScoresUploaded         = "scores.uploaded"
+
+	domainEventDispatchLimit = 100
+	domainEventSweepInterval = time.Minute
+
+	// 管理用DBのoutboxを表すID
+	// テナントIDは1から始まるので0と重ならない
+	adminOutboxID int64 = 0
+)
+
+// テナントDBと管理用DBのdomain_eventテーブルの行
+// どちらのDBでも同じ形で、状態を変更したトランザクションの中で書き込む
+type DomainEventRow struct {
+	Seq          int64         `db:"seq"` // DBごとの書き込み順
+	ID           string        `db:"id"`
+	TenantID     int64         `db:"tenant_id"`
+	Type         string        `db:"type"`
+	Payload      string        `db:"payload"` // JSON
+	CreatedAt    int64         `db:"created_at"`
+	DispatchedAt sql.NullInt64 `db:"dispatched_at"`
+}
+
+// 各イベントのpayload
+// Webhookのdataとしてもそのまま送る
+type TenantEventData struct {
+	Tenant TenantEventTenant `json:"tenant"`
+}
+
+type TenantEventTenant struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	DisplayName string `json:"display_name"`
+}
+
+type PlayersEventData struct {
+	Players []PlayerDetail `json:"players"`
+}
+
+type PlayerEventData struct {
+	Player           PlayerDetail            `json:"player"`
+	Disqualification *DisqualificationDetail `json:"disqualification"`
+}
+
+type CompetitionEventData struct {
+	Competition CompetitionDetail `json:"competition"`
+}
+
+type ScoresUploadedEventData struct {
+	CompetitionID string `json:"competition_id"`
+	Rows          int64  `json:"rows"`
+}
+
+func competitionEventData(comp *CompetitionRow) CompetitionEventData {
+	return CompetitionEventData{
+		Competition: CompetitionDetail{
+			ID:         comp.ID,
+			Title:      comp.Title,
+			IsFinished: comp.FinishedAt.Valid,
+			StartAt:    nullInt64Ptr(comp.StartAt),
+			EndAt:      nullInt64Ptr(comp.EndAt),
+		},
+	}
+}
+
+// ドメインイベントをoutboxに書き込む
+// 状態の変更と同じトランザクションで呼び出し、コミットした後に notifyDomainEvents で配送を促すこと
+// created_at は s.now() の時刻を渡す。Webhookの重複確認で配送を積んだ時刻と比べるため
+func recordDomainEvent(ctx context.Context, db dbOrTx, now int64, tenantID int64, eventType string, data any) error {
+	id, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	payload, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	if _, err := db.ExecContext(
+		ctx,
+		"INSERT INTO domain_event (id, tenant_id, type, payload, created_at) VALUES (?, ?, ?, ?, ?)",
+		id, tenantID, eventType, string(payload), now,
+	); err != nil {
+		return fmt.Errorf("error Insert domain_event: tenantID=%d, type=%s, %w", tenantID, eventType, err)
+	}
+	return nil
+}
+
+// ドメインイベントの配送先
+// 配送に失敗したイベントは後で同じIDのまま再送されるので、IDで重複を排除できるようにしておくこと
+type domainEventSink interface {
+	Name() string
+	HandleDomainEvent(ctx context.Context, ev *DomainEventRow) error
+}
+
+// outboxのドメインイベントを配送先に順番に送る
+// コミット後の通知があったoutboxをすぐに処理し、通知を取りこぼした場合に備えて
+// 管理用DBの domain_event_outbox に記録された未配送のoutboxを定期的に確認する
+type domainEventDispatcher struct {
+	mu    sync.Mutex
+	sinks []domainEventSink
+	dirty map[int64]struct{} // 未配送のイベントがあるoutbox
+	kick  chan struct{}
+}
+
+func (d *domainEventDispatcher) addSink(s domainEventSink) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.sinks = append(d.sinks, s)
+}
+
+// テナントのoutboxにイベントを書き込んだことを通知する
+// 管理用DBのoutboxの場合は adminOutboxID を渡す
+// テナントのoutboxは、別のプロセスが配送する場合や通知を取りこぼした場合に備えて管理用DBにも記録する
+func (s *Server) notifyDomainEvents(ctx context.Context, outboxID int64) error {
+	if outboxID != adminOutboxID {
+		if err := s.markOutboxPending(ctx, outboxID); err != nil {
+			return err
+		}
+	}
+	d := s.domainEvents
+	d.mu.Lock()
+	d.dirty[outboxID] = struct{}{}
+	d.mu.Unlock()
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// テナントのoutboxに未配送のイベントがあることを管理用DBに記録する
+// 記録するたびに version を増やし、配送中に書き込まれたイベントの記録を消さないようにする
+func (s *Server) markOutboxPending(ctx context.Context, tenantID int64) error {
+	if _, err := s.adminDB.ExecContext(
+		ctx,
+		"INSERT INTO domain_event_outbox (tenant_id, version) VALUES (?, 1)",
+		tenantID,
+	); err == nil {
+		return nil
+	} else if !isDuplicateKeyError(err) {
+		return fmt.Errorf("error Insert domain_event_outbox: tenantID=%d, %w", tenantID, err)
+	}
+	if _, err := s.adminDB.ExecContext(
+		ctx,
+		"UPDATE domain_event_outbox SET version = version + 1 WHERE tenant_id = ?",
+		tenantID,
+	); err != nil {
+		return fmt.Errorf("error Update domain_event_outbox: tenantID=%d, %w", tenantID, err)
+	}
+	return nil
+}
+
+func (d *domainEventDispatcher) takeDirty() ([]int64, []domainEventSink) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	ids := make([]int64, 0, len(d.dirty))
+	for id := range d.dirty {
+		ids = append(ids, id)
+	}
+	d.dirty = map[int64]struct{}{}
+	return ids, d.sinks
+}
+
+// 管理用DBのoutboxと、未配送のイベントが記録されたテナントのoutboxを配送の対象にする
+func (d *domainEventDispatcher) sweep(ctx context.Context, adminDB dbOrTx) error {
+	ids := []int64{}
+	if err := adminDB.SelectContext(ctx, &ids, "SELECT tenant_id FROM domain_event_outbox"); err != nil {
+		return fmt.Errorf("error Select domain_event_outbox: %w", err)
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.dirty[adminOutboxID] = struct{}{}
+	for _, id := range ids {
+		d.dirty[id] = struct{}{}
+	}
+	return nil
+}
+
+// ドメインイベントを配送する
+// 同じoutboxのイベントは書き込まれた順に配送するため、1つのgoroutineで動かすこと
+func (s *Server) runDomainEventDispatcher(ctx context.Context, logger echo.Logger) {
+	d := s.domainEvents
+	sweepTicker := time.NewTicker(domainEventSweepInterval)
+	defer sweepTicker.Stop()
+	// 前回の起動時に配送しきれなかったイベントを拾う
+	if err := d.sweep(ctx, s.adminDB); err != nil {
+		logger.Errorf("error sweep domain events: %s", err)
+	}
+	for {
+		ids, sinks := d.takeDirty()
+		for _, id := range ids {
+			if err := s.dispatchOutbox(ctx, id, sinks); err != nil {
+				// 失敗したイベントは次の確認で再送する
+				logger.Errorf("error dispatchOutbox: outboxID=%d, %s", id, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.kick:
+		case <-sweepTicker.C:
+			if err := d.sweep(ctx, s.adminDB); err != nil {
+				logger.Errorf("error sweep domain events: %s", err)
+			}
+		}
+	}
+}
+
+// outboxの未配送のイベントを配送する
+// 配送に失敗したらそれ以降のイベントは送らずに終える
+func (s *Server) dispatchOutbox(ctx context.Context, outboxID int64, sinks []domainEventSink) error {
+	if outboxID == adminOutboxID {
+		return dispatchDomainEvents(ctx, s.adminDB, sinks, func(seq int64) error {
+			return markDomainEventDispatched(ctx, s.adminDB, seq, s.now())
+		})
+	}
+
+	// 配送を始める前の記録を読んでおき、配送しきったらその記録だけを消す
+	var version int64
+	if err := s.adminDB.GetContext(
+		ctx,
+		&version,
+		"SELECT version FROM domain_event_outbox WHERE tenant_id = ?",
+		outboxID,
+	); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return fmt.Errorf("error Select domain_event_outbox: tenantID=%d, %w", outboxID, err)
+	}
+	tenantDB, err := s.connectToTenantDB(ctx, outboxID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+	if err := dispatchDomainEvents(ctx, tenantDB, sinks, func(seq int64) error {
+		// テナントDBへの書き込みは排他ロックを取ってから行う
+		// 配送先がロックを取ることがあるので、配送中はロックを持たない
+		fl, err := s.flockByTenantID(ctx, outboxID)
+		if err != nil {
+			return fmt.Errorf("error flockByTenantID: %w", err)
+		}
+		defer fl.Close()
+		return markDomainEventDispatched(ctx, tenantDB, seq, s.now())
+	}); err != nil {
+		return err
+	}
+	if version > 0 {
+		if _, err := s.adminDB.ExecContext(
+			ctx,
+			"DELETE FROM domain_event_outbox WHERE tenant_id = ? AND version = ?",
+			outboxID, version,
+		); err != nil {
+			return fmt.Errorf("error Delete domain_event_outbox: tenantID=%d, %w", outboxID, err)
+		}
+	}
+	return nil
+}
+
+// outboxの未配送のイベントを書き込まれた順に配送先に渡し、1件ごとに markDispatched を呼ぶ
+func dispatchDomainEvents(ctx context.Context, db dbOrTx, sinks []domainEventSink, markDispatched func(seq int64) error) error {
+	for {
+		evs := []DomainEventRow{}
+		if err := db.SelectContext(
+			ctx,
+			&evs,
+			"SELECT * FROM domain_event WHERE dispatched_at IS NULL ORDER BY seq ASC LIMIT ?",
+			domainEventDispatchLimit,
+		); err != nil {
+			return fmt.Errorf("error Select domain_event: %w", err)
+		}
+		for _, ev := range evs {
+			for _, sink := range sinks {
+				if err := sink.HandleDomainEvent(ctx, &ev); err != nil {
+					return fmt.Errorf("error %s: id=%s, type=%s, %w", sink.Name(), ev.ID, ev.Type, err)
+				}
+			}
+			if err := markDispatched(ev.Seq); err != nil {
+				return err
+			}
+		}
+		if len(evs) < domainEventDispatchLimit {
+			return nil
+		}
+	}
+}
+
+func markDomainEventDispatched(ctx context.Context, db dbOrTx, seq int64, now int64) error {
+	if _, err := db.ExecContext(
+		ctx,
+		"UPDATE domain_event SET dispatched_at = ? WHERE seq = ?",
+		now, seq,
+	); err != nil {
+		return fmt.Errorf("error Update domain_event: seq=%d, %w", seq, err)
+	}
+	return nil
+}
+
+// ドメインイベントを1行1イベントのJSONでファイルに書き出す
+// 環境変数 ISUCON_DOMAIN_EVENT_LOG_FILE を設定すると有効になる
+type logFileDomainEventSink struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+type domainEventLog struct {
+	ID        string          `json:"id"`
+	TenantID  int64           `json:"tenant_id"`
+	Type      string          `json:"type"`
+	Payload   json.RawMessage `json:"payload"`
+	CreatedAt int64           `json:"created_at"`
+}
+
+func (s *logFileDomainEventSink) Name() string {
+	return "logFileDomainEventSink"
+}
+
+func (s *logFileDomainEventSink) HandleDomainEvent(ctx context.Context, ev *DomainEventRow) error {
+	b, err := json.Marshal(domainEventLog{
+		ID:        ev.ID,
+		TenantID:  ev.TenantID,
+		Type:      ev.Type,
+		Payload:   json.RawMessage(ev.Payload),
+		CreatedAt: ev.CreatedAt,
+	})
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, err := s.w.Write(append(b, '\n')); err != nil {
+		return fmt.Errorf("error Write: %w", err)
+	}
+	return nil
+}
+
+// ドメインイベントをWebhookの配送キューに積む
+type webhookDomainEventSink struct {
+	s *Server
+}
+
+func (webhookDomainEventSink) Name() string {
+	return "webhookDomainEventSink"
+}
+
+func (sink webhookDomainEventSink) HandleDomainEvent(ctx context.Context, ev *DomainEventRow) error {
+	return sink.s.enqueueWebhookEvent(ctx, ev)
+}
+
+// ドメインイベントをプロセス内の購読者に渡す
+// 購読者は配送を行うプロセスでのみ呼ばれる
+type domainEventBus struct {
+	mu          sync.RWMutex
+	subscribers map[string][]func(ctx context.Context, ev *DomainEventRow) error
+}
+
+func (b *domainEventBus) subscribe(eventType string, fn func(ctx context.Context, ev *DomainEventRow) error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[eventType] = append(b.subscribers[eventType], fn)
+}
+
+func (b *domainEventBus) Name() string {
+	return "domainEventBus"
+}
+
+func (b *domainEventBus) HandleDomainEvent(ctx context.Context, ev *DomainEventRow) error {
+	b.mu.RLock()
+	fns := b.subscribers[ev.Type]
+	b.mu.RUnlock()
+	for _, fn := range fns {
+		if err := fn(ctx, ev); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const readinessCheckTimeout = time.Second
+
+// 監視用API
+// GET /healthz
+// プロセスが動いていれば200を返す
+func healthzHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+type ReadinessCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type ReadyzHandlerResult struct {
+	Ready  bool             `json:"ready"`
+	Checks []ReadinessCheck `json:"checks"`
+}
+
+// 監視用API
+// GET /readyz
+// リクエストを受け付けられる状態なら200を、そうでなければ503を返す
+// 初期化中と終了処理中は受け付けられない状態とみなす
+func (s *Server) readyzHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(requestContext(c), readinessCheckTimeout)
+	defer cancel()
+
+	res := ReadyzHandlerResult{Ready: true}
+	check := func(name string, err error) {
+		rc := ReadinessCheck{Name: name, OK: err == nil}
+		if err != nil {
+			rc.Error = err.Error()
+			res.Ready = false
+		}
+		res.Checks = append(res.Checks, rc)
+	}
+	if atomic.LoadInt32(&s.shuttingDown) == 1 {
+		check("shutdown", fmt.Errorf("shutting down"))
+	}
+	if atomic.LoadInt32(&s.initializing) == 1 {
+		check("initialize", fmt.Errorf("initializing"))
+	}
+	check("admin_db", s.adminDB.PingContext(ctx))
+	check("tenant_db_dir", s.tenants.Check(ctx))
+	check("jwt_key", s.checkJWTKeyLoaded(ctx))
+
+	code := http.StatusOK
+	if !res.Ready {
+		code = http.StatusServiceUnavailable
+	}
+	return c.JSON(code, SuccessResult{Status: res.Ready, Data: res})
+}
+
+// JWTの検証に使う公開鍵を読み込めているか
+func (s *Server) checkJWTKeyLoaded(ctx context.Context) error {
+	key, err := s.keys.VerificationKey(ctx)
+	if err != nil {
+		return fmt.Errorf("error VerificationKey: %w", err)
+	}
+	if key == nil {
+		return fmt.Errorf("jwt key is not loaded")
+	}
+	return nil
+}
+
+// テナントDBのディレクトリにファイルを作れるか
+func checkTenantDBDirWritable(dir string) error {
+	f, err := os.CreateTemp(dir, ".readyz-*")
+	if err != nil {
+		return fmt.Errorf("error os.CreateTemp: dir=%s, %w", dir, err)
+	}
+	f.Close()
+	if err := os.Remove(f.Name()); err != nil {
+		return fmt.Errorf("error os.Remove: %w", err)
+	}
+	return nil
+}
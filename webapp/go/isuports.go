@@ -7,25 +7,23 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
-	"path/filepath"
+	"os/signal"
 	"reflect"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
 
-	"github.com/go-sql-driver/mysql"
-	"github.com/gofrs/flock"
-	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo/v4"
-	"github.com/labstack/echo/v4/middleware"
 	"github.com/labstack/gommon/log"
 	"github.com/lestrrat-go/jwx/v2/jwa"
-	"github.com/lestrrat-go/jwx/v2/jwk"
 	"github.com/lestrrat-go/jwx/v2/jwt"
 )
 
@@ -43,10 +41,6 @@ const (
 var (
 	// 正しいテナント名の正規表現
 	tenantNameRegexp = regexp.MustCompile(`^[a-z][a-z0-9-]{0,61}[a-z0-9]$`)
-
-	adminDB *sqlx.DB
-
-	sqliteDriverName = "sqlite3"
 )
 
 // 環境変数を取得する、なければデフォルト値を返す
@@ -57,72 +51,6 @@ func getEnv(key string, defaultValue string) string {
 	return defaultValue
 }
 
-// 管理用DBに接続する
-func connectAdminDB() (*sqlx.DB, error) {
-	config := mysql.NewConfig()
-	config.Net = "tcp"
-	config.Addr = getEnv("ISUCON_DB_HOST", "127.0.0.1") + ":" + getEnv("ISUCON_DB_PORT", "3306")
-	config.User = getEnv("ISUCON_DB_USER", "isucon")
-	config.Passwd = getEnv("ISUCON_DB_PASSWORD", "isucon")
-	config.DBName = getEnv("ISUCON_DB_NAME", "isuports")
-	config.ParseTime = true
-	dsn := config.FormatDSN()
-	return sqlx.Open("mysql", dsn)
-}
-
-// テナントDBのパスを返す
-func tenantDBPath(id int64) string {
-	tenantDBDir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
-	return filepath.Join(tenantDBDir, fmt.Sprintf("%d.db", id))
-}
-
-// テナントDBに接続する
-func connectToTenantDB(id int64) (*sqlx.DB, error) {
-	p := tenantDBPath(id)
-	db, err := sqlx.Open(sqliteDriverName, fmt.Sprintf("file:%s?mode=rw", p))
-	if err != nil {
-		return nil, fmt.Errorf("failed to open tenant DB: %w", err)
-	}
-	return db, nil
-}
-
-// テナントDBを新規に作成する
-func createTenantDB(id int64) error {
-	p := tenantDBPath(id)
-
-	cmd := exec.Command("sh", "-c", fmt.Sprintf("sqlite3 %s < %s", p, tenantDBSchemaFilePath))
-	if out, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to exec sqlite3 %s < %s, out=%s: %w", p, tenantDBSchemaFilePath, string(out), err)
-	}
-	return nil
-}
-
-// システム全体で一意なIDを生成する
-func dispenseID(ctx context.Context) (string, error) {
-	var id int64
-	var lastErr error
-	for i := 0; i < 100; i++ {
-		var ret sql.Result
-		ret, err := adminDB.ExecContext(ctx, "REPLACE INTO id_generator (stub) VALUES (?);", "a")
-		if err != nil {
-			if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1213 { // deadlock
-				lastErr = fmt.Errorf("error REPLACE INTO id_generator: %w", err)
-				continue
-			}
-			return "", fmt.Errorf("error REPLACE INTO id_generator: %w", err)
-		}
-		id, err = ret.LastInsertId()
-		if err != nil {
-			return "", fmt.Errorf("error ret.LastInsertId: %w", err)
-		}
-		break
-	}
-	if id != 0 {
-		return fmt.Sprintf("%x", id), nil
-	}
-	return "", lastErr
-}
-
 // 全APIにCache-Control: privateを設定する
 func SetCacheControlPrivate(next echo.HandlerFunc) echo.HandlerFunc {
 	return func(c echo.Context) error {
@@ -134,57 +62,46 @@ func SetCacheControlPrivate(next echo.HandlerFunc) echo.HandlerFunc {
 // Run は cmd/isuports/main.go から呼ばれるエントリーポイントです
 func Run() {
 	e := echo.New()
-	e.Debug = true
-	e.Logger.SetLevel(log.DEBUG)
 
-	var (
-		sqlLogger io.Closer
-		err       error
-	)
-	// sqliteのクエリログを出力する設定
-	// 環境変数 ISUCON_SQLITE_TRACE_FILE を設定すると、そのファイルにクエリログをJSON形式で出力する
+	// 設定を読み込む
+	// 環境変数と、ISUCON_CONFIG_FILE で指定したファイルから読み込む
+	// config.go を参照
+	conf, err := loadConfig()
+	if err != nil {
+		e.Logger.Fatalf("error loadConfig: %s", err)
+		return
+	}
+
+	// ログの設定
+	// logging.go を参照
+	configureLogger(e, conf.Log)
+	writeLog(e.Logger, conf.Log.JSONFormat, log.INFO, "config loaded", conf.redacted())
+
+	// トレースの設定
+	// 環境変数 ISUCON_TRACE_EXPORTER に file か otlp を設定すると、ハンドラやクエリの区間をOTLP/JSONで出力する
+	// 未設定なら記録しない
+	// tracing.go を参照
+	tracer, err := initializeTracer(e.Logger, conf.Trace)
+	if err != nil {
+		e.Logger.Panicf("error initializeTracer: %s", err)
+	}
+	defer tracer.Close()
+
+	// クエリログを出力する設定
+	// 環境変数 ISUCON_SQLITE_TRACE_FILE と ISUCON_MYSQL_TRACE_FILE を設定すると、そのファイルにクエリログをJSON形式で出力する
 	// 未設定なら出力しない
 	// sqltrace.go を参照
-	sqliteDriverName, sqlLogger, err = initializeSQLLogger()
+	sqlDrivers, sqlLogger, err := initializeSQLLogger(conf.SQLTrace, conf.AdminDB.Driver, tracer)
 	if err != nil {
 		e.Logger.Panicf("error initializeSQLLogger: %s", err)
 	}
 	defer sqlLogger.Close()
 
-	e.Use(middleware.Logger())
-	e.Use(middleware.Recover())
-	e.Use(SetCacheControlPrivate)
-
-	// SaaS管理者向けAPI
-	e.POST("/api/admin/tenants/add", tenantsAddHandler)
-	e.GET("/api/admin/tenants/billing", tenantsBillingHandler)
-
-	// テナント管理者向けAPI - 参加者追加、一覧、失格
-	e.GET("/api/organizer/players", playersListHandler)
-	e.POST("/api/organizer/players/add", playersAddHandler)
-	e.POST("/api/organizer/player/:player_id/disqualified", playerDisqualifiedHandler)
-
-	// テナント管理者向けAPI - 大会管理
-	e.POST("/api/organizer/competitions/add", competitionsAddHandler)
-	e.POST("/api/organizer/competition/:competition_id/finish", competitionFinishHandler)
-	e.POST("/api/organizer/competition/:competition_id/score", competitionScoreHandler)
-	e.GET("/api/organizer/billing", billingHandler)
-	e.GET("/api/organizer/competitions", organizerCompetitionsHandler)
-
-	// 参加者向けAPI
-	e.GET("/api/player/player/:player_id", playerHandler)
-	e.GET("/api/player/competition/:competition_id/ranking", competitionRankingHandler)
-	e.GET("/api/player/competitions", playerCompetitionsHandler)
+	// メトリクスはIDの採番のリトライも数えるので、Serverより先に作る
+	// metrics.go を参照
+	metrics := newMetricsRegistry()
 
-	// 全ロール及び未認証でも使えるhandler
-	e.GET("/api/me", meHandler)
-
-	// ベンチマーカー向けAPI
-	e.POST("/initialize", initializeHandler)
-
-	e.HTTPErrorHandler = errorResponseHandler
-
-	adminDB, err = connectAdminDB()
+	adminDB, err := connectAdminDB(conf.AdminDB, sqlDrivers.admin)
 	if err != nil {
 		e.Logger.Fatalf("failed to connect db: %v", err)
 		return
@@ -192,24 +109,98 @@ func Run() {
 	adminDB.SetMaxOpenConns(10)
 	defer adminDB.Close()
 
-	port := getEnv("SERVER_APP_PORT", "3000")
+	// レート制限の設定
+	// 環境変数 ISUCON_RATE_LIMITS に "score.tenant=1/5,ranking.player=10/20" のように設定する
+	// 未設定なら制限しない
+	// rate_limit.go を参照
+	s := NewServer(ServerOptions{
+		AdminDB:                      adminDB,
+		BaseHostname:                 conf.BaseHostname,
+		AdminHostname:                conf.AdminHostname,
+		TenantStore:                  &fileTenantStore{dir: conf.TenantDBDir, driverName: sqlDrivers.tenant},
+		IDDispenser:                  &adminDBIDDispenser{db: adminDB, metrics: metrics},
+		KeySource:                    staticKeySource{key: conf.JWTKey},
+		InitializeEnv:                conf.AdminDB.env(),
+		TenantCacheTTL:               conf.TenantCacheTTL,
+		TenantCacheNegativeTTL:       conf.TenantCacheNegativeTTL,
+		RateLimits:                   conf.RateLimits,
+		RateLimitRetryAfterHTTPDate:  conf.RateLimitRetryAfterHTTPDate,
+		WebhookAllowPrivateAddresses: conf.WebhookAllowPrivateAddresses,
+		Metrics:                      metrics,
+		Tracer:                       tracer,
+		JSONLogFormat:                conf.Log.JSONFormat,
+	})
+	s.registerRoutes(e)
+	go runRateLimitCleaner(context.Background(), s.rateLimits)
+
+	// バックグラウンドの処理は、処理中のリクエストを待ち終えてから止める
+	bgCtx, stopBackground := context.WithCancel(context.Background())
+	defer stopBackground()
+
+	// 終了時刻を過ぎた大会を終了させる
+	go s.runCompetitionScheduler(bgCtx, conf.CompetitionSchedulerInterval, e.Logger)
+	// 配送待ちのWebhookを送信する
+	go s.runWebhookDispatcher(bgCtx, time.Second, e.Logger)
+
+	// ドメインイベントの配送先
+	// 環境変数 ISUCON_DOMAIN_EVENT_LOG_FILE を設定すると、そのファイルにもイベントを書き出す
+	if path := conf.DomainEventLogFile; path != "" {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			e.Logger.Fatalf("failed to open ISUCON_DOMAIN_EVENT_LOG_FILE: %v", err)
+			return
+		}
+		defer f.Close()
+		s.domainEvents.addSink(&logFileDomainEventSink{w: f})
+	}
+	go s.runDomainEventDispatcher(bgCtx, e.Logger)
+
+	// SIGTERMを受けたら新しい接続の受け付けをやめ、処理中のリクエストが終わるのを待ってから終了する
+	// 待つ時間は環境変数 ISUCON_SHUTDOWN_TIMEOUT で設定する
+	shutdownTimeout := conf.ShutdownTimeout
+	sigCtx, stopSignal := signal.NotifyContext(context.Background(), syscall.SIGTERM, os.Interrupt)
+	defer stopSignal()
+	// 終了処理を始めたらリクエストのcontextをキャンセルして、ランキングのストリーミングなどの長い接続を切る
+	// ハンドラのDBアクセスは requestContext を使っているので中断されない
+	serverCtx, cancelServerCtx := context.WithCancel(context.Background())
+	defer cancelServerCtx()
+	e.Server.BaseContext = func(net.Listener) context.Context { return serverCtx }
+
+	port := conf.ServerPort
 	e.Logger.Infof("starting isuports server on : %s ...", port)
 	serverPort := fmt.Sprintf(":%s", port)
-	e.Logger.Fatal(e.Start(serverPort))
+	serverErr := make(chan error, 1)
+	go func() {
+		serverErr <- e.Start(serverPort)
+	}()
+
+	select {
+	case err := <-serverErr:
+		e.Logger.Fatal(err)
+	case <-sigCtx.Done():
+	}
+	e.Logger.Infof("shutting down isuports server (timeout %s) ...", shutdownTimeout)
+	atomic.StoreInt32(&s.shuttingDown, 1)
+	cancelServerCtx()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := e.Shutdown(shutdownCtx); err != nil {
+		e.Logger.Errorf("error e.Shutdown: %s", err)
+	}
+	stopBackground()
 }
 
 // エラー処理関数
-func errorResponseHandler(err error, c echo.Context) {
-	c.Logger().Errorf("error at %s: %s", c.Path(), err.Error())
+func (s *Server) errorResponseHandler(err error, c echo.Context) {
+	code := http.StatusInternalServerError
 	var he *echo.HTTPError
 	if errors.As(err, &he) {
-		c.JSON(he.Code, FailureResult{
-			Status: false,
-		})
-		return
+		code = he.Code
 	}
-	c.JSON(http.StatusInternalServerError, FailureResult{
-		Status: false,
+	s.logRequest(c, log.ERROR, "error", log.JSON{"status": code, "error": err.Error()})
+	c.JSON(code, FailureResult{
+		Status:    false,
+		RequestID: requestID(c),
 	})
 }
 
@@ -219,20 +210,58 @@ type SuccessResult struct {
 }
 
 type FailureResult struct {
-	Status  bool   `json:"status"`
-	Message string `json:"message"`
+	Status    bool   `json:"status"`
+	Message   string `json:"message"`
+	RequestID string `json:"request_id,omitempty"` // ログと突き合わせるためのID
 }
 
 // アクセスしてきた人の情報
 type Viewer struct {
 	role       string
-	playerID   string
+	playerID   string // JWTのsub。主催者の場合は主催者のID
 	tenantName string
 	tenantID   int64
+	apiToken   *APITokenRow // APIトークンで認証した場合
+}
+
+const viewerContextKey = "viewer"
+
+// KeySourceの公開鍵でJWTの署名を検証する
+func (s *Server) verifyJWT(ctx context.Context, tokenStr string) (jwt.Token, error) {
+	_, span := s.tracer.startSpan(ctx, "verifyJWT", spanKindInternal)
+	defer span.Finish()
+
+	key, err := s.keys.VerificationKey(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error VerificationKey: %w", err)
+	}
+	token, err := jwt.Parse(
+		[]byte(tokenStr),
+		jwt.WithKey(jwa.RS256, key),
+	)
+	if err != nil {
+		span.RecordError(err)
+		return nil, echo.NewHTTPError(http.StatusUnauthorized, fmt.Errorf("error jwt.Parse: %s", err.Error()))
+	}
+	return token, nil
 }
 
 // リクエストヘッダをパースしてViewerを返す
-func parseViewer(c echo.Context) (*Viewer, error) {
+// 同じリクエストで2回目以降に呼ばれた場合は、1回目の結果を返す
+func (s *Server) parseViewer(c echo.Context) (*Viewer, error) {
+	if v, ok := c.Get(viewerContextKey).(*Viewer); ok {
+		return v, nil
+	}
+	// Authorization: Bearer ヘッダがあればAPIトークンで認証する
+	// api_token.go を参照
+	if tokenStr, ok := bearerToken(c); ok {
+		v, err := s.parseAPITokenViewer(c, tokenStr)
+		if err != nil {
+			return nil, err
+		}
+		c.Set(viewerContextKey, v)
+		return v, nil
+	}
 	cookie, err := c.Request().Cookie(cookieName)
 	if err != nil {
 		return nil, echo.NewHTTPError(
@@ -242,22 +271,11 @@ func parseViewer(c echo.Context) (*Viewer, error) {
 	}
 	tokenStr := cookie.Value
 
-	keyFilename := getEnv("ISUCON_JWT_KEY_FILE", "../public.pem")
-	keysrc, err := os.ReadFile(keyFilename)
-	if err != nil {
-		return nil, fmt.Errorf("error os.ReadFile: keyFilename=%s: %w", keyFilename, err)
-	}
-	key, _, err := jwk.DecodePEM(keysrc)
+	ctx, span := s.tracer.startSpan(requestContext(c), "parseViewer", spanKindInternal)
+	defer span.Finish()
+	token, err := s.verifyJWT(ctx, tokenStr)
 	if err != nil {
-		return nil, fmt.Errorf("error jwk.DecodePEM: %w", err)
-	}
-
-	token, err := jwt.Parse(
-		[]byte(tokenStr),
-		jwt.WithKey(jwa.RS256, key),
-	)
-	if err != nil {
-		return nil, echo.NewHTTPError(http.StatusUnauthorized, fmt.Errorf("error jwt.Parse: %s", err.Error()))
+		return nil, err
 	}
 	if token.Subject() == "" {
 		return nil, echo.NewHTTPError(
@@ -284,6 +302,7 @@ func parseViewer(c echo.Context) (*Viewer, error) {
 		)
 	}
 	// aud は1要素でテナント名がはいっている
+	// カスタムドメインでアクセスした場合も、ドメインではなくテナント名と比べる
 	aud := token.Audience()
 	if len(aud) != 1 {
 		return nil, echo.NewHTTPError(
@@ -291,7 +310,7 @@ func parseViewer(c echo.Context) (*Viewer, error) {
 			fmt.Sprintf("invalid token: aud field is few or too much: %s", tokenStr),
 		)
 	}
-	tenant, err := retrieveTenantRowFromHeader(c)
+	tenant, err := s.retrieveTenantRowFromHeader(c)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return nil, echo.NewHTTPError(http.StatusUnauthorized, "tenant not found")
@@ -315,13 +334,32 @@ func parseViewer(c echo.Context) (*Viewer, error) {
 		tenantName: tenant.Name,
 		tenantID:   tenant.ID,
 	}
+	c.Set(viewerContextKey, v)
 	return v, nil
 }
 
-func retrieveTenantRowFromHeader(c echo.Context) (*TenantRow, error) {
+// Hostヘッダからテナント名を返す
+func (s *Server) tenantNameFromHost(c echo.Context) string {
+	return strings.TrimSuffix(c.Request().Host, s.baseHostname)
+}
+
+func (s *Server) retrieveTenantRowFromHeader(c echo.Context) (*TenantRow, error) {
+	// カスタムドメインを先に確認する
+	// テナントのサブドメインと管理者用のホスト名はカスタムドメインに登録できないので、それ以外のときだけ引く
+	host := c.Request().Host
+	if !strings.HasSuffix(host, s.baseHostname) && host != s.adminHostname {
+		tenant, err := s.retrieveTenantByDomain(requestContext(c), strings.ToLower(stripPort(host)))
+		if err == nil {
+			setRequestTenantID(c, tenant.ID)
+			return tenant, nil
+		}
+		if !errors.Is(err, sql.ErrNoRows) {
+			return nil, fmt.Errorf("error retrieveTenantByDomain: %w", err)
+		}
+	}
+
 	// JWTに入っているテナント名とHostヘッダのテナント名が一致しているか確認
-	baseHost := getEnv("ISUCON_BASE_HOSTNAME", ".t.isucon.dev")
-	tenantName := strings.TrimSuffix(c.Request().Host, baseHost)
+	tenantName := s.tenantNameFromHost(c)
 
 	// SaaS管理者用ドメイン
 	if tenantName == "admin" {
@@ -332,16 +370,24 @@ func retrieveTenantRowFromHeader(c echo.Context) (*TenantRow, error) {
 	}
 
 	// テナントの存在確認
-	var tenant TenantRow
-	if err := adminDB.GetContext(
-		context.Background(),
-		&tenant,
-		"SELECT * FROM tenant WHERE name = ?",
-		tenantName,
-	); err != nil {
-		return nil, fmt.Errorf("failed to Select tenant: name=%s, %w", tenantName, err)
+	// tenant_cache.go を参照
+	tenant, err := s.tenantCache.get(requestContext(c), tenantCacheNameKey(tenantName), func(ctx context.Context) (*TenantRow, error) {
+		var tenant TenantRow
+		if err := s.adminDB.GetContext(
+			ctx,
+			&tenant,
+			"SELECT * FROM tenant WHERE name = ?",
+			tenantName,
+		); err != nil {
+			return nil, fmt.Errorf("failed to Select tenant: name=%s, %w", tenantName, err)
+		}
+		return &tenant, nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return &tenant, nil
+	setRequestTenantID(c, tenant.ID)
+	return tenant, nil
 }
 
 type TenantRow struct {
@@ -359,12 +405,25 @@ type dbOrTx interface {
 }
 
 type PlayerRow struct {
-	TenantID       int64  `db:"tenant_id"`
-	ID             string `db:"id"`
-	DisplayName    string `db:"display_name"`
-	IsDisqualified bool   `db:"is_disqualified"`
-	CreatedAt      int64  `db:"created_at"`
-	UpdatedAt      int64  `db:"updated_at"`
+	TenantID           int64         `db:"tenant_id"`
+	ID                 string        `db:"id"`
+	DisplayName        string        `db:"display_name"`
+	IsDisqualified     bool          `db:"is_disqualified"`
+	DisqualifiedReason string        `db:"disqualified_reason"`
+	DisqualifiedUntil  sql.NullInt64 `db:"disqualified_until"`
+	CreatedBy          string        `db:"created_by"`
+	UpdatedBy          string        `db:"updated_by"`
+	CreatedAt          int64         `db:"created_at"`
+	UpdatedAt          int64         `db:"updated_at"`
+}
+
+// 現在失格中かどうかを返す
+// 期限付きの失格は期限を過ぎたら解除されたものとみなす
+func (p *PlayerRow) disqualified(now int64) bool {
+	if !p.IsDisqualified {
+		return false
+	}
+	return !p.DisqualifiedUntil.Valid || now < p.DisqualifiedUntil.Int64
 }
 
 // 参加者を取得する
@@ -378,7 +437,7 @@ func retrievePlayer(ctx context.Context, tenantDB dbOrTx, id string) (*PlayerRow
 
 // 参加者を認可する
 // 参加者向けAPIで呼ばれる
-func authorizePlayer(ctx context.Context, tenantDB dbOrTx, id string) error {
+func authorizePlayer(ctx context.Context, tenantDB dbOrTx, id string, now int64) error {
 	player, err := retrievePlayer(ctx, tenantDB, id)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -386,25 +445,33 @@ func authorizePlayer(ctx context.Context, tenantDB dbOrTx, id string) error {
 		}
 		return fmt.Errorf("error retrievePlayer from viewer: %w", err)
 	}
-	if player.IsDisqualified {
+	if player.disqualified(now) {
 		return echo.NewHTTPError(http.StatusForbidden, "player is disqualified")
 	}
 	return nil
 }
 
 type CompetitionRow struct {
-	TenantID   int64         `db:"tenant_id"`
-	ID         string        `db:"id"`
-	Title      string        `db:"title"`
-	FinishedAt sql.NullInt64 `db:"finished_at"`
-	CreatedAt  int64         `db:"created_at"`
-	UpdatedAt  int64         `db:"updated_at"`
+	TenantID    int64          `db:"tenant_id"`
+	ID          string         `db:"id"`
+	Title       string         `db:"title"`
+	FinishedAt  sql.NullInt64  `db:"finished_at"`
+	StartAt     sql.NullInt64  `db:"start_at"`
+	EndAt       sql.NullInt64  `db:"end_at"`
+	DeletedAt   sql.NullInt64  `db:"deleted_at"`
+	PublishedAt sql.NullInt64  `db:"published_at"`
+	ShareToken  sql.NullString `db:"share_token"`
+	CreatedBy   string         `db:"created_by"`
+	UpdatedBy   string         `db:"updated_by"`
+	CreatedAt   int64          `db:"created_at"`
+	UpdatedAt   int64          `db:"updated_at"`
 }
 
 // 大会を取得する
+// 削除済みの大会は存在しないものとして扱う
 func retrieveCompetition(ctx context.Context, tenantDB dbOrTx, id string) (*CompetitionRow, error) {
 	var c CompetitionRow
-	if err := tenantDB.GetContext(ctx, &c, "SELECT * FROM competition WHERE id = ?", id); err != nil {
+	if err := tenantDB.GetContext(ctx, &c, "SELECT * FROM competition WHERE id = ? AND deleted_at IS NULL", id); err != nil {
 		return nil, fmt.Errorf("error Select competition: id=%s, %w", id, err)
 	}
 	return &c, nil
@@ -417,27 +484,12 @@ type PlayerScoreRow struct {
 	CompetitionID string `db:"competition_id"`
 	Score         int64  `db:"score"`
 	RowNum        int64  `db:"row_num"`
+	CreatedBy     string `db:"created_by"`
+	UpdatedBy     string `db:"updated_by"`
 	CreatedAt     int64  `db:"created_at"`
 	UpdatedAt     int64  `db:"updated_at"`
 }
 
-// 排他ロックのためのファイル名を生成する
-func lockFilePath(id int64) string {
-	tenantDBDir := getEnv("ISUCON_TENANT_DB_DIR", "../tenant_db")
-	return filepath.Join(tenantDBDir, fmt.Sprintf("%d.lock", id))
-}
-
-// 排他ロックする
-func flockByTenantID(tenantID int64) (io.Closer, error) {
-	p := lockFilePath(tenantID)
-
-	fl := flock.New(p)
-	if err := fl.Lock(); err != nil {
-		return nil, fmt.Errorf("error flock.Lock: path=%s, %w", p, err)
-	}
-	return fl, nil
-}
-
 type TenantsAddHandlerResult struct {
 	Tenant TenantWithBilling `json:"tenant"`
 }
@@ -445,8 +497,8 @@ type TenantsAddHandlerResult struct {
 // SasS管理者用API
 // テナントを追加する
 // POST /api/admin/tenants/add
-func tenantsAddHandler(c echo.Context) error {
-	v, err := parseViewer(c)
+func (s *Server) tenantsAddHandler(c echo.Context) error {
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
 	}
@@ -467,15 +519,20 @@ func tenantsAddHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
 	}
 
-	ctx := context.Background()
-	now := time.Now().Unix()
-	insertRes, err := adminDB.ExecContext(
+	ctx := requestContext(c)
+	now := s.now()
+	tx, err := s.adminDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error adminDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	insertRes, err := tx.ExecContext(
 		ctx,
 		"INSERT INTO tenant (name, display_name, created_at, updated_at) VALUES (?, ?, ?, ?)",
 		name, displayName, now, now,
 	)
 	if err != nil {
-		if merr, ok := err.(*mysql.MySQLError); ok && merr.Number == 1062 { // duplicate entry
+		if isDuplicateKeyError(err) {
 			return echo.NewHTTPError(http.StatusBadRequest, "duplicate tenant")
 		}
 		return fmt.Errorf(
@@ -488,13 +545,33 @@ func tenantsAddHandler(c echo.Context) error {
 	if err != nil {
 		return fmt.Errorf("error get LastInsertId: %w", err)
 	}
+	if err := recordDomainEvent(ctx, tx, now, id, DomainEventTenantAdded, TenantEventData{
+		Tenant: TenantEventTenant{
+			ID:          strconv.FormatInt(id, 10),
+			Name:        name,
+			DisplayName: displayName,
+		},
+	}); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, adminOutboxID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+	// 存在しないことをキャッシュしていても、すぐにアクセスできるようにする
+	s.tenantCache.invalidateTenant(&TenantRow{ID: id, Name: name})
 	// NOTE: 先にadminDBに書き込まれることでこのAPIの処理中に
 	//       /api/admin/tenants/billingにアクセスされるとエラーになりそう
 	//       ロックなどで対処したほうが良さそう
-	if err := createTenantDB(id); err != nil {
-		return fmt.Errorf("error createTenantDB: id=%d name=%s %w", id, name, err)
+	if err := s.tenants.Create(ctx, id); err != nil {
+		return fmt.Errorf("error tenants.Create: id=%d name=%s %w", id, name, err)
 	}
 
+	setRequestTenantID(c, id)
+	setAuditTarget(c, strconv.FormatInt(id, 10))
+
 	res := TenantsAddHandlerResult{
 		Tenant: TenantWithBilling{
 			ID:          strconv.FormatInt(id, 10),
@@ -538,7 +615,7 @@ type VisitHistorySummaryRow struct {
 }
 
 // 大会ごとの課金レポートを計算する
-func billingReportByCompetition(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitonID string) (*BillingReport, error) {
+func (s *Server) billingReportByCompetition(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitonID string) (*BillingReport, error) {
 	comp, err := retrieveCompetition(ctx, tenantDB, competitonID)
 	if err != nil {
 		return nil, fmt.Errorf("error retrieveCompetition: %w", err)
@@ -546,7 +623,7 @@ func billingReportByCompetition(ctx context.Context, tenantDB dbOrTx, tenantID i
 
 	// ランキングにアクセスした参加者のIDを取得する
 	vhs := []VisitHistorySummaryRow{}
-	if err := adminDB.SelectContext(
+	if err := s.adminDB.SelectContext(
 		ctx,
 		&vhs,
 		"SELECT player_id, MIN(created_at) AS min_created_at FROM visit_history WHERE tenant_id = ? AND competition_id = ? GROUP BY player_id",
@@ -565,7 +642,7 @@ func billingReportByCompetition(ctx context.Context, tenantDB dbOrTx, tenantID i
 	}
 
 	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
-	fl, err := flockByTenantID(tenantID)
+	fl, err := s.flockByTenantID(ctx, tenantID)
 	if err != nil {
 		return nil, fmt.Errorf("error flockByTenantID: %w", err)
 	}
@@ -624,16 +701,16 @@ type TenantsBillingHandlerResult struct {
 // テナントごとの課金レポートを最大10件、テナントのid降順で取得する
 // GET /api/admin/tenants/billing
 // URL引数beforeを指定した場合、指定した値よりもidが小さいテナントの課金レポートを取得する
-func tenantsBillingHandler(c echo.Context) error {
-	if host := c.Request().Host; host != getEnv("ISUCON_ADMIN_HOSTNAME", "admin.t.isucon.dev") {
+func (s *Server) tenantsBillingHandler(c echo.Context) error {
+	if host := c.Request().Host; host != s.adminHostname {
 		return echo.NewHTTPError(
 			http.StatusNotFound,
 			fmt.Sprintf("invalid hostname %s", host),
 		)
 	}
 
-	ctx := context.Background()
-	if v, err := parseViewer(c); err != nil {
+	ctx := requestContext(c)
+	if v, err := s.parseViewer(c); err != nil {
 		return err
 	} else if v.role != RoleAdmin {
 		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
@@ -658,7 +735,7 @@ func tenantsBillingHandler(c echo.Context) error {
 	//   を合計したものを
 	// テナントの課金とする
 	ts := []TenantRow{}
-	if err := adminDB.SelectContext(ctx, &ts, "SELECT * FROM tenant ORDER BY id DESC"); err != nil {
+	if err := s.adminDB.SelectContext(ctx, &ts, "SELECT * FROM tenant ORDER BY id DESC"); err != nil {
 		return fmt.Errorf("error Select tenant: %w", err)
 	}
 	tenantBillings := make([]TenantWithBilling, 0, len(ts))
@@ -672,7 +749,7 @@ func tenantsBillingHandler(c echo.Context) error {
 				Name:        t.Name,
 				DisplayName: t.DisplayName,
 			}
-			tenantDB, err := connectToTenantDB(t.ID)
+			tenantDB, err := s.connectToTenantDB(ctx, t.ID)
 			if err != nil {
 				return fmt.Errorf("failed to connectToTenantDB: %w", err)
 			}
@@ -681,13 +758,13 @@ func tenantsBillingHandler(c echo.Context) error {
 			if err := tenantDB.SelectContext(
 				ctx,
 				&cs,
-				"SELECT * FROM competition WHERE tenant_id=?",
+				"SELECT * FROM competition WHERE tenant_id=? AND deleted_at IS NULL",
 				t.ID,
 			); err != nil {
 				return fmt.Errorf("failed to Select competition: %w", err)
 			}
 			for _, comp := range cs {
-				report, err := billingReportByCompetition(ctx, tenantDB, t.ID, comp.ID)
+				report, err := s.billingReportByCompetition(ctx, tenantDB, t.ID, comp.ID)
 				if err != nil {
 					return fmt.Errorf("failed to billingReportByCompetition: %w", err)
 				}
@@ -718,47 +795,80 @@ type PlayerDetail struct {
 }
 
 type PlayersListHandlerResult struct {
-	Players []PlayerDetail `json:"players"`
+	Players    []PlayerDetail `json:"players"`
+	Total      int64          `json:"total"`       // 検索条件に一致する参加者数
+	NextCursor string         `json:"next_cursor"` // 次のページがない場合は空文字列
 }
 
 // テナント管理者向けAPI
 // GET /api/organizer/players
 // 参加者一覧を返す
-func playersListHandler(c echo.Context) error {
-	ctx := context.Background()
-	v, err := parseViewer(c)
+// limitを指定した場合はページングし、next_cursorをcursorに指定すると次のページを取得する
+func (s *Server) playersListHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return err
-	} else if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	cond, err := parsePlayerSearchCondition(c)
+	if err != nil {
+		return err
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return fmt.Errorf("error connectToTenantDB: %w", err)
 	}
 	defer tenantDB.Close()
 
+	now := s.now()
+	where, args := cond.where(v.tenantID, now, false)
+	var total int64
+	if err := tenantDB.GetContext(
+		ctx,
+		&total,
+		"SELECT COUNT(*) FROM player WHERE "+where,
+		args...,
+	); err != nil {
+		return fmt.Errorf("error Select count player: %w", err)
+	}
+
+	where, args = cond.where(v.tenantID, now, true)
+	query := "SELECT * FROM player WHERE " + where + " ORDER BY created_at DESC, id DESC"
+	if cond.Limit > 0 {
+		// 次のページがあるかを判定するために1件多く取得する
+		query += " LIMIT ?"
+		args = append(args, cond.Limit+1)
+	}
 	var pls []PlayerRow
 	if err := tenantDB.SelectContext(
 		ctx,
 		&pls,
-		"SELECT * FROM player WHERE tenant_id=? ORDER BY created_at DESC",
-		v.tenantID,
+		query,
+		args...,
 	); err != nil {
 		return fmt.Errorf("error Select player: %w", err)
 	}
-	var pds []PlayerDetail
+	var nextCursor string
+	if cond.Limit > 0 && int64(len(pls)) > cond.Limit {
+		pls = pls[:cond.Limit]
+		last := pls[len(pls)-1]
+		nextCursor = playerCursor{CreatedAt: last.CreatedAt, ID: last.ID}.encode()
+	}
+	pds := make([]PlayerDetail, 0, len(pls))
 	for _, p := range pls {
 		pds = append(pds, PlayerDetail{
 			ID:             p.ID,
 			DisplayName:    p.DisplayName,
-			IsDisqualified: p.IsDisqualified,
+			IsDisqualified: p.disqualified(now),
 		})
 	}
 
 	res := PlayersListHandlerResult{
-		Players: pds,
+		Players:    pds,
+		Total:      total,
+		NextCursor: nextCursor,
 	}
 	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
 }
@@ -770,16 +880,14 @@ type PlayersAddHandlerResult struct {
 // テナント管理者向けAPI
 // GET /api/organizer/players/add
 // テナントに参加者を追加する
-func playersAddHandler(c echo.Context) error {
-	ctx := context.Background()
-	v, err := parseViewer(c)
+func (s *Server) playersAddHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
-	} else if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
@@ -791,34 +899,56 @@ func playersAddHandler(c echo.Context) error {
 	}
 	displayNames := params["display_name[]"]
 
-	pds := make([]PlayerDetail, 0, len(displayNames))
-	for _, displayName := range displayNames {
-		id, err := dispenseID(ctx)
+	// 管理用DBへの問い合わせでテナントDBの書き込みを待たせないように、IDはトランザクションの前に採番しておく
+	ids := make([]string, 0, len(displayNames))
+	for range displayNames {
+		id, err := s.ids.DispenseID(ctx)
 		if err != nil {
-			return fmt.Errorf("error dispenseID: %w", err)
+			return fmt.Errorf("error DispenseID: %w", err)
 		}
+		ids = append(ids, id)
+	}
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
 
-		now := time.Now().Unix()
-		if _, err := tenantDB.ExecContext(
+	now := s.now()
+	pds := make([]PlayerDetail, 0, len(displayNames))
+	for i, displayName := range displayNames {
+		id := ids[i]
+		if _, err := tx.ExecContext(
 			ctx,
-			"INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
-			id, v.tenantID, displayName, false, now, now,
+			"INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_by, updated_by, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+			id, v.tenantID, displayName, false, v.playerID, v.playerID, now, now,
 		); err != nil {
 			return fmt.Errorf(
 				"error Insert player at tenantDB: id=%s, displayName=%s, isDisqualified=%t, createdAt=%d, updatedAt=%d, %w",
 				id, displayName, false, now, now, err,
 			)
 		}
-		p, err := retrievePlayer(ctx, tenantDB, id)
+		p, err := retrievePlayer(ctx, tx, id)
 		if err != nil {
 			return fmt.Errorf("error retrievePlayer: %w", err)
 		}
 		pds = append(pds, PlayerDetail{
 			ID:             p.ID,
 			DisplayName:    p.DisplayName,
-			IsDisqualified: p.IsDisqualified,
+			IsDisqualified: p.disqualified(now),
 		})
 	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventPlayerAdded, PlayersEventData{Players: pds}); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+	setAuditTarget(c, ids...)
 
 	res := PlayersAddHandlerResult{
 		Players: pds,
@@ -827,22 +957,21 @@ func playersAddHandler(c echo.Context) error {
 }
 
 type PlayerDisqualifiedHandlerResult struct {
-	Player PlayerDetail `json:"player"`
+	Player           PlayerDetail            `json:"player"`
+	Disqualification *DisqualificationDetail `json:"disqualification"`
 }
 
 // テナント管理者向けAPI
 // POST /api/organizer/player/:player_id/disqualified
 // 参加者を失格にする
-func playerDisqualifiedHandler(c echo.Context) error {
-	ctx := context.Background()
-	v, err := parseViewer(c)
+func (s *Server) playerDisqualifiedHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
-	} else if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
@@ -850,19 +979,7 @@ func playerDisqualifiedHandler(c echo.Context) error {
 
 	playerID := c.Param("player_id")
 
-	now := time.Now().Unix()
-	if _, err := tenantDB.ExecContext(
-		ctx,
-		"UPDATE player SET is_disqualified = ?, updated_at = ? WHERE id = ?",
-		true, now, playerID,
-	); err != nil {
-		return fmt.Errorf(
-			"error Update player: isDisqualified=%t, updatedAt=%d, id=%s, %w",
-			true, now, playerID, err,
-		)
-	}
-	p, err := retrievePlayer(ctx, tenantDB, playerID)
-	if err != nil {
+	if _, err := retrievePlayer(ctx, tenantDB, playerID); err != nil {
 		// 存在しないプレイヤー
 		if errors.Is(err, sql.ErrNoRows) {
 			return echo.NewHTTPError(http.StatusNotFound, "player not found")
@@ -870,12 +987,49 @@ func playerDisqualifiedHandler(c echo.Context) error {
 		return fmt.Errorf("error retrievePlayer: %w", err)
 	}
 
+	now := s.now()
+	reason, expiresAt, err := parseDisqualificationParams(c, now)
+	if err != nil {
+		return err
+	}
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	if err := s.moderatePlayer(ctx, tx, PlayerModerationRow{
+		TenantID:  v.tenantID,
+		PlayerID:  playerID,
+		Action:    ModerationActionDisqualify,
+		Reason:    reason,
+		ExpiresAt: expiresAt,
+		Moderator: v.playerID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}); err != nil {
+		return fmt.Errorf("error moderatePlayer: %w", err)
+	}
+	p, err := retrievePlayer(ctx, tx, playerID)
+	if err != nil {
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
 	res := PlayerDisqualifiedHandlerResult{
 		Player: PlayerDetail{
 			ID:             p.ID,
 			DisplayName:    p.DisplayName,
-			IsDisqualified: p.IsDisqualified,
+			IsDisqualified: p.disqualified(now),
 		},
+		Disqualification: disqualificationDetail(p, now),
+	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventPlayerDisqualified, PlayerEventData(res)); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
 	}
 	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
 }
@@ -884,6 +1038,8 @@ type CompetitionDetail struct {
 	ID         string `json:"id"`
 	Title      string `json:"title"`
 	IsFinished bool   `json:"is_finished"`
+	StartAt    *int64 `json:"start_at"`
+	EndAt      *int64 `json:"end_at"`
 }
 
 type CompetitionsAddHandlerResult struct {
@@ -893,16 +1049,14 @@ type CompetitionsAddHandlerResult struct {
 // テナント管理者向けAPI
 // POST /api/organizer/competitions/add
 // 大会を追加する
-func competitionsAddHandler(c echo.Context) error {
-	ctx := context.Background()
-	v, err := parseViewer(c)
+func (s *Server) competitionsAddHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
-	} else if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
@@ -910,15 +1064,31 @@ func competitionsAddHandler(c echo.Context) error {
 
 	title := c.FormValue("title")
 
-	now := time.Now().Unix()
-	id, err := dispenseID(ctx)
+	now := s.now()
+	startAt, err := parseScheduleParam(c, "start_at")
+	if err != nil {
+		return err
+	}
+	endAt, err := parseScheduleParam(c, "end_at")
+	if err != nil {
+		return err
+	}
+	if err := validateSchedule(startAt, endAt, now); err != nil {
+		return err
+	}
+	id, err := s.ids.DispenseID(ctx)
+	if err != nil {
+		return fmt.Errorf("error DispenseID: %w", err)
+	}
+	tx, err := tenantDB.BeginTxx(ctx, nil)
 	if err != nil {
-		return fmt.Errorf("error dispenseID: %w", err)
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
 	}
-	if _, err := tenantDB.ExecContext(
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(
 		ctx,
-		"INSERT INTO competition (id, tenant_id, title, finished_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?)",
-		id, v.tenantID, title, sql.NullInt64{}, now, now,
+		"INSERT INTO competition (id, tenant_id, title, finished_at, start_at, end_at, created_by, updated_by, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		id, v.tenantID, title, sql.NullInt64{}, startAt, endAt, v.playerID, v.playerID, now, now,
 	); err != nil {
 		return fmt.Errorf(
 			"error Insert competition: id=%s, tenant_id=%d, title=%s, finishedAt=null, createdAt=%d, updatedAt=%d, %w",
@@ -931,24 +1101,40 @@ func competitionsAddHandler(c echo.Context) error {
 			ID:         id,
 			Title:      title,
 			IsFinished: false,
+			StartAt:    nullInt64Ptr(startAt),
+			EndAt:      nullInt64Ptr(endAt),
 		},
 	}
+	if err := bumpDataVersions(ctx, tx, now, dataVersionCompetitions); err != nil {
+		return fmt.Errorf("error bumpDataVersions: %w", err)
+	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventCompetitionCreated, CompetitionEventData(res)); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+	if err := s.scheduleCompetitionEnd(ctx, &CompetitionRow{TenantID: v.tenantID, ID: id, EndAt: endAt}); err != nil {
+		return fmt.Errorf("error scheduleCompetitionEnd: %w", err)
+	}
+	setAuditTarget(c, res.Competition.ID)
 	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
 }
 
 // テナント管理者向けAPI
 // POST /api/organizer/competition/:competition_id/finish
 // 大会を終了する
-func competitionFinishHandler(c echo.Context) error {
-	ctx := context.Background()
-	v, err := parseViewer(c)
+func (s *Server) competitionFinishHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
-	} else if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
@@ -958,7 +1144,7 @@ func competitionFinishHandler(c echo.Context) error {
 	if id == "" {
 		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
 	}
-	_, err = retrieveCompetition(ctx, tenantDB, id)
+	comp, err := retrieveCompetition(ctx, tenantDB, id)
 	if err != nil {
 		// 存在しない大会
 		if errors.Is(err, sql.ErrNoRows) {
@@ -967,17 +1153,38 @@ func competitionFinishHandler(c echo.Context) error {
 		return fmt.Errorf("error retrieveCompetition: %w", err)
 	}
 
-	now := time.Now().Unix()
-	if _, err := tenantDB.ExecContext(
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	now := s.now()
+	if _, err := tx.ExecContext(
 		ctx,
-		"UPDATE competition SET finished_at = ?, updated_at = ? WHERE id = ?",
-		now, now, id,
+		"UPDATE competition SET finished_at = ?, updated_by = ?, updated_at = ? WHERE id = ?",
+		now, v.playerID, now, id,
 	); err != nil {
 		return fmt.Errorf(
 			"error Update competition: finishedAt=%d, updatedAt=%d, id=%s, %w",
 			now, now, id, err,
 		)
 	}
+	comp.FinishedAt = sql.NullInt64{Int64: now, Valid: true}
+	if err := bumpDataVersions(ctx, tx, now, dataVersionCompetitions, competitionDataVersion(id)); err != nil {
+		return fmt.Errorf("error bumpDataVersions: %w", err)
+	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventCompetitionFinished, competitionEventData(comp)); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+	if err := s.scheduleCompetitionEnd(ctx, comp); err != nil {
+		return fmt.Errorf("error scheduleCompetitionEnd: %w", err)
+	}
 	return c.JSON(http.StatusOK, SuccessResult{Status: true})
 }
 
@@ -988,17 +1195,15 @@ type ScoreHandlerResult struct {
 // テナント管理者向けAPI
 // POST /api/organizer/competition/:competition_id/score
 // 大会のスコアをCSVでアップロードする
-func competitionScoreHandler(c echo.Context) error {
-	ctx := context.Background()
-	v, err := parseViewer(c)
+func (s *Server) competitionScoreHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
 	}
-	if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
-	}
+	defer s.metrics.trackScoreImport()()
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
@@ -1018,8 +1223,27 @@ func competitionScoreHandler(c echo.Context) error {
 	}
 	if comp.FinishedAt.Valid {
 		res := FailureResult{
-			Status:  false,
-			Message: "competition is finished",
+			Status:    false,
+			Message:   "competition is finished",
+			RequestID: requestID(c),
+		}
+		return c.JSON(http.StatusBadRequest, res)
+	}
+	now := s.now()
+	if comp.StartAt.Valid && now < comp.StartAt.Int64 {
+		res := FailureResult{
+			Status:    false,
+			Message:   "competition has not started",
+			RequestID: requestID(c),
+		}
+		return c.JSON(http.StatusBadRequest, res)
+	}
+	// 終了時刻を過ぎていれば、スケジューラが終了させる前でも受け付けない
+	if comp.EndAt.Valid && now >= comp.EndAt.Int64 {
+		res := FailureResult{
+			Status:    false,
+			Message:   "competition has ended",
+			RequestID: requestID(c),
 		}
 		return c.JSON(http.StatusBadRequest, res)
 	}
@@ -1044,7 +1268,7 @@ func competitionScoreHandler(c echo.Context) error {
 	}
 
 	// / DELETEしたタイミングで参照が来ると空っぽのランキングになるのでロックする
-	fl, err := flockByTenantID(v.tenantID)
+	fl, err := s.flockByTenantID(ctx, v.tenantID)
 	if err != nil {
 		return fmt.Errorf("error flockByTenantID: %w", err)
 	}
@@ -1081,11 +1305,11 @@ func competitionScoreHandler(c echo.Context) error {
 				fmt.Sprintf("error strconv.ParseUint: scoreStr=%s, %s", scoreStr, err),
 			)
 		}
-		id, err := dispenseID(ctx)
+		id, err := s.ids.DispenseID(ctx)
 		if err != nil {
-			return fmt.Errorf("error dispenseID: %w", err)
+			return fmt.Errorf("error DispenseID: %w", err)
 		}
-		now := time.Now().Unix()
+		now := s.now()
 		playerScoreRows = append(playerScoreRows, PlayerScoreRow{
 			ID:            id,
 			TenantID:      v.tenantID,
@@ -1093,12 +1317,19 @@ func competitionScoreHandler(c echo.Context) error {
 			CompetitionID: competitionID,
 			Score:         score,
 			RowNum:        rowNum,
+			CreatedBy:     v.playerID,
+			UpdatedBy:     v.playerID,
 			CreatedAt:     now,
 			UpdatedAt:     now,
 		})
 	}
 
-	if _, err := tenantDB.ExecContext(
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(
 		ctx,
 		"DELETE FROM player_score WHERE tenant_id = ? AND competition_id = ?",
 		v.tenantID,
@@ -1107,9 +1338,9 @@ func competitionScoreHandler(c echo.Context) error {
 		return fmt.Errorf("error Delete player_score: tenantID=%d, competitionID=%s, %w", v.tenantID, competitionID, err)
 	}
 	for _, ps := range playerScoreRows {
-		if _, err := tenantDB.NamedExecContext(
+		if _, err := tx.NamedExecContext(
 			ctx,
-			"INSERT INTO player_score (id, tenant_id, player_id, competition_id, score, row_num, created_at, updated_at) VALUES (:id, :tenant_id, :player_id, :competition_id, :score, :row_num, :created_at, :updated_at)",
+			"INSERT INTO player_score (id, tenant_id, player_id, competition_id, score, row_num, created_by, updated_by, created_at, updated_at) VALUES (:id, :tenant_id, :player_id, :competition_id, :score, :row_num, :created_by, :updated_by, :created_at, :updated_at)",
 			ps,
 		); err != nil {
 			return fmt.Errorf(
@@ -1119,6 +1350,21 @@ func competitionScoreHandler(c echo.Context) error {
 
 		}
 	}
+	if err := bumpDataVersions(ctx, tx, now, competitionDataVersion(competitionID)); err != nil {
+		return fmt.Errorf("error bumpDataVersions: %w", err)
+	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventScoresUploaded, ScoresUploadedEventData{
+		CompetitionID: competitionID,
+		Rows:          int64(len(playerScoreRows)),
+	}); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
 
 	return c.JSON(http.StatusOK, SuccessResult{
 		Status: true,
@@ -1133,34 +1379,37 @@ type BillingHandlerResult struct {
 // テナント管理者向けAPI
 // GET /api/organizer/billing
 // テナント内の課金レポートを取得する
-func billingHandler(c echo.Context) error {
-	ctx := context.Background()
-	v, err := parseViewer(c)
+func (s *Server) billingHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return fmt.Errorf("error parseViewer: %w", err)
 	}
-	if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
-	}
-
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
 	defer tenantDB.Close()
 
+	// 大会を指定したAPIトークンでは、その大会の請求額だけを返す
+	query := "SELECT * FROM competition WHERE tenant_id=? AND deleted_at IS NULL"
+	args := []any{v.tenantID}
+	if v.apiToken != nil && v.apiToken.CompetitionID != "" {
+		query += " AND id=?"
+		args = append(args, v.apiToken.CompetitionID)
+	}
 	cs := []CompetitionRow{}
 	if err := tenantDB.SelectContext(
 		ctx,
 		&cs,
-		"SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC",
-		v.tenantID,
+		query+" ORDER BY created_at DESC",
+		args...,
 	); err != nil {
 		return fmt.Errorf("error Select competition: %w", err)
 	}
 	tbrs := make([]BillingReport, 0, len(cs))
 	for _, comp := range cs {
-		report, err := billingReportByCompetition(ctx, tenantDB, v.tenantID, comp.ID)
+		report, err := s.billingReportByCompetition(ctx, tenantDB, v.tenantID, comp.ID)
 		if err != nil {
 			return fmt.Errorf("error billingReportByCompetition: %w", err)
 		}
@@ -1189,10 +1438,10 @@ type PlayerHandlerResult struct {
 // 参加者向けAPI
 // GET /api/player/player/:player_id
 // 参加者の詳細情報を取得する
-func playerHandler(c echo.Context) error {
-	ctx := context.Background()
+func (s *Server) playerHandler(c echo.Context) error {
+	ctx := requestContext(c)
 
-	v, err := parseViewer(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return err
 	}
@@ -1200,13 +1449,13 @@ func playerHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role player required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
 	defer tenantDB.Close()
 
-	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+	if err := authorizePlayer(ctx, tenantDB, v.playerID, s.now()); err != nil {
 		return err
 	}
 
@@ -1225,14 +1474,14 @@ func playerHandler(c echo.Context) error {
 	if err := tenantDB.SelectContext(
 		ctx,
 		&cs,
-		"SELECT * FROM competition WHERE tenant_id = ? ORDER BY created_at ASC",
+		"SELECT * FROM competition WHERE tenant_id = ? AND deleted_at IS NULL ORDER BY created_at ASC",
 		v.tenantID,
 	); err != nil && !errors.Is(err, sql.ErrNoRows) {
 		return fmt.Errorf("error Select competition: %w", err)
 	}
 
 	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
-	fl, err := flockByTenantID(v.tenantID)
+	fl, err := s.flockByTenantID(ctx, v.tenantID)
 	if err != nil {
 		return fmt.Errorf("error flockByTenantID: %w", err)
 	}
@@ -1276,7 +1525,7 @@ func playerHandler(c echo.Context) error {
 			Player: PlayerDetail{
 				ID:             p.ID,
 				DisplayName:    p.DisplayName,
-				IsDisqualified: p.IsDisqualified,
+				IsDisqualified: p.disqualified(s.now()),
 			},
 			Scores: psds,
 		},
@@ -1297,12 +1546,89 @@ type CompetitionRankingHandlerResult struct {
 	Ranks       []CompetitionRank `json:"ranks"`
 }
 
+// 大会のランキングを順位の昇順で返す
+// player_scoreを読んでいる間に更新が走らないように、呼び出し側でロックを取得しておくこと
+func competitionRanking(ctx context.Context, tenantDB dbOrTx, tenantID int64, competitionID string) ([]CompetitionRank, error) {
+	pss := []PlayerScoreRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&pss,
+		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num DESC",
+		tenantID,
+		competitionID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenantID, competitionID, err)
+	}
+	ranks := make([]CompetitionRank, 0, len(pss))
+	scoredPlayerSet := make(map[string]struct{}, len(pss))
+	for _, ps := range pss {
+		// player_scoreが同一player_id内ではrow_numの降順でソートされているので
+		// 現れたのが2回目以降のplayer_idはより大きいrow_numでスコアが出ているとみなせる
+		if _, ok := scoredPlayerSet[ps.PlayerID]; ok {
+			continue
+		}
+		scoredPlayerSet[ps.PlayerID] = struct{}{}
+		p, err := retrievePlayer(ctx, tenantDB, ps.PlayerID)
+		if err != nil {
+			return nil, fmt.Errorf("error retrievePlayer: %w", err)
+		}
+		ranks = append(ranks, CompetitionRank{
+			Score:             ps.Score,
+			PlayerID:          p.ID,
+			PlayerDisplayName: p.DisplayName,
+			RowNum:            ps.RowNum,
+		})
+	}
+	sort.Slice(ranks, func(i, j int) bool {
+		if ranks[i].Score == ranks[j].Score {
+			return ranks[i].RowNum < ranks[j].RowNum
+		}
+		return ranks[i].Score > ranks[j].Score
+	})
+	for i := range ranks {
+		ranks[i].Rank = int64(i + 1)
+	}
+	return ranks, nil
+}
+
+// ランキングのうちrank_afterより後の最大100件を返す
+// 大会とシーズンのランキングで共通に使う
+func pageRanks[T any](ranks []T, rankAfter int64) []T {
+	pagedRanks := make([]T, 0, 100)
+	for i, rank := range ranks {
+		if int64(i) < rankAfter {
+			continue
+		}
+		pagedRanks = append(pagedRanks, rank)
+		if len(pagedRanks) >= 100 {
+			break
+		}
+	}
+	return pagedRanks
+}
+
+// ランキングの閲覧履歴を記録する
+// 大会終了までに閲覧した参加者の課金に使われる
+func (s *Server) recordVisitHistory(ctx context.Context, playerID string, tenantID int64, competitionID string, now int64) error {
+	if _, err := s.adminDB.ExecContext(
+		ctx,
+		"INSERT INTO visit_history (player_id, tenant_id, competition_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
+		playerID, tenantID, competitionID, now, now,
+	); err != nil {
+		return fmt.Errorf(
+			"error Insert visit_history: playerID=%s, tenantID=%d, competitionID=%s, createdAt=%d, updatedAt=%d, %w",
+			playerID, tenantID, competitionID, now, now, err,
+		)
+	}
+	return nil
+}
+
 // 参加者向けAPI
 // GET /api/player/competition/:competition_id/ranking
 // 大会ごとのランキングを取得する
-func competitionRankingHandler(c echo.Context) error {
-	ctx := context.Background()
-	v, err := parseViewer(c)
+func (s *Server) competitionRankingHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return err
 	}
@@ -1310,13 +1636,13 @@ func competitionRankingHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role player required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
 	defer tenantDB.Close()
 
-	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+	if err := authorizePlayer(ctx, tenantDB, v.playerID, s.now()); err != nil {
 		return err
 	}
 
@@ -1334,21 +1660,14 @@ func competitionRankingHandler(c echo.Context) error {
 		return fmt.Errorf("error retrieveCompetition: %w", err)
 	}
 
-	now := time.Now().Unix()
-	var tenant TenantRow
-	if err := adminDB.GetContext(ctx, &tenant, "SELECT * FROM tenant WHERE id = ?", v.tenantID); err != nil {
-		return fmt.Errorf("error Select tenant: id=%d, %w", v.tenantID, err)
+	now := s.now()
+	tenant, err := s.retrieveTenantByID(ctx, v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error retrieveTenantByID: %w", err)
 	}
 
-	if _, err := adminDB.ExecContext(
-		ctx,
-		"INSERT INTO visit_history (player_id, tenant_id, competition_id, created_at, updated_at) VALUES (?, ?, ?, ?, ?)",
-		v.playerID, tenant.ID, competitionID, now, now,
-	); err != nil {
-		return fmt.Errorf(
-			"error Insert visit_history: playerID=%s, tenantID=%d, competitionID=%s, createdAt=%d, updatedAt=%d, %w",
-			v.playerID, tenant.ID, competitionID, now, now, err,
-		)
+	if err := s.recordVisitHistory(ctx, v.playerID, tenant.ID, competitionID, now); err != nil {
+		return err
 	}
 
 	var rankAfter int64
@@ -1360,62 +1679,28 @@ func competitionRankingHandler(c echo.Context) error {
 	}
 
 	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
-	fl, err := flockByTenantID(v.tenantID)
+	fl, err := s.flockByTenantID(ctx, v.tenantID)
 	if err != nil {
 		return fmt.Errorf("error flockByTenantID: %w", err)
 	}
 	defer fl.Close()
-	pss := []PlayerScoreRow{}
-	if err := tenantDB.SelectContext(
-		ctx,
-		&pss,
-		"SELECT * FROM player_score WHERE tenant_id = ? AND competition_id = ? ORDER BY row_num DESC",
-		tenant.ID,
-		competitionID,
-	); err != nil {
-		return fmt.Errorf("error Select player_score: tenantID=%d, competitionID=%s, %w", tenant.ID, competitionID, err)
+
+	// ランキングは大会の内容とスコア、参加者の表示名が変わらなければ同じになる
+	// 閲覧の記録は済んでいるので、304を返しても課金対象になる
+	versions, err := retrieveDataVersions(ctx, tenantDB, competitionDataVersion(competitionID), dataVersionPlayers)
+	if err != nil {
+		return fmt.Errorf("error retrieveDataVersions: %w", err)
 	}
-	ranks := make([]CompetitionRank, 0, len(pss))
-	scoredPlayerSet := make(map[string]struct{}, len(pss))
-	for _, ps := range pss {
-		// player_scoreが同一player_id内ではrow_numの降順でソートされているので
-		// 現れたのが2回目以降のplayer_idはより大きいrow_numでスコアが出ているとみなせる
-		if _, ok := scoredPlayerSet[ps.PlayerID]; ok {
-			continue
-		}
-		scoredPlayerSet[ps.PlayerID] = struct{}{}
-		p, err := retrievePlayer(ctx, tenantDB, ps.PlayerID)
-		if err != nil {
-			return fmt.Errorf("error retrievePlayer: %w", err)
-		}
-		ranks = append(ranks, CompetitionRank{
-			Score:             ps.Score,
-			PlayerID:          p.ID,
-			PlayerDisplayName: p.DisplayName,
-			RowNum:            ps.RowNum,
-		})
+	etag := dataETag(append([]string{"ranking", strconv.FormatInt(v.tenantID, 10), competitionID, strconv.FormatInt(rankAfter, 10)}, versions...)...)
+	if checkNotModified(c, etag) {
+		return c.NoContent(http.StatusNotModified)
 	}
-	sort.Slice(ranks, func(i, j int) bool {
-		if ranks[i].Score == ranks[j].Score {
-			return ranks[i].RowNum < ranks[j].RowNum
-		}
-		return ranks[i].Score > ranks[j].Score
-	})
-	pagedRanks := make([]CompetitionRank, 0, 100)
-	for i, rank := range ranks {
-		if int64(i) < rankAfter {
-			continue
-		}
-		pagedRanks = append(pagedRanks, CompetitionRank{
-			Rank:              int64(i + 1),
-			Score:             rank.Score,
-			PlayerID:          rank.PlayerID,
-			PlayerDisplayName: rank.PlayerDisplayName,
-		})
-		if len(pagedRanks) >= 100 {
-			break
-		}
+
+	ranks, err := competitionRanking(ctx, tenantDB, tenant.ID, competitionID)
+	if err != nil {
+		return fmt.Errorf("error competitionRanking: %w", err)
 	}
+	pagedRanks := pageRanks(ranks, rankAfter)
 
 	res := SuccessResult{
 		Status: true,
@@ -1424,6 +1709,8 @@ func competitionRankingHandler(c echo.Context) error {
 				ID:         competition.ID,
 				Title:      competition.Title,
 				IsFinished: competition.FinishedAt.Valid,
+				StartAt:    nullInt64Ptr(competition.StartAt),
+				EndAt:      nullInt64Ptr(competition.EndAt),
 			},
 			Ranks: pagedRanks,
 		},
@@ -1438,10 +1725,10 @@ type CompetitionsHandlerResult struct {
 // 参加者向けAPI
 // GET /api/player/competitions
 // 大会の一覧を取得する
-func playerCompetitionsHandler(c echo.Context) error {
-	ctx := context.Background()
+func (s *Server) playerCompetitionsHandler(c echo.Context) error {
+	ctx := requestContext(c)
 
-	v, err := parseViewer(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return err
 	}
@@ -1449,13 +1736,13 @@ func playerCompetitionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusForbidden, "role player required")
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return err
 	}
 	defer tenantDB.Close()
 
-	if err := authorizePlayer(ctx, tenantDB, v.playerID); err != nil {
+	if err := authorizePlayer(ctx, tenantDB, v.playerID, s.now()); err != nil {
 		return err
 	}
 	return competitionsHandler(c, v, tenantDB)
@@ -1464,16 +1751,12 @@ func playerCompetitionsHandler(c echo.Context) error {
 // テナント管理者向けAPI
 // GET /api/organizer/competitions
 // 大会の一覧を取得する
-func organizerCompetitionsHandler(c echo.Context) error {
-	v, err := parseViewer(c)
+func (s *Server) organizerCompetitionsHandler(c echo.Context) error {
+	v, err := s.parseViewer(c)
 	if err != nil {
 		return err
 	}
-	if v.role != RoleOrganizer {
-		return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
-	}
-
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	tenantDB, err := s.connectToTenantDB(requestContext(c), v.tenantID)
 	if err != nil {
 		return err
 	}
@@ -1483,13 +1766,22 @@ func organizerCompetitionsHandler(c echo.Context) error {
 }
 
 func competitionsHandler(c echo.Context, v *Viewer, tenantDB dbOrTx) error {
-	ctx := context.Background()
+	ctx := requestContext(c)
+
+	versions, err := retrieveDataVersions(ctx, tenantDB, dataVersionCompetitions)
+	if err != nil {
+		return fmt.Errorf("error retrieveDataVersions: %w", err)
+	}
+	etag := dataETag(append([]string{"competitions", strconv.FormatInt(v.tenantID, 10)}, versions...)...)
+	if checkNotModified(c, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
 
 	cs := []CompetitionRow{}
 	if err := tenantDB.SelectContext(
 		ctx,
 		&cs,
-		"SELECT * FROM competition WHERE tenant_id=? ORDER BY created_at DESC",
+		"SELECT * FROM competition WHERE tenant_id=? AND deleted_at IS NULL ORDER BY created_at DESC",
 		v.tenantID,
 	); err != nil {
 		return fmt.Errorf("error Select competition: %w", err)
@@ -1500,6 +1792,8 @@ func competitionsHandler(c echo.Context, v *Viewer, tenantDB dbOrTx) error {
 			ID:         comp.ID,
 			Title:      comp.Title,
 			IsFinished: comp.FinishedAt.Valid,
+			StartAt:    nullInt64Ptr(comp.StartAt),
+			EndAt:      nullInt64Ptr(comp.EndAt),
 		})
 	}
 
@@ -1518,17 +1812,18 @@ type TenantDetail struct {
 }
 
 type MeHandlerResult struct {
-	Tenant   *TenantDetail `json:"tenant"`
-	Me       *PlayerDetail `json:"me"`
-	Role     string        `json:"role"`
-	LoggedIn bool          `json:"logged_in"`
+	Tenant           *TenantDetail           `json:"tenant"`
+	Me               *PlayerDetail           `json:"me"`
+	Disqualification *DisqualificationDetail `json:"disqualification,omitempty"` // 失格中の参加者本人にのみ返す
+	Role             string                  `json:"role"`
+	LoggedIn         bool                    `json:"logged_in"`
 }
 
 // 共通API
 // GET /api/me
 // JWTで認証した結果、テナントやユーザ情報を返す
-func meHandler(c echo.Context) error {
-	tenant, err := retrieveTenantRowFromHeader(c)
+func (s *Server) meHandler(c echo.Context) error {
+	tenant, err := s.retrieveTenantRowFromHeader(c)
 	if err != nil {
 		return fmt.Errorf("error retrieveTenantRowFromHeader: %w", err)
 	}
@@ -1536,7 +1831,7 @@ func meHandler(c echo.Context) error {
 		Name:        tenant.Name,
 		DisplayName: tenant.DisplayName,
 	}
-	v, err := parseViewer(c)
+	v, err := s.parseViewer(c)
 	if err != nil {
 		var he *echo.HTTPError
 		if ok := errors.As(err, &he); ok && he.Code == http.StatusUnauthorized {
@@ -1564,11 +1859,11 @@ func meHandler(c echo.Context) error {
 		})
 	}
 
-	tenantDB, err := connectToTenantDB(v.tenantID)
+	ctx := requestContext(c)
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
 	if err != nil {
 		return fmt.Errorf("error connectToTenantDB: %w", err)
 	}
-	ctx := context.Background()
 	p, err := retrievePlayer(ctx, tenantDB, v.playerID)
 	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
@@ -1592,10 +1887,11 @@ func meHandler(c echo.Context) error {
 			Me: &PlayerDetail{
 				ID:             p.ID,
 				DisplayName:    p.DisplayName,
-				IsDisqualified: p.IsDisqualified,
+				IsDisqualified: p.disqualified(s.now()),
 			},
-			Role:     v.role,
-			LoggedIn: true,
+			Disqualification: disqualificationDetail(p, s.now()),
+			Role:             v.role,
+			LoggedIn:         true,
 		},
 	})
 }
@@ -1608,11 +1904,20 @@ type InitializeHandlerResult struct {
 // POST /initialize
 // ベンチマーカーが起動したときに最初に呼ぶ
 // データベースの初期化などが実行されるため、スキーマを変更した場合などは適宜改変すること
-func initializeHandler(c echo.Context) error {
-	out, err := exec.Command(initializeScript).CombinedOutput()
+func (s *Server) initializeHandler(c echo.Context) error {
+	// 初期化している間は /readyz で受け付けられない状態を返す
+	atomic.StoreInt32(&s.initializing, 1)
+	defer atomic.StoreInt32(&s.initializing, 0)
+	cmd := exec.Command(s.initializeScript)
+	if len(s.initializeEnv) > 0 {
+		cmd.Env = append(os.Environ(), s.initializeEnv...)
+	}
+	out, err := cmd.CombinedOutput()
 	if err != nil {
 		return fmt.Errorf("error exec.Command: %s %e", string(out), err)
 	}
+	// 初期化でテナントが消えるので、キャッシュも捨てる
+	s.tenantCache.purge()
 	res := InitializeHandlerResult{
 		Lang: "go",
 	}
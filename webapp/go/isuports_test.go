@@ -0,0 +1,2337 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+	"github.com/lestrrat-go/jwx/v2/jwa"
+	"github.com/lestrrat-go/jwx/v2/jwt"
+	"github.com/mattn/go-sqlite3"
+	proxy "github.com/shogo82148/go-sql-proxy"
+)
+
+const (
+	testBaseHostname  = ".t.isucon.local"
+	testAdminHostname = "admin.t.isucon.local"
+)
+
+// テスト用の管理用DBのスキーマ
+const testAdminDBSchemaFilePath = "../sql/admin/sqlite/10_schema.sql"
+
+// テナントDBをインメモリのSQLiteに置く
+// 接続を1つ持ち続けることで、全ての接続が閉じてもデータが消えないようにする
+type memoryTenantStore struct {
+	prefix string
+
+	mu      sync.Mutex
+	keepers map[int64]*sqlx.DB
+	locks   map[int64]*sync.Mutex
+}
+
+var memoryTenantStoreSeq int64
+
+func newMemoryTenantStore() *memoryTenantStore {
+	return &memoryTenantStore{
+		prefix:  fmt.Sprintf("tenant%d", atomic.AddInt64(&memoryTenantStoreSeq, 1)),
+		keepers: map[int64]*sqlx.DB{},
+		locks:   map[int64]*sync.Mutex{},
+	}
+}
+
+func (ts *memoryTenantStore) dsn(id int64) string {
+	return fmt.Sprintf("file:%s-%d?mode=memory&cache=shared&_busy_timeout=5000", ts.prefix, id)
+}
+
+func (ts *memoryTenantStore) Connect(ctx context.Context, id int64) (*sqlx.DB, error) {
+	ts.mu.Lock()
+	_, ok := ts.keepers[id]
+	ts.mu.Unlock()
+	if !ok {
+		return nil, fmt.Errorf("tenant DB not found: id=%d", id)
+	}
+	return sqlx.Open("sqlite3", ts.dsn(id))
+}
+
+func (ts *memoryTenantStore) Create(ctx context.Context, id int64) error {
+	schema, err := os.ReadFile(tenantDBSchemaFilePath)
+	if err != nil {
+		return err
+	}
+	db, err := sqlx.Open("sqlite3", ts.dsn(id))
+	if err != nil {
+		return err
+	}
+	if _, err := db.ExecContext(ctx, string(schema)); err != nil {
+		db.Close()
+		return err
+	}
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	ts.keepers[id] = db
+	return nil
+}
+
+func (ts *memoryTenantStore) Lock(ctx context.Context, id int64) (io.Closer, error) {
+	ts.mu.Lock()
+	l, ok := ts.locks[id]
+	if !ok {
+		l = &sync.Mutex{}
+		ts.locks[id] = l
+	}
+	ts.mu.Unlock()
+	l.Lock()
+	return mutexCloser{l}, nil
+}
+
+func (ts *memoryTenantStore) Check(ctx context.Context) error {
+	return nil
+}
+
+func (ts *memoryTenantStore) Close() {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	for _, db := range ts.keepers {
+		db.Close()
+	}
+}
+
+type mutexCloser struct {
+	mu *sync.Mutex
+}
+
+func (c mutexCloser) Close() error {
+	c.mu.Unlock()
+	return nil
+}
+
+// テストから進められる時計
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// テストで設定したTXTレコードでドメインの所有を確認する
+type testDomainVerifier struct {
+	mu      sync.Mutex
+	records map[string]string
+}
+
+func (v *testDomainVerifier) VerifyDomain(ctx context.Context, domain, token string) error {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	if v.records[tenantDomainChallengePrefix+domain] != tenantDomainChallengeValue+token {
+		return fmt.Errorf("TXT record not found: %s", domain)
+	}
+	return nil
+}
+
+func (v *testDomainVerifier) set(name, value string) {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.records[name] = value
+}
+
+type testServer struct {
+	t       *testing.T
+	e       *echo.Echo
+	s       *Server
+	clock   *testClock
+	domains *testDomainVerifier
+	signKey *rsa.PrivateKey
+}
+
+// opts でテストごとに設定を変えられる
+func newTestServer(t *testing.T, opts ...func(*ServerOptions)) *testServer {
+	t.Helper()
+
+	// 管理用DBは本番と同じ接続方法で、一時ディレクトリのSQLiteに置く
+	adminDB, err := connectAdminDB(AdminDBConfig{
+		Driver: adminDBDriverSQLite,
+		Path:   filepath.Join(t.TempDir(), "admin.db"),
+	}, adminDBDriverSQLite)
+	if err != nil {
+		t.Fatal(err)
+	}
+	schema, err := os.ReadFile(testAdminDBSchemaFilePath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := adminDB.Exec(string(schema)); err != nil {
+		t.Fatal(err)
+	}
+	tenants := newMemoryTenantStore()
+	t.Cleanup(func() {
+		tenants.Close()
+		adminDB.Close()
+	})
+
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	script := filepath.Join(t.TempDir(), "init.sh")
+	if err := os.WriteFile(script, []byte("#!/bin/sh\nexit 0\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+
+	clock := &testClock{now: time.Date(2022, 7, 23, 10, 0, 0, 0, time.UTC)}
+	domains := &testDomainVerifier{records: map[string]string{}}
+	o := ServerOptions{
+		AdminDB:          adminDB,
+		BaseHostname:     testBaseHostname,
+		AdminHostname:    testAdminHostname,
+		TenantStore:      tenants,
+		IDDispenser:      &adminDBIDDispenser{db: adminDB},
+		Clock:            clock,
+		KeySource:        staticKeySource{key: &key.PublicKey},
+		DomainVerifier:   domains,
+		InitializeScript: script,
+		// 本番と同じようにキャッシュした状態で動かす
+		TenantCacheTTL:         10 * time.Second,
+		TenantCacheNegativeTTL: time.Second,
+		// Webhookの受信にhttptestのサーバーを使う
+		WebhookAllowPrivateAddresses: true,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	s := NewServer(o)
+	e := echo.New()
+	e.Logger.SetOutput(io.Discard)
+	s.registerRoutes(e)
+	return &testServer{t: t, e: e, s: s, clock: clock, domains: domains, signKey: key}
+}
+
+// ログインしているユーザー
+type testUser struct {
+	tenant string
+	role   string
+	sub    string
+	bearer string // 設定されていればJWTのかわりにAPIトークンで認証する
+}
+
+var (
+	testAdmin     = &testUser{tenant: "admin", role: RoleAdmin, sub: "admin"}
+	testAnonymous = (*testUser)(nil)
+)
+
+func organizerOf(tenant string) *testUser {
+	return &testUser{tenant: tenant, role: RoleOrganizer, sub: "organizer"}
+}
+
+func playerOf(tenant, playerID string) *testUser {
+	return &testUser{tenant: tenant, role: RolePlayer, sub: playerID}
+}
+
+func (ts *testServer) token(u *testUser) string {
+	ts.t.Helper()
+	tok, err := jwt.NewBuilder().
+		Issuer("isuports").
+		Subject(u.sub).
+		Audience([]string{u.tenant}).
+		Claim("role", u.role).
+		Expiration(time.Now().Add(time.Hour)).
+		Build()
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	signed, err := jwt.Sign(tok, jwt.WithKey(jwa.RS256, ts.signKey))
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	return string(signed)
+}
+
+// テナントのHostヘッダでリクエストを送る
+// tenantに "." を含む場合は、カスタムドメインとしてそのままHostヘッダにする
+// userがnilなら未認証のリクエストになる
+func (ts *testServer) do(method, tenant, target string, u *testUser, body io.Reader, contentType string) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	req := httptest.NewRequest(method, target, body)
+	switch {
+	case tenant == "admin":
+		req.Host = testAdminHostname
+	case strings.Contains(tenant, "."):
+		req.Host = tenant
+	default:
+		req.Host = tenant + testBaseHostname
+	}
+	if contentType != "" {
+		req.Header.Set(echo.HeaderContentType, contentType)
+	}
+	switch {
+	case u == nil:
+	case u.bearer != "":
+		req.Header.Set(echo.HeaderAuthorization, "Bearer "+u.bearer)
+	default:
+		req.AddCookie(&http.Cookie{Name: cookieName, Value: ts.token(u)})
+	}
+	rec := httptest.NewRecorder()
+	ts.e.ServeHTTP(rec, req)
+	return rec
+}
+
+func (ts *testServer) get(tenant, target string, u *testUser) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	return ts.do(http.MethodGet, tenant, target, u, nil, "")
+}
+
+func (ts *testServer) postForm(tenant, target string, u *testUser, form url.Values) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	return ts.do(http.MethodPost, tenant, target, u, strings.NewReader(form.Encode()), echo.MIMEApplicationForm)
+}
+
+func (ts *testServer) postFile(tenant, target string, u *testUser, field, content string, form url.Values) *httptest.ResponseRecorder {
+	ts.t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for k, vs := range form {
+		for _, v := range vs {
+			mw.WriteField(k, v)
+		}
+	}
+	fw, err := mw.CreateFormFile(field, field+".csv")
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+	io.WriteString(fw, content)
+	mw.Close()
+	return ts.do(http.MethodPost, tenant, target, u, &buf, mw.FormDataContentType())
+}
+
+// ステータスコードを確認して、dataをvに読み込む
+func decodeData(t *testing.T, rec *httptest.ResponseRecorder, code int, v any) {
+	t.Helper()
+	if rec.Code != code {
+		t.Fatalf("status code: want %d, got %d: %s", code, rec.Code, rec.Body.String())
+	}
+	if v == nil {
+		return
+	}
+	var res struct {
+		Status bool            `json:"status"`
+		Data   json.RawMessage `json:"data"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+		t.Fatalf("error json.Unmarshal: %s: %s", err, rec.Body.String())
+	}
+	if err := json.Unmarshal(res.Data, v); err != nil {
+		t.Fatalf("error json.Unmarshal data: %s: %s", err, rec.Body.String())
+	}
+}
+
+func (ts *testServer) addTenant(name string) TenantWithBilling {
+	ts.t.Helper()
+	var res TenantsAddHandlerResult
+	decodeData(ts.t, ts.postForm("admin", "/api/admin/tenants/add", testAdmin, url.Values{
+		"name":         {name},
+		"display_name": {name + " display"},
+	}), http.StatusOK, &res)
+	return res.Tenant
+}
+
+func (ts *testServer) addPlayers(tenant string, names ...string) []PlayerDetail {
+	ts.t.Helper()
+	var res PlayersAddHandlerResult
+	decodeData(ts.t, ts.postForm(tenant, "/api/organizer/players/add", organizerOf(tenant), url.Values{
+		"display_name[]": names,
+	}), http.StatusOK, &res)
+	return res.Players
+}
+
+func (ts *testServer) addCompetition(tenant, title string) CompetitionDetail {
+	ts.t.Helper()
+	var res CompetitionsAddHandlerResult
+	decodeData(ts.t, ts.postForm(tenant, "/api/organizer/competitions/add", organizerOf(tenant), url.Values{
+		"title": {title},
+	}), http.StatusOK, &res)
+	return res.Competition
+}
+
+func (ts *testServer) uploadScores(tenant, competitionID string, scores map[string]int64) {
+	ts.t.Helper()
+	csv := "player_id,score\n"
+	for id, score := range scores {
+		csv += fmt.Sprintf("%s,%d\n", id, score)
+	}
+	var res ScoreHandlerResult
+	decodeData(ts.t, ts.postFile(tenant, "/api/organizer/competition/"+competitionID+"/score", organizerOf(tenant), "scores", csv, nil), http.StatusOK, &res)
+	if res.Rows != int64(len(scores)) {
+		ts.t.Fatalf("rows: want %d, got %d", len(scores), res.Rows)
+	}
+}
+
+func TestAdminDBErrors(t *testing.T) {
+	for _, tc := range []struct {
+		err                 error
+		duplicate, deadlock bool
+	}{
+		{err: &mysql.MySQLError{Number: 1062}, duplicate: true},
+		{err: fmt.Errorf("wrapped: %w", &mysql.MySQLError{Number: 1213}), deadlock: true},
+		{err: sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintUnique}, duplicate: true},
+		{err: sqlite3.Error{Code: sqlite3.ErrBusy}, deadlock: true},
+		{err: sqlite3.Error{Code: sqlite3.ErrConstraint, ExtendedCode: sqlite3.ErrConstraintNotNull}},
+		{err: sql.ErrNoRows},
+	} {
+		if got := isDuplicateKeyError(tc.err); got != tc.duplicate {
+			t.Errorf("isDuplicateKeyError(%v): want %v, got %v", tc.err, tc.duplicate, got)
+		}
+		if got := isDeadlockError(tc.err); got != tc.deadlock {
+			t.Errorf("isDeadlockError(%v): want %v, got %v", tc.err, tc.deadlock, got)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	dir := t.TempDir()
+	confFile := filepath.Join(dir, "config.json")
+	if err := os.WriteFile(confFile, []byte(`{"ISUCON_DB_HOST": "10.0.0.2", "ISUCON_DB_PORT": "3307", "ISUCON_RATE_LIMITS": "score.tenant=1/5"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	// 環境変数、設定ファイル、デフォルト値の順に優先する
+	t.Setenv("ISUCON_CONFIG_FILE", confFile)
+	t.Setenv("ISUCON_DB_PORT", "3308")
+	conf, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conf.AdminDB.Host != "10.0.0.2" || conf.AdminDB.Port != "3308" || conf.AdminDB.User != "isucon" {
+		t.Errorf("unexpected admin db config: %+v", conf.AdminDB)
+	}
+	if conf.RateLimits[RateLimitClassScore][RateLimitScopeTenant] != (rateLimitRule{Rate: 1, Burst: 5}) {
+		t.Errorf("unexpected rate limits: %+v", conf.RateLimits)
+	}
+	if !filepath.IsAbs(conf.TenantDBDir) || conf.JWTKey == nil {
+		t.Errorf("unexpected config: %+v", conf)
+	}
+
+	// 不正な値はまとめてエラーにする
+	t.Setenv("ISUCON_DB_PORT", "0")
+	t.Setenv("ISUCON_LOG_LEVEL", "verbose")
+	if _, err := loadConfig(); err == nil || !strings.Contains(err.Error(), "ISUCON_DB_PORT") || !strings.Contains(err.Error(), "ISUCON_LOG_LEVEL") {
+		t.Errorf("want errors for ISUCON_DB_PORT and ISUCON_LOG_LEVEL, got %v", err)
+	}
+	t.Setenv("ISUCON_CONFIG_FILE", filepath.Join(dir, "missing.json"))
+	if _, err := loadConfig(); err == nil {
+		t.Error("want error for missing ISUCON_CONFIG_FILE")
+	}
+}
+
+func TestLoadConfigDurations(t *testing.T) {
+	for _, tc := range []struct {
+		key, value string
+		valid      bool
+	}{
+		{"ISUCON_COMPETITION_SCHEDULER_INTERVAL", "1s", true},
+		{"ISUCON_COMPETITION_SCHEDULER_INTERVAL", "0s", false},
+		{"ISUCON_SHUTDOWN_TIMEOUT", "0s", false},
+		{"ISUCON_SHUTDOWN_TIMEOUT", "-1s", false},
+		{"ISUCON_TENANT_CACHE_TTL", "0s", true},
+		{"ISUCON_TENANT_CACHE_NEGATIVE_TTL", "-1s", false},
+		{"ISUCON_SQL_TRACE_SLOW_THRESHOLD", "0s", true},
+		{"ISUCON_SQL_TRACE_SLOW_THRESHOLD", "1", false},
+	} {
+		t.Run(tc.key+"="+tc.value, func(t *testing.T) {
+			t.Setenv(tc.key, tc.value)
+			_, err := loadConfig()
+			if tc.valid && err != nil {
+				t.Errorf("want valid, got %s", err)
+			}
+			if !tc.valid && (err == nil || !strings.Contains(err.Error(), tc.key)) {
+				t.Errorf("want error for %s, got %v", tc.key, err)
+			}
+		})
+	}
+}
+
+func TestParseTraceparent(t *testing.T) {
+	const (
+		tid = "4bf92f3577b34da6a3ce929d0e0e4736"
+		sid = "00f067aa0ba902b7"
+	)
+	for _, tc := range []struct {
+		header string
+		valid  bool
+	}{
+		{"00-" + tid + "-" + sid + "-01", true},
+		{" 00-" + tid + "-" + sid + "-00 ", true},
+		// 将来のバージョンは後ろに要素が増えてもよい
+		{"01-" + tid + "-" + sid + "-01-extra", true},
+		{"00-" + tid + "-" + sid + "-01-extra", false},
+		{"ff-" + tid + "-" + sid + "-01", false},
+		{"0-" + tid + "-" + sid + "-01", false},
+		{"00-" + tid + "-" + sid, false},
+		{"00-" + tid[1:] + "-" + sid + "-01", false},
+		{"00-" + tid + "-" + sid[1:] + "-01", false},
+		{"00-" + tid + "-" + sid + "-1", false},
+		{"00-" + strings.Repeat("0", 32) + "-" + sid + "-01", false},
+		{"00-" + tid + "-" + strings.Repeat("0", 16) + "-01", false},
+		{"00-" + strings.Repeat("g", 32) + "-" + sid + "-01", false},
+		{"", false},
+	} {
+		gotTID, gotSID, ok := parseTraceparent(tc.header)
+		if ok != tc.valid {
+			t.Errorf("parseTraceparent(%q): want %v, got %v", tc.header, tc.valid, ok)
+			continue
+		}
+		if ok && (gotTID.String() != tid || gotSID.String() != sid) {
+			t.Errorf("parseTraceparent(%q): want %s %s, got %s %s", tc.header, tid, sid, gotTID, gotSID)
+		}
+	}
+}
+
+func TestAdminAPI(t *testing.T) {
+	ts := newTestServer(t)
+
+	tenant := ts.addTenant("tenant-a")
+	if tenant.Name != "tenant-a" || tenant.DisplayName != "tenant-a display" {
+		t.Fatalf("unexpected tenant: %+v", tenant)
+	}
+	decodeData(t, ts.postForm("admin", "/api/admin/tenants/add", testAdmin, url.Values{"name": {"Invalid_Name"}}), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("admin", "/api/admin/tenants/add", testAdmin, url.Values{"name": {"tenant-a"}, "display_name": {"dup"}}), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("admin", "/api/admin/tenants/add", organizerOf("admin"), url.Values{"name": {"tenant-b"}}), http.StatusUnauthorized, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/admin/tenants/add", organizerOf("tenant-a"), url.Values{"name": {"tenant-b"}}), http.StatusNotFound, nil)
+
+	players := ts.addPlayers("tenant-a", "alice", "bob")
+	comp := ts.addCompetition("tenant-a", "first")
+	ts.uploadScores("tenant-a", comp.ID, map[string]int64{players[0].ID: 100})
+	decodeData(t, ts.get("tenant-a", "/api/player/competition/"+comp.ID+"/ranking", playerOf("tenant-a", players[1].ID)), http.StatusOK, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/finish", organizerOf("tenant-a"), nil), http.StatusOK, nil)
+
+	var billing TenantsBillingHandlerResult
+	decodeData(t, ts.get("admin", "/api/admin/tenants/billing", testAdmin), http.StatusOK, &billing)
+	if len(billing.Tenants) != 1 {
+		t.Fatalf("tenants: want 1, got %d", len(billing.Tenants))
+	}
+	// スコアを登録した参加者が100円、閲覧しただけの参加者が10円
+	if got := billing.Tenants[0].BillingYen; got != 110 {
+		t.Errorf("billing: want 110, got %d", got)
+	}
+	decodeData(t, ts.get("tenant-a", "/api/admin/tenants/billing", organizerOf("tenant-a")), http.StatusNotFound, nil)
+
+	var limits RateLimitsHandlerResult
+	decodeData(t, ts.get("admin", "/api/admin/rate_limits", testAdmin), http.StatusOK, &limits)
+	decodeData(t, ts.get("tenant-a", "/api/admin/rate_limits", organizerOf("tenant-a")), http.StatusNotFound, nil)
+}
+
+func TestTenantCache(t *testing.T) {
+	ts := newTestServer(t)
+	counts := func() (uint64, uint64) {
+		return atomic.LoadUint64(&ts.s.metrics.tenantCacheHits), atomic.LoadUint64(&ts.s.metrics.tenantCacheMisses)
+	}
+
+	// 存在しないテナントも短い時間覚えておく
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players", organizerOf("tenant-a")), http.StatusUnauthorized, nil)
+	hits, misses := counts()
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players", organizerOf("tenant-a")), http.StatusUnauthorized, nil)
+	if h, m := counts(); h != hits+1 || m != misses {
+		t.Fatalf("negative cache: want hits=%d misses=%d, got hits=%d misses=%d", hits+1, misses, h, m)
+	}
+
+	// 追加したテナントには、存在しないことを覚えていてもすぐにアクセスできる
+	ts.addTenant("tenant-a")
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players", organizerOf("tenant-a")), http.StatusOK, nil)
+	hits, misses = counts()
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players", organizerOf("tenant-a")), http.StatusOK, nil)
+	if h, m := counts(); h != hits+1 || m != misses {
+		t.Fatalf("cache: want hits=%d misses=%d, got hits=%d misses=%d", hits+1, misses, h, m)
+	}
+
+	// TTLが切れたら読み直す
+	ts.clock.Advance(11 * time.Second)
+	hits, misses = counts()
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players", organizerOf("tenant-a")), http.StatusOK, nil)
+	if h, m := counts(); h != hits || m != misses+1 {
+		t.Fatalf("expired: want hits=%d misses=%d, got hits=%d misses=%d", hits, misses+1, h, m)
+	}
+}
+
+func TestAuditLogsAPI(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.addTenant("tenant-a")
+	ts.addTenant("tenant-b")
+	players := ts.addPlayers("tenant-a", "alice")
+	org := organizerOf("tenant-a")
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+players[0].ID+"/disqualified", org, url.Values{"reason": {"cheating"}}), http.StatusOK, nil)
+	// 失敗した書き込みと読み込みは記録しない
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/unknown/disqualified", org, url.Values{"reason": {"cheating"}}), http.StatusNotFound, nil)
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players", org), http.StatusOK, nil)
+
+	var all AuditLogsHandlerResult
+	decodeData(t, ts.get("admin", "/api/admin/audit_logs", testAdmin), http.StatusOK, &all)
+	if len(all.AuditLogs) != 4 {
+		t.Fatalf("audit logs: want 4, got %+v", all.AuditLogs)
+	}
+	if a := all.AuditLogs[3]; a.Action != "POST /api/admin/tenants/add" || a.Actor != "admin" || a.Role != RoleAdmin || a.TenantID != tenant.ID || a.TargetID != tenant.ID || a.RequestID == "" {
+		t.Errorf("unexpected audit log: %+v", a)
+	}
+	if a := all.AuditLogs[0]; a.Action != "POST /api/organizer/player/:player_id/disqualified" || a.Actor != "organizer" || a.TenantID != tenant.ID || a.TargetID != players[0].ID {
+		t.Errorf("unexpected audit log: %+v", a)
+	}
+
+	var filtered AuditLogsHandlerResult
+	decodeData(t, ts.get("admin", "/api/admin/audit_logs?tenant_id="+tenant.ID+"&actor=organizer", testAdmin), http.StatusOK, &filtered)
+	if len(filtered.AuditLogs) != 2 {
+		t.Errorf("filtered audit logs: want 2, got %+v", filtered.AuditLogs)
+	}
+	decodeData(t, ts.get("admin", fmt.Sprintf("/api/admin/audit_logs?since=%d", ts.clock.Now().Add(time.Second).Unix()), testAdmin), http.StatusOK, &filtered)
+	if len(filtered.AuditLogs) != 0 {
+		t.Errorf("audit logs since future: want 0, got %+v", filtered.AuditLogs)
+	}
+	decodeData(t, ts.get("admin", "/api/admin/audit_logs?until=x", testAdmin), http.StatusBadRequest, nil)
+	decodeData(t, ts.get("tenant-a", "/api/admin/audit_logs", org), http.StatusNotFound, nil)
+
+	rec := ts.get("admin", "/api/admin/audit_logs/export?tenant_id="+tenant.ID, testAdmin)
+	if rec.Code != http.StatusOK || !strings.HasPrefix(rec.Header().Get(echo.HeaderContentType), "text/csv") {
+		t.Fatalf("export: unexpected response: %d %s", rec.Code, rec.Header().Get(echo.HeaderContentType))
+	}
+	lines := strings.Split(strings.TrimSpace(rec.Body.String()), "\n")
+	if len(lines) != 4 || lines[0] != "id,tenant_id,actor,role,action,target_id,request_id,created_at" {
+		t.Errorf("export: unexpected csv: %s", rec.Body.String())
+	}
+}
+
+func TestTenantDomainsAPI(t *testing.T) {
+	ts := newTestServer(t)
+
+	tenant := ts.addTenant("tenant-a")
+	players := ts.addPlayers("tenant-a", "alice")
+	alice := playerOf("tenant-a", players[0].ID)
+	base := "/api/admin/tenant/" + tenant.ID
+
+	var added TenantDomainHandlerResult
+	decodeData(t, ts.postForm("admin", base+"/domains/add", testAdmin, url.Values{"domain": {"Scores.Example.com"}}), http.StatusOK, &added)
+	if added.Domain.Domain != "scores.example.com" || added.Domain.Verified {
+		t.Fatalf("unexpected domain: %+v", added.Domain)
+	}
+	decodeData(t, ts.postForm("admin", base+"/domains/add", testAdmin, url.Values{"domain": {"scores.example.com"}}), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("admin", base+"/domains/add", testAdmin, url.Values{"domain": {"evil" + testBaseHostname}}), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("admin", base+"/domains/add", testAdmin, url.Values{"domain": {"localhost"}}), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("admin", "/api/admin/tenant/999/domains/add", testAdmin, url.Values{"domain": {"other.example.com"}}), http.StatusNotFound, nil)
+	decodeData(t, ts.postForm("tenant-a", base+"/domains/add", organizerOf("tenant-a"), url.Values{"domain": {"other.example.com"}}), http.StatusNotFound, nil)
+
+	// 所有を確認するまでは使えない
+	decodeData(t, ts.get("scores.example.com", "/api/player/player/"+players[0].ID, alice), http.StatusUnauthorized, nil)
+	decodeData(t, ts.postForm("admin", base+"/domain/scores.example.com/verify", testAdmin, nil), http.StatusBadRequest, nil)
+	ts.domains.set(added.Domain.VerificationRecord, added.Domain.VerificationValue)
+	var verified TenantDomainHandlerResult
+	decodeData(t, ts.postForm("admin", base+"/domain/scores.example.com/verify", testAdmin, nil), http.StatusOK, &verified)
+	if !verified.Domain.Verified || verified.Domain.VerifiedAt == nil {
+		t.Fatalf("domain is not verified: %+v", verified.Domain)
+	}
+
+	// カスタムドメインでも、JWTのaudは正規のテナント名
+	decodeData(t, ts.get("scores.example.com", "/api/player/player/"+players[0].ID, alice), http.StatusOK, nil)
+	decodeData(t, ts.get("scores.example.com:443", "/api/player/player/"+players[0].ID, alice), http.StatusOK, nil)
+	decodeData(t, ts.get("scores.example.com", "/api/player/player/"+players[0].ID, playerOf("scores.example.com", players[0].ID)), http.StatusUnauthorized, nil)
+	decodeData(t, ts.get("tenant-a", "/api/player/player/"+players[0].ID, alice), http.StatusOK, nil)
+
+	var list TenantDomainsHandlerResult
+	decodeData(t, ts.get("admin", base+"/domains", testAdmin), http.StatusOK, &list)
+	if len(list.Domains) != 1 || !list.Domains[0].Verified {
+		t.Fatalf("unexpected domains: %+v", list.Domains)
+	}
+
+	decodeData(t, ts.postForm("admin", base+"/domain/scores.example.com/delete", testAdmin, nil), http.StatusOK, nil)
+	decodeData(t, ts.postForm("admin", base+"/domain/scores.example.com/delete", testAdmin, nil), http.StatusNotFound, nil)
+	decodeData(t, ts.get("scores.example.com", "/api/player/player/"+players[0].ID, alice), http.StatusUnauthorized, nil)
+}
+
+func TestParseRateLimitRules(t *testing.T) {
+	for _, tc := range []struct {
+		spec  string
+		want  map[string]map[string]rateLimitRule
+		valid bool
+	}{
+		{"", map[string]map[string]rateLimitRule{}, true},
+		{
+			" score.tenant=1/5, ranking.player=0.5/20 ",
+			map[string]map[string]rateLimitRule{
+				RateLimitClassScore:   {RateLimitScopeTenant: {Rate: 1, Burst: 5}},
+				RateLimitClassRanking: {RateLimitScopePlayer: {Rate: 0.5, Burst: 20}},
+			},
+			true,
+		},
+		{"score.tenant", nil, false},
+		{"score=1/5", nil, false},
+		{"unknown.tenant=1/5", nil, false},
+		{"score.unknown=1/5", nil, false},
+		{"score.tenant=1", nil, false},
+		{"score.tenant=0/5", nil, false},
+		{"score.tenant=1/0.5", nil, false},
+	} {
+		got, err := parseRateLimitRules(tc.spec)
+		if !tc.valid {
+			if err == nil {
+				t.Errorf("parseRateLimitRules(%q): want error, got %+v", tc.spec, got)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseRateLimitRules(%q): %s", tc.spec, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tc.want) {
+			t.Errorf("parseRateLimitRules(%q): want %+v, got %+v", tc.spec, tc.want, got)
+		}
+	}
+}
+
+func TestRateLimiterTake(t *testing.T) {
+	l := newRateLimiter(map[string]map[string]rateLimitRule{
+		RateLimitClassScore: {
+			RateLimitScopeTenant: {Rate: 1, Burst: 2},
+			RateLimitScopePlayer: {Rate: 0.5, Burst: 1},
+		},
+	}, false)
+	tenant := rateLimitBucketKey{class: RateLimitClassScore, scope: RateLimitScopeTenant, subject: "tenant-a"}
+	alice := rateLimitBucketKey{class: RateLimitClassScore, scope: RateLimitScopePlayer, subject: "tenant-a:alice"}
+	bob := rateLimitBucketKey{class: RateLimitClassScore, scope: RateLimitScopePlayer, subject: "tenant-a:bob"}
+	start := time.Date(2022, 7, 23, 10, 0, 0, 0, time.UTC)
+
+	for i, tc := range []struct {
+		keys    []rateLimitBucketKey
+		elapsed time.Duration
+		ok      bool
+		wait    time.Duration
+	}{
+		{[]rateLimitBucketKey{tenant, alice}, 0, true, 0},
+		// aliceのバケットが空なので、テナントのバケットからも取り出さない
+		{[]rateLimitBucketKey{tenant, alice}, 0, false, 2 * time.Second},
+		{[]rateLimitBucketKey{tenant, bob}, 0, true, 0},
+		// テナントのバケットが空になり、待ち時間の長い方を返す
+		{[]rateLimitBucketKey{tenant, alice}, 0, false, 2 * time.Second},
+		{[]rateLimitBucketKey{tenant}, 0, false, time.Second},
+		// 1秒でテナントに1つ、aliceに0.5補充される
+		{[]rateLimitBucketKey{tenant, alice}, time.Second, false, time.Second},
+		{[]rateLimitBucketKey{tenant}, time.Second, true, 0},
+		// 補充はバーストまで
+		{[]rateLimitBucketKey{tenant, alice}, time.Hour, true, 0},
+		{[]rateLimitBucketKey{tenant}, time.Hour, true, 0},
+		{[]rateLimitBucketKey{tenant}, time.Hour, false, time.Second},
+	} {
+		ok, wait := l.take(tc.keys, "tenant-a", start.Add(tc.elapsed))
+		if ok != tc.ok || wait != tc.wait {
+			t.Errorf("#%d take: want (%v, %s), got (%v, %s)", i, tc.ok, tc.wait, ok, wait)
+		}
+	}
+	if got := l.stats().Throttled; len(got) != 2 {
+		t.Errorf("throttled: want 2 counters, got %+v", got)
+	}
+}
+
+func TestRateLimiterRetryAfter(t *testing.T) {
+	now := time.Date(2022, 7, 23, 10, 0, 0, 0, time.UTC)
+	for _, tc := range []struct {
+		httpDate bool
+		wait     time.Duration
+		want     string
+	}{
+		{false, 0, "1"},
+		{false, 1500 * time.Millisecond, "2"},
+		{false, 3 * time.Second, "3"},
+		{true, 0, "Sat, 23 Jul 2022 10:00:01 GMT"},
+		{true, 1500 * time.Millisecond, "Sat, 23 Jul 2022 10:00:02 GMT"},
+	} {
+		l := newRateLimiter(nil, tc.httpDate)
+		if got := l.retryAfter(tc.wait, now); got != tc.want {
+			t.Errorf("retryAfter(%s, httpDate=%v): want %s, got %s", tc.wait, tc.httpDate, tc.want, got)
+		}
+	}
+}
+
+func TestRateLimitMiddleware(t *testing.T) {
+	ts := newTestServer(t, func(o *ServerOptions) {
+		o.RateLimits = map[string]map[string]rateLimitRule{
+			RateLimitClassRead: {RateLimitScopeTenant: {Rate: 0.001, Burst: 1}},
+		}
+	})
+	ts.addTenant("tenant-a")
+	ts.addTenant("tenant-b")
+
+	decodeData(t, ts.get("tenant-a", "/api/organizer/competitions", organizerOf("tenant-a")), http.StatusOK, nil)
+	rec := ts.get("tenant-a", "/api/organizer/competitions", organizerOf("tenant-a"))
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get(echo.HeaderRetryAfter) != "1000" {
+		t.Errorf("want 429 with Retry-After 1000, got %d %q", rec.Code, rec.Header().Get(echo.HeaderRetryAfter))
+	}
+	// 他のテナントは制限されない
+	decodeData(t, ts.get("tenant-b", "/api/organizer/competitions", organizerOf("tenant-b")), http.StatusOK, nil)
+}
+
+func TestRateLimitCustomDomain(t *testing.T) {
+	ts := newTestServer(t, func(o *ServerOptions) {
+		o.RateLimits = map[string]map[string]rateLimitRule{
+			RateLimitClassRead: {RateLimitScopeTenant: {Rate: 0.001, Burst: 2}},
+		}
+	})
+	tenant := ts.addTenant("tenant-a")
+	players := ts.addPlayers("tenant-a", "alice")
+	alice := playerOf("tenant-a", players[0].ID)
+	base := "/api/admin/tenant/" + tenant.ID
+
+	var added TenantDomainHandlerResult
+	decodeData(t, ts.postForm("admin", base+"/domains/add", testAdmin, url.Values{"domain": {"scores.example.com"}}), http.StatusOK, &added)
+	ts.domains.set(added.Domain.VerificationRecord, added.Domain.VerificationValue)
+	decodeData(t, ts.postForm("admin", base+"/domain/scores.example.com/verify", testAdmin, nil), http.StatusOK, nil)
+
+	// サブドメインとカスタムドメインで同じテナントのバケットを使う
+	decodeData(t, ts.get("tenant-a", "/api/player/player/"+players[0].ID, alice), http.StatusOK, nil)
+	decodeData(t, ts.get("scores.example.com", "/api/player/player/"+players[0].ID, alice), http.StatusOK, nil)
+	if rec := ts.get("scores.example.com", "/api/player/player/"+players[0].ID, alice); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("status: want %d, got %d", http.StatusTooManyRequests, rec.Code)
+	}
+
+	var limits RateLimitsHandlerResult
+	decodeData(t, ts.get("admin", "/api/admin/rate_limits", testAdmin), http.StatusOK, &limits)
+	if len(limits.Throttled) != 1 || limits.Throttled[0].Tenant != "tenant-a" {
+		t.Errorf("throttled: want tenant-a, got %+v", limits.Throttled)
+	}
+}
+
+func TestOrganizerPlayersAPI(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+
+	players := ts.addPlayers("tenant-a", "alice", "bob", "carol")
+	if len(players) != 3 {
+		t.Fatalf("players: want 3, got %d", len(players))
+	}
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/players/add", playerOf("tenant-a", players[0].ID), url.Values{"display_name[]": {"dave"}}), http.StatusForbidden, nil)
+
+	var list PlayersListHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players?display_name=b", org), http.StatusOK, &list)
+	if list.Total != 1 || list.Players[0].DisplayName != "bob" {
+		t.Errorf("unexpected players: %+v", list)
+	}
+
+	var updated PlayerUpdateHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+players[0].ID+"/update", org, url.Values{"display_name": {"alice2"}}), http.StatusOK, &updated)
+	if updated.Player.DisplayName != "alice2" {
+		t.Errorf("display_name: want alice2, got %s", updated.Player.DisplayName)
+	}
+
+	// 期限付きで失格にして、期限を過ぎたら失格ではなくなる
+	expiresAt := ts.clock.Now().Add(time.Hour).Unix()
+	var dq PlayerDisqualifiedHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+players[1].ID+"/disqualified", org, url.Values{
+		"reason":     {"cheating"},
+		"expires_at": {fmt.Sprint(expiresAt)},
+	}), http.StatusOK, &dq)
+	if !dq.Player.IsDisqualified || dq.Disqualification == nil || dq.Disqualification.Reason != "cheating" {
+		t.Fatalf("unexpected disqualification: %+v", dq)
+	}
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players?disqualified=true", org), http.StatusOK, &list)
+	if list.Total != 1 {
+		t.Errorf("disqualified players: want 1, got %d", list.Total)
+	}
+	ts.clock.Advance(2 * time.Hour)
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players?disqualified=true", org), http.StatusOK, &list)
+	if list.Total != 0 {
+		t.Errorf("disqualified players after expiry: want 0, got %d", list.Total)
+	}
+
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+players[2].ID+"/disqualified", org, url.Values{"reason": {"spam"}}), http.StatusOK, nil)
+	decodeData(t, ts.get("tenant-a", "/api/player/player/"+players[0].ID, playerOf("tenant-a", players[2].ID)), http.StatusForbidden, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+players[2].ID+"/reinstate", org, url.Values{"reason": {"appeal"}}), http.StatusOK, nil)
+	decodeData(t, ts.get("tenant-a", "/api/player/player/"+players[0].ID, playerOf("tenant-a", players[2].ID)), http.StatusOK, nil)
+
+	var moderations PlayerModerationsHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/player/"+players[2].ID+"/moderations", org), http.StatusOK, &moderations)
+	if len(moderations.Moderations) != 2 {
+		t.Errorf("moderations: want 2, got %d", len(moderations.Moderations))
+	}
+
+	// 存在しない参加者はパラメータの検証より先に404になる。理由は省略できる
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/unknown/disqualified", org, url.Values{"expires_at": {"x"}}), http.StatusNotFound, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+players[1].ID+"/disqualified", org, url.Values{"expires_at": {"x"}}), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+players[1].ID+"/disqualified", org, nil), http.StatusOK, &dq)
+	if !dq.Player.IsDisqualified || dq.Disqualification == nil || dq.Disqualification.Reason != "" {
+		t.Errorf("unexpected disqualification without reason: %+v", dq)
+	}
+
+	var imported PlayersImportHandlerResult
+	csv := "player_id,display_name\n" + players[0].ID + ",alice3\n,erin\n"
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/players/import", org, "players", csv, nil), http.StatusOK, &imported)
+	if imported.Created != 1 || imported.Updated != 1 {
+		t.Errorf("unexpected import result: %+v", imported)
+	}
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players", org), http.StatusOK, &list)
+	if list.Total != 4 {
+		t.Errorf("players: want 4, got %d", list.Total)
+	}
+}
+
+func TestPlayersImport(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+	alice := ts.addPlayers("tenant-a", "alice")[0]
+	csv := fmt.Sprintf("player_id,display_name,is_disqualified\n,bob,\n%s,alice2,\n%s,,true\n", alice.ID, alice.ID)
+
+	// dry_run では変更内容だけを返し、何も書き込まない
+	var dryRun PlayersImportHandlerResult
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/players/import", org, "players", csv, url.Values{
+		"dry_run": {"true"},
+	}), http.StatusOK, &dryRun)
+	if !dryRun.DryRun || dryRun.Created != 1 || dryRun.Updated != 1 || dryRun.Disqualified != 1 || len(dryRun.Results) != 3 {
+		t.Errorf("unexpected dry run result: %+v", dryRun)
+	}
+	if dryRun.Results[0].Player.ID != "" {
+		t.Errorf("player id is dispensed in dry run: %+v", dryRun.Results[0])
+	}
+	var list PlayersListHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players", org), http.StatusOK, &list)
+	if len(list.Players) != 1 || list.Players[0].DisplayName != "alice" || list.Players[0].IsDisqualified {
+		t.Errorf("players are changed by dry run: %+v", list.Players)
+	}
+
+	var imported PlayersImportHandlerResult
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/players/import", org, "players", csv, nil), http.StatusOK, &imported)
+	if imported.DryRun || imported.Created != 1 || imported.Results[0].Player.ID == "" {
+		t.Errorf("unexpected import result: %+v", imported)
+	}
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players", org), http.StatusOK, &list)
+	if len(list.Players) != 2 {
+		t.Fatalf("players: want 2, got %d", len(list.Players))
+	}
+	for _, p := range list.Players {
+		if p.ID == alice.ID && (p.DisplayName != "alice2" || !p.IsDisqualified) {
+			t.Errorf("player is not updated: %+v", p)
+		}
+	}
+
+	// ヘッダの誤りや存在しない参加者は全体をエラーにする
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/players/import", org, "players", "id,name\n,carol\n", nil), http.StatusBadRequest, nil)
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/players/import", org, "players", "player_id,display_name\n,carol\nunknown,dave\n", nil), http.StatusBadRequest, nil)
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/players/import", org, "players", csv, url.Values{"dry_run": {"x"}}), http.StatusBadRequest, nil)
+	decodeData(t, ts.get("tenant-a", "/api/organizer/players", org), http.StatusOK, &list)
+	if len(list.Players) != 2 {
+		t.Errorf("players: want 2, got %d", len(list.Players))
+	}
+
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+alice.ID+"/update", org, nil), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/unknown/update", org, url.Values{"display_name": {"x"}}), http.StatusNotFound, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+alice.ID+"/update", playerOf("tenant-a", alice.ID), url.Values{"display_name": {"x"}}), http.StatusForbidden, nil)
+}
+
+func TestPlayerModeration(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+	alice := ts.addPlayers("tenant-a", "alice")[0]
+
+	var dq PlayerDisqualifiedHandlerResult
+	expiresAt := ts.clock.Now().Add(time.Hour).Unix()
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+alice.ID+"/disqualified", org, url.Values{
+		"reason":     {"cheating"},
+		"expires_at": {fmt.Sprint(expiresAt)},
+	}), http.StatusOK, &dq)
+	if dq.Disqualification == nil || dq.Disqualification.ExpiresAt == nil || *dq.Disqualification.ExpiresAt != expiresAt {
+		t.Errorf("unexpected disqualification: %+v", dq)
+	}
+
+	var reinstated PlayerReinstateHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+alice.ID+"/reinstate", org, url.Values{
+		"reason": {"appeal accepted"},
+	}), http.StatusOK, &reinstated)
+	if reinstated.Player.IsDisqualified {
+		t.Errorf("player is still disqualified: %+v", reinstated.Player)
+	}
+	// 失格でない参加者は復帰させられない
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+alice.ID+"/reinstate", org, nil), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/unknown/reinstate", org, nil), http.StatusNotFound, nil)
+
+	// 新しい順に返す
+	var moderations PlayerModerationsHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/player/"+alice.ID+"/moderations", org), http.StatusOK, &moderations)
+	if moderations.Player.IsDisqualified || moderations.Disqualification != nil || len(moderations.Moderations) != 2 ||
+		moderations.Moderations[0].Action != ModerationActionReinstate || moderations.Moderations[1].Reason != "cheating" {
+		t.Errorf("unexpected moderations: %+v", moderations)
+	}
+}
+
+func TestPlayersSearch(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+	players := ts.addPlayers("tenant-a", "alice", "alan", "bob", "carol")
+	bob, carol := players[2], players[3]
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+bob.ID+"/disqualified", org, nil), http.StatusOK, nil)
+	comp := ts.addCompetition("tenant-a", "c1")
+	ts.uploadScores("tenant-a", comp.ID, map[string]int64{carol.ID: 10})
+
+	list := func(query string) PlayersListHandlerResult {
+		t.Helper()
+		var res PlayersListHandlerResult
+		decodeData(t, ts.get("tenant-a", "/api/organizer/players?"+query, org), http.StatusOK, &res)
+		return res
+	}
+	for query, want := range map[string][]string{
+		"display_name=al":                        {"alan", "alice"},
+		"id=" + bob.ID:                           {"bob"},
+		"disqualified=true":                      {"bob"},
+		"competition_id=" + comp.ID:              {"carol"},
+		"display_name=al&competition_id=unknown": {},
+	} {
+		res := list(query)
+		names := []string{}
+		for _, p := range res.Players {
+			names = append(names, p.DisplayName)
+		}
+		if strings.Join(names, ",") != strings.Join(want, ",") || res.Total != int64(len(want)) {
+			t.Errorf("%s: want %v, got %v (total %d)", query, want, names, res.Total)
+		}
+	}
+
+	// 同じ時刻に追加した参加者もカーソルで重複なく辿れる
+	seen := map[string]bool{}
+	res := list("limit=3")
+	for {
+		if res.Total != 4 {
+			t.Errorf("total: want 4, got %d", res.Total)
+		}
+		for _, p := range res.Players {
+			if seen[p.ID] {
+				t.Errorf("duplicated player: %+v", p)
+			}
+			seen[p.ID] = true
+		}
+		if res.NextCursor == "" {
+			break
+		}
+		res = list("limit=3&cursor=" + res.NextCursor)
+	}
+	if len(seen) != 4 {
+		t.Errorf("players: want 4, got %d", len(seen))
+	}
+
+	for _, query := range []string{"limit=0", "limit=1001", "cursor=" + (playerCursor{CreatedAt: 1, ID: "x"}).encode(), "limit=1&cursor=x", "disqualified=x"} {
+		decodeData(t, ts.get("tenant-a", "/api/organizer/players?"+query, org), http.StatusBadRequest, nil)
+	}
+}
+
+func TestOrganizerCompetitionsAPI(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+	players := ts.addPlayers("tenant-a", "alice", "bob")
+
+	comp := ts.addCompetition("tenant-a", "first")
+	var updated CompetitionsAddHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/update", org, url.Values{"title": {"renamed"}}), http.StatusOK, &updated)
+	if updated.Competition.Title != "renamed" {
+		t.Errorf("title: want renamed, got %s", updated.Competition.Title)
+	}
+
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/competition/"+comp.ID+"/score", org, "scores", "player_id,score\nunknown,1\n", nil), http.StatusBadRequest, nil)
+	ts.uploadScores("tenant-a", comp.ID, map[string]int64{players[0].ID: 10, players[1].ID: 20})
+
+	// 終了時刻を過ぎた大会は、スケジューラが終了させる前でもスコアを受け付けない
+	// 名前は変更できるが、過去の終了時刻には変更できない
+	scheduled := ts.addCompetition("tenant-a", "scheduled")
+	endAt := ts.clock.Now().Add(time.Minute).Unix()
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+scheduled.ID+"/update", org, url.Values{"end_at": {fmt.Sprint(endAt)}}), http.StatusOK, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+scheduled.ID+"/update", org, url.Values{"start_at": {fmt.Sprint(endAt)}}), http.StatusBadRequest, nil)
+	ts.clock.Advance(2 * time.Minute)
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/competition/"+scheduled.ID+"/score", org, "scores", "player_id,score\n"+players[0].ID+",1\n", nil), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+scheduled.ID+"/update", org, url.Values{"title": {"renamed"}}), http.StatusOK, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+scheduled.ID+"/update", org, url.Values{"end_at": {fmt.Sprint(endAt)}}), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+scheduled.ID+"/delete", org, nil), http.StatusOK, nil)
+
+	var competitions CompetitionsHandlerResult
+	rec := ts.get("tenant-a", "/api/organizer/competitions", org)
+	decodeData(t, rec, http.StatusOK, &competitions)
+	if len(competitions.Competitions) != 1 {
+		t.Fatalf("competitions: want 1, got %d", len(competitions.Competitions))
+	}
+	// データが変わっていなければ304を返す
+	req := httptest.NewRequest(http.MethodGet, "/api/organizer/competitions", nil)
+	req.Host = "tenant-a" + testBaseHostname
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: ts.token(org)})
+	req.Header.Set("If-None-Match", rec.Header().Get("ETag"))
+	notModified := httptest.NewRecorder()
+	ts.e.ServeHTTP(notModified, req)
+	if notModified.Code != http.StatusNotModified {
+		t.Errorf("status code: want 304, got %d", notModified.Code)
+	}
+
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/finish", org, nil), http.StatusOK, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/unknown/finish", org, nil), http.StatusNotFound, nil)
+
+	var billing BillingHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/billing", org), http.StatusOK, &billing)
+	if len(billing.Reports) != 1 || billing.Reports[0].BillingYen != 200 {
+		t.Errorf("unexpected billing: %+v", billing)
+	}
+
+	var published CompetitionPublishHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/publish", org, url.Values{"share_token": {"true"}}), http.StatusOK, &published)
+	if published.ShareToken == nil {
+		t.Fatal("share_token is not issued")
+	}
+	decodeData(t, ts.get("tenant-a", "/api/public/competition/"+comp.ID+"/ranking", testAnonymous), http.StatusNotFound, nil)
+	var ranking CompetitionRankingHandlerResult
+	decodeData(t, ts.get("tenant-a", published.Path, testAnonymous), http.StatusOK, &ranking)
+	if len(ranking.Ranks) != 2 || ranking.Ranks[0].PlayerID != players[1].ID {
+		t.Errorf("unexpected ranking: %+v", ranking.Ranks)
+	}
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/unpublish", org, nil), http.StatusOK, nil)
+	decodeData(t, ts.get("tenant-a", published.Path, testAnonymous), http.StatusNotFound, nil)
+
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/delete", org, nil), http.StatusOK, nil)
+	decodeData(t, ts.get("tenant-a", "/api/organizer/competitions", org), http.StatusOK, &competitions)
+	if len(competitions.Competitions) != 0 {
+		t.Errorf("competitions after delete: want 0, got %d", len(competitions.Competitions))
+	}
+}
+
+func TestPublicRanking(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+	players := ts.addPlayers("tenant-a", "alice", "bob")
+	comp := ts.addCompetition("tenant-a", "c1")
+	ts.uploadScores("tenant-a", comp.ID, map[string]int64{players[0].ID: 10, players[1].ID: 20})
+
+	// 公開APIは認証しない
+	target := "/api/public/competition/" + comp.ID + "/ranking"
+	decodeData(t, ts.get("tenant-a", target, testAnonymous), http.StatusNotFound, nil)
+
+	var published CompetitionPublishHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/publish", org, nil), http.StatusOK, &published)
+	if published.ShareToken != nil || published.Path != target {
+		t.Errorf("unexpected publish result: %+v", published)
+	}
+	rec := ts.get("tenant-a", target+"?rank_after=1", testAnonymous)
+	if cc := rec.Header().Get(echo.HeaderCacheControl); cc != fmt.Sprintf("public, max-age=%d", publicRankingMaxAge) {
+		t.Errorf("Cache-Control: got %s", cc)
+	}
+	var ranking CompetitionRankingHandlerResult
+	decodeData(t, rec, http.StatusOK, &ranking)
+	if len(ranking.Ranks) != 1 || ranking.Ranks[0].PlayerID != players[0].ID {
+		t.Errorf("unexpected ranking: %+v", ranking.Ranks)
+	}
+	decodeData(t, ts.get("tenant-a", target+"?rank_after=x", testAnonymous), http.StatusBadRequest, nil)
+
+	// 共有用トークンを発行すると、トークンを知っている人だけが閲覧できる
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/publish", org, url.Values{
+		"share_token": {"true"},
+	}), http.StatusOK, &published)
+	if published.ShareToken == nil || published.Path != target+"?token="+url.QueryEscape(*published.ShareToken) {
+		t.Fatalf("unexpected publish result: %+v", published)
+	}
+	decodeData(t, ts.get("tenant-a", target, testAnonymous), http.StatusNotFound, nil)
+	decodeData(t, ts.get("tenant-a", target+"?token=wrong", testAnonymous), http.StatusNotFound, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/publish", org, url.Values{
+		"share_token": {"x"},
+	}), http.StatusBadRequest, nil)
+
+	// 公開をやめると発行済みのトークンでも閲覧できない
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/unpublish", org, nil), http.StatusOK, nil)
+	decodeData(t, ts.get("tenant-a", published.Path, testAnonymous), http.StatusNotFound, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/unpublish", org, nil), http.StatusBadRequest, nil)
+	decodeData(t, ts.get("tenant-a", "/api/public/competition/unknown/ranking", testAnonymous), http.StatusNotFound, nil)
+}
+
+func TestDataVersionETag(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+	players := ts.addPlayers("tenant-a", "alice", "bob")
+	alice, bob := playerOf("tenant-a", players[0].ID), players[1]
+	comp := ts.addCompetition("tenant-a", "c1")
+	upload := func(score int64) {
+		t.Helper()
+		ts.uploadScores("tenant-a", comp.ID, map[string]int64{players[0].ID: score, bob.ID: 20})
+	}
+	upload(10)
+
+	// ETagを返し、変更がなければ304を返す
+	get := func(u *testUser, target, etag string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest(http.MethodGet, target, nil)
+		req.Host = "tenant-a" + testBaseHostname
+		req.AddCookie(&http.Cookie{Name: cookieName, Value: ts.token(u)})
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		ts.e.ServeHTTP(rec, req)
+		return rec
+	}
+	ranking := "/api/player/competition/" + comp.ID + "/ranking"
+	for _, tc := range []struct {
+		u      *testUser
+		target string
+		modify func()
+	}{
+		{org, "/api/organizer/competitions", func() { ts.addCompetition("tenant-a", "c2") }},
+		{alice, ranking, func() { upload(30) }},
+		{alice, ranking, func() {
+			decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+bob.ID+"/update", org, url.Values{
+				"display_name": {"bobby"},
+			}), http.StatusOK, nil)
+		}},
+	} {
+		rec := get(tc.u, tc.target, "")
+		etag := rec.Header().Get("ETag")
+		if rec.Code != http.StatusOK || etag == "" {
+			t.Fatalf("%s: want 200 with ETag, got %d %q", tc.target, rec.Code, etag)
+		}
+		if rec := get(tc.u, tc.target, etag); rec.Code != http.StatusNotModified {
+			t.Errorf("%s: want 304, got %d", tc.target, rec.Code)
+		}
+		if rec := get(tc.u, tc.target, "W/"+etag); rec.Code != http.StatusNotModified {
+			t.Errorf("%s: weak If-None-Match: want 304, got %d", tc.target, rec.Code)
+		}
+		tc.modify()
+		if rec := get(tc.u, tc.target, etag); rec.Code != http.StatusOK || rec.Header().Get("ETag") == etag {
+			t.Errorf("%s: want 200 with new ETag after update, got %d %q", tc.target, rec.Code, rec.Header().Get("ETag"))
+		}
+	}
+	// 順位の範囲が違えば別のETagになる
+	if a, b := get(alice, ranking, "").Header().Get("ETag"), get(alice, ranking+"?rank_after=1", "").Header().Get("ETag"); a == b {
+		t.Errorf("ETag does not depend on rank_after: %s", a)
+	}
+}
+
+func TestCompetitionScheduleValidation(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+	now := ts.s.now()
+	endAt := now + 3600
+
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competitions/add", org, url.Values{
+		"title": {"past"}, "end_at": {fmt.Sprint(now - 1)},
+	}), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competitions/add", org, url.Values{
+		"title": {"reversed"}, "start_at": {fmt.Sprint(endAt)}, "end_at": {fmt.Sprint(endAt)},
+	}), http.StatusBadRequest, nil)
+	var scheduled CompetitionsAddHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competitions/add", org, url.Values{
+		"title": {"scheduled"}, "start_at": {fmt.Sprint(now + 60)}, "end_at": {fmt.Sprint(endAt)},
+	}), http.StatusOK, &scheduled)
+	comp := scheduled.Competition
+	if comp.EndAt == nil || *comp.EndAt != endAt {
+		t.Errorf("unexpected competition: %+v", comp)
+	}
+
+	// 開始前はスコアを入稿できない
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/competition/"+comp.ID+"/score", org, "scores", "player_id,score\n", nil), http.StatusBadRequest, nil)
+
+	// 変更した項目だけを確認する
+	var updated CompetitionUpdateHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/update", org, url.Values{
+		"title": {"renamed"},
+	}), http.StatusOK, &updated)
+	if updated.Competition.Title != "renamed" || updated.Competition.EndAt == nil || *updated.Competition.EndAt != endAt {
+		t.Errorf("unexpected competition: %+v", updated.Competition)
+	}
+
+	// 終了時刻になった大会から終了させる
+	finished := func(at int64) bool {
+		t.Helper()
+		if err := ts.s.finishEndedCompetitions(context.Background(), at, ts.e.Logger); err != nil {
+			t.Fatal(err)
+		}
+		var list CompetitionsHandlerResult
+		decodeData(t, ts.get("tenant-a", "/api/organizer/competitions", org), http.StatusOK, &list)
+		if len(list.Competitions) != 1 {
+			t.Fatalf("competitions: want 1, got %d", len(list.Competitions))
+		}
+		return list.Competitions[0].IsFinished
+	}
+	if finished(endAt - 1) {
+		t.Error("competition is finished before end_at")
+	}
+	if !finished(endAt) {
+		t.Error("competition is not finished at end_at")
+	}
+}
+
+func TestCompetitionScheduler(t *testing.T) {
+	ts := newTestServer(t)
+	tenantA, tenantB := ts.addTenant("tenant-a"), ts.addTenant("tenant-b")
+	org := organizerOf("tenant-a")
+	ctx := context.Background()
+
+	scheduled := func(tenantID string) []string {
+		ids := []string{}
+		if err := ts.s.adminDB.SelectContext(ctx, &ids, "SELECT competition_id FROM competition_schedule WHERE tenant_id = ? ORDER BY end_at", tenantID); err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+	addScheduled := func(title string, endAt time.Time) CompetitionDetail {
+		var res CompetitionsAddHandlerResult
+		decodeData(t, ts.postForm("tenant-a", "/api/organizer/competitions/add", org, url.Values{
+			"title":  {title},
+			"end_at": {fmt.Sprint(endAt.Unix())},
+		}), http.StatusOK, &res)
+		return res.Competition
+	}
+	soon := addScheduled("soon", ts.clock.Now().Add(time.Minute))
+	later := addScheduled("later", ts.clock.Now().Add(time.Hour))
+	deleted := addScheduled("deleted", ts.clock.Now().Add(time.Minute))
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+deleted.ID+"/delete", org, nil), http.StatusOK, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+deleted.ID+"/delete", org, nil), http.StatusNotFound, nil)
+	ts.addCompetition("tenant-b", "unscheduled")
+
+	// 終了予定は管理用DBに記録され、削除した大会や終了時刻のない大会は含まない
+	if got := scheduled(tenantA.ID); len(got) != 2 || got[0] != soon.ID || got[1] != later.ID {
+		t.Fatalf("scheduled competitions: want [%s %s], got %v", soon.ID, later.ID, got)
+	}
+	if got := scheduled(tenantB.ID); len(got) != 0 {
+		t.Fatalf("scheduled competitions: want none, got %v", got)
+	}
+
+	ts.clock.Advance(2 * time.Minute)
+	if err := ts.s.finishEndedCompetitions(ctx, ts.s.now(), ts.e.Logger); err != nil {
+		t.Fatal(err)
+	}
+	var competitions CompetitionsHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/competitions", org), http.StatusOK, &competitions)
+	for _, c := range competitions.Competitions {
+		if want := c.ID == soon.ID; c.IsFinished != want {
+			t.Errorf("is_finished of %s: want %t, got %t", c.Title, want, c.IsFinished)
+		}
+	}
+	if got := scheduled(tenantA.ID); len(got) != 1 || got[0] != later.ID {
+		t.Errorf("scheduled competitions: want [%s], got %v", later.ID, got)
+	}
+
+	// 終了時刻を消すと予定からも消える
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+later.ID+"/update", org, url.Values{"end_at": {""}}), http.StatusOK, nil)
+	if got := scheduled(tenantA.ID); len(got) != 0 {
+		t.Errorf("scheduled competitions: want none, got %v", got)
+	}
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+soon.ID+"/update", org, url.Values{"title": {"renamed"}}), http.StatusBadRequest, nil)
+}
+
+func TestWebhookPrivateAddresses(t *testing.T) {
+	s := NewServer(ServerOptions{})
+	for _, tc := range []struct {
+		url   string
+		valid bool
+	}{
+		{"http://203.0.113.10/hook", true},
+		{"https://[2001:db8::1]:8443/hook", true},
+		{"ftp://203.0.113.10/hook", false},
+		{"http://127.0.0.1:3000/api/admin/tenants/add", false},
+		{"http://localhost/hook", false},
+		{"http://[::1]/hook", false},
+		{"http://169.254.169.254/latest/meta-data/", false},
+		{"http://10.0.0.2:3306/", false},
+		{"http://192.168.0.1/", false},
+		{"http://100.64.0.1/", false},
+		{"http://0.0.0.0/", false},
+		{"http://[::ffff:127.0.0.1]/", false},
+	} {
+		if err := s.validateWebhookURL(context.Background(), tc.url); (err == nil) != tc.valid {
+			t.Errorf("validateWebhookURL(%s): want valid=%t, got %v", tc.url, tc.valid, err)
+		}
+	}
+
+	// 登録後にDNSの応答が変わっても、送信時に内部のアドレスには接続しない
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t.Error("webhook was sent to a private address")
+	}))
+	defer receiver.Close()
+	status, err := s.sendWebhook(context.Background(), &WebhookEndpointRow{URL: receiver.URL}, 1, WebhookEventPing, []byte("{}"))
+	if err == nil || status != 0 {
+		t.Errorf("sendWebhook to private address: want error, got status=%d", status)
+	}
+	if err := NewServer(ServerOptions{WebhookAllowPrivateAddresses: true}).validateWebhookURL(context.Background(), receiver.URL); err != nil {
+		t.Errorf("validateWebhookURL with WebhookAllowPrivateAddresses: %s", err)
+	}
+}
+
+func TestOrganizerWebhooksAPI(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+
+	type request struct {
+		header http.Header
+		body   []byte
+	}
+	received := make(chan request, 1)
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- request{header: r.Header, body: body}
+	}))
+	defer receiver.Close()
+
+	var added WebhooksAddHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/webhooks/add", org, url.Values{
+		"url":     {receiver.URL},
+		"event[]": {WebhookEventCompetitionFinish},
+	}), http.StatusOK, &added)
+	if added.Secret == "" {
+		t.Fatal("secret is empty")
+	}
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/webhooks/add", org, url.Values{"url": {"ftp://example.com"}}), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/webhooks/add", org, url.Values{
+		"url": {receiver.URL}, "event[]": {"unknown.event"},
+	}), http.StatusBadRequest, nil)
+
+	var webhooks WebhooksHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/webhooks", org), http.StatusOK, &webhooks)
+	if len(webhooks.Webhooks) != 1 {
+		t.Fatalf("webhooks: want 1, got %d", len(webhooks.Webhooks))
+	}
+
+	var tested WebhookTestHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/webhook/"+added.Webhook.ID+"/test", org, nil), http.StatusOK, &tested)
+	if tested.Delivery.Status != WebhookDeliveryStatusSucceeded {
+		t.Errorf("delivery status: want %s, got %s", WebhookDeliveryStatusSucceeded, tested.Delivery.Status)
+	}
+	r := <-received
+	if r.header.Get(webhookEventHeader) != WebhookEventPing {
+		t.Errorf("event header: want %s, got %s", WebhookEventPing, r.header.Get(webhookEventHeader))
+	}
+	// 受信側は登録時のsecretで署名を検証できる
+	timestamp, err := strconv.ParseInt(r.header.Get(webhookTimestampHeader), 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := signWebhookPayload(added.Secret, timestamp, r.body); r.header.Get(webhookSignatureHeader) != want {
+		t.Errorf("signature: want %s, got %s", want, r.header.Get(webhookSignatureHeader))
+	}
+	if signWebhookPayload(added.Secret, timestamp+1, r.body) == r.header.Get(webhookSignatureHeader) {
+		t.Error("signature does not cover timestamp")
+	}
+
+	var deliveries WebhookDeliveriesHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/webhook/"+added.Webhook.ID+"/deliveries", org), http.StatusOK, &deliveries)
+	if len(deliveries.Deliveries) != 1 {
+		t.Errorf("deliveries: want 1, got %d", len(deliveries.Deliveries))
+	}
+
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/webhook/"+added.Webhook.ID+"/delete", org, nil), http.StatusOK, nil)
+	decodeData(t, ts.get("tenant-a", "/api/organizer/webhook/"+added.Webhook.ID+"/deliveries", org), http.StatusNotFound, nil)
+}
+
+func TestDomainEventClock(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.addTenant("tenant-a")
+	ts.clock.Advance(time.Hour)
+	ts.addPlayers("tenant-a", "alice")
+
+	// Webhookの配送を積んだ時刻と比べられるように、イベントの時刻もServerの時計で記録する
+	tenantID, err := strconv.ParseInt(tenant.ID, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantDB, err := ts.s.connectToTenantDB(context.Background(), tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenantDB.Close()
+	var createdAt int64
+	if err := tenantDB.Get(&createdAt, "SELECT created_at FROM domain_event WHERE type = ?", DomainEventPlayerAdded); err != nil {
+		t.Fatal(err)
+	}
+	if want := ts.clock.Now().Unix(); createdAt != want {
+		t.Errorf("domain_event.created_at: want %d, got %d", want, createdAt)
+	}
+}
+
+type testDomainEventSink struct {
+	events []string
+	handle func(ev *DomainEventRow) error
+}
+
+func (s *testDomainEventSink) Name() string {
+	return "testDomainEventSink"
+}
+
+func (s *testDomainEventSink) HandleDomainEvent(ctx context.Context, ev *DomainEventRow) error {
+	if s.handle != nil {
+		if err := s.handle(ev); err != nil {
+			return err
+		}
+	}
+	s.events = append(s.events, ev.Type)
+	return nil
+}
+
+func TestDispatchOutbox(t *testing.T) {
+	ts := newTestServer(t)
+	ctx := context.Background()
+	tenant := ts.addTenant("tenant-a")
+	ts.addTenant("tenant-b")
+	tenantID, err := strconv.ParseInt(tenant.ID, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pending := func() []int64 {
+		ids := []int64{}
+		if err := ts.s.adminDB.SelectContext(ctx, &ids, "SELECT tenant_id FROM domain_event_outbox ORDER BY tenant_id"); err != nil {
+			t.Fatal(err)
+		}
+		return ids
+	}
+
+	// 未配送のイベントがあるテナントだけが管理用DBに記録され、定期的な確認の対象になる
+	ts.addPlayers("tenant-a", "alice")
+	if got := pending(); len(got) != 1 || got[0] != tenantID {
+		t.Fatalf("pending outboxes: want [%d], got %v", tenantID, got)
+	}
+	ts.s.domainEvents.takeDirty()
+	if err := ts.s.domainEvents.sweep(ctx, ts.s.adminDB); err != nil {
+		t.Fatal(err)
+	}
+	if ids, _ := ts.s.domainEvents.takeDirty(); len(ids) != 2 {
+		t.Errorf("swept outboxes: want admin and tenant-a, got %v", ids)
+	}
+
+	// 配送中に書き込まれたイベントがあれば、記録は残して次の確認で配送する
+	sink := &testDomainEventSink{handle: func(ev *DomainEventRow) error {
+		return ts.s.markOutboxPending(ctx, tenantID)
+	}}
+	if err := ts.s.dispatchOutbox(ctx, tenantID, []domainEventSink{sink}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 1 || sink.events[0] != DomainEventPlayerAdded {
+		t.Errorf("dispatched events: want [%s], got %v", DomainEventPlayerAdded, sink.events)
+	}
+	if got := pending(); len(got) != 1 {
+		t.Fatalf("pending outboxes: want [%d], got %v", tenantID, got)
+	}
+
+	// 配送しきったら記録を消し、配送したイベントは送り直さない
+	sink = &testDomainEventSink{}
+	if err := ts.s.dispatchOutbox(ctx, tenantID, []domainEventSink{sink}); err != nil {
+		t.Fatal(err)
+	}
+	if len(sink.events) != 0 {
+		t.Errorf("dispatched events: want none, got %v", sink.events)
+	}
+	if got := pending(); len(got) != 0 {
+		t.Errorf("pending outboxes: want none, got %v", got)
+	}
+
+	// 配送に失敗したイベントは記録を残して再送する
+	ts.addPlayers("tenant-a", "bob")
+	sink = &testDomainEventSink{handle: func(ev *DomainEventRow) error {
+		return errors.New("unavailable")
+	}}
+	if err := ts.s.dispatchOutbox(ctx, tenantID, []domainEventSink{sink}); err == nil {
+		t.Fatal("dispatchOutbox: want error, got nil")
+	}
+	if got := pending(); len(got) != 1 {
+		t.Errorf("pending outboxes: want [%d], got %v", tenantID, got)
+	}
+
+	// Webhookには購読しているイベントだけを積む
+	if _, err := ts.s.adminDB.ExecContext(
+		ctx,
+		"INSERT INTO webhook_endpoint (tenant_id, url, secret, events, created_at, updated_at) VALUES (?, ?, ?, ?, 0, 0)",
+		tenantID, "http://203.0.113.10/hook", "secret", WebhookEventPlayerAdded,
+	); err != nil {
+		t.Fatal(err)
+	}
+	ts.addPlayers("tenant-a", "carol")
+	ts.addCompetition("tenant-a", "c1")
+	if err := ts.s.dispatchOutbox(ctx, tenantID, []domainEventSink{webhookDomainEventSink{s: ts.s}}); err != nil {
+		t.Fatal(err)
+	}
+	var events []string
+	if err := ts.s.adminDB.SelectContext(ctx, &events, "SELECT event FROM webhook_delivery WHERE tenant_id = ? ORDER BY id", tenantID); err != nil {
+		t.Fatal(err)
+	}
+	if strings.Join(events, ",") != WebhookEventPlayerAdded+","+WebhookEventPlayerAdded {
+		t.Errorf("webhook deliveries: want 2 %s, got %v", WebhookEventPlayerAdded, events)
+	}
+}
+
+func TestWebhookClock(t *testing.T) {
+	ts := newTestServer(t)
+	var timestamp, signature string
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		timestamp = r.Header.Get(webhookTimestampHeader)
+		signature = r.Header.Get(webhookSignatureHeader)
+	}))
+	defer receiver.Close()
+
+	// 署名する時刻もServerの時計で決める
+	ts.clock.Advance(time.Hour)
+	payload := []byte("{}")
+	if _, err := ts.s.sendWebhook(context.Background(), &WebhookEndpointRow{URL: receiver.URL, Secret: "secret"}, 1, WebhookEventPing, payload); err != nil {
+		t.Fatal(err)
+	}
+	now := ts.s.now()
+	if timestamp != strconv.FormatInt(now, 10) {
+		t.Errorf("timestamp: want %d, got %s", now, timestamp)
+	}
+	if want := signWebhookPayload("secret", now, payload); signature != want {
+		t.Errorf("signature: want %s, got %s", want, signature)
+	}
+}
+
+func TestDataVersionClock(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.addTenant("tenant-a")
+	ts.clock.Advance(time.Hour)
+	ts.addCompetition("tenant-a", "first")
+
+	tenantID, err := strconv.ParseInt(tenant.ID, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantDB, err := ts.s.connectToTenantDB(context.Background(), tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenantDB.Close()
+	var updatedAt int64
+	if err := tenantDB.Get(&updatedAt, "SELECT updated_at FROM data_version WHERE name = ?", dataVersionCompetitions); err != nil {
+		t.Fatal(err)
+	}
+	if want := ts.clock.Now().Unix(); updatedAt != want {
+		t.Errorf("data_version.updated_at: want %d, got %d", want, updatedAt)
+	}
+}
+
+func TestDispatchWebhooks(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+
+	// 2つの配送先が両方とも呼ばれるまで応答しないので、順番に送ると終わらない
+	var arrived sync.WaitGroup
+	arrived.Add(2)
+	var calls int64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt64(&calls, 1) <= 2 {
+			arrived.Done()
+			arrived.Wait()
+		}
+	}))
+	defer receiver.Close()
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+
+	webhookIDs := []string{}
+	for _, u := range []string{receiver.URL, receiver.URL, receiver.URL, failing.URL} {
+		var added WebhooksAddHandlerResult
+		decodeData(t, ts.postForm("tenant-a", "/api/organizer/webhooks/add", org, url.Values{"url": {u}}), http.StatusOK, &added)
+		webhookIDs = append(webhookIDs, added.Webhook.ID)
+	}
+	// 削除された配送先への配送があっても、他の配送は続ける
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/webhook/"+webhookIDs[2]+"/delete", org, nil), http.StatusOK, nil)
+
+	now := ts.s.now()
+	for i, id := range webhookIDs {
+		webhookID, _ := strconv.ParseInt(id, 10, 64)
+		if _, err := ts.s.adminDB.ExecContext(
+			context.Background(),
+			"INSERT INTO webhook_delivery (tenant_id, webhook_id, event_id, event, payload, status, attempts, next_attempt_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, 0, ?, ?, ?)",
+			tenant.ID, webhookID, fmt.Sprintf("event-%d", i), WebhookEventPing, "{}", WebhookDeliveryStatusPending, now, now, now,
+		); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dispatch := func(now int64) {
+		t.Helper()
+		done := make(chan error, 1)
+		go func() { done <- ts.s.dispatchWebhooks(context.Background(), now, ts.e.Logger) }()
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(webhookRequestTimeout / 2):
+			t.Fatal("dispatchWebhooks did not send webhooks in parallel")
+		}
+	}
+	deliveriesOf := func(id string) []WebhookDeliveryDetail {
+		t.Helper()
+		var res WebhookDeliveriesHandlerResult
+		decodeData(t, ts.get("tenant-a", "/api/organizer/webhook/"+id+"/deliveries", org), http.StatusOK, &res)
+		return res.Deliveries
+	}
+	dispatch(now)
+	for i, id := range webhookIDs[:2] {
+		if ds := deliveriesOf(id); len(ds) != 1 || ds[0].Status != WebhookDeliveryStatusSucceeded {
+			t.Errorf("webhook %d deliveries: want 1 succeeded, got %+v", i, ds)
+		}
+	}
+
+	// 失敗した配送は間隔を空けて再送し、上限に達したら諦める
+	ds := deliveriesOf(webhookIDs[3])
+	if len(ds) != 1 || ds[0].Status != WebhookDeliveryStatusPending || ds[0].Attempts != 1 {
+		t.Fatalf("failed delivery: want pending after 1 attempt, got %+v", ds)
+	}
+	next := ds[0].NextAttemptAt
+	if want := now + int64(webhookRetryBaseDelay.Seconds()); next < want {
+		t.Errorf("next_attempt_at: want >= %d, got %d", want, next)
+	}
+	dispatch(next - 1)
+	if ds := deliveriesOf(webhookIDs[3]); ds[0].Attempts != 1 {
+		t.Errorf("retried before next_attempt_at: %+v", ds[0])
+	}
+	if _, err := ts.s.adminDB.ExecContext(context.Background(), "UPDATE webhook_delivery SET attempts = ? WHERE event_id = ?", webhookMaxAttempts-1, "event-3"); err != nil {
+		t.Fatal(err)
+	}
+	dispatch(next)
+	if ds := deliveriesOf(webhookIDs[3]); ds[0].Status != WebhookDeliveryStatusFailed || ds[0].Attempts != webhookMaxAttempts {
+		t.Errorf("failed delivery: want failed after %d attempts, got %+v", webhookMaxAttempts, ds[0])
+	}
+}
+
+func TestOrganizersAPI(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.addTenant("tenant-a")
+	owner := organizerOf("tenant-a")
+
+	var added OrganizerHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/organizers/add", owner, url.Values{
+		"display_name": {"staff"},
+		"permission[]": {PermissionManagePlayers, PermissionManagePlayers},
+	}), http.StatusOK, &added)
+	if added.Organizer.CreatedBy != OrganizerOwnerID || len(added.Organizer.Permissions) != 1 {
+		t.Fatalf("unexpected organizer: %+v", added.Organizer)
+	}
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/organizers/add", owner, url.Values{
+		"display_name": {"staff"},
+		"permission[]": {"superuser"},
+	}), http.StatusBadRequest, nil)
+	staff := &testUser{tenant: "tenant-a", role: RoleOrganizer, sub: added.Organizer.ID}
+
+	// 権限のない操作はできない。一覧の閲覧は権限がなくてもできる
+	var players PlayersAddHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/players/add", staff, url.Values{"display_name[]": {"alice"}}), http.StatusOK, &players)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competitions/add", staff, url.Values{"title": {"c1"}}), http.StatusForbidden, nil)
+	decodeData(t, ts.get("tenant-a", "/api/organizer/billing", staff), http.StatusForbidden, nil)
+	decodeData(t, ts.get("tenant-a", "/api/organizer/competitions", staff), http.StatusOK, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/organizers/add", staff, url.Values{"display_name": {"x"}}), http.StatusForbidden, nil)
+
+	// 書き込んだ主催者が記録される
+	tenantID, err := strconv.ParseInt(tenant.ID, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tenantDB, err := ts.s.connectToTenantDB(context.Background(), tenantID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tenantDB.Close()
+	p, err := retrievePlayer(context.Background(), tenantDB, players.Players[0].ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.CreatedBy != staff.sub || p.UpdatedBy != staff.sub {
+		t.Errorf("audit: want %s, got created_by=%s updated_by=%s", staff.sub, p.CreatedBy, p.UpdatedBy)
+	}
+
+	var updated OrganizerHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/organizer/"+staff.sub+"/update", owner, url.Values{
+		"permission[]": {PermissionManageCompetitions},
+	}), http.StatusOK, &updated)
+	if updated.Organizer.DisplayName != "staff" || len(updated.Organizer.Permissions) != 1 || updated.Organizer.Permissions[0] != PermissionManageCompetitions {
+		t.Fatalf("unexpected organizer: %+v", updated.Organizer)
+	}
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competitions/add", staff, url.Values{"title": {"c1"}}), http.StatusOK, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/players/add", staff, url.Values{"display_name[]": {"bob"}}), http.StatusForbidden, nil)
+
+	var list OrganizersHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/organizers", owner), http.StatusOK, &list)
+	if len(list.Organizers) != 1 {
+		t.Errorf("organizers: want 1, got %d", len(list.Organizers))
+	}
+
+	// 所有者は変更できない。削除した主催者のJWTは使えない
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/organizer/"+OrganizerOwnerID+"/delete", owner, nil), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/organizer/"+staff.sub+"/delete", owner, nil), http.StatusOK, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/organizer/"+staff.sub+"/delete", owner, nil), http.StatusNotFound, nil)
+	decodeData(t, ts.get("tenant-a", "/api/organizer/competitions", staff), http.StatusUnauthorized, nil)
+}
+
+func TestAPITokensAPI(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	ts.addTenant("tenant-b")
+	owner := organizerOf("tenant-a")
+	players := ts.addPlayers("tenant-a", "alice")
+	c1 := ts.addCompetition("tenant-a", "c1")
+	c2 := ts.addCompetition("tenant-a", "c2")
+	expiresAt := fmt.Sprint(ts.clock.Now().Add(time.Hour).Unix())
+
+	var added APITokensAddHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/api_tokens/add", owner, url.Values{
+		"name":           {"uploader"},
+		"scope[]":        {APITokenScopeScoresWrite},
+		"competition_id": {c1.ID},
+		"expires_at":     {expiresAt},
+	}), http.StatusOK, &added)
+	if !strings.HasPrefix(added.Token, apiTokenPrefix) || added.APIToken.CompetitionID == nil || *added.APIToken.CompetitionID != c1.ID {
+		t.Fatalf("unexpected api token: %+v", added)
+	}
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/api_tokens/add", owner, url.Values{
+		"name": {"x"}, "scope[]": {"tenant:write"}, "expires_at": {expiresAt},
+	}), http.StatusBadRequest, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/api_tokens/add", owner, url.Values{
+		"name": {"x"}, "scope[]": {APITokenScopeScoresWrite}, "expires_at": {fmt.Sprint(ts.clock.Now().Unix())},
+	}), http.StatusBadRequest, nil)
+
+	// スコープと大会の範囲でだけ使える
+	bot := &testUser{tenant: "tenant-a", bearer: added.Token}
+	scores := fmt.Sprintf("player_id,score\n%s,100\n", players[0].ID)
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/competition/"+c1.ID+"/score", bot, "scores", scores, nil), http.StatusOK, nil)
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/competition/"+c2.ID+"/score", bot, "scores", scores, nil), http.StatusForbidden, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/players/add", bot, url.Values{"display_name[]": {"bob"}}), http.StatusForbidden, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/api_tokens/add", bot, url.Values{"name": {"x"}}), http.StatusForbidden, nil)
+	decodeData(t, ts.postFile("tenant-b", "/api/organizer/competition/"+c1.ID+"/score", &testUser{tenant: "tenant-b", bearer: added.Token}, "scores", scores, nil), http.StatusUnauthorized, nil)
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/competition/"+c1.ID+"/score", &testUser{tenant: "tenant-a", bearer: "isp_unknown"}, "scores", scores, nil), http.StatusUnauthorized, nil)
+	// 権限の要らない閲覧もできない
+	for _, target := range []string{
+		"/api/organizer/players",
+		"/api/organizer/competitions",
+		"/api/organizer/webhooks",
+		"/api/organizer/webhook/1/deliveries",
+		"/api/organizer/organizers",
+		"/api/organizer/api_tokens",
+	} {
+		decodeData(t, ts.get("tenant-a", target, bot), http.StatusForbidden, nil)
+	}
+
+	var list APITokensHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/api_tokens", owner), http.StatusOK, &list)
+	if len(list.APITokens) != 1 || list.APITokens[0].LastUsedAt == nil || list.APITokens[0].CreatedBy != OrganizerOwnerID {
+		t.Fatalf("unexpected api tokens: %+v", list.APITokens)
+	}
+	if strings.Contains(ts.get("tenant-a", "/api/organizer/api_tokens", owner).Body.String(), added.Token) {
+		t.Errorf("api token is listed")
+	}
+
+	// 監査ログにはトークンを作った主催者ではなく、トークンでの操作として記録する
+	var audit AuditLogsHandlerResult
+	decodeData(t, ts.get("admin", "/api/admin/audit_logs?actor=token:"+added.APIToken.ID, testAdmin), http.StatusOK, &audit)
+	if len(audit.AuditLogs) != 1 || audit.AuditLogs[0].Action != "POST /api/organizer/competition/:competition_id/score" {
+		t.Errorf("unexpected audit logs: %+v", audit.AuditLogs)
+	}
+
+	// 大会を指定したトークンは、大会を指定しない操作にはスコープがあっても使えない
+	// 請求額はその大会の分だけ返す
+	var scoped APITokensAddHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/api_tokens/add", owner, url.Values{
+		"name":           {"c1"},
+		"scope[]":        {APITokenScopePlayersWrite, APITokenScopeCompetitionsWrite, APITokenScopeBillingRead},
+		"competition_id": {c1.ID},
+		"expires_at":     {expiresAt},
+	}), http.StatusOK, &scoped)
+	c1bot := &testUser{tenant: "tenant-a", bearer: scoped.Token}
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/players/add", c1bot, url.Values{"display_name[]": {"bob"}}), http.StatusForbidden, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/player/"+players[0].ID+"/update", c1bot, url.Values{"display_name": {"bob"}}), http.StatusForbidden, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competitions/add", c1bot, url.Values{"title": {"c3"}}), http.StatusForbidden, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+c2.ID+"/update", c1bot, url.Values{"title": {"c3"}}), http.StatusForbidden, nil)
+	var billing BillingHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/billing", c1bot), http.StatusOK, &billing)
+	if len(billing.Reports) != 1 || billing.Reports[0].CompetitionID != c1.ID {
+		t.Errorf("unexpected billing reports: %+v", billing.Reports)
+	}
+	decodeData(t, ts.get("tenant-a", "/api/organizer/billing", owner), http.StatusOK, &billing)
+	if len(billing.Reports) != 2 {
+		t.Errorf("billing reports: want 2, got %d", len(billing.Reports))
+	}
+
+	// 期限切れと失効
+	ts.clock.Advance(2 * time.Hour)
+	decodeData(t, ts.postFile("tenant-a", "/api/organizer/competition/"+c1.ID+"/score", bot, "scores", scores, nil), http.StatusUnauthorized, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/api_token/"+added.APIToken.ID+"/revoke", owner, nil), http.StatusOK, nil)
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/api_token/"+added.APIToken.ID+"/revoke", owner, nil), http.StatusNotFound, nil)
+}
+
+func TestSeasonsAPI(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+	players := ts.addPlayers("tenant-a", "alice", "bob")
+	comp1 := ts.addCompetition("tenant-a", "first")
+	comp2 := ts.addCompetition("tenant-a", "second")
+	ts.uploadScores("tenant-a", comp1.ID, map[string]int64{players[0].ID: 10, players[1].ID: 20})
+	ts.uploadScores("tenant-a", comp2.ID, map[string]int64{players[0].ID: 30, players[1].ID: 20})
+
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/seasons/add", org, url.Values{
+		"title":            {"season 1"},
+		"competition_id[]": {comp1.ID, comp2.ID},
+		"points[]":         {"10", "-1"},
+	}), http.StatusBadRequest, nil)
+	var added SeasonsAddHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/seasons/add", org, url.Values{
+		"title":            {"season 1"},
+		"competition_id[]": {comp1.ID, comp2.ID},
+		"points[]":         {"10", "3"},
+	}), http.StatusOK, &added)
+	if len(added.Season.Competitions) != 2 {
+		t.Fatalf("season competitions: want 2, got %d", len(added.Season.Competitions))
+	}
+
+	var seasons SeasonsHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/organizer/seasons", org), http.StatusOK, &seasons)
+	if len(seasons.Seasons) != 1 {
+		t.Errorf("organizer seasons: want 1, got %d", len(seasons.Seasons))
+	}
+	decodeData(t, ts.get("tenant-a", "/api/player/seasons", playerOf("tenant-a", players[0].ID)), http.StatusOK, &seasons)
+	if len(seasons.Seasons) != 1 {
+		t.Errorf("player seasons: want 1, got %d", len(seasons.Seasons))
+	}
+
+	// 同点なので大会での最高順位が同じになり、参加者IDの昇順になる
+	var ranking SeasonRankingHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/player/season/"+added.Season.ID+"/ranking", playerOf("tenant-a", players[0].ID)), http.StatusOK, &ranking)
+	if len(ranking.Ranks) != 2 || ranking.Ranks[0].Points != 13 || ranking.Ranks[0].PlayerID != players[0].ID {
+		t.Errorf("unexpected season ranking: %+v", ranking.Ranks)
+	}
+	decodeData(t, ts.get("tenant-a", "/api/player/season/"+added.Season.ID+"/ranking?rank_after=1", playerOf("tenant-a", players[0].ID)), http.StatusOK, &ranking)
+	if len(ranking.Ranks) != 1 || ranking.Ranks[0].PlayerID != players[1].ID {
+		t.Errorf("unexpected season ranking after 1: %+v", ranking.Ranks)
+	}
+	decodeData(t, ts.get("tenant-a", "/api/player/season/"+added.Season.ID+"/ranking?rank_after=x", playerOf("tenant-a", players[0].ID)), http.StatusBadRequest, nil)
+}
+
+func TestSeasonRanking(t *testing.T) {
+	ranks := seasonRanking([]int64{10, 3}, [][]CompetitionRank{
+		{
+			{Rank: 1, PlayerID: "b", PlayerDisplayName: "bob"},
+			{Rank: 2, PlayerID: "a", PlayerDisplayName: "alice"},
+			{Rank: 3, PlayerID: "c", PlayerDisplayName: "carol"},
+		},
+		{
+			{Rank: 1, PlayerID: "a", PlayerDisplayName: "alice"},
+			{Rank: 2, PlayerID: "b", PlayerDisplayName: "bob"},
+		},
+	})
+	// aとbは同点で最高順位も同じなので、参加者IDの昇順になる
+	// ポイント表より下の順位はポイントなし
+	want := []SeasonRank{
+		{Rank: 1, Points: 13, PlayerID: "a", PlayerDisplayName: "alice", Competitions: 2, BestRank: 1},
+		{Rank: 2, Points: 13, PlayerID: "b", PlayerDisplayName: "bob", Competitions: 2, BestRank: 1},
+		{Rank: 3, Points: 0, PlayerID: "c", PlayerDisplayName: "carol", Competitions: 1, BestRank: 3},
+	}
+	if len(ranks) != len(want) {
+		t.Fatalf("ranks: want %d, got %d", len(want), len(ranks))
+	}
+	for i := range want {
+		if ranks[i] != want[i] {
+			t.Errorf("rank %d: want %+v, got %+v", i, want[i], ranks[i])
+		}
+	}
+}
+
+func TestPlayerAPI(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	ts.addTenant("tenant-b")
+	players := ts.addPlayers("tenant-a", "alice", "bob")
+	alice := playerOf("tenant-a", players[0].ID)
+	comp := ts.addCompetition("tenant-a", "first")
+	ts.uploadScores("tenant-a", comp.ID, map[string]int64{players[0].ID: 10, players[1].ID: 20})
+
+	var player PlayerHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/player/player/"+players[1].ID, alice), http.StatusOK, &player)
+	if player.Player.DisplayName != "bob" || len(player.Scores) != 1 || player.Scores[0].Score != 20 {
+		t.Errorf("unexpected player: %+v", player)
+	}
+	decodeData(t, ts.get("tenant-b", "/api/player/player/"+players[1].ID, alice), http.StatusUnauthorized, nil)
+
+	var ranking CompetitionRankingHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/player/competition/"+comp.ID+"/ranking?rank_after=1", alice), http.StatusOK, &ranking)
+	if len(ranking.Ranks) != 1 || ranking.Ranks[0].Rank != 2 {
+		t.Errorf("unexpected ranking: %+v", ranking.Ranks)
+	}
+
+	var competitions CompetitionsHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/player/competitions", alice), http.StatusOK, &competitions)
+	if len(competitions.Competitions) != 1 {
+		t.Errorf("competitions: want 1, got %d", len(competitions.Competitions))
+	}
+
+	// 終了した大会のストリームはsnapshotとfinishedを送って閉じる
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+comp.ID+"/finish", organizerOf("tenant-a"), nil), http.StatusOK, nil)
+	rec := ts.get("tenant-a", "/api/player/competition/"+comp.ID+"/ranking/stream", alice)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status code: want 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if body := rec.Body.String(); !strings.Contains(body, "event: snapshot\n") || !strings.Contains(body, "event: finished\n") {
+		t.Errorf("unexpected stream: %s", body)
+	}
+
+	var me MeHandlerResult
+	decodeData(t, ts.get("tenant-a", "/api/me", alice), http.StatusOK, &me)
+	if !me.LoggedIn || me.Me == nil || me.Me.ID != players[0].ID || me.Tenant.Name != "tenant-a" {
+		t.Errorf("unexpected me: %+v", me)
+	}
+	decodeData(t, ts.get("tenant-a", "/api/me", testAnonymous), http.StatusOK, &me)
+	if me.LoggedIn {
+		t.Errorf("anonymous user is logged in: %+v", me)
+	}
+}
+
+func TestDiffCompetitionRanks(t *testing.T) {
+	prev := []CompetitionRank{
+		{Rank: 1, Score: 30, PlayerID: "a", PlayerDisplayName: "alice"},
+		{Rank: 2, Score: 20, PlayerID: "b", PlayerDisplayName: "bob"},
+		{Rank: 3, Score: 10, PlayerID: "c", PlayerDisplayName: "carol"},
+	}
+	next := []CompetitionRank{
+		{Rank: 1, Score: 30, PlayerID: "a", PlayerDisplayName: "alice"},
+		{Rank: 2, Score: 25, PlayerID: "d", PlayerDisplayName: "dave"},
+		{Rank: 3, Score: 20, PlayerID: "b", PlayerDisplayName: "bob"},
+	}
+	upserts, removes := diffCompetitionRanks(prev, next)
+	ids := []string{}
+	for _, r := range upserts {
+		ids = append(ids, r.PlayerID)
+	}
+	if strings.Join(ids, ",") != "d,b" {
+		t.Errorf("upserts: want d,b, got %v", ids)
+	}
+	if strings.Join(removes, ",") != "c" {
+		t.Errorf("removes: want c, got %v", removes)
+	}
+}
+
+func TestRankingStream(t *testing.T) {
+	ts := newTestServer(t)
+	tenant := ts.addTenant("tenant-a")
+	org := organizerOf("tenant-a")
+	ctx := context.Background()
+	tenantID, err := strconv.ParseInt(tenant.ID, 10, 64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	players := ts.addPlayers("tenant-a", "alice", "bob")
+	alice := playerOf("tenant-a", players[0].ID)
+	endAt := ts.clock.Now().Add(time.Minute).Unix()
+	var scheduled CompetitionsAddHandlerResult
+	decodeData(t, ts.postForm("tenant-a", "/api/organizer/competitions/add", org, url.Values{
+		"title": {"scheduled"}, "end_at": {fmt.Sprint(endAt)},
+	}), http.StatusOK, &scheduled)
+	manual := ts.addCompetition("tenant-a", "manual")
+	ts.uploadScores("tenant-a", manual.ID, map[string]int64{players[0].ID: 10, players[1].ID: 20})
+
+	// 購読者には大会の終了のドメインイベントを配送したときにランキングが配信される
+	sink := &testDomainEventSink{handle: func(ev *DomainEventRow) error {
+		return ts.s.publishRankingOnDomainEvent(ctx, ev)
+	}}
+	for id, finish := range map[string]func(){
+		manual.ID: func() {
+			decodeData(t, ts.postForm("tenant-a", "/api/organizer/competition/"+manual.ID+"/finish", org, nil), http.StatusOK, nil)
+		},
+		scheduled.Competition.ID: func() {
+			if err := ts.s.finishEndedCompetitions(ctx, endAt, ts.e.Logger); err != nil {
+				t.Fatal(err)
+			}
+		},
+	} {
+		topic := rankingTopic{tenantID: tenantID, competitionID: id}
+		sub := ts.s.rankingStreamHub.subscribe(topic)
+		finish()
+		if err := ts.s.dispatchOutbox(ctx, tenantID, []domainEventSink{sink}); err != nil {
+			t.Fatal(err)
+		}
+		ts.s.rankingStreamHub.unsubscribe(topic, sub)
+		snap := sub.take()
+		if snap == nil || !snap.Competition.IsFinished {
+			t.Errorf("finished ranking is not published: %s, %+v", id, snap)
+		}
+	}
+
+	// 終了した大会を購読すると、現在のランキングを送って切断する
+	rec := ts.get("tenant-a", "/api/player/competition/"+manual.ID+"/ranking/stream?rank_after=1", alice)
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderContentType) != "text/event-stream" {
+		t.Fatalf("unexpected response: %d %s", rec.Code, rec.Body)
+	}
+	body := rec.Body.String()
+	if !strings.HasPrefix(body, "event: snapshot\n") || !strings.Contains(body, "\nevent: finished\n") {
+		t.Errorf("unexpected stream: %s", body)
+	}
+	if !strings.Contains(body, `"player_id":"`+players[0].ID+`"`) || strings.Contains(body, `"player_id":"`+players[1].ID+`"`) {
+		t.Errorf("rank_after is not applied: %s", body)
+	}
+	decodeData(t, ts.get("tenant-a", "/api/player/competition/unknown/ranking/stream", alice), http.StatusNotFound, nil)
+	decodeData(t, ts.get("tenant-a", "/api/player/competition/"+manual.ID+"/ranking/stream?rank_after=x", alice), http.StatusBadRequest, nil)
+}
+
+func TestMonitoringAPI(t *testing.T) {
+	ts := newTestServer(t)
+
+	decodeData(t, ts.get("admin", "/healthz", testAnonymous), http.StatusOK, nil)
+
+	var ready ReadyzHandlerResult
+	decodeData(t, ts.get("admin", "/readyz", testAnonymous), http.StatusOK, &ready)
+	if !ready.Ready {
+		t.Errorf("not ready: %+v", ready)
+	}
+	// JWTの公開鍵を読み込めていなければリクエストを受け付けられない
+	noKey := newTestServer(t, func(o *ServerOptions) { o.KeySource = staticKeySource{} })
+	decodeData(t, noKey.get("admin", "/readyz", testAnonymous), http.StatusServiceUnavailable, &ready)
+	if ready.Ready || ready.Checks[len(ready.Checks)-1].Name != "jwt_key" {
+		t.Errorf("unexpected readiness: %+v", ready)
+	}
+
+	decodeData(t, ts.get("admin", "/metrics", testAnonymous), http.StatusUnauthorized, nil)
+	rec := ts.get("admin", "/metrics", testAdmin)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("unexpected metrics: %d %s", rec.Code, rec.Body.String())
+	}
+	for _, name := range []string{"isuports_http_requests_total", "isuports_score_imports_in_flight 0", "isuports_player_imports_in_flight 0"} {
+		if !strings.Contains(rec.Body.String(), name) {
+			t.Errorf("metrics: %s not found", name)
+		}
+	}
+
+	var initialized InitializeHandlerResult
+	decodeData(t, ts.postForm("admin", "/initialize", testAnonymous, nil), http.StatusOK, &initialized)
+	if initialized.Lang != "go" {
+		t.Errorf("lang: want go, got %s", initialized.Lang)
+	}
+}
+
+func TestHealthCheck(t *testing.T) {
+	ts := newTestServer(t)
+	readyz := func() (int, ReadyzHandlerResult) {
+		t.Helper()
+		rec := ts.get("admin", "/readyz", testAnonymous)
+		var res struct {
+			Data ReadyzHandlerResult `json:"data"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil {
+			t.Fatalf("%s: %s", err, rec.Body.String())
+		}
+		return rec.Code, res.Data
+	}
+
+	for _, tc := range []struct {
+		name string
+		flag *int32
+	}{
+		{"initialize", &ts.s.initializing},
+		{"shutdown", &ts.s.shuttingDown},
+	} {
+		atomic.StoreInt32(tc.flag, 1)
+		code, res := readyz()
+		atomic.StoreInt32(tc.flag, 0)
+		failed := ""
+		for _, c := range res.Checks {
+			if !c.OK {
+				failed = c.Name
+			}
+		}
+		if code != http.StatusServiceUnavailable || res.Ready || failed != tc.name {
+			t.Errorf("readyz during %s: want 503 with failed check, got %d %+v", tc.name, code, res)
+		}
+	}
+	// プロセスは生きているのでhealthzは成功する
+	atomic.StoreInt32(&ts.s.shuttingDown, 1)
+	decodeData(t, ts.get("admin", "/healthz", testAnonymous), http.StatusOK, nil)
+	atomic.StoreInt32(&ts.s.shuttingDown, 0)
+	if code, res := readyz(); code != http.StatusOK || !res.Ready {
+		t.Errorf("readyz: want ready, got %d %+v", code, res)
+	}
+}
+
+func TestMetricsAccess(t *testing.T) {
+	ts := newTestServer(t)
+	ts.addTenant("tenant-a")
+	decodeData(t, ts.get("tenant-a", "/api/organizer/competitions", organizerOf("tenant-a")), http.StatusOK, nil)
+
+	for _, tc := range []struct {
+		name       string
+		remoteAddr string
+		host       string
+		u          *testUser
+		header     http.Header
+		want       int
+	}{
+		{"internal", "10.0.0.2:40000", testAdminHostname, testAnonymous, nil, http.StatusOK},
+		{"loopback", "127.0.0.1:40000", testAdminHostname, testAnonymous, nil, http.StatusOK},
+		{"external anonymous", "192.0.2.1:40000", testAdminHostname, testAnonymous, nil, http.StatusUnauthorized},
+		{"forwarded anonymous", "10.0.0.2:40000", testAdminHostname, testAnonymous, http.Header{"X-Forwarded-For": {"192.0.2.1"}}, http.StatusUnauthorized},
+		{"external organizer", "192.0.2.1:40000", "tenant-a" + testBaseHostname, organizerOf("tenant-a"), nil, http.StatusForbidden},
+		{"external admin", "192.0.2.1:40000", testAdminHostname, testAdmin, nil, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+		req.Host = tc.host
+		req.RemoteAddr = tc.remoteAddr
+		if tc.u != nil {
+			req.AddCookie(&http.Cookie{Name: cookieName, Value: ts.token(tc.u)})
+		}
+		for k, v := range tc.header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		ts.e.ServeHTTP(rec, req)
+		if rec.Code != tc.want {
+			t.Errorf("%s: want %d, got %d %s", tc.name, tc.want, rec.Code, rec.Body.String())
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			continue
+		}
+		for _, name := range []string{
+			`isuports_http_requests_total{method="GET",route="/api/organizer/competitions",status="200"}`,
+			"isuports_score_imports_in_flight 0",
+			"isuports_player_imports_in_flight 0",
+		} {
+			if !strings.Contains(rec.Body.String(), name) {
+				t.Errorf("%s: %s not found in metrics", tc.name, name)
+			}
+		}
+	}
+}
+
+func TestRequestLogging(t *testing.T) {
+	ts := newTestServer(t, func(o *ServerOptions) { o.JSONLogFormat = true })
+	ts.addTenant("tenant-a")
+	var logs bytes.Buffer
+	ts.e.Logger.SetOutput(&logs)
+	ts.e.Logger.SetHeader(`{"level":"${level}"}`)
+	ts.e.Logger.SetLevel(log.INFO)
+
+	// 指定されたリクエストIDはそのまま返し、ログにも出力する
+	req := httptest.NewRequest(http.MethodGet, "/api/organizer/competitions", nil)
+	req.Host = "tenant-a" + testBaseHostname
+	req.AddCookie(&http.Cookie{Name: cookieName, Value: ts.token(organizerOf("tenant-a"))})
+	req.Header.Set(echo.HeaderXRequestID, "req-1.a_b")
+	rec := httptest.NewRecorder()
+	ts.e.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Header().Get(echo.HeaderXRequestID) != "req-1.a_b" {
+		t.Fatalf("want 200 with X-Request-ID req-1.a_b, got %d %q", rec.Code, rec.Header().Get(echo.HeaderXRequestID))
+	}
+	var access map[string]any
+	if err := json.Unmarshal(logs.Bytes(), &access); err != nil {
+		t.Fatalf("access log is not JSON: %s", logs.String())
+	}
+	for k, want := range map[string]any{
+		"message":    "request",
+		"request_id": "req-1.a_b",
+		"route":      "/api/organizer/competitions",
+		"tenant":     "tenant-a",
+		"role":       RoleOrganizer,
+		"status":     float64(http.StatusOK),
+	} {
+		if access[k] != want {
+			t.Errorf("access log %s: want %v, got %v", k, want, access[k])
+		}
+	}
+
+	// 受け付けない形式のリクエストIDは採番し直し、エラーレスポンスにも含める
+	for _, id := range []string{"", "bad id", strings.Repeat("a", 129)} {
+		req := httptest.NewRequest(http.MethodGet, "/api/organizer/competitions", nil)
+		req.Host = "tenant-a" + testBaseHostname
+		req.Header.Set(echo.HeaderXRequestID, id)
+		rec := httptest.NewRecorder()
+		ts.e.ServeHTTP(rec, req)
+		got := rec.Header().Get(echo.HeaderXRequestID)
+		if got == id || !requestIDRegexp.MatchString(got) {
+			t.Errorf("X-Request-ID %q: got %q", id, got)
+		}
+		var res FailureResult
+		if err := json.Unmarshal(rec.Body.Bytes(), &res); err != nil || rec.Code != http.StatusUnauthorized || res.RequestID != got {
+			t.Errorf("X-Request-ID %q: want 401 with request_id %s, got %d %s", id, got, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestSQLQueryLogger(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "trace.json")
+	logger, err := newSQLQueryLogger(path, SQLTraceConfig{MaxSize: 300, MaxBackups: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer logger.Close()
+
+	// リクエストの中で実行したクエリにはリクエストの情報が付く
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set(echo.HeaderXRequestID, "req-1")
+	c := echo.New().NewContext(req, httptest.NewRecorder())
+	c.SetPath("/api/player/competition/:competition_id/ranking")
+	var ctx context.Context
+	if err := SetRequestInfo(func(c echo.Context) error {
+		setRequestTenantID(c, 42)
+		ctx = requestContext(c)
+		return nil
+	})(c); err != nil {
+		t.Fatal(err)
+	}
+	starts := time.Now()
+	if err := logger.write(ctx, "admin", starts, time.Millisecond, &proxy.Stmt{QueryString: "SELECT * FROM tenant WHERE id = ?"}, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var log sqlTraceLog
+	if err := json.Unmarshal(b, &log); err != nil {
+		t.Fatal(err)
+	}
+	if log.DB != "admin" || log.RequestID != "req-1" || log.TenantID != 42 || log.Route != "/api/player/competition/:competition_id/ranking" {
+		t.Errorf("unexpected trace log: %+v", log)
+	}
+
+	// リクエストの外のクエリにはリクエストの情報が付かず、サイズの上限を超えるとローテートする
+	for i := 0; i < 3; i++ {
+		if err := logger.write(context.Background(), "admin", starts, time.Millisecond, &proxy.Stmt{QueryString: "SELECT 1"}, nil, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := os.Stat(path + ".1"); err != nil {
+		t.Errorf("trace file is not rotated: %s", err)
+	}
+	if _, err := os.Stat(path + ".2"); !os.IsNotExist(err) {
+		t.Errorf("want only 1 backup, got %v", err)
+	}
+	b, err = os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(b), "request_id") {
+		t.Errorf("trace log outside a request has request info: %s", b)
+	}
+}
@@ -0,0 +1,142 @@
+package isuports
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/gommon/log"
+)
+
+// ログの設定
+// ISUCON_LOG_LEVEL: debug, info, warn, error, off のいずれか。未設定なら info
+// ISUCON_LOG_FORMAT: json か text。未設定なら json
+// ISUCON_DEBUG: true にするとechoのデバッグモードを有効にする。未設定なら無効
+// 値は config.go の loadConfig で読み込む
+
+var logLevels = map[string]log.Lvl{
+	"debug": log.DEBUG,
+	"info":  log.INFO,
+	"warn":  log.WARN,
+	"error": log.ERROR,
+	"off":   log.OFF,
+}
+
+func configureLogger(e *echo.Echo, conf LogConfig) {
+	e.Logger.SetLevel(conf.Level)
+	if conf.JSONFormat {
+		e.Logger.SetHeader(`{"time":"${time_rfc3339_nano}","level":"${level}"}`)
+	} else {
+		e.Logger.SetHeader("${time_rfc3339} ${level}")
+	}
+	e.Debug = conf.Debug
+}
+
+// メッセージと項目を jsonFormat に応じた形式で出力する
+func writeLog(logger echo.Logger, jsonFormat bool, level log.Lvl, msg string, fields log.JSON) {
+	if jsonFormat {
+		j := make(log.JSON, len(fields)+1)
+		for k, v := range fields {
+			j[k] = v
+		}
+		j["message"] = msg
+		switch level {
+		case log.DEBUG:
+			logger.Debugj(j)
+		case log.INFO:
+			logger.Infoj(j)
+		case log.WARN:
+			logger.Warnj(j)
+		default:
+			logger.Errorj(j)
+		}
+		return
+	}
+
+	// text形式では key=value を名前順に並べる
+	keys := make([]string, 0, len(fields))
+	for k := range fields {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var b strings.Builder
+	b.WriteString(msg)
+	for _, k := range keys {
+		v := fmt.Sprint(fields[k])
+		if v == "" || strings.ContainsAny(v, " \t\n\"=") {
+			v = strconv.Quote(v)
+		}
+		fmt.Fprintf(&b, " %s=%s", k, v)
+	}
+	switch level {
+	case log.DEBUG:
+		logger.Debug(b.String())
+	case log.INFO:
+		logger.Info(b.String())
+	case log.WARN:
+		logger.Warn(b.String())
+	default:
+		logger.Error(b.String())
+	}
+}
+
+// リクエストを識別する項目
+// 認証済みのリクエストではViewerのテナント名とロールを、それ以外は解決済みのテナントIDを出力する
+// Hostヘッダはカスタムドメインのこともあるので、テナント名としては使わない
+func requestLogFields(c echo.Context) log.JSON {
+	fields := log.JSON{
+		"method": c.Request().Method,
+		"route":  c.Path(),
+	}
+	ri, _ := c.Get(requestInfoContextKey).(*requestInfo)
+	if ri != nil {
+		fields["request_id"] = ri.RequestID
+	}
+	if v, ok := c.Get(viewerContextKey).(*Viewer); ok {
+		fields["tenant"] = v.tenantName
+		fields["role"] = v.role
+		if v.playerID != "" {
+			fields["player_id"] = v.playerID
+		}
+		if v.apiToken != nil {
+			fields["api_token_id"] = v.apiToken.ID
+		}
+	} else if ri != nil && ri.TenantID() != 0 {
+		fields["tenant_id"] = ri.TenantID()
+	}
+	return fields
+}
+
+// リクエストに紐づくログを出力する
+func (s *Server) logRequest(c echo.Context, level log.Lvl, msg string, extra log.JSON) {
+	fields := requestLogFields(c)
+	for k, v := range extra {
+		fields[k] = v
+	}
+	writeLog(c.Logger(), s.jsonLogFormat, level, msg, fields)
+}
+
+// アクセスログを出力するミドルウェア
+// SetRequestInfo より内側に置くこと
+func (s *Server) AccessLog(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		// ステータスコードを確定させるため、ここでエラーレスポンスを書き込む
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+		req, res := c.Request(), c.Response()
+		s.logRequest(c, log.INFO, "request", log.JSON{
+			"uri":        req.RequestURI,
+			"status":     res.Status,
+			"latency_ms": float64(time.Since(start).Microseconds()) / 1000,
+			"bytes_out":  res.Size,
+			"remote_ip":  c.RealIP(),
+			"user_agent": req.UserAgent(),
+		})
+		return nil
+	}
+}
@@ -0,0 +1,305 @@
+package isuports
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// レイテンシのヒストグラムのバケット(秒)
+var defaultHistogramBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type histogram struct {
+	buckets []float64
+	counts  []uint64 // バケットごとの件数。累積はしない
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, le := range h.buckets {
+		if v <= le {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+type httpRequestLabels struct {
+	method string
+	route  string
+	status int
+}
+
+type httpRouteLabels struct {
+	method string
+	route  string
+}
+
+// Prometheusのテキスト形式で公開するメトリクス
+type metricsRegistry struct {
+	mu               sync.Mutex
+	httpRequests     map[httpRequestLabels]uint64
+	httpDurations    map[httpRouteLabels]*histogram
+	flockWaitSeconds *histogram
+	routesOnce       sync.Once
+	routes           map[string]struct{} // 登録済みのパスのテンプレート
+
+	// atomicで更新する
+	tenantDBOpens         uint64
+	dispenseIDRetries     uint64
+	tenantCacheHits       uint64
+	tenantCacheMisses     uint64
+	scoreImportsInFlight  int64
+	playerImportsInFlight int64
+}
+
+func newMetricsRegistry() *metricsRegistry {
+	return &metricsRegistry{
+		httpRequests:     map[httpRequestLabels]uint64{},
+		httpDurations:    map[httpRouteLabels]*histogram{},
+		flockWaitSeconds: newHistogram(defaultHistogramBuckets),
+	}
+}
+
+func (m *metricsRegistry) observeHTTPRequest(method, route string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.httpRequests[httpRequestLabels{method: method, route: route, status: status}]++
+	rl := httpRouteLabels{method: method, route: route}
+	h, ok := m.httpDurations[rl]
+	if !ok {
+		h = newHistogram(defaultHistogramBuckets)
+		m.httpDurations[rl] = h
+	}
+	h.observe(d.Seconds())
+}
+
+func (m *metricsRegistry) observeFlockWait(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.flockWaitSeconds.observe(d.Seconds())
+}
+
+func (m *metricsRegistry) incTenantDBOpens() {
+	atomic.AddUint64(&m.tenantDBOpens, 1)
+}
+
+func (m *metricsRegistry) incDispenseIDRetries() {
+	atomic.AddUint64(&m.dispenseIDRetries, 1)
+}
+
+func (m *metricsRegistry) incTenantCacheHits() {
+	atomic.AddUint64(&m.tenantCacheHits, 1)
+}
+
+func (m *metricsRegistry) incTenantCacheMisses() {
+	atomic.AddUint64(&m.tenantCacheMisses, 1)
+}
+
+// スコアの入稿の処理中の件数を1増やし、減らす関数を返す
+func (m *metricsRegistry) trackScoreImport() func() {
+	atomic.AddInt64(&m.scoreImportsInFlight, 1)
+	return func() {
+		atomic.AddInt64(&m.scoreImportsInFlight, -1)
+	}
+}
+
+// 参加者CSVの入稿の処理中の件数を1増やし、減らす関数を返す
+func (m *metricsRegistry) trackPlayerImport() func() {
+	atomic.AddInt64(&m.playerImportsInFlight, 1)
+	return func() {
+		atomic.AddInt64(&m.playerImportsInFlight, -1)
+	}
+}
+
+// ルートごとのリクエスト数とレイテンシを記録するミドルウェア
+// ルートはRun()で登録したパスのテンプレートで集計する
+func (m *metricsRegistry) Middleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		start := time.Now()
+		// ステータスコードを確定させるため、ここでエラーレスポンスを書き込む
+		if err := next(c); err != nil {
+			c.Error(err)
+		}
+		route := c.Path()
+		if !m.isRegisteredRoute(c.Echo(), route) {
+			// 存在しないパスへのリクエストでラベルが増え続けないようにまとめる
+			route = "unmatched"
+		}
+		m.observeHTTPRequest(c.Request().Method, route, c.Response().Status, time.Since(start))
+		return nil
+	}
+}
+
+// Run()で登録したパスのテンプレートか
+// ルーティングに失敗したリクエストではリクエストのパスがそのまま入っている
+func (m *metricsRegistry) isRegisteredRoute(e *echo.Echo, path string) bool {
+	m.routesOnce.Do(func() {
+		m.routes = map[string]struct{}{}
+		for _, r := range e.Routes() {
+			m.routes[r.Path] = struct{}{}
+		}
+	})
+	_, ok := m.routes[path]
+	return ok
+}
+
+// ラベルの値をエスケープする
+var labelValueReplacer = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(kv ...string) string {
+	parts := make([]string, 0, len(kv)/2)
+	for i := 0; i+1 < len(kv); i += 2 {
+		parts = append(parts, fmt.Sprintf(`%s="%s"`, kv[i], labelValueReplacer.Replace(kv[i+1])))
+	}
+	return "{" + strings.Join(parts, ",") + "}"
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func writeMetricHeader(buf *bytes.Buffer, name, typ, help string) {
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// ヒストグラムを書き出す
+// kvはラベル名と値を交互に並べたもの
+func writeHistogram(buf *bytes.Buffer, name string, kv []string, h *histogram) {
+	var cumulative uint64
+	for i, le := range h.buckets {
+		cumulative += h.counts[i]
+		fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatLabels(append(kv, "le", formatFloat(le))...), cumulative)
+	}
+	fmt.Fprintf(buf, "%s_bucket%s %d\n", name, formatLabels(append(kv, "le", "+Inf")...), h.count)
+	labels := ""
+	if len(kv) > 0 {
+		labels = formatLabels(kv...)
+	}
+	fmt.Fprintf(buf, "%s_sum%s %s\n", name, labels, formatFloat(h.sum))
+	fmt.Fprintf(buf, "%s_count%s %d\n", name, labels, h.count)
+}
+
+// Prometheusのテキスト形式で書き出す
+func (m *metricsRegistry) write(buf *bytes.Buffer, adminDB AdminDB, tracer *spanTracer) {
+	m.mu.Lock()
+	reqLabels := make([]httpRequestLabels, 0, len(m.httpRequests))
+	for l := range m.httpRequests {
+		reqLabels = append(reqLabels, l)
+	}
+	sort.Slice(reqLabels, func(i, j int) bool {
+		a, b := reqLabels[i], reqLabels[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		if a.method != b.method {
+			return a.method < b.method
+		}
+		return a.status < b.status
+	})
+	writeMetricHeader(buf, "isuports_http_requests_total", "counter", "Number of HTTP requests by route template and status code.")
+	for _, l := range reqLabels {
+		fmt.Fprintf(buf, "isuports_http_requests_total%s %d\n",
+			formatLabels("method", l.method, "route", l.route, "status", strconv.Itoa(l.status)), m.httpRequests[l])
+	}
+
+	routeLabels := make([]httpRouteLabels, 0, len(m.httpDurations))
+	for l := range m.httpDurations {
+		routeLabels = append(routeLabels, l)
+	}
+	sort.Slice(routeLabels, func(i, j int) bool {
+		a, b := routeLabels[i], routeLabels[j]
+		if a.route != b.route {
+			return a.route < b.route
+		}
+		return a.method < b.method
+	})
+	writeMetricHeader(buf, "isuports_http_request_duration_seconds", "histogram", "HTTP request latency by route template.")
+	for _, l := range routeLabels {
+		writeHistogram(buf, "isuports_http_request_duration_seconds", []string{"method", l.method, "route", l.route}, m.httpDurations[l])
+	}
+
+	writeMetricHeader(buf, "isuports_flock_wait_seconds", "histogram", "Time spent waiting for the tenant file lock.")
+	writeHistogram(buf, "isuports_flock_wait_seconds", nil, m.flockWaitSeconds)
+	m.mu.Unlock()
+
+	writeMetricHeader(buf, "isuports_tenant_db_open_total", "counter", "Number of tenant DB connections opened.")
+	fmt.Fprintf(buf, "isuports_tenant_db_open_total %d\n", atomic.LoadUint64(&m.tenantDBOpens))
+	writeMetricHeader(buf, "isuports_dispense_id_retries_total", "counter", "Number of dispenseID retries caused by deadlocks.")
+	fmt.Fprintf(buf, "isuports_dispense_id_retries_total %d\n", atomic.LoadUint64(&m.dispenseIDRetries))
+	writeMetricHeader(buf, "isuports_tenant_cache_hits_total", "counter", "Number of tenant lookups served from the in-process cache.")
+	fmt.Fprintf(buf, "isuports_tenant_cache_hits_total %d\n", atomic.LoadUint64(&m.tenantCacheHits))
+	writeMetricHeader(buf, "isuports_tenant_cache_misses_total", "counter", "Number of tenant lookups that queried the admin DB.")
+	fmt.Fprintf(buf, "isuports_tenant_cache_misses_total %d\n", atomic.LoadUint64(&m.tenantCacheMisses))
+	writeMetricHeader(buf, "isuports_score_imports_in_flight", "gauge", "Number of score CSV imports in progress.")
+	fmt.Fprintf(buf, "isuports_score_imports_in_flight %d\n", atomic.LoadInt64(&m.scoreImportsInFlight))
+	writeMetricHeader(buf, "isuports_player_imports_in_flight", "gauge", "Number of player CSV imports in progress.")
+	fmt.Fprintf(buf, "isuports_player_imports_in_flight %d\n", atomic.LoadInt64(&m.playerImportsInFlight))
+
+	writeMetricHeader(buf, "isuports_trace_spans_dropped_total", "counter", "Number of trace spans dropped because the export queue was full.")
+	fmt.Fprintf(buf, "isuports_trace_spans_dropped_total %d\n", atomic.LoadInt64(&tracer.dropped))
+
+	if adminDB != nil {
+		st := adminDB.Stats()
+		writeMetricHeader(buf, "isuports_admin_db_max_open_connections", "gauge", "Maximum number of open connections to the admin DB.")
+		fmt.Fprintf(buf, "isuports_admin_db_max_open_connections %d\n", st.MaxOpenConnections)
+		writeMetricHeader(buf, "isuports_admin_db_open_connections", "gauge", "Number of open connections to the admin DB.")
+		fmt.Fprintf(buf, "isuports_admin_db_open_connections %d\n", st.OpenConnections)
+		writeMetricHeader(buf, "isuports_admin_db_in_use_connections", "gauge", "Number of admin DB connections in use.")
+		fmt.Fprintf(buf, "isuports_admin_db_in_use_connections %d\n", st.InUse)
+		writeMetricHeader(buf, "isuports_admin_db_idle_connections", "gauge", "Number of idle admin DB connections.")
+		fmt.Fprintf(buf, "isuports_admin_db_idle_connections %d\n", st.Idle)
+		writeMetricHeader(buf, "isuports_admin_db_wait_total", "counter", "Number of admin DB connections waited for.")
+		fmt.Fprintf(buf, "isuports_admin_db_wait_total %d\n", st.WaitCount)
+		writeMetricHeader(buf, "isuports_admin_db_wait_seconds_total", "counter", "Time spent waiting for admin DB connections.")
+		fmt.Fprintf(buf, "isuports_admin_db_wait_seconds_total %s\n", formatFloat(st.WaitDuration.Seconds()))
+	}
+}
+
+// 内部ネットワークから直接来たリクエストか
+// リバースプロキシを経由したリクエストは送信元が分からないので内部とみなさない
+func isInternalRequest(r *http.Request) bool {
+	if r.Header.Get(echo.HeaderXForwardedFor) != "" || r.Header.Get(echo.HeaderXRealIP) != "" {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return false
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && (ip.IsLoopback() || ip.IsPrivate())
+}
+
+// 監視用API
+// GET /metrics
+// Prometheusのテキスト形式でメトリクスを返す
+// 内部ネットワークから直接アクセスするか、SaaS管理者としてログインしている必要がある
+func (s *Server) metricsHandler(c echo.Context) error {
+	if !isInternalRequest(c.Request()) {
+		v, err := s.parseViewer(c)
+		if err != nil {
+			return fmt.Errorf("error parseViewer: %w", err)
+		} else if v.role != RoleAdmin {
+			return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+		}
+	}
+	var buf bytes.Buffer
+	s.metrics.write(&buf, s.adminDB, s.tracer)
+	return c.Blob(http.StatusOK, "text/plain; version=0.0.4; charset=utf-8", buf.Bytes())
+}
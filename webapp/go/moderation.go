@@ -0,0 +1,256 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	ModerationActionDisqualify = "disqualify"
+	ModerationActionReinstate  = "reinstate"
+)
+
+type PlayerModerationRow struct {
+	TenantID  int64         `db:"tenant_id"`
+	ID        string        `db:"id"`
+	PlayerID  string        `db:"player_id"`
+	Action    string        `db:"action"`
+	Reason    string        `db:"reason"`
+	ExpiresAt sql.NullInt64 `db:"expires_at"`
+	Moderator string        `db:"moderator"`
+	CreatedAt int64         `db:"created_at"`
+	UpdatedAt int64         `db:"updated_at"`
+}
+
+// 失格の詳細
+// 失格になった参加者本人とテナント管理者にのみ返す
+type DisqualificationDetail struct {
+	Reason    string `json:"reason"`
+	ExpiresAt *int64 `json:"expires_at"`
+}
+
+type PlayerModerationDetail struct {
+	ID        string `json:"id"`
+	Action    string `json:"action"`
+	Reason    string `json:"reason"`
+	ExpiresAt *int64 `json:"expires_at"`
+	Moderator string `json:"moderator"`
+	CreatedAt int64  `json:"created_at"`
+}
+
+func nullInt64Ptr(n sql.NullInt64) *int64 {
+	if !n.Valid {
+		return nil
+	}
+	return &n.Int64
+}
+
+// 失格中の参加者について失格の詳細を返す
+// 失格中でなければnilを返す
+func disqualificationDetail(p *PlayerRow, now int64) *DisqualificationDetail {
+	if !p.disqualified(now) {
+		return nil
+	}
+	return &DisqualificationDetail{
+		Reason:    p.DisqualifiedReason,
+		ExpiresAt: nullInt64Ptr(p.DisqualifiedUntil),
+	}
+}
+
+// リクエストから失格の理由と期限を読み取る
+// reason は省略できる。expires_at はUnix秒で、省略した場合は無期限の失格になる
+func parseDisqualificationParams(c echo.Context, now int64) (string, sql.NullInt64, error) {
+	reason := c.FormValue("reason")
+	var expiresAt sql.NullInt64
+	if s := c.FormValue("expires_at"); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return "", sql.NullInt64{}, echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("failed to parse expires_at: %s", err.Error()),
+			)
+		}
+		if v <= now {
+			return "", sql.NullInt64{}, echo.NewHTTPError(http.StatusBadRequest, "expires_at must be in the future")
+		}
+		expiresAt = sql.NullInt64{Int64: v, Valid: true}
+	}
+	return reason, expiresAt, nil
+}
+
+// 参加者の失格状態を更新し、履歴を記録する
+// 参加者の存在確認は呼び出し側で行うこと
+func (s *Server) moderatePlayer(ctx context.Context, tenantDB dbOrTx, m PlayerModerationRow) error {
+	id, err := s.ids.DispenseID(ctx)
+	if err != nil {
+		return fmt.Errorf("error DispenseID: %w", err)
+	}
+	m.ID = id
+
+	isDisqualified := m.Action == ModerationActionDisqualify
+	reason, until := m.Reason, m.ExpiresAt
+	if !isDisqualified {
+		reason, until = "", sql.NullInt64{}
+	}
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"UPDATE player SET is_disqualified = ?, disqualified_reason = ?, disqualified_until = ?, updated_by = ?, updated_at = ? WHERE id = ?",
+		isDisqualified, reason, until, m.Moderator, m.UpdatedAt, m.PlayerID,
+	); err != nil {
+		return fmt.Errorf(
+			"error Update player: isDisqualified=%t, updatedAt=%d, id=%s, %w",
+			isDisqualified, m.UpdatedAt, m.PlayerID, err,
+		)
+	}
+	if _, err := tenantDB.ExecContext(
+		ctx,
+		"INSERT INTO player_moderation (id, tenant_id, player_id, action, reason, expires_at, moderator, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		m.ID, m.TenantID, m.PlayerID, m.Action, m.Reason, m.ExpiresAt, m.Moderator, m.CreatedAt, m.UpdatedAt,
+	); err != nil {
+		return fmt.Errorf(
+			"error Insert player_moderation: id=%s, playerID=%s, action=%s, createdAt=%d, %w",
+			m.ID, m.PlayerID, m.Action, m.CreatedAt, err,
+		)
+	}
+	return nil
+}
+
+type PlayerReinstateHandlerResult struct {
+	Player PlayerDetail `json:"player"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/player/:player_id/reinstate
+// 失格を解除する
+func (s *Server) playerReinstateHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	playerID := c.Param("player_id")
+	p, err := retrievePlayer(ctx, tenantDB, playerID)
+	if err != nil {
+		// 存在しないプレイヤー
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "player not found")
+		}
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+	if !p.IsDisqualified {
+		return echo.NewHTTPError(http.StatusBadRequest, "player is not disqualified")
+	}
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+
+	now := s.now()
+	if err := s.moderatePlayer(ctx, tx, PlayerModerationRow{
+		TenantID:  v.tenantID,
+		PlayerID:  p.ID,
+		Action:    ModerationActionReinstate,
+		Reason:    c.FormValue("reason"),
+		Moderator: v.playerID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}); err != nil {
+		return fmt.Errorf("error moderatePlayer: %w", err)
+	}
+	res := PlayerReinstateHandlerResult{
+		Player: PlayerDetail{
+			ID:             p.ID,
+			DisplayName:    p.DisplayName,
+			IsDisqualified: false,
+		},
+	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventPlayerReinstated, PlayerEventData{Player: res.Player}); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type PlayerModerationsHandlerResult struct {
+	Player           PlayerDetail             `json:"player"`
+	Disqualification *DisqualificationDetail  `json:"disqualification"`
+	Moderations      []PlayerModerationDetail `json:"moderations"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/player/:player_id/moderations
+// 参加者の失格・失格解除の履歴を新しい順に取得する
+func (s *Server) playerModerationsHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return err
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	playerID := c.Param("player_id")
+	p, err := retrievePlayer(ctx, tenantDB, playerID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "player not found")
+		}
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+
+	pms := []PlayerModerationRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&pms,
+		"SELECT * FROM player_moderation WHERE tenant_id = ? AND player_id = ? ORDER BY created_at DESC, id DESC",
+		v.tenantID, p.ID,
+	); err != nil {
+		return fmt.Errorf("error Select player_moderation: tenantID=%d, playerID=%s, %w", v.tenantID, p.ID, err)
+	}
+	pmds := make([]PlayerModerationDetail, 0, len(pms))
+	for _, pm := range pms {
+		pmds = append(pmds, PlayerModerationDetail{
+			ID:        pm.ID,
+			Action:    pm.Action,
+			Reason:    pm.Reason,
+			ExpiresAt: nullInt64Ptr(pm.ExpiresAt),
+			Moderator: pm.Moderator,
+			CreatedAt: pm.CreatedAt,
+		})
+	}
+
+	res := PlayerModerationsHandlerResult{
+		Player: PlayerDetail{
+			ID:             p.ID,
+			DisplayName:    p.DisplayName,
+			IsDisqualified: p.disqualified(s.now()),
+		},
+		Disqualification: disqualificationDetail(p, s.now()),
+		Moderations:      pmds,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
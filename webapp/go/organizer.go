@@ -0,0 +1,348 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 主催者の権限
+// 一覧の閲覧は権限がなくてもできる。課金レポートの閲覧と書き込みには権限が要る
+const (
+	PermissionManagePlayers      = "manage_players"      // 参加者の追加、更新、失格
+	PermissionManageCompetitions = "manage_competitions" // 大会とシーズンの作成、更新、終了、公開
+	PermissionUploadScores       = "upload_scores"       // スコアの入稿
+	PermissionViewBilling        = "view_billing"        // 課金レポートの閲覧
+	PermissionManageTenant       = "manage_tenant"       // 主催者とWebhookの管理
+)
+
+var organizerPermissions = []string{
+	PermissionManagePlayers,
+	PermissionManageCompetitions,
+	PermissionUploadScores,
+	PermissionViewBilling,
+	PermissionManageTenant,
+}
+
+const (
+	// テナントの所有者のJWTのsub
+	// 所有者は tenant_organizer に登録せず、全ての権限を持つ
+	OrganizerOwnerID = "organizer"
+
+	// バックグラウンドの処理で書き込んだときに created_by, updated_by に記録する値
+	auditActorSystem = "system"
+)
+
+type TenantOrganizerRow struct {
+	TenantID    int64  `db:"tenant_id"`
+	ID          string `db:"id"`
+	DisplayName string `db:"display_name"`
+	Permissions string `db:"permissions"` // カンマ区切りの権限
+	CreatedBy   string `db:"created_by"`
+	UpdatedBy   string `db:"updated_by"`
+	CreatedAt   int64  `db:"created_at"`
+	UpdatedAt   int64  `db:"updated_at"`
+}
+
+func (o *TenantOrganizerRow) permissions() []string {
+	if o.Permissions == "" {
+		return []string{}
+	}
+	return strings.Split(o.Permissions, ",")
+}
+
+func (o *TenantOrganizerRow) has(perm string) bool {
+	for _, p := range o.permissions() {
+		if p == perm {
+			return true
+		}
+	}
+	return false
+}
+
+// 主催者を取得する
+// 所有者は全ての権限を持つものとして返す
+func (s *Server) retrieveOrganizer(ctx context.Context, tenantID int64, id string) (*TenantOrganizerRow, error) {
+	if id == OrganizerOwnerID {
+		return &TenantOrganizerRow{
+			TenantID:    tenantID,
+			ID:          OrganizerOwnerID,
+			DisplayName: OrganizerOwnerID,
+			Permissions: strings.Join(organizerPermissions, ","),
+		}, nil
+	}
+	var o TenantOrganizerRow
+	if err := s.adminDB.GetContext(
+		ctx,
+		&o,
+		"SELECT * FROM tenant_organizer WHERE tenant_id = ? AND id = ?",
+		tenantID, id,
+	); err != nil {
+		return nil, fmt.Errorf("error Select tenant_organizer: tenantID=%d, id=%s, %w", tenantID, id, err)
+	}
+	return &o, nil
+}
+
+// 主催者のAPIで、主催者としてログインしていて、指定した権限を全て持っているか確認するミドルウェア
+// 権限を指定しない場合は、主催者であれば通す
+// APIトークンの場合は、発行した主催者の権限とトークンのスコープの両方を確認する
+// 権限を指定しないAPIはどのスコープにも含まれないので、APIトークンでは使えない
+// 大会を指定したAPIトークンは、パスの :competition_id がその大会のAPIでしか使えない
+func (s *Server) requireOrganizer(perms ...string) echo.MiddlewareFunc {
+	return s.organizerMiddleware(false, perms)
+}
+
+// requireOrganizer と同じだが、パスに :competition_id がないAPIでも大会を指定したAPIトークンを使える
+// ハンドラでトークンの大会だけに絞り込むこと
+func (s *Server) requireOrganizerAllowingCompetitionToken(perms ...string) echo.MiddlewareFunc {
+	return s.organizerMiddleware(true, perms)
+}
+
+func (s *Server) organizerMiddleware(allowCompetitionToken bool, perms []string) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			v, err := s.parseViewer(c)
+			if err != nil {
+				return err
+			}
+			if v.role != RoleOrganizer {
+				return echo.NewHTTPError(http.StatusForbidden, "role organizer required")
+			}
+			o, err := s.retrieveOrganizer(requestContext(c), v.tenantID, v.playerID)
+			if err != nil {
+				// 削除された主催者のJWT
+				if errors.Is(err, sql.ErrNoRows) {
+					return echo.NewHTTPError(http.StatusUnauthorized, "organizer not found")
+				}
+				return fmt.Errorf("error retrieveOrganizer: %w", err)
+			}
+			if v.apiToken != nil && len(perms) == 0 {
+				return echo.NewHTTPError(http.StatusForbidden, "api token is not allowed for this api")
+			}
+			for _, perm := range perms {
+				if !o.has(perm) {
+					return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("permission %s required", perm))
+				}
+				// APIトークンはスコープの範囲の権限しか使えない
+				if v.apiToken != nil && !v.apiToken.allows(perm) {
+					return echo.NewHTTPError(http.StatusForbidden, fmt.Sprintf("api token scope for %s required", perm))
+				}
+			}
+			// 大会を指定したAPIトークンは、他の大会や大会を指定しない操作には使えない
+			if v.apiToken != nil && v.apiToken.CompetitionID != "" {
+				id := c.Param("competition_id")
+				if id == "" && !allowCompetitionToken {
+					return echo.NewHTTPError(http.StatusForbidden, "api token for a competition is not allowed for this api")
+				}
+				if id != "" && id != v.apiToken.CompetitionID {
+					return echo.NewHTTPError(http.StatusForbidden, "api token is not allowed for this competition")
+				}
+			}
+			return next(c)
+		}
+	}
+}
+
+// リクエストから権限の一覧を読み取る
+// 重複は除き、organizerPermissions の順に並べる
+func parsePermissionParams(c echo.Context) ([]string, error) {
+	params, err := c.FormParams()
+	if err != nil {
+		return nil, fmt.Errorf("error c.FormParams: %w", err)
+	}
+	order := map[string]int{}
+	for i, p := range organizerPermissions {
+		order[p] = i
+	}
+	seen := map[string]struct{}{}
+	perms := []string{}
+	for _, p := range params["permission[]"] {
+		if _, ok := order[p]; !ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid permission: %s", p))
+		}
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		perms = append(perms, p)
+	}
+	sort.Slice(perms, func(i, j int) bool { return order[perms[i]] < order[perms[j]] })
+	return perms, nil
+}
+
+type OrganizerDetail struct {
+	ID          string   `json:"id"`
+	DisplayName string   `json:"display_name"`
+	Permissions []string `json:"permissions"`
+	CreatedBy   string   `json:"created_by"`
+	UpdatedBy   string   `json:"updated_by"`
+	CreatedAt   int64    `json:"created_at"`
+	UpdatedAt   int64    `json:"updated_at"`
+}
+
+func organizerDetail(o *TenantOrganizerRow) OrganizerDetail {
+	return OrganizerDetail{
+		ID:          o.ID,
+		DisplayName: o.DisplayName,
+		Permissions: o.permissions(),
+		CreatedBy:   o.CreatedBy,
+		UpdatedBy:   o.UpdatedBy,
+		CreatedAt:   o.CreatedAt,
+		UpdatedAt:   o.UpdatedAt,
+	}
+}
+
+type OrganizerHandlerResult struct {
+	Organizer OrganizerDetail `json:"organizer"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/organizers/add
+// 主催者を追加する
+// 追加した主催者は、レスポンスのidをJWTのsubにしてログインする
+func (s *Server) organizersAddHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	displayName := c.FormValue("display_name")
+	if displayName == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "display_name required")
+	}
+	perms, err := parsePermissionParams(c)
+	if err != nil {
+		return err
+	}
+	id, err := s.ids.DispenseID(ctx)
+	if err != nil {
+		return fmt.Errorf("error DispenseID: %w", err)
+	}
+
+	now := s.now()
+	o := TenantOrganizerRow{
+		TenantID:    v.tenantID,
+		ID:          id,
+		DisplayName: displayName,
+		Permissions: strings.Join(perms, ","),
+		CreatedBy:   v.playerID,
+		UpdatedBy:   v.playerID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if _, err := s.adminDB.NamedExecContext(
+		ctx,
+		"INSERT INTO tenant_organizer (tenant_id, id, display_name, permissions, created_by, updated_by, created_at, updated_at) VALUES (:tenant_id, :id, :display_name, :permissions, :created_by, :updated_by, :created_at, :updated_at)",
+		o,
+	); err != nil {
+		return fmt.Errorf("error Insert tenant_organizer: tenantID=%d, id=%s, %w", v.tenantID, id, err)
+	}
+	setAuditTarget(c, id)
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: OrganizerHandlerResult{Organizer: organizerDetail(&o)}})
+}
+
+type OrganizersHandlerResult struct {
+	Organizers []OrganizerDetail `json:"organizers"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/organizers
+// 主催者の一覧を追加した順に取得する。所有者は含まない
+func (s *Server) organizersHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return err
+	}
+
+	ors := []TenantOrganizerRow{}
+	if err := s.adminDB.SelectContext(
+		ctx,
+		&ors,
+		"SELECT * FROM tenant_organizer WHERE tenant_id = ? ORDER BY created_at ASC, id ASC",
+		v.tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select tenant_organizer: tenantID=%d, %w", v.tenantID, err)
+	}
+	ods := make([]OrganizerDetail, 0, len(ors))
+	for _, o := range ors {
+		ods = append(ods, organizerDetail(&o))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: OrganizersHandlerResult{Organizers: ods}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/organizer/:organizer_id/update
+// 主催者の表示名と権限を更新する
+// permission[] を省略すると権限を全て外す
+func (s *Server) organizerUpdateHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	id := c.Param("organizer_id")
+	if id == OrganizerOwnerID {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot update the owner")
+	}
+	o, err := s.retrieveOrganizer(ctx, v.tenantID, id)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "organizer not found")
+		}
+		return fmt.Errorf("error retrieveOrganizer: %w", err)
+	}
+	if displayName := c.FormValue("display_name"); displayName != "" {
+		o.DisplayName = displayName
+	}
+	perms, err := parsePermissionParams(c)
+	if err != nil {
+		return err
+	}
+	o.Permissions = strings.Join(perms, ",")
+	o.UpdatedBy = v.playerID
+	o.UpdatedAt = s.now()
+	if _, err := s.adminDB.ExecContext(
+		ctx,
+		"UPDATE tenant_organizer SET display_name = ?, permissions = ?, updated_by = ?, updated_at = ? WHERE tenant_id = ? AND id = ?",
+		o.DisplayName, o.Permissions, o.UpdatedBy, o.UpdatedAt, v.tenantID, id,
+	); err != nil {
+		return fmt.Errorf("error Update tenant_organizer: tenantID=%d, id=%s, %w", v.tenantID, id, err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: OrganizerHandlerResult{Organizer: organizerDetail(o)}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/organizer/:organizer_id/delete
+// 主催者を削除する。以降その主催者のJWTは使えない
+// 記録済みの created_by, updated_by はそのまま残る
+func (s *Server) organizerDeleteHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	id := c.Param("organizer_id")
+	if id == OrganizerOwnerID {
+		return echo.NewHTTPError(http.StatusBadRequest, "cannot delete the owner")
+	}
+	res, err := s.adminDB.ExecContext(ctx, "DELETE FROM tenant_organizer WHERE tenant_id = ? AND id = ?", v.tenantID, id)
+	if err != nil {
+		return fmt.Errorf("error Delete tenant_organizer: tenantID=%d, id=%s, %w", v.tenantID, id, err)
+	}
+	if n, err := res.RowsAffected(); err != nil {
+		return fmt.Errorf("error RowsAffected: %w", err)
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "organizer not found")
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
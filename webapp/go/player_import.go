@@ -0,0 +1,457 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	PlayerImportActionCreate     = "create"
+	PlayerImportActionUpdate     = "update"
+	PlayerImportActionDisqualify = "disqualify"
+	PlayerImportActionUnchanged  = "unchanged"
+)
+
+// 参加者CSVの1行分
+type playerImportRow struct {
+	RowNum             int64
+	PlayerID           string
+	DisplayName        string
+	IsDisqualified     bool
+	DisqualifiedReason string
+}
+
+type PlayerImportResult struct {
+	RowNum  int64        `json:"row_num"`
+	Action  string       `json:"action"`
+	Changes []string     `json:"changes"`
+	Player  PlayerDetail `json:"player"`
+}
+
+type PlayersImportHandlerResult struct {
+	DryRun       bool                 `json:"dry_run"`
+	Created      int64                `json:"created"`
+	Updated      int64                `json:"updated"`
+	Disqualified int64                `json:"disqualified"`
+	Unchanged    int64                `json:"unchanged"`
+	Results      []PlayerImportResult `json:"results"`
+}
+
+// 参加者CSVを読み込む
+// ヘッダは player_id,display_name が必須で、is_disqualified,disqualified_reason は省略できる
+// player_id が空の行は新規作成、指定されている行は既存参加者の更新として扱う
+func readPlayerImportCSV(r io.Reader) ([]playerImportRow, error) {
+	cr := csv.NewReader(r)
+	headers, err := cr.Read()
+	if err != nil {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("error r.Read at header: %s", err))
+	}
+	columns := map[string]int{}
+	for i, h := range headers {
+		switch h {
+		case "player_id", "display_name", "is_disqualified", "disqualified_reason":
+		default:
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid CSV headers")
+		}
+		if _, ok := columns[h]; ok {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid CSV headers")
+		}
+		columns[h] = i
+	}
+	idCol, okID := columns["player_id"]
+	nameCol, okName := columns["display_name"]
+	if !okID || !okName {
+		return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid CSV headers")
+	}
+	dqCol, okDQ := columns["is_disqualified"]
+	reasonCol, okReason := columns["disqualified_reason"]
+
+	rows := []playerImportRow{}
+	var rowNum int64
+	for {
+		rowNum++
+		record, err := cr.Read()
+		if err != nil {
+			if err == io.EOF {
+				break
+			}
+			return nil, echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("error r.Read at rows: %s", err),
+			)
+		}
+		row := playerImportRow{
+			RowNum:      rowNum,
+			PlayerID:    record[idCol],
+			DisplayName: record[nameCol],
+		}
+		if row.PlayerID == "" && row.DisplayName == "" {
+			return nil, echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("display_name required: row=%d", rowNum),
+			)
+		}
+		if okDQ && record[dqCol] != "" {
+			if row.IsDisqualified, err = strconv.ParseBool(record[dqCol]); err != nil {
+				return nil, echo.NewHTTPError(
+					http.StatusBadRequest,
+					fmt.Sprintf("invalid is_disqualified: row=%d, value=%s", rowNum, record[dqCol]),
+				)
+			}
+		}
+		if okReason {
+			row.DisqualifiedReason = record[reasonCol]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/players/import
+// 参加者CSVをアップロードして参加者を一括で追加・更新する
+// dry_run=true の場合は何も書き込まずに変更内容のみを返す
+func (s *Server) playersImportHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	var dryRun bool
+	if dryRunStr := c.FormValue("dry_run"); dryRunStr != "" {
+		if dryRun, err = strconv.ParseBool(dryRunStr); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid dry_run: %s", dryRunStr))
+		}
+	}
+	defer s.metrics.trackPlayerImport()()
+
+	fh, err := c.FormFile("players")
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("error c.FormFile(players): %s", err))
+	}
+	f, err := fh.Open()
+	if err != nil {
+		return fmt.Errorf("error fh.Open FormFile(players): %w", err)
+	}
+	defer f.Close()
+
+	rows, err := readPlayerImportCSV(f)
+	if err != nil {
+		return err
+	}
+
+	// 管理用DBへの問い合わせでテナントDBの書き込みを待たせないように、IDはトランザクションの前に採番しておく
+	newIDs := []string{}
+	if !dryRun {
+		for _, row := range rows {
+			if row.PlayerID != "" {
+				continue
+			}
+			id, err := s.ids.DispenseID(ctx)
+			if err != nil {
+				return fmt.Errorf("error DispenseID: %w", err)
+			}
+			newIDs = append(newIDs, id)
+		}
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	// スコアの入稿と同じく、テナントDBへの書き込みは排他ロックを取ってから行う
+	fl, err := s.flockByTenantID(ctx, v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+
+	res := PlayersImportHandlerResult{
+		DryRun:  dryRun,
+		Results: make([]PlayerImportResult, 0, len(rows)),
+	}
+	// 同じCSV内で同じ参加者が複数回登場した場合は後の行の内容で上書きする
+	seen := map[string]*PlayerRow{}
+	for _, row := range rows {
+		now := s.now()
+		if row.PlayerID == "" {
+			p := &PlayerRow{
+				TenantID:    v.tenantID,
+				DisplayName: row.DisplayName,
+				CreatedBy:   v.playerID,
+				UpdatedBy:   v.playerID,
+				CreatedAt:   now,
+				UpdatedAt:   now,
+			}
+			if !dryRun {
+				p.ID, newIDs = newIDs[0], newIDs[1:]
+				if _, err := tx.ExecContext(
+					ctx,
+					"INSERT INTO player (id, tenant_id, display_name, is_disqualified, created_by, updated_by, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?)",
+					p.ID, p.TenantID, p.DisplayName, false, p.CreatedBy, p.UpdatedBy, p.CreatedAt, p.UpdatedAt,
+				); err != nil {
+					return fmt.Errorf(
+						"error Insert player at tenantDB: id=%s, displayName=%s, isDisqualified=%t, createdAt=%d, updatedAt=%d, %w",
+						p.ID, p.DisplayName, false, now, now, err,
+					)
+				}
+			}
+			changes := []string{}
+			if row.IsDisqualified {
+				if err := s.importDisqualify(ctx, tx, v, p, row, now, dryRun); err != nil {
+					return err
+				}
+				changes = append(changes, "is_disqualified")
+			}
+			res.Created++
+			res.Results = append(res.Results, PlayerImportResult{
+				RowNum:  row.RowNum,
+				Action:  PlayerImportActionCreate,
+				Changes: changes,
+				Player: PlayerDetail{
+					ID:             p.ID,
+					DisplayName:    p.DisplayName,
+					IsDisqualified: p.disqualified(now),
+				},
+			})
+			continue
+		}
+
+		p, ok := seen[row.PlayerID]
+		if !ok {
+			p, err = retrievePlayer(ctx, tx, row.PlayerID)
+			if err != nil {
+				// 存在しない参加者が含まれている
+				if errors.Is(err, sql.ErrNoRows) {
+					return echo.NewHTTPError(
+						http.StatusBadRequest,
+						fmt.Sprintf("player not found: row=%d, id=%s", row.RowNum, row.PlayerID),
+					)
+				}
+				return fmt.Errorf("error retrievePlayer: %w", err)
+			}
+			seen[row.PlayerID] = p
+		}
+
+		changes := []string{}
+		action := PlayerImportActionUnchanged
+		if row.DisplayName != "" && row.DisplayName != p.DisplayName {
+			p.DisplayName = row.DisplayName
+			changes = append(changes, "display_name")
+			action = PlayerImportActionUpdate
+			if !dryRun {
+				if _, err := tx.ExecContext(
+					ctx,
+					"UPDATE player SET display_name = ?, updated_by = ?, updated_at = ? WHERE id = ?",
+					p.DisplayName, v.playerID, now, p.ID,
+				); err != nil {
+					return fmt.Errorf(
+						"error Update player: displayName=%s, updatedAt=%d, id=%s, %w",
+						p.DisplayName, now, p.ID, err,
+					)
+				}
+			}
+		}
+		// CSVからの失格の解除はできない
+		if row.IsDisqualified && !p.disqualified(now) {
+			if err := s.importDisqualify(ctx, tx, v, p, row, now, dryRun); err != nil {
+				return err
+			}
+			changes = append(changes, "is_disqualified")
+			action = PlayerImportActionDisqualify
+		}
+		switch action {
+		case PlayerImportActionUpdate:
+			res.Updated++
+		case PlayerImportActionDisqualify:
+			res.Disqualified++
+		default:
+			res.Unchanged++
+		}
+		res.Results = append(res.Results, PlayerImportResult{
+			RowNum:  row.RowNum,
+			Action:  action,
+			Changes: changes,
+			Player: PlayerDetail{
+				ID:             p.ID,
+				DisplayName:    p.DisplayName,
+				IsDisqualified: p.disqualified(now),
+			},
+		})
+	}
+
+	if !dryRun {
+		now := s.now()
+		// 表示名が変わるとランキングの内容も変わる
+		displayNameChanged := false
+		for _, r := range res.Results {
+			for _, change := range r.Changes {
+				displayNameChanged = displayNameChanged || change == "display_name"
+			}
+		}
+		if displayNameChanged {
+			if err := bumpDataVersions(ctx, tx, now, dataVersionPlayers); err != nil {
+				return fmt.Errorf("error bumpDataVersions: %w", err)
+			}
+		}
+		if err := recordPlayerImportEvents(ctx, tx, now, v.tenantID, res.Results); err != nil {
+			return fmt.Errorf("error recordPlayerImportEvents: %w", err)
+		}
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error tx.Commit: %w", err)
+		}
+		if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+			return fmt.Errorf("error notifyDomainEvents: %w", err)
+		}
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// 参加者CSVによる変更をドメインイベントとして書き込む
+// 追加された参加者はまとめて1つのイベントにする
+func recordPlayerImportEvents(ctx context.Context, tx dbOrTx, now int64, tenantID int64, results []PlayerImportResult) error {
+	added := []PlayerDetail{}
+	for _, r := range results {
+		if r.Action == PlayerImportActionCreate {
+			added = append(added, r.Player)
+		}
+	}
+	if len(added) > 0 {
+		if err := recordDomainEvent(ctx, tx, now, tenantID, DomainEventPlayerAdded, PlayersEventData{Players: added}); err != nil {
+			return err
+		}
+	}
+	for _, r := range results {
+		for _, change := range r.Changes {
+			// 追加された参加者の変更は失格だけなので、player.updatedにはならない
+			eventType := DomainEventPlayerUpdated
+			if change == "is_disqualified" {
+				eventType = DomainEventPlayerDisqualified
+			}
+			if err := recordDomainEvent(ctx, tx, now, tenantID, eventType, PlayerEventData{Player: r.Player}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// CSVの行の内容で参加者を失格にする
+// dry_runの場合はpの内容だけを書き換える
+func (s *Server) importDisqualify(ctx context.Context, tx dbOrTx, v *Viewer, p *PlayerRow, row playerImportRow, now int64, dryRun bool) error {
+	p.IsDisqualified = true
+	p.DisqualifiedReason = row.DisqualifiedReason
+	p.DisqualifiedUntil = sql.NullInt64{}
+	if dryRun {
+		return nil
+	}
+	if err := s.moderatePlayer(ctx, tx, PlayerModerationRow{
+		TenantID:  v.tenantID,
+		PlayerID:  p.ID,
+		Action:    ModerationActionDisqualify,
+		Reason:    row.DisqualifiedReason,
+		Moderator: v.playerID,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}); err != nil {
+		return fmt.Errorf("error moderatePlayer: row=%d, %w", row.RowNum, err)
+	}
+	return nil
+}
+
+type PlayerUpdateHandlerResult struct {
+	Player PlayerDetail `json:"player"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/player/:player_id/update
+// 参加者の表示名を変更する
+func (s *Server) playerUpdateHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	playerID := c.Param("player_id")
+	if playerID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "player_id required")
+	}
+	displayName := c.FormValue("display_name")
+	if displayName == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "display_name required")
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	if _, err := retrievePlayer(ctx, tenantDB, playerID); err != nil {
+		// 存在しないプレイヤー
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "player not found")
+		}
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	now := s.now()
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE player SET display_name = ?, updated_by = ?, updated_at = ? WHERE id = ?",
+		displayName, v.playerID, now, playerID,
+	); err != nil {
+		return fmt.Errorf(
+			"error Update player: displayName=%s, updatedAt=%d, id=%s, %w",
+			displayName, now, playerID, err,
+		)
+	}
+	p, err := retrievePlayer(ctx, tx, playerID)
+	if err != nil {
+		return fmt.Errorf("error retrievePlayer: %w", err)
+	}
+
+	res := PlayerUpdateHandlerResult{
+		Player: PlayerDetail{
+			ID:             p.ID,
+			DisplayName:    p.DisplayName,
+			IsDisqualified: p.disqualified(now),
+		},
+	}
+	if err := bumpDataVersions(ctx, tx, now, dataVersionPlayers); err != nil {
+		return fmt.Errorf("error bumpDataVersions: %w", err)
+	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventPlayerUpdated, PlayerEventData{Player: res.Player}); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
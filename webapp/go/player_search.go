@@ -0,0 +1,130 @@
+package isuports
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	playersListMaxLimit = 1000
+	// display_nameの前方一致検索で範囲の上限に使う、UTF-8で最大のコードポイント
+	maxRune = "\U0010FFFF"
+)
+
+// 参加者一覧の検索条件
+type playerSearchCondition struct {
+	DisplayNamePrefix string
+	ID                string
+	Disqualified      *bool
+	CompetitionID     string
+	Limit             int64 // 0の場合はページングしない
+	Cursor            *playerCursor
+}
+
+// ページングのカーソル
+// 参加者一覧は created_at, id の降順で並んでいるので、前ページの最後の参加者の値を持つ
+type playerCursor struct {
+	CreatedAt int64
+	ID        string
+}
+
+func (pc playerCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(fmt.Sprintf("%d:%s", pc.CreatedAt, pc.ID)))
+}
+
+func decodePlayerCursor(s string) (*playerCursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("error base64 decode: %w", err)
+	}
+	createdAtStr, id, ok := strings.Cut(string(b), ":")
+	if !ok || id == "" {
+		return nil, fmt.Errorf("invalid cursor: %s", s)
+	}
+	createdAt, err := strconv.ParseInt(createdAtStr, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("error strconv.ParseInt: %w", err)
+	}
+	return &playerCursor{CreatedAt: createdAt, ID: id}, nil
+}
+
+// クエリ文字列から参加者一覧の検索条件を読み取る
+func parsePlayerSearchCondition(c echo.Context) (*playerSearchCondition, error) {
+	cond := &playerSearchCondition{
+		DisplayNamePrefix: c.QueryParam("display_name"),
+		ID:                c.QueryParam("id"),
+		CompetitionID:     c.QueryParam("competition_id"),
+	}
+	if s := c.QueryParam("disqualified"); s != "" {
+		dq, err := strconv.ParseBool(s)
+		if err != nil {
+			return nil, echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("failed to parse query parameter 'disqualified': %s", err.Error()),
+			)
+		}
+		cond.Disqualified = &dq
+	}
+	if s := c.QueryParam("limit"); s != "" {
+		limit, err := strconv.ParseInt(s, 10, 64)
+		if err != nil || limit < 1 || playersListMaxLimit < limit {
+			return nil, echo.NewHTTPError(
+				http.StatusBadRequest,
+				fmt.Sprintf("query parameter 'limit' must be between 1 and %d", playersListMaxLimit),
+			)
+		}
+		cond.Limit = limit
+	}
+	if s := c.QueryParam("cursor"); s != "" {
+		if cond.Limit == 0 {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "query parameter 'cursor' requires 'limit'")
+		}
+		pc, err := decodePlayerCursor(s)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusBadRequest, "invalid cursor")
+		}
+		cond.Cursor = pc
+	}
+	return cond, nil
+}
+
+// 検索条件からWHERE句と引数を組み立てる
+// カーソルはtotalの計算に含めないため、withCursorで切り替える
+// 失格の期限はnowと比べる
+func (cond *playerSearchCondition) where(tenantID int64, now int64, withCursor bool) (string, []any) {
+	clauses := []string{"tenant_id = ?"}
+	args := []any{tenantID}
+	if cond.DisplayNamePrefix != "" {
+		// LIKEはインデックスが使われないので範囲で前方一致検索する
+		clauses = append(clauses, "display_name >= ? AND display_name < ?")
+		args = append(args, cond.DisplayNamePrefix, cond.DisplayNamePrefix+maxRune)
+	}
+	if cond.ID != "" {
+		clauses = append(clauses, "id = ?")
+		args = append(args, cond.ID)
+	}
+	if cond.Disqualified != nil {
+		// 期限切れの失格は失格していないものとみなす
+		disqualified := "is_disqualified = 1 AND (disqualified_until IS NULL OR disqualified_until > ?)"
+		if *cond.Disqualified {
+			clauses = append(clauses, disqualified)
+		} else {
+			clauses = append(clauses, "NOT ("+disqualified+")")
+		}
+		args = append(args, now)
+	}
+	if cond.CompetitionID != "" {
+		clauses = append(clauses, "EXISTS (SELECT 1 FROM player_score WHERE player_score.tenant_id = player.tenant_id AND player_score.competition_id = ? AND player_score.player_id = player.id)")
+		args = append(args, cond.CompetitionID)
+	}
+	if withCursor && cond.Cursor != nil {
+		clauses = append(clauses, "(created_at < ? OR (created_at = ? AND id < ?))")
+		args = append(args, cond.Cursor.CreatedAt, cond.Cursor.CreatedAt, cond.Cursor.ID)
+	}
+	return strings.Join(clauses, " AND "), args
+}
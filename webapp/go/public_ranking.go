@@ -0,0 +1,254 @@
+package isuports
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	// 公開ランキングをキャッシュしてよい秒数
+	// 終了した大会のランキングは変わらないので長めにする
+	publicRankingMaxAge         = 5
+	publicRankingFinishedMaxAge = 300
+)
+
+type CompetitionPublishHandlerResult struct {
+	Competition CompetitionDetail `json:"competition"`
+	PublishedAt int64             `json:"published_at"`
+	ShareToken  *string           `json:"share_token"` // 共有用トークン。発行しない場合はnull
+	Path        string            `json:"path"`        // 公開ランキングのパス
+}
+
+// 公開ランキングのパスを返す
+func publicRankingPath(comp *CompetitionRow) string {
+	p := fmt.Sprintf("/api/public/competition/%s/ranking", url.PathEscape(comp.ID))
+	if comp.ShareToken.Valid {
+		p += "?token=" + url.QueryEscape(comp.ShareToken.String)
+	}
+	return p
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/publish
+// 大会のランキングを認証なしで閲覧できるように公開する
+// share_token=true の場合は共有用トークンを発行し、トークンを知っている人だけが閲覧できるようにする
+// 公開し直すとトークンは発行し直される
+func (s *Server) competitionPublishHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	var withToken bool
+	if s := c.FormValue("share_token"); s != "" {
+		if withToken, err = strconv.ParseBool(s); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid share_token: %s", s))
+		}
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	id := c.Param("competition_id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, id)
+	if err != nil {
+		// 存在しない大会
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	now := s.now()
+	comp.PublishedAt = sql.NullInt64{Int64: now, Valid: true}
+	comp.ShareToken = sql.NullString{}
+	if withToken {
+		token, err := randomHex(32)
+		if err != nil {
+			return err
+		}
+		comp.ShareToken = sql.NullString{String: token, Valid: true}
+	}
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE competition SET published_at = ?, share_token = ?, updated_by = ?, updated_at = ? WHERE id = ?",
+		comp.PublishedAt, comp.ShareToken, v.playerID, now, id,
+	); err != nil {
+		return fmt.Errorf("error Update competition: publishedAt=%d, updatedAt=%d, id=%s, %w", now, now, id, err)
+	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventCompetitionPublished, competitionEventData(comp)); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+
+	res := CompetitionPublishHandlerResult{
+		Competition: competitionEventData(comp).Competition,
+		PublishedAt: now,
+		Path:        publicRankingPath(comp),
+	}
+	if comp.ShareToken.Valid {
+		res.ShareToken = &comp.ShareToken.String
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/competition/:competition_id/unpublish
+// 大会のランキングの公開をやめる
+// 発行済みの共有用トークンは使えなくなる
+func (s *Server) competitionUnpublishHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	id := c.Param("competition_id")
+	if id == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition_id required")
+	}
+	comp, err := retrieveCompetition(ctx, tenantDB, id)
+	if err != nil {
+		// 存在しない大会
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	if !comp.PublishedAt.Valid {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition is not published")
+	}
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+	now := s.now()
+	if _, err := tx.ExecContext(
+		ctx,
+		"UPDATE competition SET published_at = NULL, share_token = NULL, updated_by = ?, updated_at = ? WHERE id = ?",
+		v.playerID, now, id,
+	); err != nil {
+		return fmt.Errorf("error Update competition: updatedAt=%d, id=%s, %w", now, id, err)
+	}
+	if err := recordDomainEvent(ctx, tx, now, v.tenantID, DomainEventCompetitionUnpublished, competitionEventData(comp)); err != nil {
+		return fmt.Errorf("error recordDomainEvent: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+	if err := s.notifyDomainEvents(ctx, v.tenantID); err != nil {
+		return fmt.Errorf("error notifyDomainEvents: %w", err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+// 公開API
+// GET /api/public/competition/:competition_id/ranking
+// 公開された大会のランキングを認証なしで取得する
+// 閲覧は課金対象にしない
+func (s *Server) publicCompetitionRankingHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	tenant, err := s.retrieveTenantRowFromHeader(c)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "tenant not found")
+		}
+		return fmt.Errorf("error retrieveTenantRowFromHeader: %w", err)
+	}
+	if tenant.Name == "admin" {
+		return echo.NewHTTPError(http.StatusNotFound, "admin has not this API")
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, tenant.ID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition_id is required")
+	}
+	competition, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	// 公開されていない大会やトークンが一致しない場合は、大会の存在を知られないように404にする
+	if !competition.PublishedAt.Valid {
+		return echo.NewHTTPError(http.StatusNotFound, "competition not found")
+	}
+	if competition.ShareToken.Valid &&
+		subtle.ConstantTimeCompare([]byte(competition.ShareToken.String), []byte(c.QueryParam("token"))) != 1 {
+		return echo.NewHTTPError(http.StatusNotFound, "competition not found")
+	}
+
+	var rankAfter int64
+	if rankAfterStr := c.QueryParam("rank_after"); rankAfterStr != "" {
+		if rankAfter, err = strconv.ParseInt(rankAfterStr, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid rank_after: %s", rankAfterStr))
+		}
+	}
+
+	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
+	fl, err := s.flockByTenantID(ctx, tenant.ID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+	ranks, err := competitionRanking(ctx, tenantDB, tenant.ID, competitionID)
+	if err != nil {
+		return fmt.Errorf("error competitionRanking: %w", err)
+	}
+
+	// 全APIに設定されるCache-Control: privateを上書きして、CDNなどでもキャッシュできるようにする
+	maxAge := publicRankingMaxAge
+	if competition.FinishedAt.Valid {
+		maxAge = publicRankingFinishedMaxAge
+	}
+	c.Response().Header().Set(echo.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", maxAge))
+
+	res := SuccessResult{
+		Status: true,
+		Data: CompetitionRankingHandlerResult{
+			Competition: competitionEventData(competition).Competition,
+			Ranks:       pageRanks(ranks, rankAfter),
+		},
+	}
+	return c.JSON(http.StatusOK, res)
+}
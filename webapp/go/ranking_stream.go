@@ -0,0 +1,328 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const rankingStreamHeartbeatInterval = 15 * time.Second
+
+// 購読者に配信するランキング
+// 購読者間で共有されるので変更しないこと
+type rankingSnapshot struct {
+	Competition CompetitionDetail
+	Ranks       []CompetitionRank
+}
+
+type rankingTopic struct {
+	tenantID      int64
+	competitionID string
+}
+
+// ランキングの購読者
+// 通知は最新のランキングだけを保持し、読み出されていない古いランキングは捨てる
+// 遅いクライアントがいてもメモリを使い続けず、追いついたときに最新との差分を送ればよい
+type rankingSubscriber struct {
+	mu      sync.Mutex
+	pending *rankingSnapshot
+	notify  chan struct{}
+}
+
+func (s *rankingSubscriber) push(snap *rankingSnapshot) {
+	s.mu.Lock()
+	s.pending = snap
+	s.mu.Unlock()
+	select {
+	case s.notify <- struct{}{}:
+	default:
+	}
+}
+
+func (s *rankingSubscriber) take() *rankingSnapshot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snap := s.pending
+	s.pending = nil
+	return snap
+}
+
+// テナントと大会ごとのランキング購読者を管理する
+type rankingHub struct {
+	mu          sync.Mutex
+	subscribers map[rankingTopic]map[*rankingSubscriber]struct{}
+}
+
+func (h *rankingHub) subscribe(topic rankingTopic) *rankingSubscriber {
+	s := &rankingSubscriber{notify: make(chan struct{}, 1)}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.subscribers[topic]; !ok {
+		h.subscribers[topic] = map[*rankingSubscriber]struct{}{}
+	}
+	h.subscribers[topic][s] = struct{}{}
+	return s
+}
+
+func (h *rankingHub) unsubscribe(topic rankingTopic, s *rankingSubscriber) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers[topic], s)
+	if len(h.subscribers[topic]) == 0 {
+		delete(h.subscribers, topic)
+	}
+}
+
+func (h *rankingHub) hasSubscribers(topic rankingTopic) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subscribers[topic]) > 0
+}
+
+func (h *rankingHub) publish(topic rankingTopic, snap *rankingSnapshot) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subscribers[topic] {
+		s.push(snap)
+	}
+}
+
+// 大会のランキングを購読者に配信する
+// 購読者がいなければランキングを計算しない
+func (s *Server) publishRanking(ctx context.Context, tenantDB dbOrTx, comp *CompetitionRow) error {
+	topic := rankingTopic{tenantID: comp.TenantID, competitionID: comp.ID}
+	if !s.rankingStreamHub.hasSubscribers(topic) {
+		return nil
+	}
+	fl, err := s.flockByTenantID(ctx, comp.TenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+	ranks, err := competitionRanking(ctx, tenantDB, comp.TenantID, comp.ID)
+	if err != nil {
+		return fmt.Errorf("error competitionRanking: %w", err)
+	}
+	s.rankingStreamHub.publish(topic, &rankingSnapshot{
+		Competition: competitionEventData(comp).Competition,
+		Ranks:       ranks,
+	})
+	return nil
+}
+
+// スコアの入稿と大会の終了のドメインイベントを受けてランキングを配信する
+func (s *Server) publishRankingOnDomainEvent(ctx context.Context, ev *DomainEventRow) error {
+	var competitionID string
+	switch ev.Type {
+	case DomainEventScoresUploaded:
+		var data ScoresUploadedEventData
+		if err := json.Unmarshal([]byte(ev.Payload), &data); err != nil {
+			return fmt.Errorf("error json.Unmarshal: %w", err)
+		}
+		competitionID = data.CompetitionID
+	case DomainEventCompetitionFinished:
+		var data CompetitionEventData
+		if err := json.Unmarshal([]byte(ev.Payload), &data); err != nil {
+			return fmt.Errorf("error json.Unmarshal: %w", err)
+		}
+		competitionID = data.Competition.ID
+	default:
+		return nil
+	}
+	if !s.rankingStreamHub.hasSubscribers(rankingTopic{tenantID: ev.TenantID, competitionID: competitionID}) {
+		return nil
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, ev.TenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+	comp, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		// 削除された大会
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+	return s.publishRanking(ctx, tenantDB, comp)
+}
+
+type RankingStreamSnapshotEvent struct {
+	Competition CompetitionDetail `json:"competition"`
+	Ranks       []CompetitionRank `json:"ranks"`
+}
+
+type RankingStreamDiffEvent struct {
+	Competition CompetitionDetail `json:"competition"`
+	Upserts     []CompetitionRank `json:"upserts"` // 追加・変更された順位
+	Removes     []string          `json:"removes"` // 表示範囲から外れた参加者のID
+}
+
+// 前回送信したランキングとの差分を求める
+func diffCompetitionRanks(prev, next []CompetitionRank) ([]CompetitionRank, []string) {
+	prevByPlayer := make(map[string]CompetitionRank, len(prev))
+	for _, r := range prev {
+		prevByPlayer[r.PlayerID] = r
+	}
+	upserts := []CompetitionRank{}
+	for _, r := range next {
+		p, ok := prevByPlayer[r.PlayerID]
+		delete(prevByPlayer, r.PlayerID)
+		if ok && p.Rank == r.Rank && p.Score == r.Score && p.PlayerDisplayName == r.PlayerDisplayName {
+			continue
+		}
+		upserts = append(upserts, r)
+	}
+	removes := make([]string, 0, len(prevByPlayer))
+	for _, r := range prev {
+		if _, ok := prevByPlayer[r.PlayerID]; ok {
+			removes = append(removes, r.PlayerID)
+		}
+	}
+	return upserts, removes
+}
+
+// Server-Sent Eventsのイベントを1件書き込む
+func writeSSE(c echo.Context, event string, data any) error {
+	b, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	w := c.Response()
+	if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, b); err != nil {
+		return err
+	}
+	w.Flush()
+	return nil
+}
+
+// 参加者向けAPI
+// GET /api/player/competition/:competition_id/ranking/stream
+// 大会のランキングの更新をServer-Sent Eventsで配信する
+// 最初にsnapshotイベントで現在のランキングを送り、以降はスコアの入稿や大会の終了のたびにdiffイベントで差分を送る
+// 大会が終了したらfinishedイベントを送って切断する
+func (s *Server) competitionRankingStreamHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	// 配信中はテナントDBを使わないので、購読を始めたら閉じる
+	defer tenantDB.Close()
+
+	if err := authorizePlayer(ctx, tenantDB, v.playerID, s.now()); err != nil {
+		return err
+	}
+
+	competitionID := c.Param("competition_id")
+	if competitionID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition_id is required")
+	}
+	competition, err := retrieveCompetition(ctx, tenantDB, competitionID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "competition not found")
+		}
+		return fmt.Errorf("error retrieveCompetition: %w", err)
+	}
+
+	var rankAfter int64
+	if rankAfterStr := c.QueryParam("rank_after"); rankAfterStr != "" {
+		if rankAfter, err = strconv.ParseInt(rankAfterStr, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid rank_after: %s", rankAfterStr))
+		}
+	}
+
+	// 購読の開始をランキングの閲覧とみなして課金対象にする
+	if err := s.recordVisitHistory(ctx, v.playerID, v.tenantID, competitionID, s.now()); err != nil {
+		return err
+	}
+
+	// ランキングを計算している間の更新を取りこぼさないように、先に購読しておく
+	topic := rankingTopic{tenantID: v.tenantID, competitionID: competitionID}
+	sub := s.rankingStreamHub.subscribe(topic)
+	defer s.rankingStreamHub.unsubscribe(topic, sub)
+
+	fl, err := s.flockByTenantID(ctx, v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	ranks, err := competitionRanking(ctx, tenantDB, v.tenantID, competitionID)
+	fl.Close()
+	if err != nil {
+		return fmt.Errorf("error competitionRanking: %w", err)
+	}
+	tenantDB.Close()
+
+	w := c.Response()
+	w.Header().Set(echo.HeaderContentType, "text/event-stream")
+	w.Header().Set(echo.HeaderCacheControl, "private, no-cache")
+	// nginxでバッファリングされないようにする
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	detail := competitionEventData(competition).Competition
+	sent := pageRanks(ranks, rankAfter)
+	// ヘッダを送った後はエラーレスポンスを返せないので、書き込みに失敗したら切断する
+	if err := writeSSE(c, "snapshot", RankingStreamSnapshotEvent{Competition: detail, Ranks: sent}); err != nil {
+		return nil
+	}
+	if detail.IsFinished {
+		writeSSE(c, "finished", detail)
+		return nil
+	}
+
+	heartbeat := time.NewTicker(rankingStreamHeartbeatInterval)
+	defer heartbeat.Stop()
+	done := c.Request().Context().Done()
+	for {
+		select {
+		case <-done:
+			return nil
+		case <-heartbeat.C:
+			if _, err := fmt.Fprint(w, ": ping\n\n"); err != nil {
+				return nil
+			}
+			w.Flush()
+		case <-sub.notify:
+			snap := sub.take()
+			if snap == nil {
+				continue
+			}
+			next := pageRanks(snap.Ranks, rankAfter)
+			upserts, removes := diffCompetitionRanks(sent, next)
+			sent = next
+			if len(upserts) > 0 || len(removes) > 0 {
+				if err := writeSSE(c, "diff", RankingStreamDiffEvent{
+					Competition: snap.Competition,
+					Upserts:     upserts,
+					Removes:     removes,
+				}); err != nil {
+					return nil
+				}
+			}
+			if snap.Competition.IsFinished {
+				writeSSE(c, "finished", snap.Competition)
+				return nil
+			}
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package isuports
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// レート制限をかけるエンドポイントの分類
+const (
+	RateLimitClassScore   = "score"   // スコアや参加者CSVの入稿
+	RateLimitClassRanking = "ranking" // ランキングの閲覧
+	RateLimitClassWrite   = "write"   // その他の更新系API
+	RateLimitClassRead    = "read"    // その他の参照系API
+	RateLimitClassAdmin   = "admin"   // SaaS管理者向けAPI
+
+	// レート制限の単位
+	RateLimitScopeTenant = "tenant" // テナントごと
+	RateLimitScopePlayer = "player" // ログインしているユーザーごと
+
+	rateLimitCleanupInterval = time.Minute
+)
+
+var rateLimitClassByRoute = map[string]string{
+	"POST /api/organizer/competition/:competition_id/score":      RateLimitClassScore,
+	"POST /api/organizer/players/import":                         RateLimitClassScore,
+	"GET /api/player/competition/:competition_id/ranking":        RateLimitClassRanking,
+	"GET /api/player/competition/:competition_id/ranking/stream": RateLimitClassRanking,
+	"GET /api/player/season/:season_id/ranking":                  RateLimitClassRanking,
+	"GET /api/public/competition/:competition_id/ranking":        RateLimitClassRanking,
+}
+
+// ルーティングされたパスからエンドポイントの分類を返す
+// /initialize と監視用APIは制限しないので空文字列を返す
+func rateLimitClass(method, path string) string {
+	switch path {
+	case "/initialize", "/metrics", "/healthz", "/readyz":
+		return ""
+	}
+	if class, ok := rateLimitClassByRoute[method+" "+path]; ok {
+		return class
+	}
+	if strings.HasPrefix(path, "/api/admin/") {
+		return RateLimitClassAdmin
+	}
+	if method == http.MethodGet || method == http.MethodHead {
+		return RateLimitClassRead
+	}
+	return RateLimitClassWrite
+}
+
+type rateLimitRule struct {
+	Rate  float64 // 1秒あたりに補充するトークン数
+	Burst float64 // バケットの容量
+}
+
+// レート制限の設定を読み取る
+// "<分類>.<単位>=<1秒あたりのリクエスト数>/<バースト>" をカンマ区切りで並べる
+// 例: "score.tenant=1/5,ranking.player=10/20"
+func parseRateLimitRules(s string) (map[string]map[string]rateLimitRule, error) {
+	rules := map[string]map[string]rateLimitRule{}
+	for _, entry := range strings.Split(s, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		target, limit, ok := strings.Cut(entry, "=")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit: %s", entry)
+		}
+		class, scope, ok := strings.Cut(target, ".")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit target: %s", entry)
+		}
+		switch class {
+		case RateLimitClassScore, RateLimitClassRanking, RateLimitClassWrite, RateLimitClassRead, RateLimitClassAdmin:
+		default:
+			return nil, fmt.Errorf("invalid rate limit class: %s", entry)
+		}
+		if scope != RateLimitScopeTenant && scope != RateLimitScopePlayer {
+			return nil, fmt.Errorf("invalid rate limit scope: %s", entry)
+		}
+		rateStr, burstStr, ok := strings.Cut(limit, "/")
+		if !ok {
+			return nil, fmt.Errorf("invalid rate limit: %s", entry)
+		}
+		rate, err := strconv.ParseFloat(rateStr, 64)
+		if err != nil || rate <= 0 {
+			return nil, fmt.Errorf("invalid rate limit rate: %s", entry)
+		}
+		burst, err := strconv.ParseFloat(burstStr, 64)
+		if err != nil || burst < 1 {
+			return nil, fmt.Errorf("invalid rate limit burst: %s", entry)
+		}
+		if rules[class] == nil {
+			rules[class] = map[string]rateLimitRule{}
+		}
+		rules[class][scope] = rateLimitRule{Rate: rate, Burst: burst}
+	}
+	return rules, nil
+}
+
+type rateLimitBucketKey struct {
+	class   string
+	scope   string
+	subject string // テナント名、またはテナント名とユーザーID
+}
+
+type tokenBucket struct {
+	rule   rateLimitRule
+	tokens float64
+	last   time.Time
+}
+
+// 経過時間に応じてトークンを補充する
+func (b *tokenBucket) refill(now time.Time) {
+	elapsed := now.Sub(b.last).Seconds()
+	if elapsed > 0 {
+		b.tokens = math.Min(b.rule.Burst, b.tokens+elapsed*b.rule.Rate)
+		b.last = now
+	}
+}
+
+type rateLimitCounterKey struct {
+	tenant string
+	class  string
+	scope  string
+}
+
+// トークンバケットによるレート制限
+type rateLimiter struct {
+	mu                 sync.Mutex
+	rules              map[string]map[string]rateLimitRule // 分類 -> 単位 -> 制限
+	buckets            map[rateLimitBucketKey]*tokenBucket
+	throttled          map[rateLimitCounterKey]int64 // 起動してから制限したリクエスト数
+	retryAfterHTTPDate bool                          // Retry-AfterをHTTP-dateで返す
+}
+
+func newRateLimiter(rules map[string]map[string]rateLimitRule, retryAfterHTTPDate bool) *rateLimiter {
+	return &rateLimiter{
+		rules:              rules,
+		buckets:            map[rateLimitBucketKey]*tokenBucket{},
+		throttled:          map[rateLimitCounterKey]int64{},
+		retryAfterHTTPDate: retryAfterHTTPDate,
+	}
+}
+
+// 全てのバケットからトークンを1つずつ取り出す
+// どれか1つでも足りなければ取り出さずに、トークンが補充されるまでの時間を返す
+func (l *rateLimiter) take(keys []rateLimitBucketKey, tenant string, now time.Time) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	bs := make([]*tokenBucket, 0, len(keys))
+	var wait time.Duration
+	var throttledBy *rateLimitBucketKey
+	for i, key := range keys {
+		b, ok := l.buckets[key]
+		if !ok {
+			rule := l.rules[key.class][key.scope]
+			b = &tokenBucket{rule: rule, tokens: rule.Burst, last: now}
+			l.buckets[key] = b
+		}
+		b.refill(now)
+		if b.tokens < 1 {
+			w := time.Duration((1 - b.tokens) / b.rule.Rate * float64(time.Second))
+			if w > wait {
+				wait = w
+				throttledBy = &keys[i]
+			}
+		}
+		bs = append(bs, b)
+	}
+	if throttledBy != nil {
+		l.throttled[rateLimitCounterKey{tenant: tenant, class: throttledBy.class, scope: throttledBy.scope}]++
+		return false, wait
+	}
+	for _, b := range bs {
+		b.tokens--
+	}
+	return true, 0
+}
+
+// 満タンになったバケットを捨てる
+// 捨てても次のリクエストで満タンのバケットが作られるので結果は変わらない
+func (l *rateLimiter) cleanup(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for key, b := range l.buckets {
+		b.refill(now)
+		if b.tokens >= b.rule.Burst {
+			delete(l.buckets, key)
+		}
+	}
+}
+
+func runRateLimitCleaner(ctx context.Context, l *rateLimiter) {
+	ticker := time.NewTicker(rateLimitCleanupInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			l.cleanup(now)
+		}
+	}
+}
+
+// Retry-Afterの値を返す
+// delay-secondsの場合は切り上げた秒数、HTTP-dateの場合は再試行できる時刻を返す
+func (l *rateLimiter) retryAfter(wait time.Duration, now time.Time) string {
+	sec := int64(math.Ceil(wait.Seconds()))
+	if sec < 1 {
+		sec = 1
+	}
+	if l.retryAfterHTTPDate {
+		return now.Add(time.Duration(sec) * time.Second).UTC().Format(http.TimeFormat)
+	}
+	return strconv.FormatInt(sec, 10)
+}
+
+// テナント、ユーザー、エンドポイントの分類ごとにレート制限をかけるミドルウェア
+// 制限を超えたリクエストには429とRetry-Afterを返す
+// カスタムドメインとサブドメインで同じバケットを使うように、retrieveTenantで解決したテナントごとに制限する
+// ユーザーごとの制限のため、parseViewerでリクエストの参加者を調べる
+func (l *rateLimiter) Middleware(retrieveTenant func(c echo.Context) (*TenantRow, error), parseViewer func(c echo.Context) (*Viewer, error)) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			class := rateLimitClass(c.Request().Method, c.Path())
+			rules := l.rules[class]
+			if len(rules) == 0 {
+				return next(c)
+			}
+			// 存在しないテナントへのリクエストはハンドラでエラーになるので、制限はかけない
+			t, err := retrieveTenant(c)
+			if err != nil {
+				return next(c)
+			}
+			tenant := t.Name
+			keys := make([]rateLimitBucketKey, 0, 2)
+			if _, ok := rules[RateLimitScopeTenant]; ok {
+				keys = append(keys, rateLimitBucketKey{class: class, scope: RateLimitScopeTenant, subject: tenant})
+			}
+			if _, ok := rules[RateLimitScopePlayer]; ok {
+				// 認証に失敗した場合はハンドラでエラーになるので、ユーザーごとの制限はかけない
+				if v, err := parseViewer(c); err == nil {
+					keys = append(keys, rateLimitBucketKey{class: class, scope: RateLimitScopePlayer, subject: tenant + ":" + v.playerID})
+				}
+			}
+			if len(keys) == 0 {
+				return next(c)
+			}
+
+			now := time.Now()
+			if ok, wait := l.take(keys, tenant, now); !ok {
+				c.Response().Header().Set(echo.HeaderRetryAfter, l.retryAfter(wait, now))
+				return c.JSON(http.StatusTooManyRequests, FailureResult{
+					Status:    false,
+					Message:   "too many requests",
+					RequestID: requestID(c),
+				})
+			}
+			return next(c)
+		}
+	}
+}
+
+type RateLimitRuleDetail struct {
+	Class string  `json:"class"`
+	Scope string  `json:"scope"`
+	Rate  float64 `json:"rate"`
+	Burst float64 `json:"burst"`
+}
+
+type RateLimitThrottledDetail struct {
+	Tenant string `json:"tenant"`
+	Class  string `json:"class"`
+	Scope  string `json:"scope"`
+	Count  int64  `json:"count"`
+}
+
+type RateLimitsHandlerResult struct {
+	Rules     []RateLimitRuleDetail      `json:"rules"`
+	Throttled []RateLimitThrottledDetail `json:"throttled"`
+}
+
+func (l *rateLimiter) stats() RateLimitsHandlerResult {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	res := RateLimitsHandlerResult{
+		Rules:     []RateLimitRuleDetail{},
+		Throttled: make([]RateLimitThrottledDetail, 0, len(l.throttled)),
+	}
+	for class, scopes := range l.rules {
+		for scope, rule := range scopes {
+			res.Rules = append(res.Rules, RateLimitRuleDetail{Class: class, Scope: scope, Rate: rule.Rate, Burst: rule.Burst})
+		}
+	}
+	for key, count := range l.throttled {
+		res.Throttled = append(res.Throttled, RateLimitThrottledDetail{Tenant: key.tenant, Class: key.class, Scope: key.scope, Count: count})
+	}
+	sort.Slice(res.Rules, func(i, j int) bool {
+		if res.Rules[i].Class != res.Rules[j].Class {
+			return res.Rules[i].Class < res.Rules[j].Class
+		}
+		return res.Rules[i].Scope < res.Rules[j].Scope
+	})
+	sort.Slice(res.Throttled, func(i, j int) bool {
+		if res.Throttled[i].Count != res.Throttled[j].Count {
+			return res.Throttled[i].Count > res.Throttled[j].Count
+		}
+		if res.Throttled[i].Tenant != res.Throttled[j].Tenant {
+			return res.Throttled[i].Tenant < res.Throttled[j].Tenant
+		}
+		if res.Throttled[i].Class != res.Throttled[j].Class {
+			return res.Throttled[i].Class < res.Throttled[j].Class
+		}
+		return res.Throttled[i].Scope < res.Throttled[j].Scope
+	})
+	return res
+}
+
+// SaaS管理者向けAPI
+// GET /api/admin/rate_limits
+// レート制限の設定と、起動してから制限したリクエスト数を多い順に返す
+func (s *Server) rateLimitsHandler(c echo.Context) error {
+	if host := c.Request().Host; host != s.adminHostname {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("invalid hostname %s", host),
+		)
+	}
+	if v, err := s.parseViewer(c); err != nil {
+		return err
+	} else if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: s.rateLimits.stats()})
+}
@@ -0,0 +1,83 @@
+package isuports
+
+import (
+	"context"
+	"regexp"
+	"sync/atomic"
+
+	"github.com/labstack/echo/v4"
+)
+
+const requestInfoContextKey = "request_info"
+
+// リクエストを識別する情報
+// SQLのトレースログなど、echo.Contextを持たない処理からリクエストを辿るために使う
+type requestInfo struct {
+	RequestID string
+	Route     string // Run()で登録したパスのテンプレート
+	tenantID  int64  // テナントが分かるまでは0。atomicで読み書きする
+	span      *span  // ハンドラ全体の区間。トレースが無効ならnil
+}
+
+func (ri *requestInfo) TenantID() int64 {
+	return atomic.LoadInt64(&ri.tenantID)
+}
+
+type requestInfoKey struct{}
+
+// リクエストで指定されたX-Request-IDとして受け付ける形式
+// ログにそのまま出力するので、記号や長すぎる値は受け付けずに新しく採番する
+var requestIDRegexp = regexp.MustCompile(`^[A-Za-z0-9._-]{1,128}$`)
+
+// リクエストIDを決めてリクエストの情報をecho.Contextに設定するミドルウェア
+// リクエストIDはX-Request-IDヘッダでレスポンスに返す
+// ログに含めるため、最も外側に置くこと
+func SetRequestInfo(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		id := c.Request().Header.Get(echo.HeaderXRequestID)
+		if !requestIDRegexp.MatchString(id) {
+			var err error
+			if id, err = randomHex(16); err != nil {
+				return err
+			}
+		}
+		c.Response().Header().Set(echo.HeaderXRequestID, id)
+		c.Set(requestInfoContextKey, &requestInfo{
+			RequestID: id,
+			Route:     c.Path(),
+		})
+		return next(c)
+	}
+}
+
+// リクエストIDを返す
+func requestID(c echo.Context) string {
+	if ri, ok := c.Get(requestInfoContextKey).(*requestInfo); ok {
+		return ri.RequestID
+	}
+	return ""
+}
+
+// リクエストの対象のテナントを記録する
+func setRequestTenantID(c echo.Context, tenantID int64) {
+	if ri, ok := c.Get(requestInfoContextKey).(*requestInfo); ok {
+		atomic.StoreInt64(&ri.tenantID, tenantID)
+	}
+}
+
+// ハンドラでDBにアクセスするときに使うcontextを返す
+// クライアントが切断しても処理を中断しないように、リクエストのcontextのキャンセルは引き継がない
+func requestContext(c echo.Context) context.Context {
+	ctx := context.Background()
+	if ri, ok := c.Get(requestInfoContextKey).(*requestInfo); ok {
+		ctx = context.WithValue(ctx, requestInfoKey{}, ri)
+	}
+	return ctx
+}
+
+// contextからリクエストの情報を取り出す
+// リクエストの外で動いている処理ではnilを返す
+func requestInfoFromContext(ctx context.Context) *requestInfo {
+	ri, _ := ctx.Value(requestInfoKey{}).(*requestInfo)
+	return ri
+}
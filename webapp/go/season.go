@@ -0,0 +1,421 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+type SeasonRow struct {
+	TenantID    int64  `db:"tenant_id"`
+	ID          string `db:"id"`
+	Title       string `db:"title"`
+	PointsTable string `db:"points_table"` // 順位ごとの獲得ポイントのJSON配列
+	CreatedBy   string `db:"created_by"`
+	UpdatedBy   string `db:"updated_by"`
+	CreatedAt   int64  `db:"created_at"`
+	UpdatedAt   int64  `db:"updated_at"`
+}
+
+type SeasonCompetitionRow struct {
+	TenantID      int64  `db:"tenant_id"`
+	SeasonID      string `db:"season_id"`
+	CompetitionID string `db:"competition_id"`
+	CreatedAt     int64  `db:"created_at"`
+}
+
+type SeasonDetail struct {
+	ID           string              `json:"id"`
+	Title        string              `json:"title"`
+	PointsTable  []int64             `json:"points_table"`
+	Competitions []CompetitionDetail `json:"competitions"`
+}
+
+// シーズンを取得する
+func retrieveSeason(ctx context.Context, tenantDB dbOrTx, id string) (*SeasonRow, error) {
+	var s SeasonRow
+	if err := tenantDB.GetContext(ctx, &s, "SELECT * FROM season WHERE id = ?", id); err != nil {
+		return nil, fmt.Errorf("error Select season: id=%s, %w", id, err)
+	}
+	return &s, nil
+}
+
+// シーズンに含まれる大会を作成日時の昇順で取得する
+// 削除済みの大会は含まない
+func retrieveSeasonCompetitions(ctx context.Context, tenantDB dbOrTx, tenantID int64, seasonID string) ([]CompetitionRow, error) {
+	cs := []CompetitionRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&cs,
+		"SELECT competition.* FROM season_competition JOIN competition ON competition.id = season_competition.competition_id"+
+			" WHERE season_competition.tenant_id = ? AND season_competition.season_id = ? AND competition.deleted_at IS NULL"+
+			" ORDER BY competition.created_at ASC",
+		tenantID, seasonID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select season_competition: tenantID=%d, seasonID=%s, %w", tenantID, seasonID, err)
+	}
+	return cs, nil
+}
+
+func seasonDetail(s *SeasonRow, cs []CompetitionRow) (*SeasonDetail, error) {
+	var pointsTable []int64
+	if err := json.Unmarshal([]byte(s.PointsTable), &pointsTable); err != nil {
+		return nil, fmt.Errorf("error json.Unmarshal points_table: seasonID=%s, %w", s.ID, err)
+	}
+	cds := make([]CompetitionDetail, 0, len(cs))
+	for _, comp := range cs {
+		cds = append(cds, CompetitionDetail{
+			ID:         comp.ID,
+			Title:      comp.Title,
+			IsFinished: comp.FinishedAt.Valid,
+			StartAt:    nullInt64Ptr(comp.StartAt),
+			EndAt:      nullInt64Ptr(comp.EndAt),
+		})
+	}
+	return &SeasonDetail{
+		ID:           s.ID,
+		Title:        s.Title,
+		PointsTable:  pointsTable,
+		Competitions: cds,
+	}, nil
+}
+
+type SeasonsAddHandlerResult struct {
+	Season SeasonDetail `json:"season"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/seasons/add
+// 大会をまとめたシーズンを追加する
+func (s *Server) seasonsAddHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	params, err := c.FormParams()
+	if err != nil {
+		return fmt.Errorf("error c.FormParams: %w", err)
+	}
+	title := c.FormValue("title")
+	if title == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "title required")
+	}
+	competitionIDs := params["competition_id[]"]
+	if len(competitionIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "competition_id[] required")
+	}
+	pointsStrs := params["points[]"]
+	if len(pointsStrs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "points[] required")
+	}
+	// points[]はn番目の値がn位の獲得ポイントになる
+	pointsTable := make([]int64, 0, len(pointsStrs))
+	for _, ps := range pointsStrs {
+		points, err := strconv.ParseInt(ps, 10, 64)
+		if err != nil || points < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid points: %s", ps))
+		}
+		pointsTable = append(pointsTable, points)
+	}
+	pointsJSON, err := json.Marshal(pointsTable)
+	if err != nil {
+		return fmt.Errorf("error json.Marshal points_table: %w", err)
+	}
+
+	tx, err := tenantDB.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("error tenantDB.BeginTxx: %w", err)
+	}
+	defer tx.Rollback()
+
+	id, err := s.ids.DispenseID(ctx)
+	if err != nil {
+		return fmt.Errorf("error DispenseID: %w", err)
+	}
+	now := s.now()
+	season := SeasonRow{
+		TenantID:    v.tenantID,
+		ID:          id,
+		Title:       title,
+		PointsTable: string(pointsJSON),
+		CreatedBy:   v.playerID,
+		UpdatedBy:   v.playerID,
+		CreatedAt:   now,
+		UpdatedAt:   now,
+	}
+	if _, err := tx.NamedExecContext(
+		ctx,
+		"INSERT INTO season (id, tenant_id, title, points_table, created_by, updated_by, created_at, updated_at) VALUES (:id, :tenant_id, :title, :points_table, :created_by, :updated_by, :created_at, :updated_at)",
+		season,
+	); err != nil {
+		return fmt.Errorf(
+			"error Insert season: id=%s, tenant_id=%d, title=%s, createdAt=%d, updatedAt=%d, %w",
+			id, v.tenantID, title, now, now, err,
+		)
+	}
+	added := map[string]struct{}{}
+	for _, competitionID := range competitionIDs {
+		if _, ok := added[competitionID]; ok {
+			continue
+		}
+		added[competitionID] = struct{}{}
+		if _, err := retrieveCompetition(ctx, tx, competitionID); err != nil {
+			// 存在しない大会が含まれている
+			if errors.Is(err, sql.ErrNoRows) {
+				return echo.NewHTTPError(
+					http.StatusBadRequest,
+					fmt.Sprintf("competition not found: %s", competitionID),
+				)
+			}
+			return fmt.Errorf("error retrieveCompetition: %w", err)
+		}
+		if _, err := tx.ExecContext(
+			ctx,
+			"INSERT INTO season_competition (tenant_id, season_id, competition_id, created_at) VALUES (?, ?, ?, ?)",
+			v.tenantID, id, competitionID, now,
+		); err != nil {
+			return fmt.Errorf(
+				"error Insert season_competition: seasonID=%s, competitionID=%s, %w",
+				id, competitionID, err,
+			)
+		}
+	}
+	cs, err := retrieveSeasonCompetitions(ctx, tx, v.tenantID, id)
+	if err != nil {
+		return fmt.Errorf("error retrieveSeasonCompetitions: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error tx.Commit: %w", err)
+	}
+
+	sd, err := seasonDetail(&season, cs)
+	if err != nil {
+		return fmt.Errorf("error seasonDetail: %w", err)
+	}
+	setAuditTarget(c, sd.ID)
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: SeasonsAddHandlerResult{Season: *sd}})
+}
+
+type SeasonsHandlerResult struct {
+	Seasons []SeasonDetail `json:"seasons"`
+}
+
+// 参加者向けAPI
+// GET /api/player/seasons
+// シーズンの一覧を取得する
+func (s *Server) playerSeasonsHandler(c echo.Context) error {
+	ctx := requestContext(c)
+
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	if err := authorizePlayer(ctx, tenantDB, v.playerID, s.now()); err != nil {
+		return err
+	}
+	return seasonsHandler(c, v, tenantDB)
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/seasons
+// シーズンの一覧を取得する
+func (s *Server) organizerSeasonsHandler(c echo.Context) error {
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return err
+	}
+	tenantDB, err := s.connectToTenantDB(requestContext(c), v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	return seasonsHandler(c, v, tenantDB)
+}
+
+func seasonsHandler(c echo.Context, v *Viewer, tenantDB dbOrTx) error {
+	ctx := requestContext(c)
+
+	ss := []SeasonRow{}
+	if err := tenantDB.SelectContext(
+		ctx,
+		&ss,
+		"SELECT * FROM season WHERE tenant_id = ? ORDER BY created_at DESC",
+		v.tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select season: %w", err)
+	}
+	sds := make([]SeasonDetail, 0, len(ss))
+	for _, s := range ss {
+		cs, err := retrieveSeasonCompetitions(ctx, tenantDB, v.tenantID, s.ID)
+		if err != nil {
+			return fmt.Errorf("error retrieveSeasonCompetitions: %w", err)
+		}
+		sd, err := seasonDetail(&s, cs)
+		if err != nil {
+			return fmt.Errorf("error seasonDetail: %w", err)
+		}
+		sds = append(sds, *sd)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: SeasonsHandlerResult{Seasons: sds}})
+}
+
+type SeasonRank struct {
+	Rank              int64  `json:"rank"`
+	Points            int64  `json:"points"`
+	PlayerID          string `json:"player_id"`
+	PlayerDisplayName string `json:"player_display_name"`
+	Competitions      int64  `json:"competitions"` // スコアを登録した大会数
+	BestRank          int64  `json:"best_rank"`    // 大会での最高順位
+}
+
+type SeasonRankingHandlerResult struct {
+	Season SeasonDetail `json:"season"`
+	Ranks  []SeasonRank `json:"ranks"`
+}
+
+// 大会ごとのランキングの順位に応じたポイントを合計してシーズンのランキングを計算する
+// ポイントが同じ場合は大会での最高順位が高いほう、それも同じ場合は参加者IDの昇順で上位とする
+func seasonRanking(pointsTable []int64, competitionRanks [][]CompetitionRank) []SeasonRank {
+	rankByPlayer := map[string]*SeasonRank{}
+	for _, ranks := range competitionRanks {
+		for _, r := range ranks {
+			sr, ok := rankByPlayer[r.PlayerID]
+			if !ok {
+				sr = &SeasonRank{
+					PlayerID:          r.PlayerID,
+					PlayerDisplayName: r.PlayerDisplayName,
+					BestRank:          r.Rank,
+				}
+				rankByPlayer[r.PlayerID] = sr
+			}
+			if r.Rank <= int64(len(pointsTable)) {
+				sr.Points += pointsTable[r.Rank-1]
+			}
+			if r.Rank < sr.BestRank {
+				sr.BestRank = r.Rank
+			}
+			sr.Competitions++
+		}
+	}
+	srs := make([]SeasonRank, 0, len(rankByPlayer))
+	for _, sr := range rankByPlayer {
+		srs = append(srs, *sr)
+	}
+	sort.Slice(srs, func(i, j int) bool {
+		if srs[i].Points != srs[j].Points {
+			return srs[i].Points > srs[j].Points
+		}
+		if srs[i].BestRank != srs[j].BestRank {
+			return srs[i].BestRank < srs[j].BestRank
+		}
+		return srs[i].PlayerID < srs[j].PlayerID
+	})
+	for i := range srs {
+		srs[i].Rank = int64(i + 1)
+	}
+	return srs
+}
+
+// 参加者向けAPI
+// GET /api/player/season/:season_id/ranking
+// シーズンのランキングを取得する
+func (s *Server) seasonRankingHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return err
+	}
+	if v.role != RolePlayer {
+		return echo.NewHTTPError(http.StatusForbidden, "role player required")
+	}
+
+	tenantDB, err := s.connectToTenantDB(ctx, v.tenantID)
+	if err != nil {
+		return err
+	}
+	defer tenantDB.Close()
+
+	if err := authorizePlayer(ctx, tenantDB, v.playerID, s.now()); err != nil {
+		return err
+	}
+
+	seasonID := c.Param("season_id")
+	if seasonID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "season_id is required")
+	}
+	season, err := retrieveSeason(ctx, tenantDB, seasonID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "season not found")
+		}
+		return fmt.Errorf("error retrieveSeason: %w", err)
+	}
+
+	var rankAfter int64
+	if rankAfterStr := c.QueryParam("rank_after"); rankAfterStr != "" {
+		if rankAfter, err = strconv.ParseInt(rankAfterStr, 10, 64); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid rank_after: %s", rankAfterStr))
+		}
+	}
+
+	cs, err := retrieveSeasonCompetitions(ctx, tenantDB, v.tenantID, season.ID)
+	if err != nil {
+		return fmt.Errorf("error retrieveSeasonCompetitions: %w", err)
+	}
+	sd, err := seasonDetail(season, cs)
+	if err != nil {
+		return fmt.Errorf("error seasonDetail: %w", err)
+	}
+
+	// player_scoreを読んでいるときに更新が走ると不整合が起こるのでロックを取得する
+	fl, err := s.flockByTenantID(ctx, v.tenantID)
+	if err != nil {
+		return fmt.Errorf("error flockByTenantID: %w", err)
+	}
+	defer fl.Close()
+	competitionRanks := make([][]CompetitionRank, 0, len(cs))
+	for _, comp := range cs {
+		ranks, err := competitionRanking(ctx, tenantDB, v.tenantID, comp.ID)
+		if err != nil {
+			return fmt.Errorf("error competitionRanking: %w", err)
+		}
+		competitionRanks = append(competitionRanks, ranks)
+	}
+
+	ranks := seasonRanking(sd.PointsTable, competitionRanks)
+
+	res := SuccessResult{
+		Status: true,
+		Data: SeasonRankingHandlerResult{
+			Season: *sd,
+			Ranks:  pageRanks(ranks, rankAfter),
+		},
+	}
+	return c.JSON(http.StatusOK, res)
+}
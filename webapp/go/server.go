@@ -0,0 +1,418 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/gofrs/flock"
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// 管理用DB
+// *sqlx.DB が満たす
+type AdminDB interface {
+	dbOrTx
+	NamedExecContext(ctx context.Context, query string, arg interface{}) (sql.Result, error)
+	BeginTxx(ctx context.Context, opts *sql.TxOptions) (*sqlx.Tx, error)
+	PingContext(ctx context.Context) error
+	Stats() sql.DBStats
+}
+
+// テナントDBの置き場所
+type TenantStore interface {
+	// テナントDBに接続する。呼び出し側でCloseすること
+	Connect(ctx context.Context, id int64) (*sqlx.DB, error)
+	// テナントDBを新規に作成する
+	Create(ctx context.Context, id int64) error
+	// テナントごとに排他ロックする。Closeでロックを解放する
+	Lock(ctx context.Context, id int64) (io.Closer, error)
+	// テナントDBを作成できる状態か確認する
+	Check(ctx context.Context) error
+}
+
+// システム全体で一意なIDを生成する
+type IDDispenser interface {
+	DispenseID(ctx context.Context) (string, error)
+}
+
+// 現在時刻
+type Clock interface {
+	Now() time.Time
+}
+
+// JWTの署名を検証する鍵
+type KeySource interface {
+	VerificationKey(ctx context.Context) (interface{}, error)
+}
+
+// カスタムドメインの所有を確認する
+type DomainVerifier interface {
+	// domain の所有者が token を設定していれば nil を返す
+	VerifyDomain(ctx context.Context, domain, token string) error
+}
+
+// APIを提供するサーバー
+// DBや時刻などの依存をまとめて持ち、テストでは差し替えて使う
+type Server struct {
+	adminDB AdminDB
+	tenants TenantStore
+	ids     IDDispenser
+	clock   Clock
+	keys    KeySource
+	domains DomainVerifier
+
+	baseHostname  string
+	adminHostname string
+
+	initializeScript string
+	initializeEnv    []string
+
+	webhookClient                *http.Client
+	webhookAllowPrivateAddresses bool
+
+	rateLimits             *rateLimiter
+	tenantCache            *tenantCache
+	domainEvents           *domainEventDispatcher
+	domainEventSubscribers *domainEventBus
+	rankingStreamHub       *rankingHub
+
+	metrics       *metricsRegistry
+	tracer        *spanTracer
+	jsonLogFormat bool
+
+	// /initialize で初期化している間は1。atomicで読み書きする
+	initializing int32
+	// 終了処理を始めたら1。atomicで読み書きする
+	shuttingDown int32
+}
+
+type ServerOptions struct {
+	AdminDB     AdminDB
+	TenantStore TenantStore
+	IDDispenser IDDispenser
+	Clock       Clock // 未設定ならシステムの時刻を使う
+	KeySource   KeySource
+	// 未設定ならDNSのTXTレコードで確認する
+	DomainVerifier DomainVerifier
+
+	// テナントのサブドメインを除いたホスト名と、SaaS管理者用のホスト名
+	// 未設定なら .t.isucon.dev と admin.t.isucon.dev
+	BaseHostname  string
+	AdminHostname string
+
+	// /initialize で実行するスクリプト。未設定なら ../sql/init.sh
+	InitializeScript string
+	// 初期化スクリプトに追加で渡す環境変数。"KEY=value" の形式
+	InitializeEnv []string
+
+	// テナントをキャッシュする時間と、存在しないことをキャッシュする時間
+	// 未設定ならキャッシュしない
+	TenantCacheTTL         time.Duration
+	TenantCacheNegativeTTL time.Duration
+
+	// Webhookをループバックやプライベートのアドレスに送ることを許可する
+	// 手元の受信サーバーで試すときに使う
+	WebhookAllowPrivateAddresses bool
+
+	// 未設定ならレート制限しない
+	RateLimits                  map[string]map[string]rateLimitRule
+	RateLimitRetryAfterHTTPDate bool
+
+	// 未設定なら新しく作る
+	Metrics *metricsRegistry
+	// 未設定ならトレースしない
+	Tracer *spanTracer
+	// ログをJSON形式で出力する。falseならtext形式
+	JSONLogFormat bool
+}
+
+func NewServer(opts ServerOptions) *Server {
+	s := &Server{
+		adminDB:                      opts.AdminDB,
+		baseHostname:                 opts.BaseHostname,
+		adminHostname:                opts.AdminHostname,
+		tenants:                      opts.TenantStore,
+		ids:                          opts.IDDispenser,
+		clock:                        opts.Clock,
+		keys:                         opts.KeySource,
+		domains:                      opts.DomainVerifier,
+		initializeScript:             opts.InitializeScript,
+		initializeEnv:                opts.InitializeEnv,
+		webhookClient:                newWebhookHTTPClient(opts.WebhookAllowPrivateAddresses),
+		webhookAllowPrivateAddresses: opts.WebhookAllowPrivateAddresses,
+		rateLimits:                   newRateLimiter(opts.RateLimits, opts.RateLimitRetryAfterHTTPDate),
+		domainEvents: &domainEventDispatcher{
+			dirty: map[int64]struct{}{},
+			kick:  make(chan struct{}, 1),
+		},
+		domainEventSubscribers: &domainEventBus{
+			subscribers: map[string][]func(ctx context.Context, ev *DomainEventRow) error{},
+		},
+		rankingStreamHub: &rankingHub{
+			subscribers: map[rankingTopic]map[*rankingSubscriber]struct{}{},
+		},
+		metrics:       opts.Metrics,
+		tracer:        opts.Tracer,
+		jsonLogFormat: opts.JSONLogFormat,
+	}
+	if s.clock == nil {
+		s.clock = systemClock{}
+	}
+	if s.baseHostname == "" {
+		s.baseHostname = ".t.isucon.dev"
+	}
+	if s.adminHostname == "" {
+		s.adminHostname = "admin.t.isucon.dev"
+	}
+	if s.metrics == nil {
+		s.metrics = newMetricsRegistry()
+	}
+	if s.tracer == nil {
+		s.tracer = &spanTracer{}
+	}
+	s.tenantCache = newTenantCache(opts.TenantCacheTTL, opts.TenantCacheNegativeTTL, s.clock, s.metrics)
+	if s.domains == nil {
+		s.domains = dnsDomainVerifier{resolver: net.DefaultResolver}
+	}
+	if s.initializeScript == "" {
+		s.initializeScript = initializeScript
+	}
+
+	// ドメインイベントの配送先
+	s.domainEvents.addSink(webhookDomainEventSink{s: s})
+	s.domainEventSubscribers.subscribe(DomainEventScoresUploaded, s.publishRankingOnDomainEvent)
+	s.domainEventSubscribers.subscribe(DomainEventCompetitionFinished, s.publishRankingOnDomainEvent)
+	s.domainEvents.addSink(s.domainEventSubscribers)
+	return s
+}
+
+// 現在時刻をUNIX秒で返す
+func (s *Server) now() int64 {
+	return s.clock.Now().Unix()
+}
+
+// ミドルウェアとAPIのルーティングを登録する
+func (s *Server) registerRoutes(e *echo.Echo) {
+	e.Use(SetRequestInfo)
+	e.Use(s.AccessLog)
+	// panicから復帰したリクエストも記録するため、Recoverより外側に置く
+	// metrics.go を参照
+	e.Use(s.metrics.Middleware)
+	e.Use(middleware.Recover())
+	e.Use(s.tracer.TraceRequest)
+	e.Use(SetCacheControlPrivate)
+	// rate_limit.go を参照
+	e.Use(s.rateLimits.Middleware(s.retrieveTenantRowFromHeader, s.parseViewer))
+	// audit_log.go を参照
+	e.Use(s.AuditLog)
+
+	// SaaS管理者向けAPI
+	e.POST("/api/admin/tenants/add", s.tenantsAddHandler)
+	e.GET("/api/admin/tenants/billing", s.tenantsBillingHandler)
+	e.GET("/api/admin/rate_limits", s.rateLimitsHandler)
+	e.POST("/api/admin/tenant/:tenant_id/domains/add", s.tenantDomainsAddHandler)
+	e.GET("/api/admin/tenant/:tenant_id/domains", s.tenantDomainsHandler)
+	e.POST("/api/admin/tenant/:tenant_id/domain/:domain/verify", s.tenantDomainVerifyHandler)
+	e.POST("/api/admin/tenant/:tenant_id/domain/:domain/delete", s.tenantDomainDeleteHandler)
+	e.GET("/api/admin/audit_logs", s.auditLogsHandler)
+	e.GET("/api/admin/audit_logs/export", s.auditLogsExportHandler)
+
+	// テナント管理者向けAPI - 参加者追加、一覧、失格、失格解除、更新
+	// 主催者の権限は organizer.go を参照
+	e.GET("/api/organizer/players", s.playersListHandler, s.requireOrganizer())
+	e.POST("/api/organizer/players/add", s.playersAddHandler, s.requireOrganizer(PermissionManagePlayers))
+	e.POST("/api/organizer/players/import", s.playersImportHandler, s.requireOrganizer(PermissionManagePlayers))
+	e.POST("/api/organizer/player/:player_id/update", s.playerUpdateHandler, s.requireOrganizer(PermissionManagePlayers))
+	e.POST("/api/organizer/player/:player_id/disqualified", s.playerDisqualifiedHandler, s.requireOrganizer(PermissionManagePlayers))
+	e.POST("/api/organizer/player/:player_id/reinstate", s.playerReinstateHandler, s.requireOrganizer(PermissionManagePlayers))
+	e.GET("/api/organizer/player/:player_id/moderations", s.playerModerationsHandler, s.requireOrganizer())
+
+	// テナント管理者向けAPI - 大会管理
+	e.POST("/api/organizer/competitions/add", s.competitionsAddHandler, s.requireOrganizer(PermissionManageCompetitions))
+	e.POST("/api/organizer/competition/:competition_id/finish", s.competitionFinishHandler, s.requireOrganizer(PermissionManageCompetitions))
+	e.POST("/api/organizer/competition/:competition_id/update", s.competitionUpdateHandler, s.requireOrganizer(PermissionManageCompetitions))
+	e.POST("/api/organizer/competition/:competition_id/delete", s.competitionDeleteHandler, s.requireOrganizer(PermissionManageCompetitions))
+	e.POST("/api/organizer/competition/:competition_id/publish", s.competitionPublishHandler, s.requireOrganizer(PermissionManageCompetitions))
+	e.POST("/api/organizer/competition/:competition_id/unpublish", s.competitionUnpublishHandler, s.requireOrganizer(PermissionManageCompetitions))
+	e.POST("/api/organizer/competition/:competition_id/score", s.competitionScoreHandler, s.requireOrganizer(PermissionUploadScores))
+	e.GET("/api/organizer/billing", s.billingHandler, s.requireOrganizerAllowingCompetitionToken(PermissionViewBilling))
+	e.GET("/api/organizer/competitions", s.organizerCompetitionsHandler, s.requireOrganizer())
+
+	// テナント管理者向けAPI - Webhook
+	e.POST("/api/organizer/webhooks/add", s.webhooksAddHandler, s.requireOrganizer(PermissionManageTenant))
+	e.GET("/api/organizer/webhooks", s.webhooksHandler, s.requireOrganizer())
+	e.POST("/api/organizer/webhook/:webhook_id/delete", s.webhookDeleteHandler, s.requireOrganizer(PermissionManageTenant))
+	e.GET("/api/organizer/webhook/:webhook_id/deliveries", s.webhookDeliveriesHandler, s.requireOrganizer())
+	e.POST("/api/organizer/webhook/:webhook_id/test", s.webhookTestHandler, s.requireOrganizer(PermissionManageTenant))
+
+	// テナント管理者向けAPI - シーズン管理
+	e.POST("/api/organizer/seasons/add", s.seasonsAddHandler, s.requireOrganizer(PermissionManageCompetitions))
+	e.GET("/api/organizer/seasons", s.organizerSeasonsHandler, s.requireOrganizer())
+
+	// テナント管理者向けAPI - 主催者管理
+	e.POST("/api/organizer/organizers/add", s.organizersAddHandler, s.requireOrganizer(PermissionManageTenant))
+	e.GET("/api/organizer/organizers", s.organizersHandler, s.requireOrganizer())
+	e.POST("/api/organizer/organizer/:organizer_id/update", s.organizerUpdateHandler, s.requireOrganizer(PermissionManageTenant))
+	e.POST("/api/organizer/organizer/:organizer_id/delete", s.organizerDeleteHandler, s.requireOrganizer(PermissionManageTenant))
+
+	// テナント管理者向けAPI - APIトークン
+	e.POST("/api/organizer/api_tokens/add", s.apiTokensAddHandler, s.requireOrganizer(PermissionManageTenant))
+	e.GET("/api/organizer/api_tokens", s.apiTokensHandler, s.requireOrganizer())
+	e.POST("/api/organizer/api_token/:token_id/revoke", s.apiTokenRevokeHandler, s.requireOrganizer(PermissionManageTenant))
+
+	// 参加者向けAPI
+	e.GET("/api/player/player/:player_id", s.playerHandler)
+	e.GET("/api/player/competition/:competition_id/ranking", s.competitionRankingHandler)
+	e.GET("/api/player/competition/:competition_id/ranking/stream", s.competitionRankingStreamHandler)
+	e.GET("/api/player/competitions", s.playerCompetitionsHandler)
+	e.GET("/api/player/seasons", s.playerSeasonsHandler)
+	e.GET("/api/player/season/:season_id/ranking", s.seasonRankingHandler)
+
+	// 未認証で使える公開API
+	e.GET("/api/public/competition/:competition_id/ranking", s.publicCompetitionRankingHandler)
+
+	// 全ロール及び未認証でも使えるhandler
+	e.GET("/api/me", s.meHandler)
+
+	// ベンチマーカー向けAPI
+	e.POST("/initialize", s.initializeHandler)
+
+	// 監視用API
+	e.GET("/metrics", s.metricsHandler)
+	e.GET("/healthz", healthzHandler)
+	e.GET("/readyz", s.readyzHandler)
+
+	e.HTTPErrorHandler = s.errorResponseHandler
+}
+
+// テナントDBに接続する
+func (s *Server) connectToTenantDB(ctx context.Context, id int64) (*sqlx.DB, error) {
+	ctx, span := s.tracer.startSpan(ctx, "connectToTenantDB", spanKindInternal, spanAttribute{"isuports.tenant_id", id})
+	defer span.Finish()
+	db, err := s.tenants.Connect(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.incTenantDBOpens()
+	return db, nil
+}
+
+// 排他ロックする
+func (s *Server) flockByTenantID(ctx context.Context, tenantID int64) (io.Closer, error) {
+	ctx, span := s.tracer.startSpan(ctx, "flockByTenantID", spanKindInternal, spanAttribute{"isuports.tenant_id", tenantID})
+	defer span.Finish()
+	start := time.Now()
+	fl, err := s.tenants.Lock(ctx, tenantID)
+	if err != nil {
+		return nil, err
+	}
+	s.metrics.observeFlockWait(time.Since(start))
+	return fl, nil
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+// 起動時に読み込んだ公開鍵を返す
+type staticKeySource struct {
+	key interface{}
+}
+
+func (k staticKeySource) VerificationKey(ctx context.Context) (interface{}, error) {
+	return k.key, nil
+}
+
+// テナントDBをディレクトリにSQLiteのファイルとして置く
+type fileTenantStore struct {
+	dir        string
+	driverName string // クエリログやトレースを有効にしたドライバの名前
+}
+
+// テナントDBのパスを返す
+func (ts *fileTenantStore) dbPath(id int64) string {
+	return filepath.Join(ts.dir, fmt.Sprintf("%d.db", id))
+}
+
+// 排他ロックのためのファイル名を生成する
+func (ts *fileTenantStore) lockFilePath(id int64) string {
+	return filepath.Join(ts.dir, fmt.Sprintf("%d.lock", id))
+}
+
+func (ts *fileTenantStore) Connect(ctx context.Context, id int64) (*sqlx.DB, error) {
+	p := ts.dbPath(id)
+	db, err := sqlx.Open(ts.driverName, fmt.Sprintf("file:%s?mode=rw", p))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open tenant DB: %w", err)
+	}
+	return db, nil
+}
+
+func (ts *fileTenantStore) Create(ctx context.Context, id int64) error {
+	p := ts.dbPath(id)
+
+	cmd := exec.CommandContext(ctx, "sh", "-c", fmt.Sprintf("sqlite3 %s < %s", p, tenantDBSchemaFilePath))
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("failed to exec sqlite3 %s < %s, out=%s: %w", p, tenantDBSchemaFilePath, string(out), err)
+	}
+	return nil
+}
+
+func (ts *fileTenantStore) Lock(ctx context.Context, id int64) (io.Closer, error) {
+	p := ts.lockFilePath(id)
+	fl := flock.New(p)
+	if err := fl.Lock(); err != nil {
+		return nil, fmt.Errorf("error flock.Lock: path=%s, %w", p, err)
+	}
+	return fl, nil
+}
+
+// テナントDBのディレクトリにファイルを作れるか
+func (ts *fileTenantStore) Check(ctx context.Context) error {
+	return checkTenantDBDirWritable(ts.dir)
+}
+
+// 管理用DBのid_generatorテーブルでIDを生成する
+type adminDBIDDispenser struct {
+	db      AdminDB
+	metrics *metricsRegistry // 未設定ならリトライを数えない
+}
+
+func (d *adminDBIDDispenser) DispenseID(ctx context.Context) (string, error) {
+	var id int64
+	var lastErr error
+	for i := 0; i < 100; i++ {
+		var ret sql.Result
+		ret, err := d.db.ExecContext(ctx, "REPLACE INTO id_generator (stub) VALUES (?);", "a")
+		if err != nil {
+			if isDeadlockError(err) {
+				lastErr = fmt.Errorf("error REPLACE INTO id_generator: %w", err)
+				if d.metrics != nil {
+					d.metrics.incDispenseIDRetries()
+				}
+				continue
+			}
+			return "", fmt.Errorf("error REPLACE INTO id_generator: %w", err)
+		}
+		id, err = ret.LastInsertId()
+		if err != nil {
+			return "", fmt.Errorf("error ret.LastInsertId: %w", err)
+		}
+		break
+	}
+	if id != 0 {
+		return fmt.Sprintf("%x", id), nil
+	}
+	return "", lastErr
+}
@@ -8,60 +8,125 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sync"
 	"time"
 
+	"github.com/go-sql-driver/mysql"
 	"github.com/mattn/go-sqlite3"
 	proxy "github.com/shogo82148/go-sql-proxy"
 )
 
-var traceLogEncoder *json.Encoder
+// SQLのトレースログの設定
+// 環境変数 ISUCON_SQLITE_TRACE_FILE を設定するとテナントDB(sqlite)の、
+// ISUCON_MYSQL_TRACE_FILE を設定すると管理用DB(MySQLかSQLite)のクエリログをJSON形式で出力する
+// どちらも未設定なら出力しない
+//
+// ISUCON_SQL_TRACE_SLOW_THRESHOLD: "100ms" のように設定すると、それより時間がかかったクエリのみ出力する
+// ISUCON_SQL_TRACE_MAX_SIZE_MB: ファイルがこのサイズを超えたらローテートする。0なら制限しない
+// ISUCON_SQL_TRACE_MAX_BACKUPS: ローテートしたファイルを何世代残すか
+// 値は config.go の loadConfig で読み込む
+//
+// クエリログやトレースを有効にしたドライバを登録し、その名前を返す
+// 区間は tracer に記録する
+// adminDBDriver は管理用DBのドライバ。adminDBDriverMySQL か adminDBDriverSQLite
+func initializeSQLLogger(conf SQLTraceConfig, adminDBDriver string, tracer *spanTracer) (sqlDriverNames, io.Closer, error) {
+	drivers := sqlDriverNames{tenant: "sqlite3", admin: adminDBDriver}
+	closers := multiCloser{}
+	var err error
 
-func initializeSQLLogger() (string, io.Closer, error) {
-	traceFilePath := getEnv("ISUCON_SQLITE_TRACE_FILE", "")
-	if traceFilePath == "" {
-		return "sqlite3", io.NopCloser(nil), nil
+	tenantHooks := &sqlHooks{db: "tenant", system: "sqlite", tracer: tracer}
+	if p := conf.SQLiteFile; p != "" {
+		if tenantHooks.logger, err = newSQLQueryLogger(p, conf); err != nil {
+			return drivers, nil, fmt.Errorf("cannot open ISUCON_SQLITE_TRACE_FILE: %w", err)
+		}
+		closers = append(closers, tenantHooks.logger)
+	}
+	if tenantHooks.logger != nil || tracer.enabled() {
+		drivers.tenant = "sqlite3-with-trace"
+		sql.Register(drivers.tenant, proxy.NewProxyContext(&sqlite3.SQLiteDriver{}, tenantHooks.hooks()))
 	}
 
-	traceLogFile, err := os.OpenFile(traceFilePath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
-	if err != nil {
-		return "", nil, fmt.Errorf("cannot open ISUCON_SQLITE_TRACE_FILE: %w", err)
+	adminHooks := &sqlHooks{db: "admin", system: "mysql", tracer: tracer}
+	var adminDriver driver.Driver = &mysql.MySQLDriver{}
+	if adminDBDriver == adminDBDriverSQLite {
+		adminHooks.system = "sqlite"
+		adminDriver = &sqlite3.SQLiteDriver{}
+	}
+	if p := conf.MySQLFile; p != "" {
+		if adminHooks.logger, err = newSQLQueryLogger(p, conf); err != nil {
+			closers.Close()
+			return drivers, nil, fmt.Errorf("cannot open ISUCON_MYSQL_TRACE_FILE: %w", err)
+		}
+		closers = append(closers, adminHooks.logger)
+	}
+	if adminHooks.logger != nil || tracer.enabled() {
+		drivers.admin = adminDBDriver + "-admin-with-trace"
+		sql.Register(drivers.admin, proxy.NewProxyContext(adminDriver, adminHooks.hooks()))
 	}
+	return drivers, closers, nil
+}
 
-	traceLogEncoder = json.NewEncoder(traceLogFile)
-	traceLogEncoder.SetEscapeHTML(false)
-	driverName := "sqlite3-with-trace"
-	sql.Register(driverName, proxy.NewProxyContext(&sqlite3.SQLiteDriver{}, &proxy.HooksContext{
-		PreExec:   traceLogPre,
-		PostExec:  traceLogPostExec,
-		PreQuery:  traceLogPre,
-		PostQuery: traceLogPostQuery,
-	}))
-	return driverName, traceLogFile, nil
+// テナントDBと管理用DBに接続するときのドライバの名前
+type sqlDriverNames struct {
+	tenant string
+	admin  string
 }
 
-func traceLogPre(_ context.Context, _ *proxy.Stmt, _ []driver.NamedValue) (interface{}, error) {
-	return time.Now(), nil
+type multiCloser []io.Closer
+
+func (mc multiCloser) Close() error {
+	var firstErr error
+	for _, c := range mc {
+		if err := c.Close(); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
 }
 
-type sqlTraceLog struct {
-	Time         string        `json:"time"`
-	Statement    string        `json:"statement"`
-	Args         []interface{} `json:"args"`
-	QueryTime    float64       `json:"query_time"`
-	AffectedRows int64         `json:"affected_rows"`
+// 1つのDBのクエリをログとトレースの区間に記録する
+type sqlHooks struct {
+	db     string          // "tenant" か "admin"
+	system string          // トレースの db.system
+	logger *sqlQueryLogger // nilならクエリログを出力しない
+	tracer *spanTracer
 }
 
-func traceLogPostExec(_ context.Context, ctx interface{}, stmt *proxy.Stmt, args []driver.NamedValue, result driver.Result, _ error) error {
-	if traceLogEncoder == nil {
-		return nil
+func (h *sqlHooks) hooks() *proxy.HooksContext {
+	return &proxy.HooksContext{
+		PreExec:   h.pre,
+		PostExec:  h.postExec,
+		PreQuery:  h.pre,
+		PostQuery: h.postQuery,
 	}
-	starts := ctx.(time.Time)
-	queryTime := time.Since(starts)
+}
 
-	argsValues := make([]any, 0, len(args))
-	for _, arg := range args {
-		argsValues = append(argsValues, arg.Value)
+// Pre で作り Post に渡される値
+type sqlHookState struct {
+	starts time.Time
+	span   *span
+}
+
+// クエリの区間はリクエストなどの区間の中で実行したものだけ記録する
+// バックグラウンドの処理のクエリごとにトレースが作られないようにするため
+func (h *sqlHooks) pre(c context.Context, stmt *proxy.Stmt, _ []driver.NamedValue) (interface{}, error) {
+	st := sqlHookState{starts: time.Now()}
+	if spanFromContext(c) != nil {
+		_, st.span = h.tracer.startSpan(c, "sql "+h.db, spanKindClient,
+			spanAttribute{"db.system", h.system},
+			spanAttribute{"db.statement", stmt.QueryString},
+		)
 	}
+	return st, nil
+}
+
+func (h *sqlHooks) postExec(c context.Context, ctx interface{}, stmt *proxy.Stmt, args []driver.NamedValue, result driver.Result, err error) error {
+	st := ctx.(sqlHookState)
+	queryTime := time.Since(st.starts)
+
+	st.span.RecordError(err)
+	defer st.span.Finish()
+
 	var affected int64
 	if result != nil {
 		var err error
@@ -70,40 +135,166 @@ func traceLogPostExec(_ context.Context, ctx interface{}, stmt *proxy.Stmt, args
 			return fmt.Errorf("error driver.Result.RowsAffected at traceLogPost: %w", err)
 		}
 	}
+	st.span.SetAttributes(spanAttribute{"db.rows_affected", affected})
 
-	log := sqlTraceLog{
-		Time:         starts.Format(time.RFC3339),
-		Statement:    stmt.QueryString,
-		Args:         argsValues,
-		QueryTime:    queryTime.Seconds(),
-		AffectedRows: affected,
+	if h.logger == nil || queryTime < h.logger.slowThreshold {
+		return nil
 	}
-	if err := traceLogEncoder.Encode(log); err != nil {
+	if err := h.logger.write(c, h.db, st.starts, queryTime, stmt, args, affected); err != nil {
 		return fmt.Errorf("error encode.Encode at traceLogPostExec: %w", err)
 	}
 	return nil
 }
 
-func traceLogPostQuery(_ context.Context, ctx interface{}, stmt *proxy.Stmt, args []driver.NamedValue, result driver.Rows, _ error) error {
-	if traceLogEncoder == nil {
+func (h *sqlHooks) postQuery(c context.Context, ctx interface{}, stmt *proxy.Stmt, args []driver.NamedValue, _ driver.Rows, err error) error {
+	st := ctx.(sqlHookState)
+	queryTime := time.Since(st.starts)
+
+	st.span.RecordError(err)
+	st.span.Finish()
+
+	if h.logger == nil || queryTime < h.logger.slowThreshold {
 		return nil
 	}
-	starts := ctx.(time.Time)
-	queryTime := time.Since(starts)
+	if err := h.logger.write(c, h.db, st.starts, queryTime, stmt, args, 0); err != nil {
+		return fmt.Errorf("error encode.Encode at traceLogPostQuery: %w", err)
+	}
+	return nil
+}
+
+// クエリログを1行1クエリのJSONで書き出す
+type sqlQueryLogger struct {
+	slowThreshold time.Duration
+
+	mu  sync.Mutex
+	w   *rotatingFile
+	enc *json.Encoder
+}
 
+func newSQLQueryLogger(path string, conf SQLTraceConfig) (*sqlQueryLogger, error) {
+	w, err := openRotatingFile(path, conf.MaxSize, conf.MaxBackups)
+	if err != nil {
+		return nil, err
+	}
+	enc := json.NewEncoder(w)
+	enc.SetEscapeHTML(false)
+	return &sqlQueryLogger{
+		slowThreshold: conf.SlowThreshold,
+		w:             w,
+		enc:           enc,
+	}, nil
+}
+
+func (l *sqlQueryLogger) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.w.Close()
+}
+
+type sqlTraceLog struct {
+	Time         string        `json:"time"`
+	DB           string        `json:"db"`
+	RequestID    string        `json:"request_id,omitempty"`
+	TenantID     int64         `json:"tenant_id,omitempty"`
+	Route        string        `json:"route,omitempty"`
+	Statement    string        `json:"statement"`
+	Args         []interface{} `json:"args"`
+	QueryTime    float64       `json:"query_time"`
+	AffectedRows int64         `json:"affected_rows"`
+}
+
+func (l *sqlQueryLogger) write(c context.Context, db string, starts time.Time, queryTime time.Duration, stmt *proxy.Stmt, args []driver.NamedValue, affected int64) error {
 	argsValues := make([]any, 0, len(args))
 	for _, arg := range args {
 		argsValues = append(argsValues, arg.Value)
 	}
 	log := sqlTraceLog{
 		Time:         starts.Format(time.RFC3339),
+		DB:           db,
 		Statement:    stmt.QueryString,
 		Args:         argsValues,
 		QueryTime:    queryTime.Seconds(),
-		AffectedRows: 0,
+		AffectedRows: affected,
 	}
-	if err := traceLogEncoder.Encode(log); err != nil {
-		return fmt.Errorf("error encode.Encode at traceLogPostQuery: %w", err)
+	if ri := requestInfoFromContext(c); ri != nil {
+		log.RequestID = ri.RequestID
+		log.TenantID = ri.TenantID()
+		log.Route = ri.Route
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.enc.Encode(log)
+}
+
+// サイズが上限を超えたらローテートするファイル
+// path.1, path.2, ... の順に古くなり、maxBackupsを超えた世代は削除する
+type rotatingFile struct {
+	path       string
+	maxSize    int64 // 0なら制限しない
+	maxBackups int
+
+	f    *os.File
+	size int64
+}
+
+func openRotatingFile(path string, maxSize int64, maxBackups int) (*rotatingFile, error) {
+	rf := &rotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := rf.open(); err != nil {
+		return nil, err
+	}
+	return rf, nil
+}
+
+func (rf *rotatingFile) open() error {
+	f, err := os.OpenFile(rf.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return fmt.Errorf("error os.OpenFile: path=%s, %w", rf.path, err)
 	}
+	st, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("error Stat: path=%s, %w", rf.path, err)
+	}
+	rf.f = f
+	rf.size = st.Size()
 	return nil
 }
+
+// 排他制御は呼び出し側で行うこと
+func (rf *rotatingFile) Write(b []byte) (int, error) {
+	if rf.maxSize > 0 && rf.size > 0 && rf.size+int64(len(b)) > rf.maxSize {
+		if err := rf.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := rf.f.Write(b)
+	rf.size += int64(n)
+	return n, err
+}
+
+func (rf *rotatingFile) rotate() error {
+	if err := rf.f.Close(); err != nil {
+		return fmt.Errorf("error Close: path=%s, %w", rf.path, err)
+	}
+	if rf.maxBackups == 0 {
+		if err := os.Remove(rf.path); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error os.Remove: path=%s, %w", rf.path, err)
+		}
+		return rf.open()
+	}
+	for i := rf.maxBackups - 1; i >= 1; i-- {
+		src := fmt.Sprintf("%s.%d", rf.path, i)
+		dst := fmt.Sprintf("%s.%d", rf.path, i+1)
+		if err := os.Rename(src, dst); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("error os.Rename: %s -> %s, %w", src, dst, err)
+		}
+	}
+	if err := os.Rename(rf.path, rf.path+".1"); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("error os.Rename: %s -> %s.1, %w", rf.path, rf.path, err)
+	}
+	return rf.open()
+}
+
+func (rf *rotatingFile) Close() error {
+	return rf.f.Close()
+}
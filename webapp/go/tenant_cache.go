@@ -0,0 +1,162 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// 存在しないことを覚えておく件数の上限
+// ランダムなサブドメインへのスキャンでメモリを使い切らないようにする
+const tenantCacheMaxNegatives = 10000
+
+// テナントをプロセス内にキャッシュする
+// Hostヘッダからテナントを引くのはほぼ全てのリクエストなので、管理用DBへの問い合わせを減らす
+// テナント名、ID、カスタムドメインのどれからでも引ける
+// 存在しないテナント名やドメインも短い時間だけ覚えておく
+// 他のプロセスでの変更はTTLが切れるまで反映されない
+type tenantCache struct {
+	ttl         time.Duration // 0ならキャッシュしない
+	negativeTTL time.Duration // 0なら存在しないことはキャッシュしない
+	clock       Clock
+	metrics     *metricsRegistry
+
+	mu        sync.Mutex
+	entries   map[string]tenantCacheEntry // キーは "name:<テナント名>" "id:<テナントID>" "domain:<ドメイン>"
+	negatives int
+}
+
+type tenantCacheEntry struct {
+	tenant    *TenantRow // nilなら存在しない
+	expiresAt time.Time
+}
+
+func newTenantCache(ttl, negativeTTL time.Duration, clock Clock, metrics *metricsRegistry) *tenantCache {
+	return &tenantCache{
+		ttl:         ttl,
+		negativeTTL: negativeTTL,
+		clock:       clock,
+		metrics:     metrics,
+		entries:     map[string]tenantCacheEntry{},
+	}
+}
+
+func tenantCacheNameKey(name string) string     { return "name:" + name }
+func tenantCacheIDKey(id int64) string          { return "id:" + strconv.FormatInt(id, 10) }
+func tenantCacheDomainKey(domain string) string { return "domain:" + domain }
+
+// キャッシュにあればそれを返し、なければloadで読み込んでキャッシュする
+// 存在しない場合は sql.ErrNoRows をラップしたエラーを返す
+func (tc *tenantCache) get(ctx context.Context, key string, load func(ctx context.Context) (*TenantRow, error)) (*TenantRow, error) {
+	if tc.ttl <= 0 {
+		return load(ctx)
+	}
+	now := tc.clock.Now()
+	tc.mu.Lock()
+	e, ok := tc.entries[key]
+	tc.mu.Unlock()
+	if ok && now.Before(e.expiresAt) {
+		tc.metrics.incTenantCacheHits()
+		if e.tenant == nil {
+			return nil, fmt.Errorf("tenant not found in cache: key=%s, %w", key, sql.ErrNoRows)
+		}
+		t := *e.tenant
+		return &t, nil
+	}
+	tc.metrics.incTenantCacheMisses()
+
+	t, err := load(ctx)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			tc.storeNegative(key, now)
+		}
+		return nil, err
+	}
+	cached := *t
+	tc.mu.Lock()
+	tc.set(key, tenantCacheEntry{tenant: &cached, expiresAt: now.Add(tc.ttl)})
+	tc.mu.Unlock()
+	return t, nil
+}
+
+func (tc *tenantCache) storeNegative(key string, now time.Time) {
+	if tc.negativeTTL <= 0 {
+		return
+	}
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	if tc.negatives >= tenantCacheMaxNegatives {
+		tc.sweep(now)
+		// 期限内のものだけで上限に達している場合は覚えない
+		if tc.negatives >= tenantCacheMaxNegatives {
+			return
+		}
+	}
+	tc.set(key, tenantCacheEntry{expiresAt: now.Add(tc.negativeTTL)})
+}
+
+// 排他制御は呼び出し側で行うこと
+func (tc *tenantCache) set(key string, e tenantCacheEntry) {
+	tc.delete(key)
+	tc.entries[key] = e
+	if e.tenant == nil {
+		tc.negatives++
+	}
+}
+
+// 排他制御は呼び出し側で行うこと
+func (tc *tenantCache) delete(key string) {
+	if old, ok := tc.entries[key]; ok {
+		if old.tenant == nil {
+			tc.negatives--
+		}
+		delete(tc.entries, key)
+	}
+}
+
+// 期限切れのものを捨てる
+// 排他制御は呼び出し側で行うこと
+func (tc *tenantCache) sweep(now time.Time) {
+	for key, e := range tc.entries {
+		if !now.Before(e.expiresAt) {
+			tc.delete(key)
+		}
+	}
+}
+
+// テナントを追加、変更したときに、そのテナントのキャッシュを捨てる
+// 存在しないことを覚えていた場合もここで捨てる
+func (tc *tenantCache) invalidateTenant(t *TenantRow) {
+	tc.invalidate(tenantCacheNameKey(t.Name), tenantCacheIDKey(t.ID))
+}
+
+func (tc *tenantCache) invalidate(keys ...string) {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	for _, key := range keys {
+		tc.delete(key)
+	}
+}
+
+// 全て捨てる。/initialize でテナントを消したときに使う
+func (tc *tenantCache) purge() {
+	tc.mu.Lock()
+	defer tc.mu.Unlock()
+	tc.entries = map[string]tenantCacheEntry{}
+	tc.negatives = 0
+}
+
+// IDからテナントを取得する
+func (s *Server) retrieveTenantByID(ctx context.Context, id int64) (*TenantRow, error) {
+	return s.tenantCache.get(ctx, tenantCacheIDKey(id), func(ctx context.Context) (*TenantRow, error) {
+		var tenant TenantRow
+		if err := s.adminDB.GetContext(ctx, &tenant, "SELECT * FROM tenant WHERE id = ?", id); err != nil {
+			return nil, fmt.Errorf("error Select tenant: id=%d, %w", id, err)
+		}
+		return &tenant, nil
+	})
+}
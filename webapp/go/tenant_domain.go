@@ -0,0 +1,337 @@
+package isuports
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// テナントのカスタムドメイン
+// 通常テナントには <テナント名><ISUCON_BASE_HOSTNAME> でアクセスするが、
+// 所有を確認したドメインを登録すると、そのホスト名でもアクセスできる
+// 所有の確認は _isuports-challenge.<ドメイン> のTXTレコードに確認用の値が設定されているかで行う
+const (
+	tenantDomainChallengePrefix = "_isuports-challenge."
+	tenantDomainChallengeValue  = "isuports-verification="
+)
+
+type TenantDomainRow struct {
+	ID                int64         `db:"id"`
+	TenantID          int64         `db:"tenant_id"`
+	Domain            string        `db:"domain"`
+	VerificationToken string        `db:"verification_token"`
+	VerifiedAt        sql.NullInt64 `db:"verified_at"`
+	CreatedAt         int64         `db:"created_at"`
+	UpdatedAt         int64         `db:"updated_at"`
+}
+
+// DNSのTXTレコードでドメインの所有を確認する
+type dnsDomainVerifier struct {
+	resolver *net.Resolver
+}
+
+func (v dnsDomainVerifier) VerifyDomain(ctx context.Context, domain, token string) error {
+	name := tenantDomainChallengePrefix + domain
+	txts, err := v.resolver.LookupTXT(ctx, name)
+	if err != nil {
+		return fmt.Errorf("cannot lookup TXT record %s: %w", name, err)
+	}
+	for _, txt := range txts {
+		if txt == tenantDomainChallengeValue+token {
+			return nil
+		}
+	}
+	return fmt.Errorf("TXT record %s does not contain %s%s", name, tenantDomainChallengeValue, token)
+}
+
+// Hostヘッダからポート番号を除く
+func stripPort(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return host
+}
+
+// カスタムドメインとして登録できるか
+// テナントのサブドメインや管理者用のホスト名は、通常のルールで解決するので登録できない
+func (s *Server) validateTenantDomain(domain string) error {
+	if !isValidHostname(domain) || !strings.Contains(domain, ".") {
+		return fmt.Errorf("invalid domain: %s", domain)
+	}
+	base := stripPort(s.baseHostname)
+	if strings.HasSuffix(domain, base) || domain == base[1:] || domain == stripPort(s.adminHostname) {
+		return fmt.Errorf("domain is reserved: %s", domain)
+	}
+	return nil
+}
+
+// カスタムドメインからテナントを引く
+// 所有を確認していないドメインは使えない
+// tenant_cache.go を参照
+func (s *Server) retrieveTenantByDomain(ctx context.Context, domain string) (*TenantRow, error) {
+	return s.tenantCache.get(ctx, tenantCacheDomainKey(domain), func(ctx context.Context) (*TenantRow, error) {
+		var tenant TenantRow
+		if err := s.adminDB.GetContext(
+			ctx,
+			&tenant,
+			"SELECT tenant.* FROM tenant_domain JOIN tenant ON tenant.id = tenant_domain.tenant_id WHERE tenant_domain.domain = ? AND tenant_domain.verified_at IS NOT NULL",
+			domain,
+		); err != nil {
+			return nil, fmt.Errorf("failed to Select tenant_domain: domain=%s, %w", domain, err)
+		}
+		return &tenant, nil
+	})
+}
+
+// URLのtenant_idからテナントを取得する
+func (s *Server) retrieveTenantByParam(ctx context.Context, id string) (*TenantRow, error) {
+	tenantID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	var tenant TenantRow
+	if err := s.adminDB.GetContext(ctx, &tenant, "SELECT * FROM tenant WHERE id = ?", tenantID); err != nil {
+		return nil, fmt.Errorf("error Select tenant: id=%d, %w", tenantID, err)
+	}
+	return &tenant, nil
+}
+
+func (s *Server) retrieveTenantDomain(ctx context.Context, tenantID int64, domain string) (*TenantDomainRow, error) {
+	var d TenantDomainRow
+	if err := s.adminDB.GetContext(
+		ctx,
+		&d,
+		"SELECT * FROM tenant_domain WHERE tenant_id = ? AND domain = ?",
+		tenantID, strings.ToLower(domain),
+	); err != nil {
+		return nil, fmt.Errorf("error Select tenant_domain: tenantID=%d, domain=%s, %w", tenantID, domain, err)
+	}
+	return &d, nil
+}
+
+type TenantDomainDetail struct {
+	TenantID   string `json:"tenant_id"`
+	Domain     string `json:"domain"`
+	Verified   bool   `json:"verified"`
+	VerifiedAt *int64 `json:"verified_at"`
+	// 所有の確認のために設定するTXTレコードの名前と値
+	VerificationRecord string `json:"verification_record"`
+	VerificationValue  string `json:"verification_value"`
+	CreatedAt          int64  `json:"created_at"`
+}
+
+func tenantDomainDetail(d *TenantDomainRow) TenantDomainDetail {
+	return TenantDomainDetail{
+		TenantID:           strconv.FormatInt(d.TenantID, 10),
+		Domain:             d.Domain,
+		Verified:           d.VerifiedAt.Valid,
+		VerifiedAt:         nullInt64Ptr(d.VerifiedAt),
+		VerificationRecord: tenantDomainChallengePrefix + d.Domain,
+		VerificationValue:  tenantDomainChallengeValue + d.VerificationToken,
+		CreatedAt:          d.CreatedAt,
+	}
+}
+
+type TenantDomainHandlerResult struct {
+	Domain TenantDomainDetail `json:"domain"`
+}
+
+// SaaS管理者向けAPI
+// POST /api/admin/tenant/:tenant_id/domains/add
+// テナントにカスタムドメインを追加する
+// 追加しただけでは使えず、TXTレコードを設定してから verify を呼ぶ
+func (s *Server) tenantDomainsAddHandler(c echo.Context) error {
+	if host := c.Request().Host; host != s.adminHostname {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("invalid hostname %s", host),
+		)
+	}
+	ctx := requestContext(c)
+	if v, err := s.parseViewer(c); err != nil {
+		return err
+	} else if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	tenant, err := s.retrieveTenantByParam(ctx, c.Param("tenant_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "tenant not found")
+		}
+		return fmt.Errorf("error retrieveTenantByParam: %w", err)
+	}
+	domain := strings.ToLower(c.FormValue("domain"))
+	if err := s.validateTenantDomain(domain); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	token, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	d := TenantDomainRow{
+		TenantID:          tenant.ID,
+		Domain:            domain,
+		VerificationToken: token,
+		CreatedAt:         now,
+		UpdatedAt:         now,
+	}
+	insertRes, err := s.adminDB.NamedExecContext(
+		ctx,
+		"INSERT INTO tenant_domain (tenant_id, domain, verification_token, created_at, updated_at) VALUES (:tenant_id, :domain, :verification_token, :created_at, :updated_at)",
+		d,
+	)
+	if err != nil {
+		if isDuplicateKeyError(err) {
+			return echo.NewHTTPError(http.StatusBadRequest, "duplicate domain")
+		}
+		return fmt.Errorf("error Insert tenant_domain: tenantID=%d, domain=%s, %w", tenant.ID, domain, err)
+	}
+	if d.ID, err = insertRes.LastInsertId(); err != nil {
+		return fmt.Errorf("error get LastInsertId: %w", err)
+	}
+	setAuditTarget(c, d.Domain)
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: TenantDomainHandlerResult{Domain: tenantDomainDetail(&d)}})
+}
+
+type TenantDomainsHandlerResult struct {
+	Domains []TenantDomainDetail `json:"domains"`
+}
+
+// SaaS管理者向けAPI
+// GET /api/admin/tenant/:tenant_id/domains
+// テナントのカスタムドメインの一覧を取得する
+func (s *Server) tenantDomainsHandler(c echo.Context) error {
+	if host := c.Request().Host; host != s.adminHostname {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("invalid hostname %s", host),
+		)
+	}
+	ctx := requestContext(c)
+	if v, err := s.parseViewer(c); err != nil {
+		return err
+	} else if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	tenant, err := s.retrieveTenantByParam(ctx, c.Param("tenant_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "tenant not found")
+		}
+		return fmt.Errorf("error retrieveTenantByParam: %w", err)
+	}
+	ds := []TenantDomainRow{}
+	if err := s.adminDB.SelectContext(
+		ctx,
+		&ds,
+		"SELECT * FROM tenant_domain WHERE tenant_id = ? ORDER BY id ASC",
+		tenant.ID,
+	); err != nil {
+		return fmt.Errorf("error Select tenant_domain: tenantID=%d, %w", tenant.ID, err)
+	}
+	dds := make([]TenantDomainDetail, 0, len(ds))
+	for _, d := range ds {
+		dds = append(dds, tenantDomainDetail(&d))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: TenantDomainsHandlerResult{Domains: dds}})
+}
+
+// SaaS管理者向けAPI
+// POST /api/admin/tenant/:tenant_id/domain/:domain/verify
+// TXTレコードを確認して、カスタムドメインを使えるようにする
+// 確認済みのドメインはそのまま返す
+func (s *Server) tenantDomainVerifyHandler(c echo.Context) error {
+	if host := c.Request().Host; host != s.adminHostname {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("invalid hostname %s", host),
+		)
+	}
+	ctx := requestContext(c)
+	if v, err := s.parseViewer(c); err != nil {
+		return err
+	} else if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	tenant, err := s.retrieveTenantByParam(ctx, c.Param("tenant_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "tenant not found")
+		}
+		return fmt.Errorf("error retrieveTenantByParam: %w", err)
+	}
+	d, err := s.retrieveTenantDomain(ctx, tenant.ID, c.Param("domain"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "domain not found")
+		}
+		return fmt.Errorf("error retrieveTenantDomain: %w", err)
+	}
+	if !d.VerifiedAt.Valid {
+		if err := s.domains.VerifyDomain(ctx, d.Domain, d.VerificationToken); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("domain verification failed: %s", err))
+		}
+		now := s.now()
+		if _, err := s.adminDB.ExecContext(
+			ctx,
+			"UPDATE tenant_domain SET verified_at = ?, updated_at = ? WHERE id = ?",
+			now, now, d.ID,
+		); err != nil {
+			return fmt.Errorf("error Update tenant_domain: id=%d, %w", d.ID, err)
+		}
+		d.VerifiedAt = sql.NullInt64{Int64: now, Valid: true}
+		d.UpdatedAt = now
+		s.tenantCache.invalidate(tenantCacheDomainKey(d.Domain))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: TenantDomainHandlerResult{Domain: tenantDomainDetail(d)}})
+}
+
+// SaaS管理者向けAPI
+// POST /api/admin/tenant/:tenant_id/domain/:domain/delete
+// カスタムドメインを削除する。以降そのホスト名ではアクセスできない
+func (s *Server) tenantDomainDeleteHandler(c echo.Context) error {
+	if host := c.Request().Host; host != s.adminHostname {
+		return echo.NewHTTPError(
+			http.StatusNotFound,
+			fmt.Sprintf("invalid hostname %s", host),
+		)
+	}
+	ctx := requestContext(c)
+	if v, err := s.parseViewer(c); err != nil {
+		return err
+	} else if v.role != RoleAdmin {
+		return echo.NewHTTPError(http.StatusForbidden, "admin role required")
+	}
+
+	tenant, err := s.retrieveTenantByParam(ctx, c.Param("tenant_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "tenant not found")
+		}
+		return fmt.Errorf("error retrieveTenantByParam: %w", err)
+	}
+	d, err := s.retrieveTenantDomain(ctx, tenant.ID, c.Param("domain"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "domain not found")
+		}
+		return fmt.Errorf("error retrieveTenantDomain: %w", err)
+	}
+	if _, err := s.adminDB.ExecContext(ctx, "DELETE FROM tenant_domain WHERE id = ?", d.ID); err != nil {
+		return fmt.Errorf("error Delete tenant_domain: id=%d, %w", d.ID, err)
+	}
+	s.tenantCache.invalidate(tenantCacheDomainKey(d.Domain))
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
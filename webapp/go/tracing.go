@@ -0,0 +1,503 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// トレースの設定
+// 環境変数 ISUCON_TRACE_EXPORTER に file か otlp を設定すると有効になる。未設定なら記録しない
+//
+// file: ISUCON_TRACE_FILE にOTLP/JSONの ExportTraceServiceRequest を1行ずつ書き出す
+// otlp: ISUCON_TRACE_OTLP_ENDPOINT (例: http://127.0.0.1:4318/v1/traces) にOTLP/HTTPのJSONで送る
+const (
+	traceServiceName    = "isuports"
+	traceBatchSize      = 512
+	traceQueueSize      = 4096
+	traceExportInterval = time.Second
+	traceExportTimeout  = 5 * time.Second
+
+	traceparentHeader = "traceparent"
+	tracestateHeader  = "tracestate"
+)
+
+// OTLPのSpanKind
+const (
+	spanKindInternal = 1
+	spanKindServer   = 2
+	spanKindClient   = 3
+)
+
+type traceID [16]byte
+type spanID [8]byte
+
+func (t traceID) String() string { return hex.EncodeToString(t[:]) }
+func (s spanID) String() string  { return hex.EncodeToString(s[:]) }
+
+type spanAttribute struct {
+	Key   string
+	Value any
+}
+
+// 処理1つ分の区間
+// トレースが無効な場合はnilになるので、メソッドはnilでも呼び出せるようにしておく
+type span struct {
+	TraceID    traceID
+	SpanID     spanID
+	Parent     spanID // ルートの場合はゼロ値
+	Name       string
+	Kind       int
+	Start      time.Time
+	End        time.Time
+	TraceState string
+
+	tracer     *spanTracer
+	mu         sync.Mutex
+	attributes []spanAttribute
+	errMessage string
+	ended      int32
+}
+
+func (s *span) SetAttributes(kv ...spanAttribute) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.attributes = append(s.attributes, kv...)
+}
+
+// エラーを記録する
+// nilを渡した場合は何もしない
+func (s *span) RecordError(err error) {
+	if s == nil || err == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errMessage = err.Error()
+}
+
+// 区間を終えてエクスポーターに渡す
+// 2回目以降の呼び出しは無視する
+func (s *span) Finish() {
+	if s == nil || !atomic.CompareAndSwapInt32(&s.ended, 0, 1) {
+		return
+	}
+	s.End = time.Now()
+	s.tracer.enqueue(s)
+}
+
+type spanKey struct{}
+
+// contextに入っている現在の区間を返す
+// requestContext で作ったcontextの場合はハンドラの区間を返す
+func spanFromContext(ctx context.Context) *span {
+	if s, ok := ctx.Value(spanKey{}).(*span); ok {
+		return s
+	}
+	if ri := requestInfoFromContext(ctx); ri != nil {
+		return ri.span
+	}
+	return nil
+}
+
+// ctxの区間の子として新しい区間を始める
+// 返したcontextを後続の処理に渡すと、その中で始めた区間は新しい区間の子になる
+// 呼び出し側は必ず Finish を呼ぶこと
+func (t *spanTracer) startSpan(ctx context.Context, name string, kind int, attrs ...spanAttribute) (context.Context, *span) {
+	if !t.enabled() {
+		return ctx, nil
+	}
+	s := &span{Name: name, Kind: kind, Start: time.Now(), tracer: t, attributes: attrs}
+	if parent := spanFromContext(ctx); parent != nil {
+		s.TraceID = parent.TraceID
+		s.Parent = parent.SpanID
+		s.TraceState = parent.TraceState
+	} else {
+		rand.Read(s.TraceID[:])
+	}
+	rand.Read(s.SpanID[:])
+	return context.WithValue(ctx, spanKey{}, s), s
+}
+
+// W3C Trace Context の traceparent を読む
+// 形式は "00-<trace-id 32桁>-<parent-id 16桁>-<flags 2桁>"
+func parseTraceparent(h string) (traceID, spanID, bool) {
+	var tid traceID
+	var sid spanID
+	parts := strings.Split(strings.TrimSpace(h), "-")
+	if len(parts) < 4 || len(parts[0]) != 2 || parts[0] == "ff" {
+		return tid, sid, false
+	}
+	// version 00 はちょうど4要素。将来のバージョンは後ろに要素が増えてもよい
+	if parts[0] == "00" && len(parts) != 4 {
+		return tid, sid, false
+	}
+	if len(parts[1]) != 32 || len(parts[2]) != 16 || len(parts[3]) != 2 {
+		return tid, sid, false
+	}
+	if _, err := hex.Decode(tid[:], []byte(parts[1])); err != nil || tid == (traceID{}) {
+		return tid, sid, false
+	}
+	if _, err := hex.Decode(sid[:], []byte(parts[2])); err != nil || sid == (spanID{}) {
+		return tid, sid, false
+	}
+	return tid, sid, true
+}
+
+// W3C Trace Context の traceparent を作る
+func formatTraceparent(s *span) string {
+	return fmt.Sprintf("00-%s-%s-01", s.TraceID, s.SpanID)
+}
+
+// 外部へのHTTPリクエストにctxの区間の traceparent を付ける
+func injectTraceContext(ctx context.Context, req *http.Request) {
+	s := spanFromContext(ctx)
+	if s == nil {
+		return
+	}
+	req.Header.Set(traceparentHeader, formatTraceparent(s))
+	if s.TraceState != "" {
+		req.Header.Set(tracestateHeader, s.TraceState)
+	}
+}
+
+// ハンドラ全体の区間を記録するミドルウェア
+// リクエストに traceparent があればそのトレースの続きとして記録する
+// SetRequestInfo より内側に置くこと
+func (t *spanTracer) TraceRequest(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		if !t.enabled() {
+			return next(c)
+		}
+		req := c.Request()
+		s := &span{
+			Name:   req.Method + " " + c.Path(),
+			Kind:   spanKindServer,
+			Start:  time.Now(),
+			tracer: t,
+			attributes: []spanAttribute{
+				{"http.method", req.Method},
+				{"http.route", c.Path()},
+				{"http.target", req.URL.RequestURI()},
+				{"net.host.name", req.Host},
+			},
+		}
+		if tid, parent, ok := parseTraceparent(req.Header.Get(traceparentHeader)); ok {
+			s.TraceID = tid
+			s.Parent = parent
+			s.TraceState = req.Header.Get(tracestateHeader)
+		} else {
+			rand.Read(s.TraceID[:])
+		}
+		rand.Read(s.SpanID[:])
+		if ri, ok := c.Get(requestInfoContextKey).(*requestInfo); ok {
+			ri.span = s
+			s.SetAttributes(spanAttribute{"http.request_id", ri.RequestID})
+		}
+
+		err := next(c)
+		if err != nil {
+			s.RecordError(err)
+		}
+		if ri, ok := c.Get(requestInfoContextKey).(*requestInfo); ok && ri.TenantID() != 0 {
+			s.SetAttributes(spanAttribute{"isuports.tenant_id", ri.TenantID()})
+		}
+		// エラーの場合はステータスコードがまだ決まっていないので記録しない
+		if err == nil {
+			s.SetAttributes(spanAttribute{"http.status_code", c.Response().Status})
+		}
+		s.Finish()
+		return err
+	}
+}
+
+// 区間をまとめてエクスポーターに送る
+// Serverごとに持ち、区間は自分を作ったspanTracerに送られる
+type spanTracer struct {
+	exporter spanExporter // nilならトレースは無効
+	dropped  int64        // キューが溢れて捨てた区間の数。atomicで読み書きする
+	done     chan struct{}
+
+	mu     sync.RWMutex
+	queue  chan *span
+	closed bool
+}
+
+type spanExporter interface {
+	Export(ctx context.Context, body []byte) error
+	Close() error
+}
+
+func (t *spanTracer) enabled() bool {
+	return t != nil && t.exporter != nil
+}
+
+// 処理の遅延を避けるため、キューが溢れたら区間を捨てる
+func (t *spanTracer) enqueue(s *span) {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	if t.closed {
+		return
+	}
+	select {
+	case t.queue <- s:
+	default:
+		atomic.AddInt64(&t.dropped, 1)
+	}
+}
+
+// トレースの設定に従ってエクスポーターを起動する
+// 返したspanTracerを閉じると、残っている区間を送ってから終了する
+func initializeTracer(logger echo.Logger, conf TraceConfig) (*spanTracer, error) {
+	var exporter spanExporter
+	switch conf.Exporter {
+	case "":
+		return &spanTracer{}, nil
+	case "file":
+		f, err := os.OpenFile(conf.File, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return nil, fmt.Errorf("cannot open ISUCON_TRACE_FILE: %w", err)
+		}
+		exporter = &fileSpanExporter{f: f}
+	case "otlp":
+		exporter = &otlpSpanExporter{
+			endpoint: conf.OTLPEndpoint,
+			client:   &http.Client{Timeout: traceExportTimeout},
+		}
+	default:
+		return nil, fmt.Errorf("invalid ISUCON_TRACE_EXPORTER: %s", conf.Exporter)
+	}
+	t := &spanTracer{
+		exporter: exporter,
+		queue:    make(chan *span, traceQueueSize),
+		done:     make(chan struct{}),
+	}
+	go t.run(logger)
+	return t, nil
+}
+
+func (t *spanTracer) run(logger echo.Logger) {
+	defer close(t.done)
+	ticker := time.NewTicker(traceExportInterval)
+	defer ticker.Stop()
+	batch := make([]*span, 0, traceBatchSize)
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		if err := t.export(batch); err != nil {
+			logger.Errorf("error export spans: %s", err)
+		}
+		batch = batch[:0]
+	}
+	for {
+		select {
+		case s, ok := <-t.queue:
+			if !ok {
+				flush()
+				return
+			}
+			batch = append(batch, s)
+			if len(batch) >= traceBatchSize {
+				flush()
+			}
+		case <-ticker.C:
+			flush()
+		}
+	}
+}
+
+func (t *spanTracer) export(batch []*span) error {
+	body, err := json.Marshal(otlpTraceRequest(batch))
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), traceExportTimeout)
+	defer cancel()
+	return t.exporter.Export(ctx, body)
+}
+
+func (t *spanTracer) Close() error {
+	if !t.enabled() {
+		return nil
+	}
+	t.mu.Lock()
+	t.closed = true
+	close(t.queue)
+	t.mu.Unlock()
+	<-t.done
+	return t.exporter.Close()
+}
+
+// ISUCON_TRACE_FILE にOTLP/JSONを1行ずつ書き出す
+// OpenTelemetry Collectorのfile exporterと同じ形式
+type fileSpanExporter struct {
+	f *os.File
+}
+
+func (e *fileSpanExporter) Export(_ context.Context, body []byte) error {
+	if _, err := e.f.Write(append(body, '\n')); err != nil {
+		return fmt.Errorf("error Write: %w", err)
+	}
+	return nil
+}
+
+func (e *fileSpanExporter) Close() error {
+	return e.f.Close()
+}
+
+// OTLP/HTTPのJSONでCollectorに送る
+type otlpSpanExporter struct {
+	endpoint string
+	client   *http.Client
+}
+
+func (e *otlpSpanExporter) Export(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("error http.NewRequest: %w", err)
+	}
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	res, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("error POST %s: %w", e.endpoint, err)
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("error POST %s: status=%d", e.endpoint, res.StatusCode)
+	}
+	return nil
+}
+
+func (e *otlpSpanExporter) Close() error {
+	return nil
+}
+
+// OTLP/JSON の ExportTraceServiceRequest
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpKeyValue `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string         `json:"traceId"`
+	SpanID            string         `json:"spanId"`
+	ParentSpanID      string         `json:"parentSpanId,omitempty"`
+	TraceState        string         `json:"traceState,omitempty"`
+	Name              string         `json:"name"`
+	Kind              int            `json:"kind"`
+	StartTimeUnixNano string         `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string         `json:"endTimeUnixNano"`
+	Attributes        []otlpKeyValue `json:"attributes,omitempty"`
+	Status            otlpStatus     `json:"status"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 0: unset, 2: error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string       `json:"key"`
+	Value otlpAnyValue `json:"value"`
+}
+
+type otlpAnyValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"` // int64はJSONでは文字列にする
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func otlpValue(v any) otlpAnyValue {
+	switch x := v.(type) {
+	case string:
+		return otlpAnyValue{StringValue: &x}
+	case int:
+		s := strconv.Itoa(x)
+		return otlpAnyValue{IntValue: &s}
+	case int64:
+		s := strconv.FormatInt(x, 10)
+		return otlpAnyValue{IntValue: &s}
+	case bool:
+		return otlpAnyValue{BoolValue: &x}
+	case float64:
+		return otlpAnyValue{DoubleValue: &x}
+	default:
+		s := fmt.Sprint(x)
+		return otlpAnyValue{StringValue: &s}
+	}
+}
+
+func otlpTraceRequest(batch []*span) otlpRequest {
+	spans := make([]otlpSpan, 0, len(batch))
+	for _, s := range batch {
+		s.mu.Lock()
+		o := otlpSpan{
+			TraceID:           s.TraceID.String(),
+			SpanID:            s.SpanID.String(),
+			TraceState:        s.TraceState,
+			Name:              s.Name,
+			Kind:              s.Kind,
+			StartTimeUnixNano: strconv.FormatInt(s.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(s.End.UnixNano(), 10),
+		}
+		if s.Parent != (spanID{}) {
+			o.ParentSpanID = s.Parent.String()
+		}
+		for _, a := range s.attributes {
+			o.Attributes = append(o.Attributes, otlpKeyValue{Key: a.Key, Value: otlpValue(a.Value)})
+		}
+		if s.errMessage != "" {
+			o.Status = otlpStatus{Code: 2, Message: s.errMessage}
+		}
+		s.mu.Unlock()
+		spans = append(spans, o)
+	}
+	serviceName := traceServiceName
+	return otlpRequest{
+		ResourceSpans: []otlpResourceSpans{{
+			Resource: otlpResource{
+				Attributes: []otlpKeyValue{{Key: "service.name", Value: otlpAnyValue{StringValue: &serviceName}}},
+			},
+			ScopeSpans: []otlpScopeSpans{{
+				Scope: otlpScope{Name: "github.com/isucon/isucon12-qualify/webapp/go"},
+				Spans: spans,
+			}},
+		}},
+	}
+}
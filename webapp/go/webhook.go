@@ -0,0 +1,730 @@
+package isuports
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	WebhookEventPing               = "ping"
+	WebhookEventPlayerAdded        = DomainEventPlayerAdded
+	WebhookEventPlayerDisqualified = DomainEventPlayerDisqualified
+	WebhookEventCompetitionCreated = DomainEventCompetitionCreated
+	WebhookEventCompetitionFinish  = DomainEventCompetitionFinished
+	WebhookEventScoresUploaded     = DomainEventScoresUploaded
+
+	WebhookDeliveryStatusPending   = "pending"
+	WebhookDeliveryStatusSucceeded = "succeeded"
+	WebhookDeliveryStatusFailed    = "failed"
+
+	webhookSignatureHeader = "X-Isuports-Signature"
+	webhookTimestampHeader = "X-Isuports-Timestamp"
+	webhookEventHeader     = "X-Isuports-Event"
+	webhookDeliveryHeader  = "X-Isuports-Delivery"
+
+	webhookMaxAttempts     = 8
+	webhookRetryBaseDelay  = 10 * time.Second
+	webhookRequestTimeout  = 5 * time.Second
+	webhookDispatchLimit   = 100
+	webhookDispatchWorkers = 8  // 同時に送信する配送先の数
+	webhookDispatchLease   = 60 // 配送中のリクエストを他のワーカーが拾わないように次回配送時刻をずらす秒数
+	webhookDeliveryLogSize = 100
+)
+
+// 購読できるイベントの一覧
+var webhookEvents = []string{
+	WebhookEventPlayerAdded,
+	WebhookEventPlayerDisqualified,
+	WebhookEventCompetitionCreated,
+	WebhookEventCompetitionFinish,
+	WebhookEventScoresUploaded,
+}
+
+// キャリアグレードNATのアドレス。net.IP.IsPrivate には含まれない
+var webhookSharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// Webhookの送信先にできないアドレスか
+// 同じホストや内部ネットワークのサービス、クラウドのメタデータサービスにリクエストを送らせないようにする
+func isPrivateAddress(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast() ||
+		webhookSharedAddressSpace.Contains(ip)
+}
+
+// Webhookを送信するHTTPクライアントを作る
+// allowPrivate が false なら、接続する時点でもアドレスを確認する
+// 登録時の確認の後でDNSの応答を変えられても、内部のアドレスには接続しない
+func newWebhookHTTPClient(allowPrivate bool) *http.Client {
+	dialer := &net.Dialer{Timeout: webhookRequestTimeout}
+	if !allowPrivate {
+		dialer.Control = func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || isPrivateAddress(ip) {
+				return fmt.Errorf("webhook to private address is not allowed: %s", host)
+			}
+			return nil
+		}
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// プロキシを経由すると接続先のアドレスを確認できないので使わない
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{Timeout: webhookRequestTimeout, Transport: transport}
+}
+
+type WebhookEndpointRow struct {
+	ID        int64  `db:"id"`
+	TenantID  int64  `db:"tenant_id"`
+	URL       string `db:"url"`
+	Secret    string `db:"secret"`
+	Events    string `db:"events"` // カンマ区切りのイベント名
+	CreatedAt int64  `db:"created_at"`
+	UpdatedAt int64  `db:"updated_at"`
+}
+
+func (w *WebhookEndpointRow) subscribes(event string) bool {
+	for _, e := range strings.Split(w.Events, ",") {
+		if e == event {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDeliveryRow struct {
+	ID             int64          `db:"id"`
+	TenantID       int64          `db:"tenant_id"`
+	WebhookID      int64          `db:"webhook_id"`
+	EventID        string         `db:"event_id"`
+	Event          string         `db:"event"`
+	Payload        string         `db:"payload"`
+	Status         string         `db:"status"`
+	Attempts       int64          `db:"attempts"`
+	ResponseStatus sql.NullInt64  `db:"response_status"`
+	LastError      sql.NullString `db:"last_error"`
+	NextAttemptAt  int64          `db:"next_attempt_at"`
+	CreatedAt      int64          `db:"created_at"`
+	UpdatedAt      int64          `db:"updated_at"`
+}
+
+// Webhookで送信するリクエストボディ
+type WebhookPayload struct {
+	ID        string `json:"id"`
+	Event     string `json:"event"`
+	TenantID  int64  `json:"tenant_id"`
+	CreatedAt int64  `json:"created_at"`
+	Data      any    `json:"data"`
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("error rand.Read: %w", err)
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Webhookの署名を計算する
+// 署名対象は "<timestamp>.<body>" で、HMAC-SHA256の16進表現を "sha256=" に続けて送る
+func signWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d.", timestamp)
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Webhookの署名を検証する
+// 受信側の実装例として cmd/webhook-receiver から使う
+func VerifyWebhookSignature(secret string, timestamp int64, body []byte, signature string) bool {
+	return hmac.Equal([]byte(signWebhookPayload(secret, timestamp, body)), []byte(signature))
+}
+
+// 配送に失敗したときの次の配送までの待ち時間
+// 10秒から倍々で増やす
+func webhookRetryDelay(attempts int64) time.Duration {
+	return webhookRetryBaseDelay * time.Duration(1<<(attempts-1))
+}
+
+// ドメインイベントをWebhookの配送キューに積む
+// 配送は runWebhookDispatcher が非同期に行う
+// 同じイベントが再送されても配送先ごとに1回だけ積む
+func (s *Server) enqueueWebhookEvent(ctx context.Context, ev *DomainEventRow) error {
+	ws := []WebhookEndpointRow{}
+	if err := s.adminDB.SelectContext(
+		ctx,
+		&ws,
+		"SELECT * FROM webhook_endpoint WHERE tenant_id = ?",
+		ev.TenantID,
+	); err != nil {
+		return fmt.Errorf("error Select webhook_endpoint: tenantID=%d, %w", ev.TenantID, err)
+	}
+	targets := make([]WebhookEndpointRow, 0, len(ws))
+	for _, w := range ws {
+		if w.subscribes(ev.Type) {
+			targets = append(targets, w)
+		}
+	}
+	if len(targets) == 0 {
+		return nil
+	}
+
+	payload, err := json.Marshal(WebhookPayload{
+		ID:        ev.ID,
+		Event:     ev.Type,
+		TenantID:  ev.TenantID,
+		CreatedAt: ev.CreatedAt,
+		Data:      json.RawMessage(ev.Payload),
+	})
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	now := s.now()
+	for _, w := range targets {
+		// 配送はイベントの発生後に積まれるので、created_atで範囲を絞って重複を確認する
+		var count int64
+		if err := s.adminDB.GetContext(
+			ctx,
+			&count,
+			"SELECT COUNT(*) FROM webhook_delivery WHERE webhook_id = ? AND created_at >= ? AND event_id = ?",
+			w.ID, ev.CreatedAt, ev.ID,
+		); err != nil {
+			return fmt.Errorf("error Select webhook_delivery: webhookID=%d, eventID=%s, %w", w.ID, ev.ID, err)
+		}
+		if count > 0 {
+			continue
+		}
+		if _, err := s.adminDB.ExecContext(
+			ctx,
+			"INSERT INTO webhook_delivery (tenant_id, webhook_id, event_id, event, payload, status, attempts, next_attempt_at, created_at, updated_at) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+			ev.TenantID, w.ID, ev.ID, ev.Type, string(payload), WebhookDeliveryStatusPending, 0, now, now, now,
+		); err != nil {
+			return fmt.Errorf("error Insert webhook_delivery: webhookID=%d, event=%s, %w", w.ID, ev.Type, err)
+		}
+	}
+	return nil
+}
+
+// Webhookを1回送信する
+// 2xx以外のレスポンスは失敗とみなす
+func (s *Server) sendWebhook(ctx context.Context, w *WebhookEndpointRow, deliveryID int64, event string, payload []byte) (int, error) {
+	ctx, span := s.tracer.startSpan(ctx, "POST webhook", spanKindClient,
+		spanAttribute{"http.method", http.MethodPost},
+		spanAttribute{"http.url", w.URL},
+		spanAttribute{"isuports.webhook_event", event},
+	)
+	defer span.Finish()
+	now := s.now()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(payload))
+	if err != nil {
+		return 0, fmt.Errorf("error http.NewRequest: %w", err)
+	}
+	injectTraceContext(ctx, req)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set("User-Agent", "isuports-webhook")
+	req.Header.Set(webhookEventHeader, event)
+	req.Header.Set(webhookDeliveryHeader, strconv.FormatInt(deliveryID, 10))
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(now, 10))
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(w.Secret, now, payload))
+	res, err := s.webhookClient.Do(req)
+	if err != nil {
+		span.RecordError(err)
+		return 0, err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(res.Body, 64*1024))
+	span.SetAttributes(spanAttribute{"http.status_code", res.StatusCode})
+	if res.StatusCode < 200 || 300 <= res.StatusCode {
+		err := fmt.Errorf("unexpected status code: %d", res.StatusCode)
+		span.RecordError(err)
+		return res.StatusCode, err
+	}
+	return res.StatusCode, nil
+}
+
+// 配送待ちのWebhookを定期的に送信する
+func (s *Server) runWebhookDispatcher(ctx context.Context, interval time.Duration, logger echo.Logger) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.dispatchWebhooks(ctx, s.now(), logger); err != nil {
+				logger.Errorf("error dispatchWebhooks: %s", err)
+			}
+		}
+	}
+}
+
+// 配送時刻になったWebhookを送信し、結果を記録する
+// 配送先ごとにまとめて webhookDispatchWorkers 並列で送る。同じ配送先には古いものから順に送る
+// 1件の失敗で他の配送を止めないように、配送ごとのエラーはログに出して続ける
+func (s *Server) dispatchWebhooks(ctx context.Context, now int64, logger echo.Logger) error {
+	ds := []WebhookDeliveryRow{}
+	if err := s.adminDB.SelectContext(
+		ctx,
+		&ds,
+		"SELECT * FROM webhook_delivery WHERE status = ? AND next_attempt_at <= ? ORDER BY next_attempt_at ASC, id ASC LIMIT ?",
+		WebhookDeliveryStatusPending, now, webhookDispatchLimit,
+	); err != nil {
+		return fmt.Errorf("error Select webhook_delivery: %w", err)
+	}
+
+	webhookIDs := []int64{}
+	byWebhook := map[int64][]WebhookDeliveryRow{}
+	for _, d := range ds {
+		if _, ok := byWebhook[d.WebhookID]; !ok {
+			webhookIDs = append(webhookIDs, d.WebhookID)
+		}
+		byWebhook[d.WebhookID] = append(byWebhook[d.WebhookID], d)
+	}
+
+	queue := make(chan []WebhookDeliveryRow)
+	var wg sync.WaitGroup
+	for i := 0; i < webhookDispatchWorkers && i < len(webhookIDs); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for ds := range queue {
+				for _, d := range ds {
+					if err := s.dispatchWebhook(ctx, &d, now); err != nil {
+						logger.Errorf("error dispatchWebhook: id=%d, %s", d.ID, err)
+					}
+				}
+			}
+		}()
+	}
+	for _, id := range webhookIDs {
+		queue <- byWebhook[id]
+	}
+	close(queue)
+	wg.Wait()
+	return nil
+}
+
+// 配送を1件確保して送信する
+// 複数のワーカーで同じ配送を行わないように、次回配送時刻を書き換えられたものだけを送る
+func (s *Server) dispatchWebhook(ctx context.Context, d *WebhookDeliveryRow, now int64) error {
+	ret, err := s.adminDB.ExecContext(
+		ctx,
+		"UPDATE webhook_delivery SET next_attempt_at = ? WHERE id = ? AND status = ? AND next_attempt_at = ?",
+		now+webhookDispatchLease, d.ID, WebhookDeliveryStatusPending, d.NextAttemptAt,
+	)
+	if err != nil {
+		return fmt.Errorf("error Update webhook_delivery: id=%d, %w", d.ID, err)
+	}
+	if n, err := ret.RowsAffected(); err != nil {
+		return fmt.Errorf("error RowsAffected: %w", err)
+	} else if n == 0 {
+		return nil
+	}
+	if err := s.deliverWebhook(ctx, d); err != nil {
+		return fmt.Errorf("error deliverWebhook: %w", err)
+	}
+	return nil
+}
+
+// Webhookを送信し、配送ログを更新する
+func (s *Server) deliverWebhook(ctx context.Context, d *WebhookDeliveryRow) error {
+	var w WebhookEndpointRow
+	if err := s.adminDB.GetContext(ctx, &w, "SELECT * FROM webhook_endpoint WHERE id = ?", d.WebhookID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// 配送先が削除されている
+			_, err := s.adminDB.ExecContext(
+				ctx,
+				"UPDATE webhook_delivery SET status = ?, last_error = ?, updated_at = ? WHERE id = ?",
+				WebhookDeliveryStatusFailed, "webhook was deleted", s.now(), d.ID,
+			)
+			return err
+		}
+		return fmt.Errorf("error Select webhook_endpoint: id=%d, %w", d.WebhookID, err)
+	}
+
+	statusCode, sendErr := s.sendWebhook(ctx, &w, d.ID, d.Event, []byte(d.Payload))
+	now := s.now()
+	d.Attempts++
+	d.ResponseStatus = sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}
+	d.LastError = sql.NullString{}
+	switch {
+	case sendErr == nil:
+		d.Status = WebhookDeliveryStatusSucceeded
+	case d.Attempts >= webhookMaxAttempts:
+		d.Status = WebhookDeliveryStatusFailed
+		d.LastError = sql.NullString{String: sendErr.Error(), Valid: true}
+	default:
+		d.NextAttemptAt = now + int64(webhookRetryDelay(d.Attempts).Seconds())
+		d.LastError = sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+	if _, err := s.adminDB.ExecContext(
+		ctx,
+		"UPDATE webhook_delivery SET status = ?, attempts = ?, response_status = ?, last_error = ?, next_attempt_at = ?, updated_at = ? WHERE id = ?",
+		d.Status, d.Attempts, d.ResponseStatus, d.LastError, d.NextAttemptAt, now, d.ID,
+	); err != nil {
+		return fmt.Errorf("error Update webhook_delivery: id=%d, %w", d.ID, err)
+	}
+	return nil
+}
+
+type WebhookDetail struct {
+	ID        string   `json:"id"`
+	URL       string   `json:"url"`
+	Events    []string `json:"events"`
+	CreatedAt int64    `json:"created_at"`
+}
+
+func webhookDetail(w *WebhookEndpointRow) WebhookDetail {
+	return WebhookDetail{
+		ID:        strconv.FormatInt(w.ID, 10),
+		URL:       w.URL,
+		Events:    strings.Split(w.Events, ","),
+		CreatedAt: w.CreatedAt,
+	}
+}
+
+// Webhookの送信先URLが正しいかチェックする
+// 手元の受信サーバーで試せるようにhttpも許可する
+// ループバックやプライベートなどのアドレスに解決されるホストは、設定で許可しない限り登録できない
+func (s *Server) validateWebhookURL(ctx context.Context, rawURL string) error {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return fmt.Errorf("invalid url: %w", err)
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Hostname() == "" {
+		return fmt.Errorf("invalid url: %s", rawURL)
+	}
+	if s.webhookAllowPrivateAddresses {
+		return nil
+	}
+	host := u.Hostname()
+	var ips []net.IP
+	if ip := net.ParseIP(host); ip != nil {
+		ips = []net.IP{ip}
+	} else {
+		addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+		if err != nil {
+			return fmt.Errorf("cannot resolve host: %s", host)
+		}
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+	for _, ip := range ips {
+		if isPrivateAddress(ip) {
+			return fmt.Errorf("private address is not allowed: %s", host)
+		}
+	}
+	return nil
+}
+
+// テナントのWebhookを取得する
+func (s *Server) retrieveWebhook(ctx context.Context, tenantID int64, id string) (*WebhookEndpointRow, error) {
+	webhookID, err := strconv.ParseInt(id, 10, 64)
+	if err != nil {
+		return nil, sql.ErrNoRows
+	}
+	var w WebhookEndpointRow
+	if err := s.adminDB.GetContext(
+		ctx,
+		&w,
+		"SELECT * FROM webhook_endpoint WHERE id = ? AND tenant_id = ?",
+		webhookID, tenantID,
+	); err != nil {
+		return nil, fmt.Errorf("error Select webhook_endpoint: id=%s, %w", id, err)
+	}
+	return &w, nil
+}
+
+type WebhooksAddHandlerResult struct {
+	Webhook WebhookDetail `json:"webhook"`
+	Secret  string        `json:"secret"` // 署名の検証に使う。作成時にのみ返す
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/webhooks/add
+// Webhookの送信先を登録する
+func (s *Server) webhooksAddHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	webhookURL := c.FormValue("url")
+	if err := s.validateWebhookURL(ctx, webhookURL); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	params, err := c.FormParams()
+	if err != nil {
+		return fmt.Errorf("error c.FormParams: %w", err)
+	}
+	// event[]を省略した場合は全てのイベントを購読する
+	events := params["event[]"]
+	if len(events) == 0 {
+		events = webhookEvents
+	}
+	for _, e := range events {
+		valid := false
+		for _, we := range webhookEvents {
+			valid = valid || e == we
+		}
+		if !valid {
+			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid event: %s", e))
+		}
+	}
+	secret, err := randomHex(32)
+	if err != nil {
+		return err
+	}
+
+	now := s.now()
+	w := WebhookEndpointRow{
+		TenantID:  v.tenantID,
+		URL:       webhookURL,
+		Secret:    secret,
+		Events:    strings.Join(events, ","),
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+	insertRes, err := s.adminDB.NamedExecContext(
+		ctx,
+		"INSERT INTO webhook_endpoint (tenant_id, url, secret, events, created_at, updated_at) VALUES (:tenant_id, :url, :secret, :events, :created_at, :updated_at)",
+		w,
+	)
+	if err != nil {
+		return fmt.Errorf("error Insert webhook_endpoint: tenantID=%d, url=%s, %w", v.tenantID, webhookURL, err)
+	}
+	if w.ID, err = insertRes.LastInsertId(); err != nil {
+		return fmt.Errorf("error get LastInsertId: %w", err)
+	}
+
+	setAuditTarget(c, strconv.FormatInt(w.ID, 10))
+
+	res := WebhooksAddHandlerResult{
+		Webhook: webhookDetail(&w),
+		Secret:  secret,
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: res})
+}
+
+type WebhooksHandlerResult struct {
+	Webhooks []WebhookDetail `json:"webhooks"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/webhooks
+// Webhookの送信先の一覧を取得する
+func (s *Server) webhooksHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return err
+	}
+
+	ws := []WebhookEndpointRow{}
+	if err := s.adminDB.SelectContext(
+		ctx,
+		&ws,
+		"SELECT * FROM webhook_endpoint WHERE tenant_id = ? ORDER BY id ASC",
+		v.tenantID,
+	); err != nil {
+		return fmt.Errorf("error Select webhook_endpoint: %w", err)
+	}
+	wds := make([]WebhookDetail, 0, len(ws))
+	for _, w := range ws {
+		wds = append(wds, webhookDetail(&w))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: WebhooksHandlerResult{Webhooks: wds}})
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/webhook/:webhook_id/delete
+// Webhookの送信先を削除する
+// 配送ログは残る
+func (s *Server) webhookDeleteHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	w, err := s.retrieveWebhook(ctx, v.tenantID, c.Param("webhook_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+		}
+		return fmt.Errorf("error retrieveWebhook: %w", err)
+	}
+	if _, err := s.adminDB.ExecContext(ctx, "DELETE FROM webhook_endpoint WHERE id = ?", w.ID); err != nil {
+		return fmt.Errorf("error Delete webhook_endpoint: id=%d, %w", w.ID, err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true})
+}
+
+type WebhookDeliveryDetail struct {
+	ID             string `json:"id"`
+	EventID        string `json:"event_id"`
+	Event          string `json:"event"`
+	Status         string `json:"status"`
+	Attempts       int64  `json:"attempts"`
+	ResponseStatus *int64 `json:"response_status"`
+	LastError      string `json:"last_error"`
+	NextAttemptAt  int64  `json:"next_attempt_at"`
+	CreatedAt      int64  `json:"created_at"`
+	UpdatedAt      int64  `json:"updated_at"`
+}
+
+func webhookDeliveryDetail(d *WebhookDeliveryRow) WebhookDeliveryDetail {
+	return WebhookDeliveryDetail{
+		ID:             strconv.FormatInt(d.ID, 10),
+		EventID:        d.EventID,
+		Event:          d.Event,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		ResponseStatus: nullInt64Ptr(d.ResponseStatus),
+		LastError:      d.LastError.String,
+		NextAttemptAt:  d.NextAttemptAt,
+		CreatedAt:      d.CreatedAt,
+		UpdatedAt:      d.UpdatedAt,
+	}
+}
+
+type WebhookDeliveriesHandlerResult struct {
+	Deliveries []WebhookDeliveryDetail `json:"deliveries"`
+}
+
+// テナント管理者向けAPI
+// GET /api/organizer/webhook/:webhook_id/deliveries
+// Webhookの配送ログを新しい順に最大100件取得する
+func (s *Server) webhookDeliveriesHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return err
+	}
+
+	w, err := s.retrieveWebhook(ctx, v.tenantID, c.Param("webhook_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+		}
+		return fmt.Errorf("error retrieveWebhook: %w", err)
+	}
+	ds := []WebhookDeliveryRow{}
+	if err := s.adminDB.SelectContext(
+		ctx,
+		&ds,
+		"SELECT * FROM webhook_delivery WHERE webhook_id = ? ORDER BY created_at DESC, id DESC LIMIT ?",
+		w.ID, webhookDeliveryLogSize,
+	); err != nil {
+		return fmt.Errorf("error Select webhook_delivery: webhookID=%d, %w", w.ID, err)
+	}
+	dds := make([]WebhookDeliveryDetail, 0, len(ds))
+	for _, d := range ds {
+		dds = append(dds, webhookDeliveryDetail(&d))
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: WebhookDeliveriesHandlerResult{Deliveries: dds}})
+}
+
+type WebhookTestHandlerResult struct {
+	Delivery WebhookDeliveryDetail `json:"delivery"`
+}
+
+// テナント管理者向けAPI
+// POST /api/organizer/webhook/:webhook_id/test
+// pingイベントをその場で1回だけ送信して結果を返す
+// 失敗しても再送はしない
+func (s *Server) webhookTestHandler(c echo.Context) error {
+	ctx := requestContext(c)
+	v, err := s.parseViewer(c)
+	if err != nil {
+		return fmt.Errorf("error parseViewer: %w", err)
+	}
+
+	w, err := s.retrieveWebhook(ctx, v.tenantID, c.Param("webhook_id"))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+		}
+		return fmt.Errorf("error retrieveWebhook: %w", err)
+	}
+
+	eventID, err := randomHex(16)
+	if err != nil {
+		return err
+	}
+	now := s.now()
+	payload, err := json.Marshal(WebhookPayload{
+		ID:        eventID,
+		Event:     WebhookEventPing,
+		TenantID:  v.tenantID,
+		CreatedAt: now,
+		Data:      map[string]string{"webhook_id": strconv.FormatInt(w.ID, 10)},
+	})
+	if err != nil {
+		return fmt.Errorf("error json.Marshal: %w", err)
+	}
+	d := WebhookDeliveryRow{
+		TenantID:      v.tenantID,
+		WebhookID:     w.ID,
+		EventID:       eventID,
+		Event:         WebhookEventPing,
+		Payload:       string(payload),
+		Status:        WebhookDeliveryStatusPending,
+		NextAttemptAt: now,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	insertRes, err := s.adminDB.NamedExecContext(
+		ctx,
+		"INSERT INTO webhook_delivery (tenant_id, webhook_id, event_id, event, payload, status, attempts, next_attempt_at, created_at, updated_at) VALUES (:tenant_id, :webhook_id, :event_id, :event, :payload, :status, :attempts, :next_attempt_at, :created_at, :updated_at)",
+		d,
+	)
+	if err != nil {
+		return fmt.Errorf("error Insert webhook_delivery: webhookID=%d, %w", w.ID, err)
+	}
+	if d.ID, err = insertRes.LastInsertId(); err != nil {
+		return fmt.Errorf("error get LastInsertId: %w", err)
+	}
+
+	statusCode, sendErr := s.sendWebhook(ctx, w, d.ID, d.Event, payload)
+	d.Attempts = 1
+	d.ResponseStatus = sql.NullInt64{Int64: int64(statusCode), Valid: statusCode != 0}
+	d.Status = WebhookDeliveryStatusSucceeded
+	if sendErr != nil {
+		d.Status = WebhookDeliveryStatusFailed
+		d.LastError = sql.NullString{String: sendErr.Error(), Valid: true}
+	}
+	d.UpdatedAt = s.now()
+	if _, err := s.adminDB.ExecContext(
+		ctx,
+		"UPDATE webhook_delivery SET status = ?, attempts = ?, response_status = ?, last_error = ?, updated_at = ? WHERE id = ?",
+		d.Status, d.Attempts, d.ResponseStatus, d.LastError, d.UpdatedAt, d.ID,
+	); err != nil {
+		return fmt.Errorf("error Update webhook_delivery: id=%d, %w", d.ID, err)
+	}
+	return c.JSON(http.StatusOK, SuccessResult{Status: true, Data: WebhookTestHandlerResult{Delivery: webhookDeliveryDetail(&d)}})
+}
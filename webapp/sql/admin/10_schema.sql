@@ -3,6 +3,15 @@ USE `isuports`;
 DROP TABLE IF EXISTS `tenant`;
 DROP TABLE IF EXISTS `id_generator`;
 DROP TABLE IF EXISTS `visit_history`;
+DROP TABLE IF EXISTS `competition_schedule`;
+DROP TABLE IF EXISTS `webhook_endpoint`;
+DROP TABLE IF EXISTS `webhook_delivery`;
+DROP TABLE IF EXISTS `domain_event`;
+DROP TABLE IF EXISTS `domain_event_outbox`;
+DROP TABLE IF EXISTS `tenant_domain`;
+DROP TABLE IF EXISTS `tenant_organizer`;
+DROP TABLE IF EXISTS `audit_log`;
+DROP TABLE IF EXISTS `api_token`;
 
 CREATE TABLE `tenant` (
   `id` BIGINT NOT NULL AUTO_INCREMENT,
@@ -29,3 +38,117 @@ CREATE TABLE `visit_history` (
   `updated_at` BIGINT NOT NULL,
   INDEX `tenant_id_idx` (`tenant_id`)
 ) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `competition_schedule` (
+  `tenant_id` BIGINT NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `end_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `competition_id`),
+  INDEX `end_at_idx` (`end_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `webhook_endpoint` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `url` VARCHAR(2048) NOT NULL,
+  `secret` VARCHAR(255) NOT NULL,
+  `events` VARCHAR(1024) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `tenant_id_idx` (`tenant_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `webhook_delivery` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `webhook_id` BIGINT NOT NULL,
+  `event_id` VARCHAR(255) NOT NULL,
+  `event` VARCHAR(255) NOT NULL,
+  `payload` MEDIUMTEXT NOT NULL,
+  `status` VARCHAR(255) NOT NULL,
+  `attempts` INT NOT NULL,
+  `response_status` INT NULL,
+  `last_error` TEXT NULL,
+  `next_attempt_at` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `webhook_id_idx` (`webhook_id`, `created_at`),
+  INDEX `status_next_attempt_at_idx` (`status`, `next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `domain_event` (
+  `seq` BIGINT NOT NULL AUTO_INCREMENT,
+  `id` VARCHAR(255) NOT NULL,
+  `tenant_id` BIGINT NOT NULL,
+  `type` VARCHAR(255) NOT NULL,
+  `payload` MEDIUMTEXT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `dispatched_at` BIGINT NULL,
+  PRIMARY KEY (`seq`),
+  UNIQUE KEY `id` (`id`),
+  INDEX `dispatched_at_idx` (`dispatched_at`, `seq`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `domain_event_outbox` (
+  `tenant_id` BIGINT NOT NULL,
+  `version` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `tenant_domain` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `domain` VARCHAR(255) NOT NULL,
+  `verification_token` VARCHAR(255) NOT NULL,
+  `verified_at` BIGINT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `domain` (`domain`),
+  INDEX `tenant_id_idx` (`tenant_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `tenant_organizer` (
+  `tenant_id` BIGINT NOT NULL,
+  `id` VARCHAR(255) NOT NULL,
+  `display_name` VARCHAR(255) NOT NULL,
+  `permissions` VARCHAR(1024) NOT NULL,
+  `created_by` VARCHAR(255) NOT NULL,
+  `updated_by` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `audit_log` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `actor` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(255) NOT NULL,
+  `action` VARCHAR(255) NOT NULL,
+  `target_id` TEXT NOT NULL,
+  `request_id` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `tenant_id_idx` (`tenant_id`, `id`),
+  INDEX `actor_idx` (`actor`, `id`),
+  INDEX `created_at_idx` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE `api_token` (
+  `id` VARCHAR(255) NOT NULL,
+  `tenant_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `token_hash` CHAR(64) NOT NULL,
+  `scopes` VARCHAR(1024) NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  `last_used_at` BIGINT NULL,
+  `created_by` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  INDEX `tenant_id_idx` (`tenant_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
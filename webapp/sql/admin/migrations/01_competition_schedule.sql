@@ -0,0 +1,8 @@
+-- 既存の管理DBに大会の終了予定のテーブルを追加する
+CREATE TABLE IF NOT EXISTS `competition_schedule` (
+  `tenant_id` BIGINT NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `end_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `competition_id`),
+  INDEX `end_at_idx` (`end_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
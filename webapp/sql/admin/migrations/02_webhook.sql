@@ -0,0 +1,31 @@
+-- 既存の管理DBにWebhookのテーブルを追加する
+CREATE TABLE IF NOT EXISTS `webhook_endpoint` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `url` VARCHAR(2048) NOT NULL,
+  `secret` VARCHAR(255) NOT NULL,
+  `events` VARCHAR(1024) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `tenant_id_idx` (`tenant_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `webhook_delivery` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `webhook_id` BIGINT NOT NULL,
+  `event_id` VARCHAR(255) NOT NULL,
+  `event` VARCHAR(255) NOT NULL,
+  `payload` MEDIUMTEXT NOT NULL,
+  `status` VARCHAR(255) NOT NULL,
+  `attempts` INT NOT NULL,
+  `response_status` INT NULL,
+  `last_error` TEXT NULL,
+  `next_attempt_at` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `webhook_id_idx` (`webhook_id`, `created_at`),
+  INDEX `status_next_attempt_at_idx` (`status`, `next_attempt_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
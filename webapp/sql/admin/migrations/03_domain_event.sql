@@ -0,0 +1,19 @@
+-- 既存の管理DBにドメインイベントのoutboxと、未配送のイベントがあるテナントの記録を追加する
+CREATE TABLE IF NOT EXISTS `domain_event` (
+  `seq` BIGINT NOT NULL AUTO_INCREMENT,
+  `id` VARCHAR(255) NOT NULL,
+  `tenant_id` BIGINT NOT NULL,
+  `type` VARCHAR(255) NOT NULL,
+  `payload` MEDIUMTEXT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `dispatched_at` BIGINT NULL,
+  PRIMARY KEY (`seq`),
+  UNIQUE KEY `id` (`id`),
+  INDEX `dispatched_at_idx` (`dispatched_at`, `seq`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
+
+CREATE TABLE IF NOT EXISTS `domain_event_outbox` (
+  `tenant_id` BIGINT NOT NULL,
+  `version` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
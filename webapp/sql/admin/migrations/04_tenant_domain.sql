@@ -0,0 +1,13 @@
+-- 既存の管理DBにテナントのカスタムドメインのテーブルを追加する
+CREATE TABLE IF NOT EXISTS `tenant_domain` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `domain` VARCHAR(255) NOT NULL,
+  `verification_token` VARCHAR(255) NOT NULL,
+  `verified_at` BIGINT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `domain` (`domain`),
+  INDEX `tenant_id_idx` (`tenant_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,12 @@
+-- 既存の管理DBにテナントの主催者のテーブルを追加する
+CREATE TABLE IF NOT EXISTS `tenant_organizer` (
+  `tenant_id` BIGINT NOT NULL,
+  `id` VARCHAR(255) NOT NULL,
+  `display_name` VARCHAR(255) NOT NULL,
+  `permissions` VARCHAR(1024) NOT NULL,
+  `created_by` VARCHAR(255) NOT NULL,
+  `updated_by` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  `updated_at` BIGINT NOT NULL,
+  PRIMARY KEY (`tenant_id`, `id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,15 @@
+-- 既存の管理DBに監査ログのテーブルを追加する
+CREATE TABLE IF NOT EXISTS `audit_log` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT,
+  `tenant_id` BIGINT NOT NULL,
+  `actor` VARCHAR(255) NOT NULL,
+  `role` VARCHAR(255) NOT NULL,
+  `action` VARCHAR(255) NOT NULL,
+  `target_id` TEXT NOT NULL,
+  `request_id` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  INDEX `tenant_id_idx` (`tenant_id`, `id`),
+  INDEX `actor_idx` (`actor`, `id`),
+  INDEX `created_at_idx` (`created_at`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
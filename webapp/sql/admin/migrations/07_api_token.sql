@@ -0,0 +1,16 @@
+-- 既存の管理DBにAPIトークンのテーブルを追加する
+CREATE TABLE IF NOT EXISTS `api_token` (
+  `id` VARCHAR(255) NOT NULL,
+  `tenant_id` BIGINT NOT NULL,
+  `name` VARCHAR(255) NOT NULL,
+  `token_hash` CHAR(64) NOT NULL,
+  `scopes` VARCHAR(1024) NOT NULL,
+  `competition_id` VARCHAR(255) NOT NULL,
+  `expires_at` BIGINT NOT NULL,
+  `last_used_at` BIGINT NULL,
+  `created_by` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  PRIMARY KEY (`id`),
+  UNIQUE KEY `token_hash` (`token_hash`),
+  INDEX `tenant_id_idx` (`tenant_id`)
+) ENGINE=InnoDB DEFAULT CHARACTER SET=utf8mb4;
@@ -0,0 +1,140 @@
+-- 管理用DBをSQLiteで動かす場合のスキーマ
+-- ../10_schema.sql (MySQL) と同じテーブルを持つ
+DROP TABLE IF EXISTS tenant;
+DROP TABLE IF EXISTS id_generator;
+DROP TABLE IF EXISTS visit_history;
+DROP TABLE IF EXISTS competition_schedule;
+DROP TABLE IF EXISTS webhook_endpoint;
+DROP TABLE IF EXISTS webhook_delivery;
+DROP TABLE IF EXISTS domain_event;
+DROP TABLE IF EXISTS domain_event_outbox;
+DROP TABLE IF EXISTS tenant_domain;
+DROP TABLE IF EXISTS tenant_organizer;
+DROP TABLE IF EXISTS audit_log;
+DROP TABLE IF EXISTS api_token;
+
+CREATE TABLE tenant (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  name VARCHAR(255) NOT NULL UNIQUE,
+  display_name VARCHAR(255) NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE TABLE id_generator (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  stub CHAR(1) NOT NULL DEFAULT '' UNIQUE
+);
+
+CREATE TABLE visit_history (
+  player_id VARCHAR(255) NOT NULL,
+  tenant_id BIGINT NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+CREATE INDEX visit_history_tenant_id_idx ON visit_history (tenant_id);
+
+CREATE TABLE competition_schedule (
+  tenant_id BIGINT NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  end_at BIGINT NOT NULL,
+  PRIMARY KEY (tenant_id, competition_id)
+);
+CREATE INDEX competition_schedule_end_at_idx ON competition_schedule (end_at);
+
+CREATE TABLE webhook_endpoint (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tenant_id BIGINT NOT NULL,
+  url VARCHAR(2048) NOT NULL,
+  secret VARCHAR(255) NOT NULL,
+  events VARCHAR(1024) NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+CREATE INDEX webhook_endpoint_tenant_id_idx ON webhook_endpoint (tenant_id);
+
+CREATE TABLE webhook_delivery (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tenant_id BIGINT NOT NULL,
+  webhook_id BIGINT NOT NULL,
+  event_id VARCHAR(255) NOT NULL,
+  event VARCHAR(255) NOT NULL,
+  payload TEXT NOT NULL,
+  status VARCHAR(255) NOT NULL,
+  attempts INT NOT NULL,
+  response_status INT NULL,
+  last_error TEXT NULL,
+  next_attempt_at BIGINT NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+CREATE INDEX webhook_delivery_webhook_id_idx ON webhook_delivery (webhook_id, created_at);
+CREATE INDEX webhook_delivery_status_next_attempt_at_idx ON webhook_delivery (status, next_attempt_at);
+
+CREATE TABLE domain_event (
+  seq INTEGER PRIMARY KEY AUTOINCREMENT,
+  id VARCHAR(255) NOT NULL UNIQUE,
+  tenant_id BIGINT NOT NULL,
+  type VARCHAR(255) NOT NULL,
+  payload TEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  dispatched_at BIGINT NULL
+);
+CREATE INDEX domain_event_dispatched_at_idx ON domain_event (dispatched_at, seq);
+
+CREATE TABLE domain_event_outbox (
+  tenant_id BIGINT NOT NULL PRIMARY KEY,
+  version BIGINT NOT NULL
+);
+
+CREATE TABLE tenant_domain (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tenant_id BIGINT NOT NULL,
+  domain VARCHAR(255) NOT NULL UNIQUE,
+  verification_token VARCHAR(255) NOT NULL,
+  verified_at BIGINT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+CREATE INDEX tenant_domain_tenant_id_idx ON tenant_domain (tenant_id);
+
+CREATE TABLE tenant_organizer (
+  tenant_id BIGINT NOT NULL,
+  id VARCHAR(255) NOT NULL,
+  display_name VARCHAR(255) NOT NULL,
+  permissions VARCHAR(1024) NOT NULL,
+  created_by VARCHAR(255) NOT NULL,
+  updated_by VARCHAR(255) NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL,
+  PRIMARY KEY (tenant_id, id)
+);
+
+CREATE TABLE audit_log (
+  id INTEGER PRIMARY KEY AUTOINCREMENT,
+  tenant_id BIGINT NOT NULL,
+  actor VARCHAR(255) NOT NULL,
+  role VARCHAR(255) NOT NULL,
+  action VARCHAR(255) NOT NULL,
+  target_id TEXT NOT NULL,
+  request_id VARCHAR(255) NOT NULL,
+  created_at BIGINT NOT NULL
+);
+CREATE INDEX audit_log_tenant_id_idx ON audit_log (tenant_id, id);
+CREATE INDEX audit_log_actor_idx ON audit_log (actor, id);
+CREATE INDEX audit_log_created_at_idx ON audit_log (created_at);
+
+CREATE TABLE api_token (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  name VARCHAR(255) NOT NULL,
+  token_hash CHAR(64) NOT NULL UNIQUE,
+  scopes VARCHAR(1024) NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  expires_at BIGINT NOT NULL,
+  last_used_at BIGINT NULL,
+  created_by VARCHAR(255) NOT NULL,
+  created_at BIGINT NOT NULL
+);
+CREATE INDEX api_token_tenant_id_idx ON api_token (tenant_id);
@@ -0,0 +1,15 @@
+-- ../../init.sql のSQLite版
+DELETE FROM tenant WHERE id > 100;
+DELETE FROM visit_history WHERE created_at >= '1654041600';
+DELETE FROM id_generator;
+DELETE FROM sqlite_sequence WHERE name = 'id_generator';
+INSERT INTO sqlite_sequence (name, seq) VALUES ('id_generator', 2678400000);
+DELETE FROM competition_schedule;
+DELETE FROM webhook_delivery;
+DELETE FROM webhook_endpoint;
+DELETE FROM domain_event;
+DELETE FROM domain_event_outbox;
+DELETE FROM tenant_domain;
+DELETE FROM tenant_organizer;
+DELETE FROM audit_log;
+DELETE FROM api_token;
@@ -8,14 +8,29 @@ ISUCON_DB_PORT=${ISUCON_DB_PORT:-3306}
 ISUCON_DB_USER=${ISUCON_DB_USER:-isucon}
 ISUCON_DB_PASSWORD=${ISUCON_DB_PASSWORD:-isucon}
 ISUCON_DB_NAME=${ISUCON_DB_NAME:-isuports}
+ISUCON_DB_DRIVER=${ISUCON_DB_DRIVER:-mysql}
+ISUCON_DB_PATH=${ISUCON_DB_PATH:-../admin.db}
 
-# MySQLを初期化
-mysql -u"$ISUCON_DB_USER" \
-		-p"$ISUCON_DB_PASSWORD" \
-		--host "$ISUCON_DB_HOST" \
-		--port "$ISUCON_DB_PORT" \
-		"$ISUCON_DB_NAME" < init.sql
+if [ "$ISUCON_DB_DRIVER" = "sqlite3" ]; then
+  # 管理用DBをSQLiteで動かす場合。ファイルがなければスキーマから作る
+  if [ ! -f "$ISUCON_DB_PATH" ]; then
+    sqlite3 "$ISUCON_DB_PATH" < admin/sqlite/10_schema.sql
+  fi
+  sqlite3 "$ISUCON_DB_PATH" < admin/sqlite/init.sql
+else
+  # MySQLを初期化
+  cat admin/migrations/*.sql init.sql | mysql -u"$ISUCON_DB_USER" \
+      -p"$ISUCON_DB_PASSWORD" \
+      --host "$ISUCON_DB_HOST" \
+      --port "$ISUCON_DB_PORT" \
+      "$ISUCON_DB_NAME"
+fi
 
 # SQLiteのデータベースを初期化
 rm -f ../tenant_db/*.db
 cp -r ../../initial_data/*.db ../tenant_db/
+
+# 初期データのテナントDBにスキーマの変更を適用する
+for db in ../tenant_db/*.db; do
+  cat tenant/migrations/*.sql | sqlite3 "$db"
+done
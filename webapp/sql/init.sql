@@ -2,3 +2,12 @@ DELETE FROM tenant WHERE id > 100;
 DELETE FROM visit_history WHERE created_at >= '1654041600';
 UPDATE id_generator SET id=2678400000 WHERE stub='a';
 ALTER TABLE id_generator AUTO_INCREMENT=2678400000;
+TRUNCATE TABLE competition_schedule;
+TRUNCATE TABLE webhook_delivery;
+TRUNCATE TABLE webhook_endpoint;
+TRUNCATE TABLE domain_event;
+TRUNCATE TABLE domain_event_outbox;
+TRUNCATE TABLE tenant_domain;
+TRUNCATE TABLE tenant_organizer;
+TRUNCATE TABLE audit_log;
+TRUNCATE TABLE api_token;
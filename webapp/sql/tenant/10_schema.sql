@@ -1,12 +1,24 @@
 DROP TABLE IF EXISTS competition;
 DROP TABLE IF EXISTS player;
 DROP TABLE IF EXISTS player_score;
+DROP TABLE IF EXISTS player_moderation;
+DROP TABLE IF EXISTS season;
+DROP TABLE IF EXISTS season_competition;
+DROP TABLE IF EXISTS domain_event;
+DROP TABLE IF EXISTS data_version;
 
 CREATE TABLE competition (
   id VARCHAR(255) NOT NULL PRIMARY KEY,
   tenant_id BIGINT NOT NULL,
   title TEXT NOT NULL,
   finished_at BIGINT NULL,
+  start_at BIGINT NULL,
+  end_at BIGINT NULL,
+  deleted_at BIGINT NULL,
+  published_at BIGINT NULL,
+  share_token VARCHAR(255) NULL,
+  created_by VARCHAR(255) NOT NULL DEFAULT '',
+  updated_by VARCHAR(255) NOT NULL DEFAULT '',
   created_at BIGINT NOT NULL,
   updated_at BIGINT NOT NULL
 );
@@ -16,6 +28,10 @@ CREATE TABLE player (
   tenant_id BIGINT NOT NULL,
   display_name TEXT NOT NULL,
   is_disqualified BOOLEAN NOT NULL,
+  disqualified_reason TEXT NOT NULL DEFAULT '',
+  disqualified_until BIGINT NULL,
+  created_by VARCHAR(255) NOT NULL DEFAULT '',
+  updated_by VARCHAR(255) NOT NULL DEFAULT '',
   created_at BIGINT NOT NULL,
   updated_at BIGINT NOT NULL
 );
@@ -27,6 +43,61 @@ CREATE TABLE player_score (
   competition_id VARCHAR(255) NOT NULL,
   score BIGINT NOT NULL,
   row_num BIGINT NOT NULL,
+  created_by VARCHAR(255) NOT NULL DEFAULT '',
+  updated_by VARCHAR(255) NOT NULL DEFAULT '',
   created_at BIGINT NOT NULL,
   updated_at BIGINT NOT NULL
 );
+
+CREATE TABLE player_moderation (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  action VARCHAR(255) NOT NULL,
+  reason TEXT NOT NULL,
+  expires_at BIGINT NULL,
+  moderator VARCHAR(255) NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+CREATE INDEX player_moderation_player_idx ON player_moderation (tenant_id, player_id, created_at);
+
+CREATE TABLE season (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  title TEXT NOT NULL,
+  points_table TEXT NOT NULL,
+  created_by VARCHAR(255) NOT NULL DEFAULT '',
+  updated_by VARCHAR(255) NOT NULL DEFAULT '',
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE TABLE season_competition (
+  tenant_id BIGINT NOT NULL,
+  season_id VARCHAR(255) NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  created_at BIGINT NOT NULL,
+  PRIMARY KEY (season_id, competition_id)
+);
+
+CREATE INDEX player_created_at_idx ON player (tenant_id, created_at, id);
+CREATE INDEX player_display_name_idx ON player (tenant_id, display_name);
+CREATE INDEX player_score_competition_player_idx ON player_score (tenant_id, competition_id, player_id);
+
+CREATE TABLE domain_event (
+  seq INTEGER PRIMARY KEY AUTOINCREMENT,
+  id VARCHAR(255) NOT NULL UNIQUE,
+  tenant_id BIGINT NOT NULL,
+  type VARCHAR(255) NOT NULL,
+  payload TEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  dispatched_at BIGINT NULL
+);
+CREATE INDEX domain_event_dispatched_at_idx ON domain_event (dispatched_at, seq);
+
+CREATE TABLE data_version (
+  name VARCHAR(255) NOT NULL PRIMARY KEY,
+  version VARCHAR(255) NOT NULL,
+  updated_at BIGINT NOT NULL
+);
@@ -0,0 +1,16 @@
+-- 初期データのテナントDBに失格理由・失格履歴を追加する
+ALTER TABLE player ADD COLUMN disqualified_reason TEXT NOT NULL DEFAULT '';
+ALTER TABLE player ADD COLUMN disqualified_until BIGINT NULL;
+
+CREATE TABLE player_moderation (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  player_id VARCHAR(255) NOT NULL,
+  action VARCHAR(255) NOT NULL,
+  reason TEXT NOT NULL,
+  expires_at BIGINT NULL,
+  moderator VARCHAR(255) NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+CREATE INDEX player_moderation_player_idx ON player_moderation (tenant_id, player_id, created_at);
@@ -0,0 +1,4 @@
+-- 初期データのテナントDBに大会の開催期間と削除日時を追加する
+ALTER TABLE competition ADD COLUMN start_at BIGINT NULL;
+ALTER TABLE competition ADD COLUMN end_at BIGINT NULL;
+ALTER TABLE competition ADD COLUMN deleted_at BIGINT NULL;
@@ -0,0 +1,17 @@
+-- 初期データのテナントDBにシーズンを追加する
+CREATE TABLE season (
+  id VARCHAR(255) NOT NULL PRIMARY KEY,
+  tenant_id BIGINT NOT NULL,
+  title TEXT NOT NULL,
+  points_table TEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  updated_at BIGINT NOT NULL
+);
+
+CREATE TABLE season_competition (
+  tenant_id BIGINT NOT NULL,
+  season_id VARCHAR(255) NOT NULL,
+  competition_id VARCHAR(255) NOT NULL,
+  created_at BIGINT NOT NULL,
+  PRIMARY KEY (season_id, competition_id)
+);
@@ -0,0 +1,4 @@
+-- 初期データのテナントDBに参加者検索用のインデックスを追加する
+CREATE INDEX player_created_at_idx ON player (tenant_id, created_at, id);
+CREATE INDEX player_display_name_idx ON player (tenant_id, display_name);
+CREATE INDEX player_score_competition_player_idx ON player_score (tenant_id, competition_id, player_id);
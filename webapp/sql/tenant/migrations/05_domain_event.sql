@@ -0,0 +1,11 @@
+-- 初期データのテナントDBにドメインイベントのoutboxを追加する
+CREATE TABLE domain_event (
+  seq INTEGER PRIMARY KEY AUTOINCREMENT,
+  id VARCHAR(255) NOT NULL UNIQUE,
+  tenant_id BIGINT NOT NULL,
+  type VARCHAR(255) NOT NULL,
+  payload TEXT NOT NULL,
+  created_at BIGINT NOT NULL,
+  dispatched_at BIGINT NULL
+);
+CREATE INDEX domain_event_dispatched_at_idx ON domain_event (dispatched_at, seq);
@@ -0,0 +1,3 @@
+-- 初期データのテナントDBに大会のランキングの公開設定を追加する
+ALTER TABLE competition ADD COLUMN published_at BIGINT NULL;
+ALTER TABLE competition ADD COLUMN share_token VARCHAR(255) NULL;
@@ -0,0 +1,6 @@
+-- 初期データのテナントDBにETag用のデータのバージョンを追加する
+CREATE TABLE data_version (
+  name VARCHAR(255) NOT NULL PRIMARY KEY,
+  version VARCHAR(255) NOT NULL,
+  updated_at BIGINT NOT NULL
+);
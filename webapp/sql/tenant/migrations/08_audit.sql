@@ -0,0 +1,9 @@
+-- 初期データのテナントDBに、書き込んだ主催者を記録する列を追加する
+ALTER TABLE competition ADD COLUMN created_by VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE competition ADD COLUMN updated_by VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE player ADD COLUMN created_by VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE player ADD COLUMN updated_by VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE player_score ADD COLUMN created_by VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE player_score ADD COLUMN updated_by VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE season ADD COLUMN created_by VARCHAR(255) NOT NULL DEFAULT '';
+ALTER TABLE season ADD COLUMN updated_by VARCHAR(255) NOT NULL DEFAULT '';